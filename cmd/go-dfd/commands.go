@@ -0,0 +1,645 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/marqeta/go-dfd/dfd"
+	"github.com/marqeta/go-dfd/svg"
+)
+
+type command struct {
+	path   string
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+// load reads the diagram file. A missing file yields an empty diagram, but
+// unlike a Client on its own, a malformed file is an error rather than
+// something to overwrite.
+func (c *command) load() (*dfd.Client, error) {
+	return dfd.NewClientFromConfig(dfd.Config{DOTPath: c.path, Strict: true})
+}
+
+func (c *command) save(client *dfd.Client) error {
+	_, err := client.DFDToDOT(client.DFD)
+	return err
+}
+
+func (c *command) init(args []string) error {
+	flags := newFlagSet("init")
+	name := flags.String("name", "", "diagram `name`")
+	force := flags.Bool("force", false, "overwrite an existing file")
+	if err := parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+	if _, err := os.Stat(c.path); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", c.path)
+	}
+	client := &dfd.Client{Config: dfd.Config{DOTPath: c.path}, DFD: dfd.InitializeDFD(*name)}
+	return c.save(client)
+}
+
+func (c *command) add(args []string) error {
+	if len(args) == 0 {
+		return usageError(usage)
+	}
+	client, err := c.load()
+	if err != nil {
+		return err
+	}
+	d := client.DFD
+
+	var id string
+	switch kind := args[0]; kind {
+	case "process", "external-service", "data-store":
+		flags := newFlagSet("add " + kind)
+		boundary := flags.String("boundary", "", "trust `boundary` to add the element to")
+		elemID := flags.String("id", "", "element `ID`, derived from the name by default")
+		if err := parse(flags, args[1:], 1, 1); err != nil {
+			return err
+		}
+		name := flags.Arg(0)
+		if *elemID == "" {
+			*elemID = d.NewID(name)
+		}
+		var n dfd.DfdNode
+		switch kind {
+		case "process":
+			n, err = dfd.NewProcessWithID(*elemID, name)
+		case "external-service":
+			n, err = dfd.NewExternalServiceWithID(*elemID, name)
+		default:
+			n, err = dfd.NewDataStoreWithID(*elemID, name)
+		}
+		if err != nil {
+			return err
+		}
+		var boundaryID string
+		if *boundary != "" {
+			tb, err := findBoundary(d, *boundary)
+			if err != nil {
+				return err
+			}
+			boundaryID = tb.ExternalID()
+		}
+		if err := d.AddElement(n, boundaryID); err != nil {
+			return err
+		}
+		id = n.ExternalID()
+	case "boundary":
+		flags := newFlagSet("add boundary")
+		parent := flags.String("parent", "", "trust `boundary` to nest the boundary in")
+		tbID := flags.String("id", "", "trust boundary `ID`, derived from the name by default")
+		if err := parse(flags, args[1:], 1, 1); err != nil {
+			return err
+		}
+		name := flags.Arg(0)
+		if *tbID == "" {
+			*tbID = d.NewID(name)
+		}
+		var parentID string
+		if *parent != "" {
+			p, err := findBoundary(d, *parent)
+			if err != nil {
+				return err
+			}
+			parentID = p.ExternalID()
+		}
+		tb, err := d.AddTrustBoundaryWithID(*tbID, name, parentID)
+		if err != nil {
+			return err
+		}
+		id = tb.ExternalID()
+	case "flow":
+		flags := newFlagSet("add flow")
+		name := flags.String("name", "", "flow `name`")
+		flowID := flags.String("id", "", "flow `id`")
+		both := flags.Bool("both", false, "the flow carries data both ways")
+		response := flags.String("response", "", "also add a response `name`d so, going back")
+		if err := parse(flags, args[1:], 2, 2); err != nil {
+			return err
+		}
+		from, to, err := findEnds(d, flags.Arg(0), flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		var flow *dfd.Flow
+		if *flowID == "" {
+			flow = d.AddFlow(from, to, *name)
+		} else if flow, err = d.AddFlowWithID(*flowID, from, to, *name); err != nil {
+			return err
+		}
+		if *both {
+			flow.Dir = "both"
+		}
+		id = flow.ExternalID()
+		if *response != "" {
+			resp := d.AddFlow(to, from, *response)
+			if err := d.SetResponse(resp.ExternalID(), id); err != nil {
+				return err
+			}
+			id += "\n" + resp.ExternalID()
+		}
+	default:
+		return usageError(fmt.Sprintf("cannot add %q\n%s", kind, usage))
+	}
+
+	if err := c.save(client); err != nil {
+		return err
+	}
+	fmt.Fprintln(c.stdout, id)
+	return nil
+}
+
+func (c *command) remove(args []string) error {
+	if len(args) == 0 {
+		return usageError(usage)
+	}
+	kind := args[0]
+	flags := newFlagSet("remove " + kind)
+	ends := 1
+	var name, policyName *string
+	switch kind {
+	case "flow":
+		ends = 2
+		name = flags.String("name", "", "flow `name`, when several flows connect the elements")
+	case "boundary":
+		policyName = flags.String("policy", "refuse", "refuse if the boundary holds elements, cascade to remove them, or reparent to move them out")
+	default:
+		policyName = flags.String("policy", "cascade", "cascade to remove the flows of the element, or refuse if it has flows")
+	}
+	if err := parse(flags, args[1:], ends, ends); err != nil {
+		return err
+	}
+	var policy dfd.RemovePolicy
+	if policyName != nil {
+		var err error
+		if policy, err = parsePolicy(*policyName); err != nil {
+			return err
+		}
+	}
+	client, err := c.load()
+	if err != nil {
+		return err
+	}
+	d := client.DFD
+
+	switch kind {
+	case "process", "external-service", "data-store", "element":
+		n, err := findElement(d, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		if k := kindOf(n); kind != "element" && k != kind {
+			return fmt.Errorf("%s is a %s, not a %s", flags.Arg(0), k, kind)
+		}
+		if err := d.RemoveElement(n.(dfd.DfdNode).ExternalID(), policy); err != nil {
+			return removeError(flags.Arg(0), err)
+		}
+	case "boundary":
+		tb, err := findBoundary(d, flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		if err := d.RemoveTrustBoundaryWithPolicy(tb.ExternalID(), policy); err != nil {
+			return removeError(flags.Arg(0), err)
+		}
+	case "flow":
+		from, to, err := findEnds(d, flags.Arg(0), flags.Arg(1))
+		if err != nil {
+			return err
+		}
+		var flows []*dfd.Flow
+		for _, f := range d.FlowsBetween(from, to) {
+			if *name == "" || f.Name == *name {
+				flows = append(flows, f)
+			}
+		}
+		switch {
+		case len(flows) == 0 && *name != "":
+			return fmt.Errorf("no flow %q from %s to %s", *name, flags.Arg(0), flags.Arg(1))
+		case len(flows) == 0:
+			return fmt.Errorf("no flow from %s to %s", flags.Arg(0), flags.Arg(1))
+		case len(flows) > 1:
+			return fmt.Errorf("%d flows from %s to %s, choose one with -name", len(flows), flags.Arg(0), flags.Arg(1))
+		}
+		d.RemoveFlowWithID(flows[0].ExternalID())
+	default:
+		return usageError(fmt.Sprintf("cannot remove %q\n%s", kind, usage))
+	}
+	return c.save(client)
+}
+
+func (c *command) move(args []string) error {
+	flags := newFlagSet("move")
+	boundary := flags.String("boundary", "", "trust `boundary` to move the element into, by default the top level")
+	if err := parse(flags, args, 1, 1); err != nil {
+		return err
+	}
+	client, err := c.load()
+	if err != nil {
+		return err
+	}
+	d := client.DFD
+	n, err := findElement(d, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	var target string
+	if *boundary != "" {
+		tb, err := findBoundary(d, *boundary)
+		if err != nil {
+			return err
+		}
+		target = tb.ExternalID()
+	}
+	if err := d.MoveElement(n.(dfd.DfdNode).ExternalID(), target); err != nil {
+		return err
+	}
+	return c.save(client)
+}
+
+func (c *command) decompose(args []string) error {
+	flags := newFlagSet("decompose")
+	remove := flags.Bool("remove", false, "remove the child diagram of the process")
+	if err := parse(flags, args, 1, 2); err != nil {
+		return err
+	}
+	if *remove != (flags.NArg() == 1) {
+		return usageError(usage)
+	}
+	client, err := c.load()
+	if err != nil {
+		return err
+	}
+	n, err := findElement(client.DFD, flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	p, ok := n.(*dfd.Process)
+	if !ok {
+		return fmt.Errorf("%s is a %s, not a process", flags.Arg(0), kindOf(n))
+	}
+	if *remove {
+		p.Child = nil
+	} else if p.Child, err = c.read(flags.Arg(1), ""); err != nil {
+		return fmt.Errorf("%s: %v", flags.Arg(1), err)
+	}
+	return c.save(client)
+}
+
+// removeError explains why remove could not remove name: the reason of a
+// *dfd.ReferenceError, or else err itself.
+func removeError(name string, err error) error {
+	var ref *dfd.ReferenceError
+	if errors.As(err, &ref) {
+		return fmt.Errorf("cannot remove %s: %s", name, ref.Reason)
+	}
+	return fmt.Errorf("cannot remove %s: %v", name, err)
+}
+
+// parsePolicy parses the -policy flag of remove.
+func parsePolicy(name string) (dfd.RemovePolicy, error) {
+	for _, p := range []dfd.RemovePolicy{dfd.Cascade, dfd.Reparent, dfd.Refuse} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, usageError(fmt.Sprintf("unknown policy %q, policies are cascade, reparent and refuse", name))
+}
+
+func (c *command) repair(args []string) error {
+	flags := newFlagSet("repair")
+	dryRun := flags.Bool("n", false, "only list the problems")
+	if err := parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+	client, err := c.load()
+	if err != nil {
+		return err
+	}
+	var findings []dfd.Finding
+	if *dryRun {
+		findings = dfd.CheckIntegrity(client.DFD)
+	} else {
+		findings = dfd.RepairIntegrity(client.DFD)
+	}
+	for _, f := range findings {
+		if _, err := fmt.Fprintln(c.stdout, f); err != nil {
+			return err
+		}
+	}
+	if *dryRun || len(findings) == 0 {
+		return nil
+	}
+	return c.save(client)
+}
+
+type listedElement struct {
+	Kind     string `json:"kind"`
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Boundary string `json:"boundary,omitempty"`
+}
+
+type listedBoundary struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Parent string `json:"parent,omitempty"`
+}
+
+type listedFlow struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	// ResponseTo is the ID of the request the flow is the response to.
+	ResponseTo string `json:"response_to,omitempty"`
+}
+
+type listing struct {
+	Name            string           `json:"name"`
+	Elements        []listedElement  `json:"elements"`
+	TrustBoundaries []listedBoundary `json:"trust_boundaries"`
+	Flows           []listedFlow     `json:"flows"`
+}
+
+func (c *command) list(args []string) error {
+	flags := newFlagSet("list")
+	asJSON := flags.Bool("json", false, "write JSON")
+	if err := parse(flags, args, 0, 0); err != nil {
+		return err
+	}
+	client, err := c.load()
+	if err != nil {
+		return err
+	}
+	l := newListing(client.DFD)
+
+	if *asJSON {
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(l)
+	}
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tID\tNAME\tBOUNDARY")
+	for _, el := range l.Elements {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", el.Kind, el.ID, el.Name, el.Boundary)
+	}
+	fmt.Fprintln(w, "\nBOUNDARY\tNAME\tPARENT")
+	for _, tb := range l.TrustBoundaries {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", tb.ID, tb.Name, tb.Parent)
+	}
+	fmt.Fprintln(w, "\nFLOW\tNAME\tFROM\tTO\tRESPONSE TO")
+	for _, f := range l.Flows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", f.ID, f.Name, f.From, f.To, f.ResponseTo)
+	}
+	return w.Flush()
+}
+
+// newListing lists the contents of d sorted by kind, then name, then ID.
+func newListing(d *dfd.DataFlowDiagram) listing {
+	l := listing{Name: d.Name, Elements: []listedElement{}, TrustBoundaries: []listedBoundary{}, Flows: []listedFlow{}}
+	for _, n := range elements(d) {
+		el := listedElement{Kind: kindOf(n), ID: n.(dfd.DfdNode).ExternalID(), Name: nameOf(n)}
+		if tb := d.BoundaryOf(el.ID); tb != nil {
+			el.Boundary = tb.ExternalID()
+		}
+		l.Elements = append(l.Elements, el)
+	}
+	for id, tb := range d.TrustBoundaries {
+		b := listedBoundary{ID: id, Name: tb.Name}
+		if tb.Parent() != nil {
+			b.Parent = tb.Parent().ExternalID()
+		}
+		l.TrustBoundaries = append(l.TrustBoundaries, b)
+	}
+	sort.Slice(l.TrustBoundaries, func(i, j int) bool {
+		a, b := l.TrustBoundaries[i], l.TrustBoundaries[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	})
+	for id, f := range d.Flows {
+		l.Flows = append(l.Flows, listedFlow{
+			ID:         id,
+			Name:       f.Name,
+			From:       f.From().(dfd.DfdNode).ExternalID(),
+			To:         f.To().(dfd.DfdNode).ExternalID(),
+			ResponseTo: f.ResponseTo(),
+		})
+	}
+	sort.Slice(l.Flows, func(i, j int) bool {
+		a, b := l.Flows[i], l.Flows[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ID < b.ID
+	})
+	return l
+}
+
+// Formats by file extension.
+var extensions = map[string]string{
+	".dot":      "dot",
+	".gv":       "dot",
+	".json":     "json",
+	".yaml":     "yaml",
+	".yml":      "yaml",
+	".puml":     "plantuml",
+	".plantuml": "plantuml",
+	".mmd":      "mermaid",
+	".svg":      "svg",
+}
+
+func formatOf(path string) string {
+	if format, ok := extensions[strings.ToLower(filepath.Ext(path))]; ok {
+		return format
+	}
+	return "dot"
+}
+
+func (c *command) convert(args []string) error {
+	flags := newFlagSet("convert")
+	from := flags.String("from", "", "input `format`")
+	to := flags.String("to", "", "output `format`")
+	expand := flags.Bool("expand", false, "replace decomposed processes with their child diagrams")
+	if err := parse(flags, args, 0, 2); err != nil {
+		return err
+	}
+	input, output := c.path, flags.Arg(1)
+	if flags.NArg() > 0 {
+		input = flags.Arg(0)
+	}
+	if *to == "" {
+		*to = formatOf(output)
+	}
+
+	d, err := c.read(input, *from)
+	if err != nil {
+		return err
+	}
+	if *expand {
+		if d, err = dfd.Expand(d); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	if err := encode(*to, &buf, d); err != nil {
+		return err
+	}
+	if output == "" || output == "-" {
+		_, err = c.stdout.Write(buf.Bytes())
+		return err
+	}
+	return ioutil.WriteFile(output, buf.Bytes(), 0660)
+}
+
+// read reads the diagram in the file at path, or standard input if path is
+// -, in the given format, or the one matching the file extension if empty.
+func (c *command) read(path, format string) (*dfd.DataFlowDiagram, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = ioutil.ReadAll(c.stdin)
+	} else {
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = formatOf(path)
+	}
+	return decode(format, data)
+}
+
+func (c *command) diff(args []string) error {
+	flags := newFlagSet("diff")
+	asJSON := flags.Bool("json", false, "write JSON")
+	if err := parse(flags, args, 1, 2); err != nil {
+		return err
+	}
+	before, after := flags.Arg(0), c.path
+	if flags.NArg() == 2 {
+		after = flags.Arg(1)
+	}
+	a, err := c.read(before, "")
+	if err != nil {
+		return err
+	}
+	b, err := c.read(after, "")
+	if err != nil {
+		return err
+	}
+	diff := dfd.Compare(a, b)
+
+	if *asJSON {
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(diff)
+	}
+	_, err = io.WriteString(c.stdout, diff.String())
+	return err
+}
+
+func (c *command) merge(args []string) error {
+	flags := newFlagSet("merge")
+	name := flags.String("name", "", "merged diagram `name`, by default that of the first input")
+	matchNames := flags.Bool("match-names", false, "unify elements and trust boundaries with matching names")
+	force := flags.Bool("force", false, "overwrite an existing file")
+	asJSON := flags.Bool("json", false, "write conflicts as JSON")
+	if err := parse(flags, args, 1, len(args)); err != nil {
+		return err
+	}
+	if _, err := os.Stat(c.path); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use -force to overwrite it", c.path)
+	}
+	var inputs []*dfd.DataFlowDiagram
+	for _, path := range flags.Args() {
+		d, err := c.read(path, "")
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		inputs = append(inputs, d)
+	}
+	merged, conflicts, err := dfd.Merge(dfd.MergeOptions{Name: *name, MatchNames: *matchNames}, inputs...)
+	if err != nil {
+		return err
+	}
+	if err := c.save(&dfd.Client{Config: dfd.Config{DOTPath: c.path}, DFD: merged}); err != nil {
+		return err
+	}
+
+	if *asJSON {
+		if conflicts == nil {
+			conflicts = []dfd.Conflict{}
+		}
+		enc := json.NewEncoder(c.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(conflicts)
+	}
+	for _, conflict := range conflicts {
+		if _, err := fmt.Fprintln(c.stdout, conflict); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decode(format string, data []byte) (*dfd.DataFlowDiagram, error) {
+	switch format {
+	case "dot":
+		return dfd.Decode(bytes.NewReader(data))
+	case "json":
+		d := &dfd.DataFlowDiagram{}
+		if err := json.Unmarshal(data, d); err != nil {
+			return nil, err
+		}
+		return d, nil
+	case "yaml":
+		return dfd.DecodeYAML(bytes.NewReader(data))
+	case "plantuml":
+		return dfd.DecodePlantUML(bytes.NewReader(data))
+	default:
+		return nil, usageError(fmt.Sprintf("cannot read %q, input formats are dot, json, yaml and plantuml", format))
+	}
+}
+
+func encode(format string, w io.Writer, d *dfd.DataFlowDiagram) error {
+	switch format {
+	case "dot":
+		return dfd.Encode(w, d)
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(d)
+	case "yaml":
+		return dfd.EncodeYAML(w, d)
+	case "plantuml":
+		return dfd.EncodePlantUML(w, d)
+	case "mermaid":
+		return dfd.EncodeMermaid(w, d)
+	case "svg":
+		return svg.Encode(w, d)
+	default:
+		return usageError(fmt.Sprintf("cannot write %q, output formats are dot, json, yaml, plantuml, mermaid and svg", format))
+	}
+}
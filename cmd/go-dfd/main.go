@@ -0,0 +1,179 @@
+// Command go-dfd creates, edits and converts data flow diagrams stored in DOT
+// files, so that diagrams can be maintained from the shell.
+//
+// Usage:
+//
+//	go-dfd [-f file] <command> [arguments]
+//
+// The diagram is read from and written to the file given by -f, which
+// defaults to $DFD_PATH, or dfd.dot if that is not set. The commands are:
+//
+//	init [-name name] [-force]
+//	add process|external-service|data-store [-boundary boundary] [-id id] name
+//	add boundary [-parent boundary] [-id id] name
+//	add flow [-name name] [-id id] [-both] [-response name] from to
+//	remove process|external-service|data-store|element [-policy policy] element
+//	remove boundary [-policy policy] boundary
+//	remove flow [-name name] from to
+//	move [-boundary boundary] element
+//	list [-json]
+//	repair [-n]
+//	convert [-from format] [-to format] [-expand] [input [output]]
+//	decompose process child
+//	decompose -remove process
+//	diff [-json] old [new]
+//	merge [-name name] [-match-names] [-force] [-json] input...
+//
+// Elements and trust boundaries are referred to by ID, by DOT ID (e.g.
+// process_web-server or cluster_aws) or by name when it is unique. They are
+// added with the ID given by -id, or one derived from their name, and the add
+// commands print the ID of what they added. Several flows may connect the same
+// elements, and remove flow then needs the -name of the one to remove. add flow
+// -both adds a flow that carries data both ways, and -response also adds a
+// response going back, printing its ID too.
+//
+// remove process and the other element kinds also remove the flows of the
+// element, or fail if it has any with -policy refuse. remove boundary fails if
+// the trust boundary holds elements, unless -policy is cascade, which removes
+// them and their flows, or reparent, which moves them and the trust boundaries
+// nested in it to its parent.
+//
+// move moves an element into the trust boundary given by -boundary, or out of
+// all trust boundaries, keeping its ID and flows.
+//
+// repair fixes the inconsistencies that older versions of go-dfd or editing
+// the file by hand may leave in the diagram, such as flows to elements that
+// are gone, and lists them. With -n, it only lists them.
+//
+// convert reads the diagram file, or input when given, and writes it to
+// standard output, or output when given. Formats are dot, json, yaml,
+// plantuml, mermaid and svg, the last two for output only, and default to the
+// one matching the file extension, or dot. With -expand, decomposed processes
+// are replaced by their child diagrams.
+//
+// decompose sets the child diagram of a process to the diagram in the file
+// child, in the formats supported by convert, or removes it with -remove.
+//
+// diff compares two diagrams, or a diagram with the diagram file, and lists
+// the elements, trust boundaries and flows that were added, removed, renamed,
+// moved or modified, in the formats supported by convert.
+//
+// merge combines several diagrams, such as one per service, into the diagram
+// file, unifying elements and trust boundaries with the same ID, or the same
+// name with -match-names, and lists where the inputs disagree.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "go-dfd: %v\n", err)
+		if _, ok := err.(usageError); ok {
+			os.Exit(2)
+		}
+		os.Exit(1)
+	}
+}
+
+// usageError is returned for invalid command lines.
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+const usage = `usage: go-dfd [-f file] <command> [arguments]
+
+commands:
+  init [-name name] [-force]
+  add process|external-service|data-store [-boundary boundary] [-id id] name
+  add boundary [-parent boundary] [-id id] name
+  add flow [-name name] [-id id] [-both] [-response name] from to
+  remove process|external-service|data-store|element [-policy policy] element
+  remove boundary [-policy policy] boundary
+  remove flow [-name name] from to
+  move [-boundary boundary] element
+  list [-json]
+  repair [-n]
+  convert [-from format] [-to format] [-expand] [input [output]]
+  decompose process child
+  decompose -remove process
+  diff [-json] old [new]
+  merge [-name name] [-match-names] [-force] [-json] input...`
+
+// run runs the command line args, without the program name.
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	path := os.Getenv("DFD_PATH")
+	if path == "" {
+		path = "dfd.dot"
+	}
+	flags := newFlagSet("go-dfd")
+	flags.StringVar(&path, "f", path, "diagram `file`")
+	if err := flags.Parse(args); err != nil {
+		return usageError(fmt.Sprintf("%v\n%s", err, usage))
+	}
+	if flags.NArg() == 0 {
+		return usageError(usage)
+	}
+
+	cmd := &command{path: path, stdin: stdin, stdout: stdout}
+	args = flags.Args()[1:]
+	switch flags.Arg(0) {
+	case "init":
+		return cmd.init(args)
+	case "add":
+		return cmd.add(args)
+	case "remove", "rm":
+		return cmd.remove(args)
+	case "move", "mv":
+		return cmd.move(args)
+	case "list", "ls":
+		return cmd.list(args)
+	case "repair":
+		return cmd.repair(args)
+	case "decompose":
+		return cmd.decompose(args)
+	case "convert":
+		return cmd.convert(args)
+	case "diff":
+		return cmd.diff(args)
+	case "merge":
+		return cmd.merge(args)
+	case "help":
+		fmt.Fprintln(stdout, usage)
+		return nil
+	default:
+		return usageError(fmt.Sprintf("unknown command %q\n%s", flags.Arg(0), usage))
+	}
+}
+
+// newFlagSet returns a flag set that reports errors rather than printing
+// them.
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.Usage = func() {}
+	return flags
+}
+
+// parse parses the flags of a command, which must be followed by at least min
+// and at most max arguments.
+func parse(flags *flag.FlagSet, args []string, min, max int) error {
+	if err := flags.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return usageError(usage)
+		}
+		return usageError(fmt.Sprintf("%s: %v", flags.Name(), err))
+	}
+	if flags.NArg() < min || flags.NArg() > max {
+		return usageError(fmt.Sprintf("%s: wrong number of arguments\n%s", flags.Name(), usage))
+	}
+	return nil
+}
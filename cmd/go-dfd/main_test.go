@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/marqeta/go-dfd/dfd"
+)
+
+// goDFD runs a command line against the diagram at path and returns its
+// output.
+func goDFD(t *testing.T, path string, args ...string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	err := run(append([]string{"-f", path}, args...), strings.NewReader(""), &out)
+	return strings.TrimSpace(out.String()), err
+}
+
+func mustGoDFD(t *testing.T, path string, args ...string) string {
+	t.Helper()
+	out, err := goDFD(t, path, args...)
+	if err != nil {
+		t.Fatalf("Unexpected error running %q: %v", args, err)
+	}
+	return out
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "go-dfd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestEditing(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "shop.dot")
+
+	mustGoDFD(t, path, "init", "-name", "Shop")
+	if _, err := goDFD(t, path, "init"); err == nil {
+		t.Error("Expected init to refuse to overwrite an existing diagram")
+	}
+	aws := mustGoDFD(t, path, "add", "boundary", "AWS")
+	vpc := mustGoDFD(t, path, "add", "boundary", "-parent", "AWS", "VPC")
+	api := mustGoDFD(t, path, "add", "process", "-boundary", "cluster_"+vpc, "API")
+	db := mustGoDFD(t, path, "add", "data-store", "-boundary", vpc, "DB")
+	customer := mustGoDFD(t, path, "add", "external-service", "Customer")
+	mustGoDFD(t, path, "add", "flow", "-name", "HTTPS", "Customer", "process_"+api)
+	mustGoDFD(t, path, "add", "flow", api, db)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := dfd.Decode(f)
+	f.Close()
+	if err != nil {
+		t.Fatalf("Unexpected error decoding the diagram: %v", err)
+	}
+	if d.Name != "Shop" || len(d.ExternalServices) != 1 || len(d.Flows) != 2 {
+		t.Errorf("Expected Shop with 1 external service and 2 flows, got %s with %d and %d", d.Name, len(d.ExternalServices), len(d.Flows))
+	}
+	if tb := d.BoundaryOf(db); tb == nil || tb.ExternalID() != vpc || tb.Parent() == nil || tb.Parent().ExternalID() != aws {
+		t.Errorf("Expected DB to be in VPC, nested in AWS, got %+v", tb)
+	}
+
+	var l listing
+	if err := json.Unmarshal([]byte(mustGoDFD(t, path, "list", "-json")), &l); err != nil {
+		t.Fatalf("Unexpected error reading the JSON listing: %v", err)
+	}
+	if len(l.Elements) != 3 || l.Elements[0].Name != "DB" || l.Elements[1].ID != customer || l.Elements[2].Boundary != vpc {
+		t.Errorf("Expected DB, Customer and API in that order, got %+v", l.Elements)
+	}
+	if text := mustGoDFD(t, path, "list"); !strings.Contains(text, "HTTPS") || !strings.Contains(text, customer) {
+		t.Errorf("Expected the listing to include the HTTPS flow, got:\n%s", text)
+	}
+
+	if _, err := goDFD(t, path, "remove", "boundary", "AWS"); err == nil {
+		t.Error("Expected a trust boundary holding elements not to be removed")
+	}
+	if _, err := goDFD(t, path, "remove", "data-store", "API"); err == nil {
+		t.Error("Expected removing a process as a data store to fail")
+	}
+	mustGoDFD(t, path, "remove", "flow", "Customer", "API")
+	if _, err := goDFD(t, path, "remove", "flow", "Customer", "API"); err == nil {
+		t.Error("Expected removing a missing flow to fail")
+	}
+	mustGoDFD(t, path, "remove", "process", "API")
+	mustGoDFD(t, path, "remove", "element", "DB")
+	mustGoDFD(t, path, "remove", "boundary", "AWS")
+	l = listing{}
+	if err := json.Unmarshal([]byte(mustGoDFD(t, path, "list", "-json")), &l); err != nil {
+		t.Fatalf("Unexpected error reading the JSON listing: %v", err)
+	}
+	if len(l.Elements) != 1 || len(l.TrustBoundaries) != 0 || len(l.Flows) != 0 {
+		t.Errorf("Expected only Customer to be left, got %+v", l)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "shop.dot")
+	mustGoDFD(t, path, "init", "-name", "Shop")
+	mustGoDFD(t, path, "add", "process", "API")
+	mustGoDFD(t, path, "add", "data-store", "DB")
+	mustGoDFD(t, path, "add", "flow", "-name", "SQL", "API", "DB")
+
+	yamlPath := filepath.Join(dir, "shop.yaml")
+	mustGoDFD(t, path, "convert", path, yamlPath)
+	for _, format := range []string{"json", "plantuml", "dot"} {
+		out := mustGoDFD(t, path, "convert", "-to", format, yamlPath)
+		d, err := decode(format, []byte(out))
+		if err != nil {
+			t.Fatalf("Unexpected error decoding %s: %v\n%s", format, err, out)
+		}
+		if d.Name != "Shop" || len(d.Flows) != 1 {
+			t.Errorf("Expected Shop with 1 flow in %s, got:\n%s", format, out)
+		}
+	}
+	if out := mustGoDFD(t, path, "convert", "-to", "mermaid"); !strings.HasPrefix(out, "---\ntitle: Shop") {
+		t.Errorf("Expected a Mermaid flowchart, got:\n%s", out)
+	}
+	if _, err := goDFD(t, path, "convert", "-from", "svg"); err == nil {
+		t.Error("Expected reading SVG to fail")
+	}
+}
+
+func TestUsage(t *testing.T) {
+	cases := [][]string{
+		{},
+		{"bogus"},
+		{"add"},
+		{"add", "actor", "x"},
+		{"add", "flow", "a"},
+		{"list", "extra"},
+		{"list", "-unknown"},
+	}
+	for _, args := range cases {
+		if _, err := goDFD(t, "unused.dot", args...); err == nil {
+			t.Errorf("Expected %q to be rejected", args)
+		} else if _, ok := err.(usageError); !ok {
+			t.Errorf("Expected a usage error for %q, got %T (%v)", args, err, err)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "shop.dot")
+	mustGoDFD(t, path, "init", "-name", "Shop")
+	mustGoDFD(t, path, "add", "process", "API")
+	mustGoDFD(t, path, "add", "data-store", "DB")
+	mustGoDFD(t, path, "add", "flow", "-name", "SQL", "API", "DB")
+
+	old := filepath.Join(dir, "old.yaml")
+	mustGoDFD(t, path, "convert", path, old)
+	if out := mustGoDFD(t, path, "diff", old); out != "" {
+		t.Errorf("Expected no changes, got:\n%s", out)
+	}
+	mustGoDFD(t, path, "add", "external-service", "User")
+	mustGoDFD(t, path, "remove", "flow", "API", "DB")
+	out := mustGoDFD(t, path, "diff", old, path)
+	if !strings.Contains(out, `+ external service "User"`) || !strings.Contains(out, `- flow "SQL" from "API" to "DB"`) {
+		t.Errorf("Expected an added external service and a removed flow, got:\n%s", out)
+	}
+
+	var diff dfd.Diff
+	if err := json.Unmarshal([]byte(mustGoDFD(t, path, "diff", "-json", old)), &diff); err != nil {
+		t.Fatalf("Unexpected error reading the JSON diff: %v", err)
+	}
+	if len(diff.Changes) != 2 || diff.Changes[0].Type != dfd.Added || diff.Changes[1].Type != dfd.Removed {
+		t.Errorf("Expected an addition and a removal, got %+v", diff.Changes)
+	}
+}
+
+func TestIDs(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "shop.dot")
+	mustGoDFD(t, path, "init", "-name", "Shop")
+	if id := mustGoDFD(t, path, "add", "boundary", "AWS"); id != "aws" {
+		t.Errorf("Expected the trust boundary ID aws, got %s", id)
+	}
+	if id := mustGoDFD(t, path, "add", "process", "-boundary", "aws", "Web Server"); id != "web-server" {
+		t.Errorf("Expected the process ID web-server, got %s", id)
+	}
+	if id := mustGoDFD(t, path, "add", "data-store", "Web Server"); id != "web-server-2" {
+		t.Errorf("Expected the data store ID web-server-2, got %s", id)
+	}
+	if id := mustGoDFD(t, path, "add", "external-service", "-id", "stripe", "Payments"); id != "stripe" {
+		t.Errorf("Expected the external service ID stripe, got %s", id)
+	}
+	if _, err := goDFD(t, path, "add", "process", "-id", "stripe", "API"); err == nil {
+		t.Error("Expected a duplicate ID to be rejected")
+	}
+	if _, err := goDFD(t, path, "add", "process", "-id", "my_api", "API"); err == nil {
+		t.Error("Expected a malformed ID to be rejected")
+	}
+	mustGoDFD(t, path, "add", "flow", "process_web-server", "stripe")
+	if out := mustGoDFD(t, path, "list"); !strings.Contains(out, "web-server-2") {
+		t.Errorf("Expected the listing to show slug IDs, got:\n%s", out)
+	}
+}
+
+func TestMultipleFlows(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "payments.dot")
+	mustGoDFD(t, path, "init", "-name", "Payments")
+	mustGoDFD(t, path, "add", "process", "API")
+	mustGoDFD(t, path, "add", "external-service", "Issuer")
+	mustGoDFD(t, path, "add", "flow", "-name", "Authorization", "api", "issuer")
+	if id := mustGoDFD(t, path, "add", "flow", "-name", "Refund", "-id", "refund", "api", "issuer"); id != "refund" {
+		t.Errorf("Expected the flow ID refund, got %s", id)
+	}
+	if _, err := goDFD(t, path, "add", "flow", "-id", "refund", "issuer", "api"); err == nil {
+		t.Error("Expected a duplicate flow ID to be rejected")
+	}
+	if _, err := goDFD(t, path, "remove", "flow", "api", "issuer"); err == nil {
+		t.Error("Expected removing one of several flows without -name to fail")
+	}
+	mustGoDFD(t, path, "remove", "flow", "-name", "Refund", "api", "issuer")
+	out := mustGoDFD(t, path, "convert", "-to", "yaml")
+	if !strings.Contains(out, "Authorization") || strings.Contains(out, "Refund") {
+		t.Errorf("Expected only the authorization flow to be left, got:\n%s", out)
+	}
+	mustGoDFD(t, path, "remove", "flow", "api", "issuer")
+
+	ids := strings.Fields(mustGoDFD(t, path, "add", "flow", "-name", "Authorization", "-response", "Approval", "api", "issuer"))
+	if len(ids) != 2 {
+		t.Fatalf("Expected the IDs of the request and the response, got %q", ids)
+	}
+	mustGoDFD(t, path, "add", "flow", "-name", "Sync", "-both", "api", "issuer")
+	d, err := dfd.Decode(strings.NewReader(mustGoDFD(t, path, "convert")))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding the diagram: %v", err)
+	}
+	if resp := d.Flows[ids[1]]; resp == nil || resp.ResponseTo() != ids[0] || resp.Name != "Approval" {
+		t.Errorf("Expected %s to be the response to %s, got %+v", ids[1], ids[0], resp)
+	}
+	var both int
+	for _, f := range d.Flows {
+		if f.Bidirectional() {
+			both++
+		}
+	}
+	if both != 1 {
+		t.Errorf("Expected 1 bidirectional flow, got %d", both)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	orders := filepath.Join(dir, "orders.dot")
+	mustGoDFD(t, orders, "init", "-name", "Orders")
+	mustGoDFD(t, orders, "add", "boundary", "AWS")
+	mustGoDFD(t, orders, "add", "process", "-boundary", "aws", "API")
+	mustGoDFD(t, orders, "add", "data-store", "-boundary", "aws", "DB")
+	mustGoDFD(t, orders, "add", "flow", "API", "DB")
+	payments := filepath.Join(dir, "payments.dot")
+	mustGoDFD(t, payments, "init", "-name", "Payments")
+	mustGoDFD(t, payments, "add", "process", "API")
+	mustGoDFD(t, payments, "add", "external-service", "Stripe")
+	mustGoDFD(t, payments, "add", "flow", "API", "Stripe")
+
+	path := filepath.Join(dir, "shop.dot")
+	out := mustGoDFD(t, path, "merge", "-name", "Shop", orders, payments)
+	if !strings.Contains(out, `process "API" (process_api): boundary trust boundary "AWS" kept over outside all trust boundaries from diagram 1`) {
+		t.Errorf("Expected a boundary conflict for API, got:\n%s", out)
+	}
+	var l listing
+	if err := json.Unmarshal([]byte(mustGoDFD(t, path, "list", "-json")), &l); err != nil {
+		t.Fatalf("Unexpected error reading the JSON listing: %v", err)
+	}
+	if l.Name != "Shop" || len(l.Elements) != 3 || len(l.Flows) != 2 {
+		t.Errorf("Expected Shop with 3 elements and 2 flows, got %+v", l)
+	}
+	if _, err := goDFD(t, path, "merge", orders); err == nil {
+		t.Error("Expected merge to refuse to overwrite an existing diagram")
+	}
+	var conflicts []dfd.Conflict
+	if err := json.Unmarshal([]byte(mustGoDFD(t, path, "merge", "-force", "-json", orders, orders)), &conflicts); err != nil || len(conflicts) != 0 {
+		t.Errorf("Expected no conflicts merging a diagram with itself, got %v (%v)", conflicts, err)
+	}
+}
+
+func TestDecompose(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "shop.dot")
+	mustGoDFD(t, path, "init", "-name", "Shop")
+	mustGoDFD(t, path, "add", "external-service", "Customer")
+	mustGoDFD(t, path, "add", "process", "Orders")
+	mustGoDFD(t, path, "add", "flow", "Customer", "Orders")
+	orders := filepath.Join(dir, "orders.dot")
+	mustGoDFD(t, orders, "init", "-name", "Orders")
+	mustGoDFD(t, orders, "add", "external-service", "Customer")
+	mustGoDFD(t, orders, "add", "process", "Validate")
+	mustGoDFD(t, orders, "add", "flow", "Customer", "Validate")
+
+	if _, err := goDFD(t, path, "decompose", "Customer", orders); err == nil {
+		t.Error("Expected decompose to refuse to decompose an external service")
+	}
+	mustGoDFD(t, path, "decompose", "Orders", orders)
+	out := mustGoDFD(t, path, "convert", "-expand", "-to", "json")
+	var expanded struct {
+		Processes []struct {
+			Name string `json:"name"`
+		} `json:"processes"`
+		TrustBoundaries []struct {
+			Name      string `json:"name"`
+			Processes []struct {
+				Name string `json:"name"`
+			} `json:"processes"`
+		} `json:"trust_boundaries"`
+	}
+	if err := json.Unmarshal([]byte(out), &expanded); err != nil {
+		t.Fatalf("Unexpected error reading the expanded diagram: %v", err)
+	}
+	if len(expanded.Processes) != 0 || len(expanded.TrustBoundaries) != 1 || len(expanded.TrustBoundaries[0].Processes) != 1 || expanded.TrustBoundaries[0].Processes[0].Name != "Validate" {
+		t.Errorf("Expected Orders to expand into Validate, got:\n%s", out)
+	}
+
+	mustGoDFD(t, path, "decompose", "-remove", "Orders")
+	if out := mustGoDFD(t, path, "convert", "-expand", "-to", "mermaid"); strings.Contains(out, "Validate") {
+		t.Errorf("Expected the child diagram to be removed, got:\n%s", out)
+	}
+}
+
+func TestRemovePolicies(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "shop.dot")
+	mustGoDFD(t, path, "init", "-name", "Shop")
+	mustGoDFD(t, path, "add", "boundary", "-id", "aws", "AWS")
+	mustGoDFD(t, path, "add", "boundary", "-id", "vpc", "-parent", "aws", "VPC")
+	mustGoDFD(t, path, "add", "process", "-boundary", "vpc", "API")
+	mustGoDFD(t, path, "add", "external-service", "Customer")
+	mustGoDFD(t, path, "add", "flow", "Customer", "API")
+
+	if _, err := goDFD(t, path, "remove", "element", "-policy", "refuse", "API"); err == nil || !strings.HasPrefix(err.Error(), "cannot remove API: ") {
+		t.Errorf("Expected -policy refuse not to remove an element with flows, got %v", err)
+	}
+	if err := removeError("API", errors.New("disk full")); err.Error() != "cannot remove API: disk full" {
+		t.Errorf("Expected errors other than *dfd.ReferenceError to be reported as is, got %v", err)
+	}
+	if _, err := goDFD(t, path, "remove", "boundary", "-policy", "sideways", "VPC"); err == nil {
+		t.Error("Expected an unknown policy to be rejected")
+	}
+	mustGoDFD(t, path, "remove", "boundary", "-policy", "reparent", "VPC")
+	var l listing
+	if err := json.Unmarshal([]byte(mustGoDFD(t, path, "list", "-json")), &l); err != nil {
+		t.Fatalf("Unexpected error reading the JSON listing: %v", err)
+	}
+	if len(l.Elements) != 2 || l.Elements[1].Name != "API" || l.Elements[1].Boundary != "aws" || len(l.Flows) != 1 {
+		t.Errorf("Expected API to move to AWS and keep its flow, got %+v", l)
+	}
+
+	mustGoDFD(t, path, "remove", "boundary", "-policy", "cascade", "AWS")
+	l = listing{}
+	if err := json.Unmarshal([]byte(mustGoDFD(t, path, "list", "-json")), &l); err != nil {
+		t.Fatalf("Unexpected error reading the JSON listing: %v", err)
+	}
+	if len(l.Elements) != 1 || len(l.TrustBoundaries) != 0 || len(l.Flows) != 0 {
+		t.Errorf("Expected only Customer to be left, got %+v", l)
+	}
+	if out := mustGoDFD(t, path, "repair", "-n"); out != "" {
+		t.Errorf("Expected no problems to repair, got:\n%s", out)
+	}
+}
+
+func TestMove(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "shop.dot")
+	mustGoDFD(t, path, "init", "-name", "Shop")
+	mustGoDFD(t, path, "add", "boundary", "-id", "aws", "AWS")
+	api := mustGoDFD(t, path, "add", "process", "API")
+	mustGoDFD(t, path, "add", "external-service", "Customer")
+	mustGoDFD(t, path, "add", "flow", "Customer", "API")
+
+	if _, err := goDFD(t, path, "move", "-boundary", "GCP", "API"); err == nil {
+		t.Error("Expected moving an element to an unknown trust boundary to fail")
+	}
+	mustGoDFD(t, path, "move", "-boundary", "AWS", "API")
+	var l listing
+	if err := json.Unmarshal([]byte(mustGoDFD(t, path, "list", "-json")), &l); err != nil {
+		t.Fatalf("Unexpected error reading the JSON listing: %v", err)
+	}
+	if len(l.Elements) != 2 || l.Elements[1].ID != api || l.Elements[1].Boundary != "aws" || len(l.Flows) != 1 {
+		t.Errorf("Expected API to move to AWS and keep its flow, got %+v", l)
+	}
+
+	mustGoDFD(t, path, "mv", "API")
+	l = listing{}
+	if err := json.Unmarshal([]byte(mustGoDFD(t, path, "list", "-json")), &l); err != nil {
+		t.Fatalf("Unexpected error reading the JSON listing: %v", err)
+	}
+	for _, e := range l.Elements {
+		if e.Boundary != "" {
+			t.Errorf("Expected %s to be outside all trust boundaries, got %s", e.Name, e.Boundary)
+		}
+	}
+}
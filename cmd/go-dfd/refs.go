@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/marqeta/go-dfd/dfd"
+	"gonum.org/v1/gonum/graph"
+)
+
+// elements returns every element of d, at any depth, sorted by kind, then
+// name, then ID.
+func elements(d *dfd.DataFlowDiagram) []graph.Node {
+	var elems []graph.Node
+	collect := func(ps map[string]*dfd.Process, es map[string]*dfd.ExternalService, ds map[string]*dfd.DataStore) {
+		for _, n := range ps {
+			elems = append(elems, n)
+		}
+		for _, n := range es {
+			elems = append(elems, n)
+		}
+		for _, n := range ds {
+			elems = append(elems, n)
+		}
+	}
+	collect(d.Processes, d.ExternalServices, d.DataStores)
+	for _, tb := range d.TrustBoundaries {
+		collect(tb.Processes, tb.ExternalServices, tb.DataStores)
+	}
+	sort.Slice(elems, func(i, j int) bool {
+		a, b := elems[i], elems[j]
+		if kindOf(a) != kindOf(b) {
+			return kindOf(a) < kindOf(b)
+		}
+		if nameOf(a) != nameOf(b) {
+			return nameOf(a) < nameOf(b)
+		}
+		return a.(dfd.DfdNode).ExternalID() < b.(dfd.DfdNode).ExternalID()
+	})
+	return elems
+}
+
+// kindOf returns the kind of an element as written on the command line.
+func kindOf(n graph.Node) string {
+	switch n.(type) {
+	case *dfd.ExternalService:
+		return "external-service"
+	case *dfd.DataStore:
+		return "data-store"
+	default:
+		return "process"
+	}
+}
+
+func nameOf(n graph.Node) string {
+	switch n := n.(type) {
+	case *dfd.Process:
+		return n.Name
+	case *dfd.ExternalService:
+		return n.Name
+	case *dfd.DataStore:
+		return n.Name
+	}
+	return ""
+}
+
+// findElement returns the element with the given ID, DOT ID or name.
+func findElement(d *dfd.DataFlowDiagram, ref string) (graph.Node, error) {
+	if n := d.FindNode(ref); n != nil {
+		return n, nil
+	}
+	var matches []graph.Node
+	for _, n := range elements(d) {
+		if n.(dfd.DfdNode).DOTID() == ref {
+			return n, nil
+		}
+		if nameOf(n) == ref {
+			matches = append(matches, n)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no element %q", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		ids := make([]string, len(matches))
+		for i, n := range matches {
+			ids[i] = n.(dfd.DfdNode).ExternalID()
+		}
+		return nil, fmt.Errorf("%d elements are named %q, use one of the IDs %s", len(matches), ref, strings.Join(ids, ", "))
+	}
+}
+
+// findEnds returns the elements at either end of a flow, which must differ.
+func findEnds(d *dfd.DataFlowDiagram, fromRef, toRef string) (graph.Node, graph.Node, error) {
+	from, err := findElement(d, fromRef)
+	if err != nil {
+		return nil, nil, err
+	}
+	to, err := findElement(d, toRef)
+	if err != nil {
+		return nil, nil, err
+	}
+	if from.ID() == to.ID() {
+		return nil, nil, fmt.Errorf("a flow cannot start and end at %s", fromRef)
+	}
+	return from, to, nil
+}
+
+// findBoundary returns the trust boundary with the given ID, DOT ID or name.
+func findBoundary(d *dfd.DataFlowDiagram, ref string) (*dfd.TrustBoundary, error) {
+	if tb, ok := d.TrustBoundaries[ref]; ok {
+		return tb, nil
+	}
+	var matches []*dfd.TrustBoundary
+	for _, tb := range d.TrustBoundaries {
+		if tb.DOTID() == ref {
+			return tb, nil
+		}
+		if tb.Name == ref {
+			matches = append(matches, tb)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no trust boundary %q", ref)
+	case 1:
+		return matches[0], nil
+	default:
+		ids := make([]string, len(matches))
+		for i, tb := range matches {
+			ids[i] = tb.ExternalID()
+		}
+		sort.Strings(ids)
+		return nil, fmt.Errorf("%d trust boundaries are named %q, use one of the IDs %s", len(matches), ref, strings.Join(ids, ", "))
+	}
+}
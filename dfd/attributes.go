@@ -14,6 +14,16 @@ func (a *attributes) SetAttribute(attr encoding.Attribute) error {
 	return nil
 }
 
+// get returns the value of the first attribute with the given key.
+func (a attributes) get(key string) (string, bool) {
+	for _, attr := range a {
+		if attr.Key == key {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
 type dotPortLabels struct {
 	Port, Compass string
 }
@@ -0,0 +1,91 @@
+package dfd
+
+import (
+	"sort"
+
+	"gonum.org/v1/gonum/graph"
+)
+
+// FlowBoundaries records the trust boundaries at either end of a Flow.
+type FlowBoundaries struct {
+	// ID is the key of the flow in DataFlowDiagram.Flows.
+	ID   string
+	Flow *Flow
+	// Source and Destination are the trust boundaries containing the ends
+	// of the flow, nil when an end is outside all trust boundaries.
+	Source      *TrustBoundary
+	Destination *TrustBoundary
+}
+
+// Crosses reports whether the flow crosses a trust boundary, that is whether
+// its ends are in different trust boundaries or only one of them is in a
+// trust boundary.
+func (fb FlowBoundaries) Crosses() bool {
+	return fb.Source != fb.Destination
+}
+
+// BoundaryOf returns the trust boundary containing the element with the given
+// ID, or nil if the element is outside all trust boundaries.
+func (dfd *DataFlowDiagram) BoundaryOf(id string) *TrustBoundary {
+	for _, tb := range dfd.TrustBoundaries {
+		if tb.FindNode(id) != nil {
+			return tb
+		}
+	}
+	return nil
+}
+
+// FlowBoundaries returns the trust boundaries of every flow, sorted by flow
+// ID.
+func (dfd *DataFlowDiagram) FlowBoundaries() []FlowBoundaries {
+	fbs := make([]FlowBoundaries, 0, len(dfd.Flows))
+	for id, f := range dfd.Flows {
+		fbs = append(fbs, FlowBoundaries{
+			ID:          id,
+			Flow:        f,
+			Source:      dfd.BoundaryOf(f.From().(DfdNode).ExternalID()),
+			Destination: dfd.BoundaryOf(f.To().(DfdNode).ExternalID()),
+		})
+	}
+	sort.Slice(fbs, func(i, j int) bool {
+		return fbs[i].ID < fbs[j].ID
+	})
+	return fbs
+}
+
+// CrossingFlows returns the trust boundaries of the flows that cross a trust
+// boundary, sorted by flow ID.
+func (dfd *DataFlowDiagram) CrossingFlows() []FlowBoundaries {
+	crossing := []FlowBoundaries{}
+	for _, fb := range dfd.FlowBoundaries() {
+		if fb.Crosses() {
+			crossing = append(crossing, fb)
+		}
+	}
+	return crossing
+}
+
+// MoveElement moves the element with the given ID into the trust boundary with
+// the ID targetBoundaryID, or to the top level if it is empty. The element
+// keeps its ID and flows. Errors are *ReferenceError.
+func (dfd *DataFlowDiagram) MoveElement(id, targetBoundaryID string) error {
+	dfd.mtx.Lock()
+	defer dfd.mtx.Unlock()
+	n, ok := dfd.FindNode(id).(DfdNode)
+	if !ok {
+		return &ReferenceError{ID: id, Reason: "unknown element"}
+	}
+	var target *TrustBoundary
+	if targetBoundaryID != "" {
+		if target, ok = dfd.TrustBoundaries[targetBoundaryID]; !ok {
+			return &ReferenceError{ID: targetBoundaryID, Reason: "unknown trust boundary"}
+		}
+	}
+	dfd.placeElement(n, target)
+	// Elements in a trust boundary are only in the graph of the diagram
+	// through their flows.
+	if xid := n.(graph.Node).ID(); target != nil && len(dfd.flowsOf(xid)) == 0 {
+		dfd.RemoveNode(xid)
+	}
+	return nil
+}
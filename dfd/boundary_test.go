@@ -0,0 +1,128 @@
+package dfd
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"gonum.org/v1/gonum/graph"
+)
+
+func TestFlowBoundaries(t *testing.T) {
+	dfd, err := DecodeYAML(strings.NewReader(testYAML))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	aws, browser := dfd.TrustBoundaries["aws"], dfd.TrustBoundaries["browser"]
+	flowID := func(from, to string) string {
+		return genFlowID(dfd.FindNode(from), dfd.FindNode(to))
+	}
+
+	cases := []struct {
+		from, to    string
+		source      *TrustBoundary
+		destination *TrustBoundary
+		crosses     bool
+	}{
+		{"client", "google-analytics", browser, nil, true},
+		{"client", "web-server", browser, aws, true},
+		{"web-server", "logs", aws, aws, false},
+	}
+	fbs := map[string]FlowBoundaries{}
+	for _, fb := range dfd.FlowBoundaries() {
+		fbs[fb.ID] = fb
+	}
+	if len(fbs) != len(cases) {
+		t.Errorf("Expected %d flows, but got %d", len(cases), len(fbs))
+	}
+	crossing := map[string]bool{}
+	for _, fb := range dfd.CrossingFlows() {
+		crossing[fb.ID] = true
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("Flow from %s to %s", c.from, c.to), func(t *testing.T) {
+			id := flowID(c.from, c.to)
+			fb, ok := fbs[id]
+			if !ok {
+				t.Fatalf("Expected flow %s to be listed", id)
+			}
+			if fb.Flow != dfd.Flows[id] {
+				t.Errorf("Expected the flow to be %v, but got %v", dfd.Flows[id], fb.Flow)
+			}
+			if fb.Source != c.source || fb.Destination != c.destination {
+				t.Errorf("Expected boundaries %v and %v, but got %v and %v", c.source, c.destination, fb.Source, fb.Destination)
+			}
+			if fb.Crosses() != c.crosses || crossing[id] != c.crosses {
+				t.Errorf("Expected crossing to be %t, but got %t and %t", c.crosses, fb.Crosses(), crossing[id])
+			}
+		})
+	}
+}
+
+func TestBoundaryOf(t *testing.T) {
+	dfd, err := DecodeYAML(strings.NewReader(testYAML))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	if tb := dfd.BoundaryOf("logs"); tb == nil || tb.Name != "AWS" {
+		t.Errorf("Expected logs to be in AWS, but got %v", tb)
+	}
+	if tb := dfd.BoundaryOf("google-analytics"); tb != nil {
+		t.Errorf("Expected google-analytics to be outside all boundaries, but got %v", tb)
+	}
+	if tb := dfd.BoundaryOf("42"); tb != nil {
+		t.Errorf("Expected an unknown element to be outside all boundaries, but got %v", tb)
+	}
+}
+
+func TestMoveElement(t *testing.T) {
+	dfd, api, req, _ := integrityDFD()
+	idle, _ := NewProcessWithID("idle", "Idle")
+	dfd.AddElement(idle, "")
+	if err := dfd.MoveElement("nowhere", ""); err == nil {
+		t.Error("Expected moving an unknown element to fail")
+	}
+	err := dfd.MoveElement(api.ExternalID(), "nowhere")
+	if _, ok := err.(*ReferenceError); !ok {
+		t.Fatalf("Expected a *ReferenceError moving to an unknown trust boundary, got %v", err)
+	}
+
+	moves := []struct {
+		id, target string
+		want       string
+	}{
+		{"api", "", "api@- idle@- user@- db@subnet"},
+		{"api", "subnet", "idle@- user@- api@subnet db@subnet"},
+		{"idle", "aws", "user@- idle@aws api@subnet db@subnet"},
+		{"user", "vpc", "idle@aws api@subnet db@subnet user@vpc"},
+		{"idle", "", "idle@- api@subnet db@subnet user@vpc"},
+	}
+	for _, m := range moves {
+		if err := dfd.MoveElement(m.id, m.target); err != nil {
+			t.Fatalf("Unexpected error moving %s to %q: %v", m.id, m.target, err)
+		}
+		got := strings.Join(strings.Fields(describeIntegrity(dfd))[:4], " ")
+		if got != m.want {
+			t.Errorf("Expected %s after moving %s to %q, got %s", m.want, m.id, m.target, got)
+		}
+		if findings := CheckIntegrity(dfd); len(findings) != 0 {
+			t.Errorf("Expected no integrity problems after moving %s, got %v", m.id, findings)
+		}
+	}
+	if dfd.FindNode("api") != graph.Node(api) || dfd.Flows[req.ExternalID()].To() != graph.Node(api) {
+		t.Error("Expected the moved element to keep its identity and flows")
+	}
+
+	out, err := dfd.MarshalDOT()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding DOT: %v", err)
+	}
+	back, err := Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding DOT: %v", err)
+	}
+	if got, want := describeIntegrity(back), describeIntegrity(dfd); got != want {
+		t.Errorf("Expected %s after a DOT round trip, got %s", want, got)
+	}
+}
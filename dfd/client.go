@@ -1,32 +1,42 @@
 package dfd
 
 import (
-	"fmt"
-	"log"
 	"os"
 	"sync"
 
 	"gonum.org/v1/gonum/graph/encoding"
-	"gonum.org/v1/gonum/graph/encoding/dot"
-	fdot "gonum.org/v1/gonum/graph/formats/dot"
 )
 
+// Client reads and writes a DFD stored in the DOT file at Config.DOTPath. It
+// is a thin wrapper around Decode and Encode.
 type Client struct {
 	Config Config
 	DFD    *DataFlowDiagram
 }
 
-func NewClient(dot_path string) *Client {
+// NewClient returns a Client for the DOT file at dot_path, loading the DFD it
+// contains. A missing file yields an empty DFD.
+func NewClient(dot_path string) (*Client, error) {
+	return NewClientFromConfig(Config{DOTPath: dot_path})
+}
+
+// NewClientFromConfig returns a Client for the given Config, loading the DFD
+// found at Config.DOTPath.
+func NewClientFromConfig(config Config) (*Client, error) {
 	client := &Client{
-		Config: Config{
-			DOTPath: dot_path,
-		},
+		Config: config,
+	}
+	dfd, err := client.DFDFromDOT()
+	if err != nil {
+		return nil, err
 	}
-	dfd, _ := client.DFDFromDOT()
 	client.DFD = dfd.(*DataFlowDiagram)
-	return client
+	return client, nil
 }
 
+// DFDFromDOT reads the DFD stored at Config.DOTPath. A missing file yields an
+// empty DFD. A file that is not valid DOT also yields an empty DFD unless
+// Config.Strict is set, in which case a *ParseError is returned.
 func (client *Client) DFDFromDOT() (encoding.Builder, error) {
 	mutex := &sync.Mutex{}
 	mutex.Lock()
@@ -35,60 +45,48 @@ func (client *Client) DFDFromDOT() (encoding.Builder, error) {
 	if os.IsNotExist(err) { // We'll initialize an empty DFD
 		return InitializeDFD(""), nil
 	} else if err != nil { // Bail if something else went wrong
-		log.Fatal(err)
+		return nil, &IOError{Op: "open", Path: client.Config.DOTPath, Err: err}
 	}
 	defer f.Close()
 
-	fileinfo, err := f.Stat()
-	if err != nil {
-		log.Fatal(err)
-	}
-	filesize := fileinfo.Size()
-	buffer := make([]byte, filesize)
-
-	_, err = f.Read(buffer)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	ast, err := fdot.ParseBytes(buffer)
-	if err != nil { // Initialize an empty DFD if the file is malformed
+	dfd, err := Decode(f)
+	switch err := err.(type) {
+	case nil:
+		return dfd, nil
+	case *ParseError:
+		if client.Config.Strict {
+			return nil, err
+		}
+		// Initialize an empty DFD if the file is malformed
 		return InitializeDFD(""), nil
+	case *IOError:
+		err.Path = client.Config.DOTPath
+		return nil, err
+	default:
+		return nil, err
 	}
-
-	gast := ast.Graphs[0]
-	dst := DeserializeDFD(gast.ID)
-	gen := initGenerator(dst)
-	for _, stmt := range gast.Stmts {
-		gen.addStmt(dst, stmt)
-	}
-	return dst, nil
 }
 
+// DFDToDOT writes the DOT representation of dfd to Config.DOTPath and returns
+// it.
 func (client *Client) DFDToDOT(dfd encoding.Builder) (string, error) {
 	mutex := &sync.Mutex{}
 	mutex.Lock()
 	defer mutex.Unlock()
-	got, err := client.marshal(dfd)
+	got, err := marshalDOT(dfd)
 	if err != nil {
-		fmt.Println(err)
 		return "", err
 	}
 
 	f, err := os.OpenFile(client.Config.DOTPath, os.O_WRONLY|os.O_TRUNC|os.O_CREATE, 0660)
 	if err != nil {
-		log.Fatal(err)
+		return "", &IOError{Op: "open", Path: client.Config.DOTPath, Err: err}
 	}
 	defer f.Close()
 
 	_, err = f.Write(got)
 	if err != nil {
-		log.Fatal(err)
+		return "", &IOError{Op: "write", Path: client.Config.DOTPath, Err: err}
 	}
 	return string(got), nil
 }
-
-// Wrapper function for Marshal method in the dot package
-func (client *Client) marshal(dfd encoding.Builder) ([]byte, error) {
-	return dot.Marshal(dfd, "", "", "\t")
-}
@@ -1,8 +1,20 @@
 package dfd
 
 import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"testing/quick"
+
+	"gonum.org/v1/gonum/graph"
 )
 
 // This can be thought of as an integration test
@@ -52,6 +64,373 @@ func TestClientDFDToDOT(t *testing.T) {
 	}
 }
 
+// randomDFD is a DataFlowDiagram that can be generated by testing/quick.
+type randomDFD struct {
+	*DataFlowDiagram
+}
+
+const randomNameRunes = "abcXYZ019 _-\"'<>&\\é"
+
+func randomName(r *rand.Rand) string {
+	runes := []rune(randomNameRunes)
+	name := make([]rune, r.Intn(12))
+	for i := range name {
+		name[i] = runes[r.Intn(len(runes))]
+	}
+	return string(name)
+}
+
+func randomNode(r *rand.Rand) graph.Node {
+	var n graph.Node
+	switch r.Intn(3) {
+	case 0:
+		p := NewProcess(randomName(r))
+		if r.Intn(2) == 0 {
+			p.Properties = ProcessProperties{Runtime: randomName(r), Language: randomName(r), Privilege: PrivilegeLevel(randomName(r))}
+		}
+		n = p
+	case 1:
+		es := NewExternalService(randomName(r))
+		if r.Intn(2) == 0 {
+			es.Properties = ExternalServiceProperties{Vendor: randomName(r), Trust: TrustLevel(randomName(r))}
+		}
+		n = es
+	default:
+		ds := NewDataStore(randomName(r))
+		if r.Intn(2) == 0 {
+			ds.Properties = DataStoreProperties{EncryptedAtRest: r.Intn(2) == 0, BackedUp: r.Intn(2) == 0, Classifications: randomClassifications(r)}
+		}
+		n = ds
+	}
+	var tags []string
+	for i := r.Intn(3); i > 0; i-- {
+		// Surrounding spaces are trimmed from tags.
+		if tag := strings.TrimSpace(randomName(r)); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	n.(tagged).setTags(tags)
+	return n
+}
+
+func randomClassifications(r *rand.Rand) []DataClassification {
+	var cs []DataClassification
+	for _, c := range []DataClassification{ClassificationPII, ClassificationPCI, ClassificationSecrets} {
+		if r.Intn(2) == 0 {
+			cs = append(cs, c)
+		}
+	}
+	return cs
+}
+
+func randomFlowProperties(r *rand.Rand) FlowProperties {
+	p := FlowProperties{
+		Protocol:       randomName(r),
+		Port:           r.Intn(65536),
+		Authenticated:  r.Intn(2) == 0,
+		Authentication: randomName(r),
+		Encrypted:      r.Intn(2) == 0,
+		TLSVersion:     randomName(r),
+	}
+	p.Classifications = randomClassifications(r)
+	return p
+}
+
+// Generate implements quick.Generator.
+func (randomDFD) Generate(r *rand.Rand, size int) reflect.Value {
+	dfd := InitializeDFD(randomName(r))
+	nodes := []graph.Node{}
+	for i := r.Intn(size + 1); i > 0; i-- {
+		n := randomNode(r)
+		dfd.AddNodeElem(n)
+		nodes = append(nodes, n)
+	}
+	tbs := []*TrustBoundary{}
+	for i := r.Intn(5); i > 0; i-- {
+		var tb *TrustBoundary
+		if len(tbs) > 0 && r.Intn(2) == 0 {
+			tb, _ = dfd.AddNestedTrustBoundary(tbs[r.Intn(len(tbs))].ExternalID(), randomName(r))
+		} else {
+			tb, _ = dfd.AddTrustBoundary(randomName(r))
+		}
+		tbs = append(tbs, tb)
+		for j := r.Intn(size/2 + 1); j > 0; j-- {
+			n := randomNode(r)
+			tb.AddNodeElem(n)
+			nodes = append(nodes, n)
+		}
+	}
+	if len(nodes) > 1 {
+		for i := r.Intn(size + 1); i > 0; i-- {
+			f, t := nodes[r.Intn(len(nodes))], nodes[r.Intn(len(nodes))]
+			if f.ID() != t.ID() {
+				flow := dfd.AddFlow(f, t, randomName(r))
+				if r.Intn(2) == 0 {
+					flow.setProperties(randomFlowProperties(r))
+				}
+			}
+		}
+	}
+	return reflect.ValueOf(randomDFD{dfd})
+}
+
+// describeDFD returns a canonical description of the structure of a DFD, so
+// that two diagrams can be compared irrespective of map ordering.
+func describeDFD(dfd *DataFlowDiagram) string {
+	lines := []string{
+		fmt.Sprintf("dfd %s %q %v %v %v", dfd.ExternalID(), dfd.Name, dfd.graph, dfd.node, dfd.edge),
+	}
+	describeNodes := func(prefix string, ps map[string]*Process, es map[string]*ExternalService, ds map[string]*DataStore) {
+		for id, n := range ps {
+			lines = append(lines, fmt.Sprintf("%sprocess %s %q %v", prefix, id, n.Name, n.Attributes()))
+		}
+		for id, n := range es {
+			lines = append(lines, fmt.Sprintf("%sexternalservice %s %q %v", prefix, id, n.Name, n.Attributes()))
+		}
+		for id, n := range ds {
+			lines = append(lines, fmt.Sprintf("%sdatastore %s %q %v", prefix, id, n.Name, n.Attributes()))
+		}
+	}
+	describeNodes("", dfd.Processes, dfd.ExternalServices, dfd.DataStores)
+	for id, tb := range dfd.TrustBoundaries {
+		prefix := fmt.Sprintf("boundary %s ", id)
+		parent := ""
+		if tb.Parent() != nil {
+			parent = tb.Parent().ExternalID()
+			if tb.Parent().TrustBoundaries[id] != tb {
+				parent += " (not linked)"
+			}
+		}
+		lines = append(lines, fmt.Sprintf("%s%q %v in %q", prefix, tb.Name, tb.graph, parent))
+		describeNodes(prefix, tb.Processes, tb.ExternalServices, tb.DataStores)
+	}
+	for id, f := range dfd.Flows {
+		lines = append(lines, fmt.Sprintf("flow %s %d->%d %q %v", id, f.From().ID(), f.To().ID(), f.Name, f.Attributes()))
+	}
+	for _, n := range graph.NodesOf(dfd.Nodes()) {
+		lines = append(lines, fmt.Sprintf("node %d", n.ID()))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// describeNesting returns the trust boundaries leading to every element, by
+// name, so that nesting can be compared across formats that assign their own
+// IDs.
+func describeNesting(dfd *DataFlowDiagram) string {
+	path := func(tb *TrustBoundary) string {
+		names := []string{}
+		for ; tb != nil; tb = tb.Parent() {
+			names = append([]string{strconv.Quote(tb.Name)}, names...)
+		}
+		return strings.Join(names, " > ")
+	}
+	lines := []string{}
+	for _, tb := range dfd.TrustBoundaries {
+		lines = append(lines, "boundary "+path(tb))
+		for _, n := range sortedElements(tb.Processes, tb.ExternalServices, tb.DataStores) {
+			lines = append(lines, fmt.Sprintf("%q in %s", nodeName(n), path(tb)))
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestClientRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-dfd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	client := &Client{
+		Config: Config{
+			DOTPath: filepath.Join(dir, "roundtrip.dot"),
+		},
+	}
+
+	roundTrip := func(in randomDFD) bool {
+		if _, err := client.DFDToDOT(in.DataFlowDiagram); err != nil {
+			t.Log(err)
+			return false
+		}
+		out, err := client.DFDFromDOT()
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		want, got := describeDFD(in.DataFlowDiagram), describeDFD(out.(*DataFlowDiagram))
+		if want != got {
+			t.Logf("want:\n%s\ngot:\n%s", want, got)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientRoundTripHandWritten(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-dfd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name  string
+		dot   string
+		flows int
+	}{
+		{"edge chain", `digraph 1 { process_1 -> process_2 -> datastore_3 [label="SQL"] }`, 2},
+		{"edge to a subgraph", `digraph 1 { process_1 -> {process_2 datastore_3} }`, 2},
+		{"edge from a subgraph", `digraph 1 { {process_1 process_2} -> datastore_3 }`, 2},
+		{"chain through a subgraph", `digraph 1 { process_1 -> {process_2 process_3} -> datastore_4 }`, 4},
+		{"edge chain in a trust boundary", `digraph 1 {
+	subgraph cluster_5 {
+		graph [label="AWS"]
+		process_1 -> process_2 -> datastore_3
+	}
+	externalservice_4 -> {process_1 process_2}
+}`, 4},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(dir, "handwritten.dot")
+			if err := ioutil.WriteFile(path, []byte(c.dot), 0660); err != nil {
+				t.Fatal(err)
+			}
+			client := &Client{Config: Config{DOTPath: path}}
+			in, err := client.DFDFromDOT()
+			if err != nil {
+				t.Fatalf("Unexpected error decoding DOT: %v", err)
+			}
+			if n := len(in.(*DataFlowDiagram).Flows); n != c.flows {
+				t.Errorf("Expected %d flows, but got %d", c.flows, n)
+			}
+			if _, err := client.DFDToDOT(in.(*DataFlowDiagram)); err != nil {
+				t.Fatalf("Unexpected error encoding DOT: %v", err)
+			}
+			out, err := client.DFDFromDOT()
+			if err != nil {
+				t.Fatalf("Unexpected error decoding encoded DOT: %v", err)
+			}
+			want, got := describeDFD(in.(*DataFlowDiagram)), describeDFD(out.(*DataFlowDiagram))
+			if want != got {
+				t.Errorf("want:\n%s\ngot:\n%s", want, got)
+			}
+		})
+	}
+}
+
+func TestClientDFDFromDOTErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-dfd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		name   string
+		dot    string
+		strict bool
+		err    error
+	}{
+		{"empty file", "", false, nil},
+		{"empty file in strict mode", "", true, &ParseError{}},
+		{"syntax error", "strict digraph 1 {\n\tprocess_1 [label=\n}", false, nil},
+		{"syntax error in strict mode", "strict digraph 1 {\n\tprocess_1 [label=\n}", true, &ParseError{Line: 3, Column: 1}},
+		{"malformed node ID", "strict digraph 1 { process1; }", false, &MalformedIDError{}},
+		{"malformed trust boundary ID", "strict digraph 1 { subgraph \"cluster_a b\" { process_1; } }", false, &MalformedIDError{}},
+		{"unknown node type", "strict digraph 1 { actor_1; }", false, &UnknownElementError{}},
+		{"unknown node attribute", "strict digraph 1 { process_1 [color=red]; }", false, &AttributeError{}},
+		{"valid", "strict digraph 1 { process_1 [label=\"p\"]; }", true, nil},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("Reading DOT with %s", c.name), func(t *testing.T) {
+			path := filepath.Join(dir, "errors.dot")
+			if err := ioutil.WriteFile(path, []byte(c.dot), 0660); err != nil {
+				t.Fatal(err)
+			}
+			client := &Client{Config: Config{DOTPath: path, Strict: c.strict}}
+			dfd, err := client.DFDFromDOT()
+			if c.err == nil {
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+				if dfd == nil {
+					t.Error("Expected a DFD, got nil")
+				}
+				return
+			}
+			if reflect.TypeOf(err) != reflect.TypeOf(c.err) {
+				t.Fatalf("Expected an error of type %T, got %T (%v)", c.err, err, err)
+			}
+			if pe, ok := c.err.(*ParseError); ok && pe.Line != 0 {
+				actual := err.(*ParseError)
+				if actual.Line != pe.Line || actual.Column != pe.Column {
+					t.Errorf("Expected error at %d:%d, got %d:%d", pe.Line, pe.Column, actual.Line, actual.Column)
+				}
+			}
+		})
+	}
+}
+
+func TestNewClientIOError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-dfd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Reading a directory fails with something other than os.ErrNotExist
+	_, err = NewClient(dir)
+	if _, ok := err.(*IOError); !ok {
+		t.Errorf("Expected an *IOError, got %T (%v)", err, err)
+	}
+
+	client, err := NewClient(filepath.Join(dir, "missing.dot"))
+	if err != nil {
+		t.Fatalf("Expected no error for a missing file, got %v", err)
+	}
+	if client.DFD == nil {
+		t.Error("Expected an empty DFD for a missing file")
+	}
+
+	client.Config.DOTPath = filepath.Join(dir, "missing", "dfd.dot")
+	if _, err := client.DFDToDOT(client.DFD); err == nil {
+		t.Error("Expected an error writing to a missing directory")
+	} else if _, ok := err.(*IOError); !ok {
+		t.Errorf("Expected an *IOError, got %T (%v)", err, err)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the error to wrap os.ErrNotExist, got %v", err)
+	} else if strings.Count(err.Error(), client.Config.DOTPath) != 1 {
+		t.Errorf("Expected the error to name the path once, got %v", err)
+	}
+}
+
+func TestParseFlowLabel(t *testing.T) {
+	cases := []struct {
+		label, name string
+	}{
+		{formatFlowLabel("HTTPS", FlowProperties{}), "HTTPS"},
+		{formatFlowLabel(`<a & "b">`, FlowProperties{}), `<a & "b">`},
+		{formatFlowLabel("", FlowProperties{}), ""},
+		{`"TCP"`, "TCP"},
+		{"TCP", "TCP"},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("Parsing flow label %s", c.label), func(t *testing.T) {
+			if actual := parseFlowLabel(c.label); actual != c.name {
+				t.Errorf("Expected %q, got %q", c.name, actual)
+			}
+		})
+	}
+}
+
 const testGraph = `
 strict digraph 1552575689497326632 {
 	graph [
@@ -73,9 +452,9 @@ strict digraph 1552575689497326632 {
 		fontsize="12"
 	];
 
-	subgraph cluster_2377452644169062617 {
+	subgraph cluster_7626181850182627084 {
 		graph [
-			label="Browser"
+			label="AWS"
 			fontsize="10"
 			style="dashed"
 			color="grey35"
@@ -83,14 +462,18 @@ strict digraph 1552575689497326632 {
 		];
 
 		// Node definitions.
-		process_6384522904477046688 [
-			label="Client"
+		process_6865082864924295608 [
+			label="Web Server"
 			shape=circle
 		];
+		externalservice_4258120822598301454 [
+			label="Logs"
+			shape=diamond
+		];
 	}
-	subgraph cluster_7626181850182627084 {
+	subgraph cluster_2377452644169062617 {
 		graph [
-			label="AWS"
+			label="Browser"
 			fontsize="10"
 			style="dashed"
 			color="grey35"
@@ -98,36 +481,32 @@ strict digraph 1552575689497326632 {
 		];
 
 		// Node definitions.
-		externalservice_4258120822598301454 [
-			label="Logs"
-			shape=diamond
-		];
-		process_6865082864924295608 [
-			label="Web Server"
+		process_6384522904477046688 [
+			label="Client"
 			shape=circle
 		];
 	}
 	// Node definitions.
-	externalservice_4258120822598301454 [
-		label="Logs"
-		shape=diamond
+	process_6384522904477046688 [
+		label="Client"
+		shape=circle
 	];
 	process_4404728580455388596 [
 		label="Google Analytics"
 		shape=circle
 	];
-	process_6384522904477046688 [
-		label="Client"
-		shape=circle
-	];
 	process_6865082864924295608 [
 		label="Web Server"
 		shape=circle
 	];
+	externalservice_4258120822598301454 [
+		label="Logs"
+		shape=diamond
+	];
 
 	// Edge definitions.
-	process_6384522904477046688 -> externalservice_4258120822598301454 [label=<<table border="0" cellborder="0" cellpadding="2"><tr><td><b>HTTPS</b></td></tr></table>>];
 	process_6384522904477046688 -> process_6865082864924295608 [label=<<table border="0" cellborder="0" cellpadding="2"><tr><td><b>HTTPS</b></td></tr></table>>];
+	process_6384522904477046688 -> externalservice_4258120822598301454 [label=<<table border="0" cellborder="0" cellpadding="2"><tr><td><b>HTTPS</b></td></tr></table>>];
 	process_6865082864924295608 -> externalservice_4258120822598301454 [label=<<table border="0" cellborder="0" cellpadding="2"><tr><td><b>TCP</b></td></tr></table>>];
 }
 `
@@ -3,4 +3,7 @@ package dfd
 type Config struct {
 	DFDName string
 	DOTPath string
+	// Strict makes a Client return an error, rather than an empty DFD, when
+	// the file at DOTPath is not valid DOT.
+	Strict bool
 }
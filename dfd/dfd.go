@@ -2,11 +2,16 @@ package dfd
 
 import (
 	"fmt"
+	"html"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 
 	"gonum.org/v1/gonum/graph"
 	"gonum.org/v1/gonum/graph/encoding"
 	"gonum.org/v1/gonum/graph/encoding/dot"
+	"gonum.org/v1/gonum/graph/iterator"
 )
 
 // Graph
@@ -18,8 +23,12 @@ type DataFlowDiagram struct {
 	Processes        map[string]*Process
 	ExternalServices map[string]*ExternalService
 	DataStores       map[string]*DataStore
-	TrustBoundaries  map[string]*TrustBoundary
-	Flows            map[string]*Flow
+	// TrustBoundaries holds every trust boundary of the diagram, including
+	// the ones nested in other trust boundaries.
+	TrustBoundaries map[string]*TrustBoundary
+	// Flows holds the flows of the diagram by ID. Several flows may connect
+	// the same source and destination.
+	Flows map[string]*Flow
 }
 
 // Subgraph
@@ -27,15 +36,29 @@ type TrustBoundary struct {
 	*dfdGraph
 
 	Name string
+	// key is the human-readable key the boundary was decoded with, if any.
+	key string
+	// parent is the trust boundary containing this one, nil at the top level.
+	parent *TrustBoundary
+	// dfd is the diagram the boundary belongs to, nil until it is added to
+	// one. Removing an element from the boundary removes its flows from it.
+	dfd *DataFlowDiagram
 
 	Processes        map[string]*Process
 	ExternalServices map[string]*ExternalService
 	DataStores       map[string]*DataStore
+	// TrustBoundaries holds the trust boundaries directly nested in this one.
+	TrustBoundaries map[string]*TrustBoundary
 }
 
 // Edge
 type Flow struct {
 	*dotEdge
+	id         string
+	Name       string
+	Properties FlowProperties
+	// responseTo is the ID of the request the flow is the response to.
+	responseTo string
 }
 
 type DfdGraph interface {
@@ -85,6 +108,7 @@ func DeserializeTrustBoundary(id string) *TrustBoundary {
 		Processes:        make(map[string]*Process),
 		ExternalServices: make(map[string]*ExternalService),
 		DataStores:       make(map[string]*DataStore),
+		TrustBoundaries:  make(map[string]*TrustBoundary),
 		dfdGraph:         sg,
 	}
 }
@@ -95,6 +119,7 @@ func InitializeTrustBoundary(name string) *TrustBoundary {
 		Processes:        make(map[string]*Process),
 		ExternalServices: make(map[string]*ExternalService),
 		DataStores:       make(map[string]*DataStore),
+		TrustBoundaries:  make(map[string]*TrustBoundary),
 		dfdGraph:         NewDfdGraph(),
 	}
 	tb.setAttributes()
@@ -134,10 +159,6 @@ func (g *TrustBoundary) FindNode(id string) graph.Node {
 	return nil
 }
 
-func (dfd *DataFlowDiagram) ToDOT() error {
-	return nil
-}
-
 func (dfd *DataFlowDiagram) GetTrustBoundary(id string) *TrustBoundary {
 	return dfd.TrustBoundaries[id]
 }
@@ -169,17 +190,71 @@ func (g *DataFlowDiagram) AddNodeElem(n graph.Node) {
 	return
 }
 
+// NewID returns an ID derived from name that no element or trust boundary of
+// the diagram uses, e.g. "web-server", or "web-server-2" if that is taken.
+func (dfd *DataFlowDiagram) NewID(name string) string {
+	return uniqueSlug(name, "element", func(id string) bool {
+		return dfd.checkElementID(id) != nil || dfd.TrustBoundaries[id] != nil
+	})
+}
+
+// AddElement adds a Process, ExternalService or DataStore to the diagram, or
+// to the trust boundary with the given ID if it is not empty. Unlike
+// AddNodeElem, it returns a *ReferenceError rather than corrupting the
+// diagram if the ID of the element is already in use.
+func (dfd *DataFlowDiagram) AddElement(n DfdNode, boundaryID string) error {
+	if err := dfd.checkElementID(n.ExternalID()); err != nil {
+		return err
+	}
+	var g DfdGraph = dfd
+	if boundaryID != "" {
+		tb, ok := dfd.TrustBoundaries[boundaryID]
+		if !ok {
+			return &ReferenceError{ID: boundaryID, Reason: "unknown trust boundary"}
+		}
+		g = tb
+	}
+	switch n.(type) {
+	case *Process, *ExternalService, *DataStore:
+		g.AddNodeElem(n.(graph.Node))
+		return nil
+	default:
+		return &UnknownElementError{Kind: "element type", Type: fmt.Sprintf("%T", n)}
+	}
+}
+
+// checkElementID returns a *ReferenceError if an element of the diagram
+// already uses id, or if id maps onto the gonum node ID of another element.
+func (dfd *DataFlowDiagram) checkElementID(id string) error {
+	if !validID(id) {
+		return &MalformedIDError{ID: id}
+	}
+	if dfd.FindNode(id) != nil {
+		return &ReferenceError{ID: id, Reason: "element ID already in use"}
+	}
+	xid := idToID64(id)
+	if dfd.Node(xid) != nil {
+		return &ReferenceError{ID: id, Reason: "element ID collides with another element's node ID"}
+	}
+	for _, tb := range dfd.TrustBoundaries {
+		if tb.Node(xid) != nil {
+			return &ReferenceError{ID: id, Reason: "element ID collides with another element's node ID"}
+		}
+	}
+	return nil
+}
+
 func (g *DataFlowDiagram) addProcess(p *Process) error {
 	g.Processes[p.ExternalID()] = p
 	return nil
 }
 
+// RemoveProcess removes the process with the given ID and its flows, wherever
+// it is in the diagram. It is RemoveElement with the Cascade policy.
 func (g *DataFlowDiagram) RemoveProcess(id string) {
-	g.mtx.Lock()
-	defer g.mtx.Unlock()
-	delete(g.Processes, id)
-	g.RemoveNode(idToID64(id))
-	return
+	if _, ok := g.FindNode(id).(*Process); ok {
+		g.RemoveElement(id, Cascade)
+	}
 }
 
 func (g *DataFlowDiagram) addExternalService(es *ExternalService) error {
@@ -187,12 +262,12 @@ func (g *DataFlowDiagram) addExternalService(es *ExternalService) error {
 	return nil
 }
 
+// RemoveExternalService removes the external service with the given ID and its flows, wherever
+// it is in the diagram. It is RemoveElement with the Cascade policy.
 func (g *DataFlowDiagram) RemoveExternalService(id string) {
-	g.mtx.Lock()
-	defer g.mtx.Unlock()
-	delete(g.ExternalServices, id)
-	g.RemoveNode(idToID64(id))
-	return
+	if _, ok := g.FindNode(id).(*ExternalService); ok {
+		g.RemoveElement(id, Cascade)
+	}
 }
 
 func (g *DataFlowDiagram) addDataStore(es *DataStore) error {
@@ -200,34 +275,86 @@ func (g *DataFlowDiagram) addDataStore(es *DataStore) error {
 	return nil
 }
 
+// RemoveDataStore removes the data store with the given ID and its flows, wherever
+// it is in the diagram. It is RemoveElement with the Cascade policy.
 func (g *DataFlowDiagram) RemoveDataStore(id string) {
-	g.mtx.Lock()
-	defer g.mtx.Unlock()
-	delete(g.DataStores, id)
-	g.RemoveNode(idToID64(id))
-	return
+	if _, ok := g.FindNode(id).(*DataStore); ok {
+		g.RemoveElement(id, Cascade)
+	}
 }
 
+// AddTrustBoundary adds a top level trust boundary with an ID derived from
+// its name by NewID.
 func (dfd *DataFlowDiagram) AddTrustBoundary(name string) (*TrustBoundary, error) {
+	return dfd.AddTrustBoundaryWithID(dfd.NewID(name), name, "")
+}
+
+// AddNestedTrustBoundary adds a trust boundary inside the trust boundary with
+// the given ID.
+func (dfd *DataFlowDiagram) AddNestedTrustBoundary(parent_id, name string) (*TrustBoundary, error) {
+	return dfd.AddTrustBoundaryWithID(dfd.NewID(name), name, parent_id)
+}
+
+// AddTrustBoundaryWithID adds a trust boundary with the given ID inside the
+// trust boundary with the ID parent_id, or at the top level if it is empty.
+// IDs are made of letters, digits and dashes, and must not be used by another
+// trust boundary.
+func (dfd *DataFlowDiagram) AddTrustBoundaryWithID(id, name, parent_id string) (*TrustBoundary, error) {
 	dfd.mtx.Lock()
 	defer dfd.mtx.Unlock()
+	if !validID(id) {
+		return nil, &MalformedIDError{ID: id}
+	}
+	if _, ok := dfd.TrustBoundaries[id]; ok {
+		return nil, &ReferenceError{ID: id, Reason: "trust boundary ID already in use"}
+	}
+	var parent *TrustBoundary
+	if parent_id != "" {
+		var ok bool
+		if parent, ok = dfd.TrustBoundaries[parent_id]; !ok {
+			return nil, &ReferenceError{ID: parent_id, Reason: "unknown trust boundary"}
+		}
+	}
 	tb := InitializeTrustBoundary(name)
-	dfd.TrustBoundaries[tb.ExternalID()] = tb
-	return dfd.TrustBoundaries[tb.ExternalID()], nil
+	tb.id = id
+	if parent != nil {
+		parent.addTrustBoundary(tb)
+	}
+	dfd.registerTrustBoundary(tb)
+	return tb, nil
 }
 
+// RemoveTrustBoundary removes a trust boundary along with the trust
+// boundaries nested in it, moving their elements to its parent, or to the top
+// level. See RemoveTrustBoundaryWithPolicy for other ways to remove it.
 func (g *DataFlowDiagram) RemoveTrustBoundary(id string) {
 	g.mtx.Lock()
 	defer g.mtx.Unlock()
-	delete(g.TrustBoundaries, id)
+	tb, ok := g.TrustBoundaries[id]
+	if !ok {
+		return
+	}
+	var move func(*TrustBoundary)
+	move = func(nested *TrustBoundary) {
+		for _, n := range sortedElements(nested.Processes, nested.ExternalServices, nested.DataStores) {
+			g.placeElement(n, tb.parent)
+		}
+		for _, child := range nested.TrustBoundaries {
+			move(child)
+		}
+	}
+	move(tb)
+	g.removeTrustBoundary(tb, Cascade)
 	return
 }
 
+// Structure implements dot.Structurer, returning the top level trust
+// boundaries ordered by name, then ID.
 func (g *DataFlowDiagram) Structure() []dot.Graph {
 	g.mtx.Lock()
 	defer g.mtx.Unlock()
 	graphs := []dot.Graph{}
-	for _, tb := range g.TrustBoundaries {
+	for _, tb := range topLevelBoundaries(g) {
 		graphs = append(graphs, tb)
 	}
 	return graphs
@@ -286,6 +413,36 @@ func (g *TrustBoundary) Subgraph() graph.Graph {
 	return g
 }
 
+// Parent returns the trust boundary containing this one, or nil if it is at
+// the top level of the diagram.
+func (tb *TrustBoundary) Parent() *TrustBoundary {
+	return tb.parent
+}
+
+// registerTrustBoundary adds tb to the trust boundaries of the diagram and
+// links it back to the diagram. It does not nest tb in its parent.
+func (dfd *DataFlowDiagram) registerTrustBoundary(tb *TrustBoundary) {
+	tb.dfd = dfd
+	dfd.TrustBoundaries[tb.ExternalID()] = tb
+}
+
+func (tb *TrustBoundary) addTrustBoundary(child *TrustBoundary) {
+	child.parent = tb
+	tb.TrustBoundaries[child.ExternalID()] = child
+}
+
+// Structure implements dot.Structurer, returning the trust boundaries nested
+// in this one ordered by name, then ID.
+func (tb *TrustBoundary) Structure() []dot.Graph {
+	tb.mtx.Lock()
+	defer tb.mtx.Unlock()
+	graphs := []dot.Graph{}
+	for _, child := range sortedBoundaries(tb.TrustBoundaries) {
+		graphs = append(graphs, child)
+	}
+	return graphs
+}
+
 func (sg *TrustBoundary) setAttributes() {
 	sg.graph = nil
 	sg.node = nil
@@ -335,12 +492,17 @@ func (g *TrustBoundary) addProcess(p *Process) error {
 	return nil
 }
 
+// RemoveProcess removes the process with the given ID from the trust boundary,
+// and its flows from the diagram the boundary belongs to.
 func (g *TrustBoundary) RemoveProcess(id string) {
 	g.mtx.Lock()
-	defer g.mtx.Unlock()
+	_, ok := g.Processes[id]
 	delete(g.Processes, id)
 	g.RemoveNode(idToID64(id))
-	return
+	g.mtx.Unlock()
+	if ok {
+		g.removeFlowsOf(id)
+	}
 }
 
 func (g *TrustBoundary) addExternalService(es *ExternalService) error {
@@ -348,12 +510,17 @@ func (g *TrustBoundary) addExternalService(es *ExternalService) error {
 	return nil
 }
 
+// RemoveExternalService removes the external service with the given ID from the trust boundary,
+// and its flows from the diagram the boundary belongs to.
 func (g *TrustBoundary) RemoveExternalService(id string) {
 	g.mtx.Lock()
-	defer g.mtx.Unlock()
+	_, ok := g.ExternalServices[id]
 	delete(g.ExternalServices, id)
 	g.RemoveNode(idToID64(id))
-	return
+	g.mtx.Unlock()
+	if ok {
+		g.removeFlowsOf(id)
+	}
 }
 
 func (g *TrustBoundary) addDataStore(es *DataStore) error {
@@ -361,52 +528,263 @@ func (g *TrustBoundary) addDataStore(es *DataStore) error {
 	return nil
 }
 
+// RemoveDataStore removes the data store with the given ID from the trust boundary,
+// and its flows from the diagram the boundary belongs to.
 func (g *TrustBoundary) RemoveDataStore(id string) {
 	g.mtx.Lock()
-	defer g.mtx.Unlock()
+	_, ok := g.DataStores[id]
 	delete(g.DataStores, id)
 	g.RemoveNode(idToID64(id))
-	return
+	g.mtx.Unlock()
+	if ok {
+		g.removeFlowsOf(id)
+	}
 }
 
+// removeFlowsOf removes the flows of the element with the given ID, just
+// removed from the trust boundary, from the diagram the boundary belongs to.
+func (g *TrustBoundary) removeFlowsOf(id string) {
+	if g.dfd == nil {
+		return
+	}
+	g.dfd.mtx.Lock()
+	defer g.dfd.mtx.Unlock()
+	xid := idToID64(id)
+	g.dfd.removeFlowsOf(xid)
+	if g.dfd.FindNode(id) == nil {
+		g.dfd.RemoveNode(xid)
+	}
+}
+
+// AddFlow adds a flow from f to t with an ID derived from theirs, e.g.
+// "12-34", or "12-34-2" if another flow already connects them.
 func (g *DataFlowDiagram) AddFlow(f graph.Node, t graph.Node, name string) *Flow {
 	g.mtx.Lock()
 	defer g.mtx.Unlock()
-	flow := &Flow{dotEdge: &dotEdge{Label: formatFlowLabel(name), Edge: g.NewEdge(f, t)}}
-	flow_id := genFlowID(f, t)
-	g.SetEdge(flow)
-	g.Flows[flow_id] = flow
+	return g.addFlow(g.newFlowID(f, t), f, t, name)
+}
+
+// AddFlowWithID adds a flow from f to t with the given ID. IDs are made of
+// letters, digits and dashes, and must not be used by another flow.
+func (g *DataFlowDiagram) AddFlowWithID(id string, f graph.Node, t graph.Node, name string) (*Flow, error) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if !validID(id) {
+		return nil, &MalformedIDError{ID: id}
+	}
+	if _, ok := g.Flows[id]; ok {
+		return nil, &ReferenceError{ID: id, Reason: "flow ID already in use"}
+	}
+	return g.addFlow(id, f, t, name), nil
+}
+
+func (g *DataFlowDiagram) addFlow(id string, f graph.Node, t graph.Node, name string) *Flow {
+	flow := &Flow{id: id, Name: name, dotEdge: &dotEdge{Label: formatFlowLabel(name, FlowProperties{}), Edge: g.NewEdge(f, t)}}
+	// The graph holds a single edge between two nodes, standing for all the
+	// flows between them.
+	if !g.HasEdgeFromTo(f.ID(), t.ID()) {
+		g.SetEdge(flow)
+	}
+	g.Flows[id] = flow
 	return flow
 }
 
+// newFlowID returns the ID of a new flow from f to t.
+func (g *DataFlowDiagram) newFlowID(f, t graph.Node) string {
+	id := genFlowID(f, t)
+	for i := 2; g.Flows[id] != nil; i++ {
+		id = fmt.Sprintf("%s-%d", genFlowID(f, t), i)
+	}
+	return id
+}
+
+// RemoveFlow removes the flows from the element with the ID src_id to the
+// one with the ID dest_id.
 func (g *DataFlowDiagram) RemoveFlow(src_id, dest_id string) {
 	g.mtx.Lock()
 	defer g.mtx.Unlock()
-	delete(g.Flows, fmt.Sprintf("%s%s", src_id, dest_id))
-	g.RemoveEdge(idToID64(src_id), idToID64(dest_id))
+	fid, tid := idToID64(src_id), idToID64(dest_id)
+	var ids []string
+	for id, f := range g.Flows {
+		if f.From().ID() == fid && f.To().ID() == tid {
+			ids = append(ids, id)
+		}
+	}
+	for _, id := range ids {
+		g.removeFlow(id)
+	}
 	return
 }
 
-func (f *Flow) Attributes() []encoding.Attribute {
-	if len(f.Label) == 0 {
+// RemoveFlowWithID removes the flow with the given ID.
+func (g *DataFlowDiagram) RemoveFlowWithID(id string) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.removeFlow(id)
+	return
+}
+
+// removeFlow removes the flow with the given ID, unpairing its response and
+// keeping another flow between its ends as their edge.
+func (g *DataFlowDiagram) removeFlow(id string) {
+	flow, ok := g.Flows[id]
+	if !ok {
+		return
+	}
+	delete(g.Flows, id)
+	for _, other := range g.Flows {
+		if other.responseTo == id {
+			other.responseTo = ""
+		}
+	}
+	fid, tid := flow.From().ID(), flow.To().ID()
+	if g.from[fid][tid] != graph.Edge(flow) {
+		return
+	}
+	g.RemoveEdge(fid, tid)
+	for _, other := range g.Flows {
+		if other.From().ID() == fid && other.To().ID() == tid {
+			g.SetEdge(other)
+			return
+		}
+	}
+	// Elements in a trust boundary are only in the graph of the diagram
+	// through their flows.
+	for _, n := range []graph.Node{flow.From(), flow.To()} {
+		xid := n.ID()
+		if len(g.from[xid])+len(g.to[xid]) != 0 {
+			continue
+		}
+		id := n.(DfdNode).ExternalID()
+		if g.Processes[id] == nil && g.ExternalServices[id] == nil && g.DataStores[id] == nil {
+			g.RemoveNode(xid)
+		}
+	}
+}
+
+// FlowsBetween returns the flows from f to t, ordered by name, then ID.
+func (g *DataFlowDiagram) FlowsBetween(f, t graph.Node) []*Flow {
+	if f == nil || t == nil {
+		return nil
+	}
+	var flows []*Flow
+	for _, flow := range g.Flows {
+		if flow.From().ID() == f.ID() && flow.To().ID() == t.ID() {
+			flows = append(flows, flow)
+		}
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		return lessFlow(flows[i], flows[j])
+	})
+	return flows
+}
+
+// Lines implements graph.Multigraph, returning the flows from the node with
+// the ID uid to the one with the ID vid, or nil if there are none.
+func (g *DataFlowDiagram) Lines(uid, vid int64) graph.Lines {
+	if !g.HasEdgeFromTo(uid, vid) {
+		return nil
+	}
+	var lines []graph.Line
+	for _, f := range g.FlowsBetween(g.Node(uid), g.Node(vid)) {
+		lines = append(lines, f)
+	}
+	return iterator.NewOrderedLines(lines)
+}
+
+// ExternalID returns the ID of the flow.
+func (f *Flow) ExternalID() string {
+	return f.id
+}
+
+// ID implements graph.Line, distinguishing flows between the same elements.
+func (f *Flow) ID() int64 {
+	return idToID64(f.id)
+}
+
+// SetAttribute sets a DOT attribute on the flow. Labels written by
+// formatFlowLabel are unwrapped so that Name survives a round-trip, and the
+// dfd_ attributes set Properties. The dashed style of responses is implied by
+// their request, and ignored.
+func (f *Flow) SetAttribute(attr encoding.Attribute) error {
+	switch {
+	case attr.Key == "label":
+		f.Name = parseFlowLabel(attr.Value)
+		f.Label = formatFlowLabel(f.Name, f.Properties)
+		return nil
+	case attr.Key == flowResponseToAttr:
+		f.responseTo = unquoteDOT(attr.Value)
+		return nil
+	case attr.Key == "style" && unquoteDOT(attr.Value) == "dashed" && f.responseTo != "":
+		// Responses are drawn dashed, so the style is implied.
 		return nil
 	}
-	return []encoding.Attribute{{
+	ok, err := f.Properties.setAttribute(attr)
+	if !ok {
+		return f.dotEdge.SetAttribute(attr)
+	}
+	f.Label = formatFlowLabel(f.Name, f.Properties)
+	return err
+}
+
+func (f *Flow) setProperties(p FlowProperties) {
+	f.Properties = p
+	f.Label = formatFlowLabel(f.Name, p)
+}
+
+// Attributes returns the DOT attributes of the flow. The label is rebuilt
+// from Name and Properties so that it reflects their current values.
+func (f *Flow) Attributes() []encoding.Attribute {
+	attrs := []encoding.Attribute{{
 		Key:   "label",
-		Value: f.Label,
+		Value: formatFlowLabel(f.Name, f.Properties),
 	}}
+	attrs = append(attrs, f.dotEdge.attributes()...)
+	attrs = append(attrs, f.Properties.attributes()...)
+	if f.id != genFlowID(f.From(), f.To()) {
+		attrs = append(attrs, makeAttribute(flowIDAttr, f.id))
+	}
+	if f.responseTo != "" {
+		attrs = append(attrs, makeAttribute(flowResponseToAttr, f.responseTo))
+		if f.Style == "" {
+			attrs = append(attrs, encoding.Attribute{Key: "style", Value: "dashed"})
+		}
+	}
+	return attrs
 }
 
 func makeAttribute(key, value string) encoding.Attribute {
 	return encoding.Attribute{Key: key, Value: strconv.Quote(value)}
 }
 
+// genFlowID returns the ID of the first flow from f to t.
 func genFlowID(f graph.Node, t graph.Node) string {
-	return fmt.Sprintf("%d%d", f.ID(), t.ID())
+	return fmt.Sprintf("%d-%d", f.ID(), t.ID())
 }
 
-func formatFlowLabel(name string) string {
-	return fmt.Sprintf(`<<table border="0" cellborder="0" cellpadding="2"><tr><td><b>%s</b></td></tr></table>>`, name)
+// hasDerivedID reports whether the ID of f is one AddFlow derives from the
+// IDs of its ends.
+func (f *Flow) hasDerivedID() bool {
+	id := genFlowID(f.From(), f.To())
+	if f.id == id {
+		return true
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(f.id, id+"-"))
+	return strings.HasPrefix(f.id, id+"-") && err == nil && n >= 2
+}
+
+// flowLabelRE matches labels written by formatFlowLabel. The name is HTML
+// escaped, so it cannot contain a tag; the property rows that follow it are
+// rebuilt from the dfd_ attributes.
+var flowLabelRE = regexp.MustCompile(`(?s)^<<table[^>]*><tr><td><b>([^<]*)</b></td></tr>.*</table>>$`)
+
+// parseFlowLabel is the inverse of formatFlowLabel. Labels that were not
+// produced by formatFlowLabel are treated as plain DOT strings.
+func parseFlowLabel(label string) string {
+	if m := flowLabelRE.FindStringSubmatch(label); m != nil {
+		return html.UnescapeString(m[1])
+	}
+	return unquoteDOT(label)
 }
 
 func (g *DataFlowDiagram) DOTID() string {
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strconv"
 
+	"gonum.org/v1/gonum/graph/encoding"
 	"gonum.org/v1/gonum/graph/simple"
 )
 
@@ -20,19 +21,24 @@ type DfdNode interface {
 // Node circle
 type Process struct {
 	*dotNode
-	Name string
+	Name       string
+	Properties ProcessProperties
+	// Child is the lower level DFD the process decomposes into, if any.
+	Child *DataFlowDiagram
 }
 
 // Node diamond
 type ExternalService struct {
 	*dotNode
-	Name string
+	Name       string
+	Properties ExternalServiceProperties
 }
 
 // Node cylinder
 type DataStore struct {
 	*dotNode
-	Name string
+	Name       string
+	Properties DataStoreProperties
 }
 
 // DeserializeProcess returns a pointer to a Process with a given id
@@ -56,6 +62,18 @@ func NewProcess(name string) *Process {
 	return p
 }
 
+// NewProcessWithID returns a pointer to a Process with the given ID and
+// name. IDs are made of letters, digits and dashes, e.g. "web-server";
+// anything else yields a *MalformedIDError.
+func NewProcessWithID(id, name string) (*Process, error) {
+	if !validID(id) {
+		return nil, &MalformedIDError{ID: id}
+	}
+	p := DeserializeProcess(id)
+	p.UpdateName(name)
+	return p, nil
+}
+
 func NewExternalService(name string) *ExternalService {
 	xid := genID()
 	xid64 := idToID64(xid)
@@ -67,6 +85,17 @@ func NewExternalService(name string) *ExternalService {
 	return es
 }
 
+// NewExternalServiceWithID returns a pointer to an ExternalService with the
+// given ID and name, as NewProcessWithID does.
+func NewExternalServiceWithID(id, name string) (*ExternalService, error) {
+	if !validID(id) {
+		return nil, &MalformedIDError{ID: id}
+	}
+	es := DeserializeExternalService(id)
+	es.UpdateName(name)
+	return es, nil
+}
+
 func DeserializeExternalService(id string) *ExternalService {
 	xid64 := idToID64(id)
 	n := &ExternalService{dotNode: &dotNode{Node: simple.Node(xid64)}}
@@ -86,6 +115,17 @@ func NewDataStore(name string) *DataStore {
 	return ds
 }
 
+// NewDataStoreWithID returns a pointer to a DataStore with the given ID and
+// name, as NewProcessWithID does.
+func NewDataStoreWithID(id, name string) (*DataStore, error) {
+	if !validID(id) {
+		return nil, &MalformedIDError{ID: id}
+	}
+	ds := DeserializeDataStore(id)
+	ds.UpdateName(name)
+	return ds, nil
+}
+
 func DeserializeDataStore(id string) *DataStore {
 	xid64 := idToID64(id)
 	n := &DataStore{dotNode: &dotNode{Node: simple.Node(xid64)}}
@@ -108,6 +148,49 @@ func (n *Process) UpdateName(new_name string) {
 	return
 }
 
+// SetAttribute sets a DOT attribute, keeping Name in sync with the label.
+func (n *Process) SetAttribute(attr encoding.Attribute) error {
+	if ok, err := n.Properties.setAttribute(attr); ok {
+		return err
+	}
+	if attr.Key == childAttr {
+		child, err := unmarshalDOT([]byte(unquoteDOT(attr.Value)))
+		if err != nil {
+			return err
+		}
+		n.Child = child
+		return nil
+	}
+	if err := n.dotNode.SetAttribute(attr); err != nil {
+		return err
+	}
+	if attr.Key == "label" {
+		n.Name = unquoteDOT(attr.Value)
+	}
+	return nil
+}
+
+// Attributes returns the DOT attributes of the node, including its
+// properties and its child DFD, which is stored as a DOT document.
+func (n *Process) Attributes() []encoding.Attribute {
+	attrs := append(n.dotNode.Attributes(), n.Properties.attributes()...)
+	if n.Child != nil {
+		// The printer of DFDs cannot fail.
+		child, _ := marshalDOT(n.Child)
+		attrs = append(attrs, makeAttribute(childAttr, string(child)))
+	}
+	return attrs
+}
+
+// Decompose returns the child DFD of the process, giving it an empty one
+// named after the process if it has none.
+func (n *Process) Decompose() *DataFlowDiagram {
+	if n.Child == nil {
+		n.Child = InitializeDFD(n.Name)
+	}
+	return n.Child
+}
+
 func (es *ExternalService) DOTID() string {
 	return fmt.Sprintf("externalservice_%s", es.dotID)
 }
@@ -118,6 +201,25 @@ func (n *ExternalService) UpdateName(new_name string) {
 	return
 }
 
+// SetAttribute sets a DOT attribute, keeping Name in sync with the label.
+func (n *ExternalService) SetAttribute(attr encoding.Attribute) error {
+	if ok, err := n.Properties.setAttribute(attr); ok {
+		return err
+	}
+	if err := n.dotNode.SetAttribute(attr); err != nil {
+		return err
+	}
+	if attr.Key == "label" {
+		n.Name = unquoteDOT(attr.Value)
+	}
+	return nil
+}
+
+// Attributes returns the DOT attributes of the node, including its properties.
+func (n *ExternalService) Attributes() []encoding.Attribute {
+	return append(n.dotNode.Attributes(), n.Properties.attributes()...)
+}
+
 func (n *DataStore) UpdateName(new_name string) {
 	n.Name = new_name
 	n.Label = strconv.Quote(new_name)
@@ -131,3 +233,35 @@ func (n *DataStore) ExternalID() string {
 func (n *DataStore) DOTID() string {
 	return fmt.Sprintf("datastore_%s", n.dotID)
 }
+
+// SetAttribute sets a DOT attribute, keeping Name in sync with the label.
+func (n *DataStore) SetAttribute(attr encoding.Attribute) error {
+	if ok, err := n.Properties.setAttribute(attr); ok {
+		return err
+	}
+	if err := n.dotNode.SetAttribute(attr); err != nil {
+		return err
+	}
+	if attr.Key == "label" {
+		n.Name = unquoteDOT(attr.Value)
+	}
+	return nil
+}
+
+// Attributes returns the DOT attributes of the node, including its properties.
+func (n *DataStore) Attributes() []encoding.Attribute {
+	return append(n.dotNode.Attributes(), n.Properties.attributes()...)
+}
+
+// nodeName returns the name of a Process, ExternalService or DataStore.
+func nodeName(n DfdNode) string {
+	switch n := n.(type) {
+	case *Process:
+		return n.Name
+	case *ExternalService:
+		return n.Name
+	case *DataStore:
+		return n.Name
+	}
+	return ""
+}
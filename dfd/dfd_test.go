@@ -1,8 +1,10 @@
 package dfd
 
 import (
+	"bytes"
 	"fmt"
 	"reflect"
+	"strings"
 	"testing"
 
 	"gonum.org/v1/gonum/graph"
@@ -191,3 +193,164 @@ func TestDFDAddNodeRace(t *testing.T) {
 		}()
 	}
 }
+
+func TestSlugIDs(t *testing.T) {
+	dfd := InitializeDFD("Shop")
+	aws, err := dfd.AddTrustBoundary("AWS")
+	if err != nil || aws.ExternalID() != "aws" || aws.DOTID() != "cluster_aws" {
+		t.Fatalf("Expected a trust boundary with ID aws, got %v (%v)", aws, err)
+	}
+	if _, err := dfd.AddTrustBoundaryWithID("aws", "Other AWS", ""); err == nil {
+		t.Error("Expected a duplicate trust boundary ID to be rejected")
+	}
+
+	ws, err := NewProcessWithID(dfd.NewID("Web Server"), "Web Server")
+	if err != nil || ws.ExternalID() != "web-server" || ws.DOTID() != "process_web-server" {
+		t.Fatalf("Expected a process with ID web-server, got %v (%v)", ws, err)
+	}
+	if err := dfd.AddElement(ws, "aws"); err != nil {
+		t.Fatalf("Unexpected error adding the web server: %v", err)
+	}
+	if id := dfd.NewID("web server!"); id != "web-server-2" {
+		t.Errorf("Expected the next web server ID to be web-server-2, got %s", id)
+	}
+	if id := dfd.NewID("AWS"); id != "aws-2" {
+		t.Errorf("Expected IDs not to reuse trust boundary IDs, got %s", id)
+	}
+	dup, _ := NewDataStoreWithID("web-server", "Logs")
+	if err := dfd.AddElement(dup, ""); err == nil {
+		t.Error("Expected a duplicate element ID to be rejected")
+	} else if _, ok := err.(*ReferenceError); !ok {
+		t.Errorf("Expected a *ReferenceError, got %T", err)
+	}
+	if _, err := NewExternalServiceWithID("web_server", "Web"); err == nil {
+		t.Error("Expected an ID with an underscore to be rejected")
+	}
+	logs, _ := NewDataStoreWithID("logs", "Logs")
+	if err := dfd.AddElement(logs, "nowhere"); err == nil {
+		t.Error("Expected adding to an unknown trust boundary to fail")
+	}
+	if err := dfd.AddElement(logs, ""); err != nil {
+		t.Fatalf("Unexpected error adding logs: %v", err)
+	}
+	if ws.ID() == logs.ID() || ws.ID() != idToID64("web-server") {
+		t.Errorf("Expected distinct, stable node IDs, got %d and %d", ws.ID(), logs.ID())
+	}
+	dfd.AddFlow(ws, logs, "TCP")
+
+	out, err := dfd.MarshalDOT()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding: %v", err)
+	}
+	if !strings.Contains(string(out), `"process_web-server" -> datastore_logs`) {
+		t.Errorf("Expected quoted slug IDs in the DOT output, got:\n%s", out)
+	}
+	back, err := Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding:\n%s\n%v", out, err)
+	}
+	if back.TrustBoundaries["aws"].Processes["web-server"] == nil || back.DataStores["logs"] == nil || len(back.Flows) != 1 {
+		t.Errorf("Expected slug IDs to survive a round trip, got:\n%s", out)
+	}
+
+	dfd.RemoveDataStore("logs")
+	if dfd.Node(logs.ID()) != nil {
+		t.Error("Expected removing a data store by slug ID to remove its node")
+	}
+}
+
+func TestMultipleFlows(t *testing.T) {
+	dfd := InitializeDFD("Payments")
+	api, _ := NewProcessWithID("api", "API")
+	issuer, _ := NewExternalServiceWithID("issuer", "Issuer")
+	dfd.AddElement(api, "")
+	dfd.AddElement(issuer, "")
+	auth := dfd.AddFlow(api, issuer, "Authorization")
+	refund := dfd.AddFlow(api, issuer, "Refund")
+	if auth == refund || auth.ExternalID() == refund.ExternalID() || len(dfd.Flows) != 2 {
+		t.Fatalf("Expected two distinct flows, got %v", dfd.Flows)
+	}
+	reversal, err := dfd.AddFlowWithID("reversal", api, issuer, "Reversal")
+	if err != nil {
+		t.Fatalf("Unexpected error adding a flow with an ID: %v", err)
+	}
+	if _, err := dfd.AddFlowWithID("reversal", issuer, api, "Other"); err == nil {
+		t.Error("Expected a duplicate flow ID to be rejected")
+	} else if _, ok := err.(*ReferenceError); !ok {
+		t.Errorf("Expected a *ReferenceError, got %T", err)
+	}
+	if _, err := dfd.AddFlowWithID("bad_id", api, issuer, "Other"); err == nil {
+		t.Error("Expected a malformed flow ID to be rejected")
+	}
+	dfd.AddFlow(issuer, api, "Result")
+	if flows := dfd.FlowsBetween(api, issuer); len(flows) != 3 {
+		t.Errorf("Expected 3 flows from the API to the issuer, got %d", len(flows))
+	}
+	if lines := graph.LinesOf(dfd.Lines(api.ID(), issuer.ID())); len(lines) != 3 {
+		t.Errorf("Expected 3 lines from the API to the issuer, got %d", len(lines))
+	}
+
+	names := func(d *DataFlowDiagram) string {
+		var s []string
+		for _, f := range sortedFlows(d) {
+			s = append(s, fmt.Sprintf("%s:%s", f.ExternalID(), f.Name))
+		}
+		return strings.Join(s, " ")
+	}
+	want := names(dfd)
+	out, err := dfd.MarshalDOT()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding: %v", err)
+	}
+	back, err := Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding:\n%s\n%v", out, err)
+	}
+	if got := names(back); got != want {
+		t.Errorf("Expected flows %s after a DOT round trip, got %s", want, got)
+	}
+	js, err := dfd.MarshalJSON()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding JSON: %v", err)
+	}
+	back = InitializeDFD("")
+	if err := back.UnmarshalJSON(js); err != nil {
+		t.Fatalf("Unexpected error decoding JSON: %v", err)
+	}
+	if got := names(back); got != want {
+		t.Errorf("Expected flows %s after a JSON round trip, got %s", want, got)
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeYAML(&buf, dfd); err != nil {
+		t.Fatalf("Unexpected error encoding YAML: %v", err)
+	}
+	if back, err = DecodeYAML(&buf); err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	if got := names(back); got != want {
+		t.Errorf("Expected flows %s after a YAML round trip, got %s", want, got)
+	}
+
+	dfd.RemoveFlowWithID(auth.ExternalID())
+	if len(dfd.Flows) != 3 || dfd.Edge(api.ID(), issuer.ID()) == nil {
+		t.Errorf("Expected removing one flow to keep the others, got %v", dfd.Flows)
+	}
+	dfd.RemoveFlowWithID(refund.ExternalID())
+	dfd.RemoveFlowWithID(reversal.ExternalID())
+	if dfd.Edge(api.ID(), issuer.ID()) != nil || dfd.Edge(issuer.ID(), api.ID()) == nil {
+		t.Error("Expected removing the last flow between two elements to remove their edge only")
+	}
+	dfd.RemoveFlow("issuer", "api")
+	if len(dfd.Flows) != 0 {
+		t.Errorf("Expected no flows left, got %v", dfd.Flows)
+	}
+
+	// Flow IDs are made of the IDs of their ends, which must not run
+	// together.
+	a, b := DeserializeProcess("1"), DeserializeProcess("23")
+	c, d := DeserializeProcess("12"), DeserializeProcess("3")
+	if genFlowID(a, b) == genFlowID(c, d) {
+		t.Errorf("Expected distinct flow IDs, got %s for both", genFlowID(a, b))
+	}
+}
@@ -0,0 +1,389 @@
+package dfd
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gonum.org/v1/gonum/graph/encoding"
+)
+
+// ChangeType is the kind of change reported by Compare.
+type ChangeType string
+
+const (
+	Added    ChangeType = "added"
+	Removed  ChangeType = "removed"
+	Renamed  ChangeType = "renamed"
+	Moved    ChangeType = "moved"
+	Modified ChangeType = "modified"
+)
+
+// Kinds of things that a Change applies to, besides the YAML element kinds.
+const (
+	ChangeTrustBoundary = "trust_boundary"
+	ChangeFlow          = "flow"
+)
+
+// Change is a difference between two DFDs.
+type Change struct {
+	Type ChangeType `json:"type" yaml:"type"`
+	// Kind is one of YAMLProcess, YAMLExternalService, YAMLDataStore,
+	// ChangeTrustBoundary or ChangeFlow.
+	Kind string `json:"kind" yaml:"kind"`
+	// ID is the DOT ID of the element or trust boundary, or flow_<id> for a
+	// Flow, in the new DFD, or in the old one if it was removed.
+	ID   string `json:"id" yaml:"id"`
+	Name string `json:"name" yaml:"name"`
+	// From and To are the names of the ends of a flow.
+	From string `json:"from,omitempty" yaml:"from,omitempty"`
+	To   string `json:"to,omitempty" yaml:"to,omitempty"`
+	// Field is what was modified: "endpoints", "direction", "request",
+	// "properties" or "tags". The request of a flow is the name of the flow
+	// it is the response to, empty if none.
+	Field string `json:"field,omitempty" yaml:"field,omitempty"`
+	// Old and New are the values before and after a change other than an
+	// addition or removal. Trust boundaries are described by name, or as
+	// "outside all trust boundaries".
+	Old string `json:"old,omitempty" yaml:"old,omitempty"`
+	New string `json:"new,omitempty" yaml:"new,omitempty"`
+}
+
+func (c Change) String() string {
+	var what string
+	switch c.Kind {
+	case ChangeFlow:
+		what = fmt.Sprintf("flow %q from %q to %q", c.Name, c.From, c.To)
+	case ChangeTrustBoundary:
+		what = fmt.Sprintf("trust boundary %q", c.Name)
+	default:
+		what = fmt.Sprintf("%s %q", strings.Replace(c.Kind, "_", " ", -1), c.Name)
+	}
+	switch c.Type {
+	case Added:
+		return fmt.Sprintf("+ %s (%s)", what, c.ID)
+	case Removed:
+		return fmt.Sprintf("- %s (%s)", what, c.ID)
+	case Renamed:
+		return fmt.Sprintf("~ %s renamed from %q", what, c.Old)
+	case Moved:
+		return fmt.Sprintf("> %s moved from %s to %s", what, c.Old, c.New)
+	default:
+		return fmt.Sprintf("~ %s %s changed from %q to %q", what, c.Field, c.Old, c.New)
+	}
+}
+
+// Diff lists the changes between two DFDs.
+type Diff struct {
+	Changes []Change `json:"changes" yaml:"changes"`
+}
+
+// Empty reports whether there are no changes.
+func (d *Diff) Empty() bool {
+	return len(d.Changes) == 0
+}
+
+// String returns the changes one per line, prefixed with + for additions, -
+// for removals, > for moves and ~ for other changes.
+func (d *Diff) String() string {
+	var buf bytes.Buffer
+	for _, c := range d.Changes {
+		fmt.Fprintln(&buf, c)
+	}
+	return buf.String()
+}
+
+// Compare returns the changes that turn one DFD into another.
+//
+// Elements and trust boundaries are matched by ID, and those left over by
+// kind and name when the name is unique, so that diagrams built separately
+// can be compared. Flows are matched by ID, then by their ends and name, then
+// by name when one of their ends is the same. Changes are sorted trust
+// boundaries first, then elements, then flows, each by name.
+func Compare(before, after *DataFlowDiagram) *Diff {
+	c := &comparison{before: before, after: after, boundaries: map[*TrustBoundary]*TrustBoundary{}, elements: map[string]string{}}
+	c.compareBoundaries()
+	c.compareElements()
+	c.compareFlows()
+
+	sort.SliceStable(c.changes, func(i, j int) bool {
+		a, b := c.changes[i], c.changes[j]
+		if changeOrder[a.Kind] != changeOrder[b.Kind] {
+			return changeOrder[a.Kind] < changeOrder[b.Kind]
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		return a.Field < b.Field
+	})
+	return &Diff{Changes: append([]Change{}, c.changes...)}
+}
+
+// changeOrder sorts trust boundaries first, then elements, then flows.
+var changeOrder = map[string]int{ChangeTrustBoundary: 0, YAMLProcess: 1, YAMLExternalService: 1, YAMLDataStore: 1, ChangeFlow: 2}
+
+type comparison struct {
+	before, after *DataFlowDiagram
+	// boundaries maps trust boundaries of before to those of after.
+	boundaries map[*TrustBoundary]*TrustBoundary
+	// elements maps element IDs of before to those of after.
+	elements map[string]string
+	changes  []Change
+}
+
+func (c *comparison) add(change Change) {
+	c.changes = append(c.changes, change)
+}
+
+func (c *comparison) compareBoundaries() {
+	olds, news := sortedTrustBoundaries(c.before), sortedTrustBoundaries(c.after)
+	matched := map[*TrustBoundary]bool{}
+	for _, o := range olds {
+		if n, ok := c.after.TrustBoundaries[o.ExternalID()]; ok {
+			c.boundaries[o] = n
+			matched[n] = true
+		}
+	}
+	byName := map[string][]*TrustBoundary{}
+	for _, n := range news {
+		if !matched[n] {
+			byName[n.Name] = append(byName[n.Name], n)
+		}
+	}
+	unmatched := map[string]int{}
+	for _, o := range olds {
+		if _, ok := c.boundaries[o]; !ok {
+			unmatched[o.Name]++
+		}
+	}
+	for _, o := range olds {
+		if _, ok := c.boundaries[o]; !ok && unmatched[o.Name] == 1 && len(byName[o.Name]) == 1 {
+			c.boundaries[o] = byName[o.Name][0]
+			matched[byName[o.Name][0]] = true
+		}
+	}
+
+	for _, o := range olds {
+		n, ok := c.boundaries[o]
+		if !ok {
+			c.add(Change{Type: Removed, Kind: ChangeTrustBoundary, ID: o.DOTID(), Name: o.Name})
+			continue
+		}
+		if o.Name != n.Name {
+			c.add(Change{Type: Renamed, Kind: ChangeTrustBoundary, ID: n.DOTID(), Name: n.Name, Old: o.Name, New: n.Name})
+		}
+		if !c.sameBoundary(o.parent, n.parent) {
+			c.add(Change{Type: Moved, Kind: ChangeTrustBoundary, ID: n.DOTID(), Name: n.Name, Old: boundaryName(o.parent), New: boundaryName(n.parent)})
+		}
+	}
+	for _, n := range news {
+		if !matched[n] {
+			c.add(Change{Type: Added, Kind: ChangeTrustBoundary, ID: n.DOTID(), Name: n.Name})
+		}
+	}
+}
+
+// sameBoundary reports whether an old and a new trust boundary, either of
+// which may be nil for the top level, match.
+func (c *comparison) sameBoundary(o, n *TrustBoundary) bool {
+	if o == nil || n == nil {
+		return o == nil && n == nil
+	}
+	return c.boundaries[o] == n
+}
+
+func (c *comparison) compareElements() {
+	olds, news := allElements(c.before), allElements(c.after)
+	newByID := map[string]DfdNode{}
+	for _, n := range news {
+		newByID[n.ExternalID()] = n
+	}
+	matched := map[string]bool{}
+	for _, o := range olds {
+		if n, ok := newByID[o.ExternalID()]; ok && elementKind(n) == elementKind(o) {
+			c.elements[o.ExternalID()] = n.ExternalID()
+			matched[n.ExternalID()] = true
+		}
+	}
+	key := func(n DfdNode) string {
+		return elementKind(n) + " " + nodeName(n)
+	}
+	byName := map[string][]DfdNode{}
+	for _, n := range news {
+		if !matched[n.ExternalID()] {
+			byName[key(n)] = append(byName[key(n)], n)
+		}
+	}
+	unmatched := map[string]int{}
+	for _, o := range olds {
+		if _, ok := c.elements[o.ExternalID()]; !ok {
+			unmatched[key(o)]++
+		}
+	}
+	for _, o := range olds {
+		if _, ok := c.elements[o.ExternalID()]; !ok && unmatched[key(o)] == 1 && len(byName[key(o)]) == 1 {
+			n := byName[key(o)][0]
+			c.elements[o.ExternalID()] = n.ExternalID()
+			matched[n.ExternalID()] = true
+		}
+	}
+
+	for _, o := range olds {
+		id, ok := c.elements[o.ExternalID()]
+		if !ok {
+			c.add(Change{Type: Removed, Kind: elementKind(o), ID: o.DOTID(), Name: nodeName(o)})
+			continue
+		}
+		n := newByID[id]
+		change := Change{Kind: elementKind(n), ID: n.DOTID(), Name: nodeName(n)}
+		if nodeName(o) != nodeName(n) {
+			change.Type, change.Old, change.New = Renamed, nodeName(o), nodeName(n)
+			c.add(change)
+		}
+		ob, nb := c.before.BoundaryOf(o.ExternalID()), c.after.BoundaryOf(n.ExternalID())
+		if !c.sameBoundary(ob, nb) {
+			change.Type, change.Old, change.New = Moved, boundaryName(ob), boundaryName(nb)
+			c.add(change)
+		}
+		change.Type = Modified
+		if op, np := describeAttributes(propertiesOf(o).attributes()), describeAttributes(propertiesOf(n).attributes()); op != np {
+			change.Field, change.Old, change.New = "properties", op, np
+			c.add(change)
+		}
+		if ot, nt := o.(tagged).tags(), n.(tagged).tags(); !reflect.DeepEqual(ot, nt) && len(ot)+len(nt) != 0 {
+			change.Field, change.Old, change.New = "tags", strings.Join(ot, ", "), strings.Join(nt, ", ")
+			c.add(change)
+		}
+	}
+	for _, n := range news {
+		if !matched[n.ExternalID()] {
+			c.add(Change{Type: Added, Kind: elementKind(n), ID: n.DOTID(), Name: nodeName(n)})
+		}
+	}
+}
+
+func (c *comparison) compareFlows() {
+	ends := func(f *Flow) (string, string) {
+		return f.From().(DfdNode).ExternalID(), f.To().(DfdNode).ExternalID()
+	}
+	// oldEnds returns the IDs in the new DFD of the ends of an old flow, or
+	// empty strings for ends that were removed.
+	oldEnds := func(f *Flow) (string, string) {
+		from, to := ends(f)
+		return c.elements[from], c.elements[to]
+	}
+
+	olds, news := sortedFlowIDs(c.before), sortedFlowIDs(c.after)
+	pairs := map[string]string{}
+	matched := map[string]bool{}
+	pair := func(match func(oid, nid string, o, n *Flow) bool) {
+		for _, oid := range olds {
+			if _, ok := pairs[oid]; ok {
+				continue
+			}
+			for _, nid := range news {
+				if !matched[nid] && match(oid, nid, c.before.Flows[oid], c.after.Flows[nid]) {
+					pairs[oid] = nid
+					matched[nid] = true
+					break
+				}
+			}
+		}
+	}
+	pair(func(oid, nid string, o, n *Flow) bool {
+		return oid == nid
+	})
+	pair(func(oid, nid string, o, n *Flow) bool {
+		of, ot := oldEnds(o)
+		nf, nt := ends(n)
+		return of == nf && ot == nt && o.Name == n.Name
+	})
+	pair(func(oid, nid string, o, n *Flow) bool {
+		of, ot := oldEnds(o)
+		nf, nt := ends(n)
+		return of == nf && ot == nt
+	})
+	pair(func(oid, nid string, o, n *Flow) bool {
+		of, ot := oldEnds(o)
+		nf, nt := ends(n)
+		return o.Name != "" && o.Name == n.Name && (of == nf || ot == nt)
+	})
+
+	flowChange := func(t ChangeType, id string, f *Flow) Change {
+		return Change{Type: t, Kind: ChangeFlow, ID: "flow_" + id, Name: f.Name, From: nodeName(f.From().(DfdNode)), To: nodeName(f.To().(DfdNode))}
+	}
+	for _, oid := range olds {
+		o := c.before.Flows[oid]
+		nid, ok := pairs[oid]
+		if !ok {
+			c.add(flowChange(Removed, oid, o))
+			continue
+		}
+		n := c.after.Flows[nid]
+		change := flowChange(Modified, nid, n)
+		if o.Name != n.Name {
+			change.Type, change.Old, change.New = Renamed, o.Name, n.Name
+			c.add(change)
+			change.Type = Modified
+		}
+		of, ot := oldEnds(o)
+		if nf, nt := ends(n); of != nf || ot != nt {
+			change.Field = "endpoints"
+			change.Old = fmt.Sprintf("%s -> %s", nodeName(o.From().(DfdNode)), nodeName(o.To().(DfdNode)))
+			change.New = fmt.Sprintf("%s -> %s", change.From, change.To)
+			c.add(change)
+		}
+		if od, nd := unquoteDOT(o.Dir), unquoteDOT(n.Dir); od != nd {
+			change.Field, change.Old, change.New = "direction", od, nd
+			c.add(change)
+		}
+		if (o.responseTo == "") != (n.responseTo == "") || o.responseTo != "" && pairs[o.responseTo] != n.responseTo {
+			change.Field, change.Old, change.New = "request", requestName(c.before, o), requestName(c.after, n)
+			c.add(change)
+		}
+		if op, np := describeAttributes(o.Properties.attributes()), describeAttributes(n.Properties.attributes()); op != np {
+			change.Field, change.Old, change.New = "properties", op, np
+			c.add(change)
+		}
+	}
+	for _, nid := range news {
+		if !matched[nid] {
+			c.add(flowChange(Added, nid, c.after.Flows[nid]))
+		}
+	}
+}
+
+// requestName returns the name of the request f is the response to, or "".
+func requestName(dfd *DataFlowDiagram, f *Flow) string {
+	if req := dfd.RequestOf(f); req != nil {
+		return req.Name
+	}
+	return ""
+}
+
+// elementKind returns the YAML kind of an element.
+func elementKind(n DfdNode) string {
+	switch n.(type) {
+	case *ExternalService:
+		return YAMLExternalService
+	case *DataStore:
+		return YAMLDataStore
+	default:
+		return YAMLProcess
+	}
+}
+
+// describeAttributes describes the dfd_ attributes holding properties as
+// comma separated key=value pairs.
+func describeAttributes(attrs []encoding.Attribute) string {
+	pairs := make([]string, len(attrs))
+	for i, attr := range attrs {
+		pairs[i] = strings.TrimPrefix(attr.Key, "dfd_") + "=" + unquoteDOT(attr.Value)
+	}
+	return strings.Join(pairs, ", ")
+}
@@ -0,0 +1,110 @@
+package dfd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const testYAMLChanged = `version: 1
+name: My WebApp
+elements:
+  logs:
+    kind: data_store
+    name: Logs
+trust_boundaries:
+  aws:
+    name: Amazon
+    elements:
+      web-server:
+        kind: process
+        name: API
+        tags: [internet-facing]
+      cache:
+        kind: data_store
+        name: Cache
+  browser:
+    name: Browser
+    elements:
+      client:
+        kind: process
+        name: Client
+flows:
+  - from: client
+    to: web-server
+    name: HTTPS
+    properties: {protocol: HTTPS, port: 443}
+  - from: web-server
+    to: logs
+    name: TCP
+  - from: web-server
+    to: cache
+    name: Redis
+`
+
+func TestCompare(t *testing.T) {
+	before, err := DecodeYAML(strings.NewReader(testYAML))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	after, err := DecodeYAML(strings.NewReader(testYAMLChanged))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	if diff := Compare(before, before); !diff.Empty() {
+		t.Errorf("Expected no changes between a DFD and itself, got:\n%s", diff)
+	}
+
+	flowID := func(dfd *DataFlowDiagram, from, to string) string {
+		return genFlowID(dfd.FindNode(from), dfd.FindNode(to))
+	}
+	expected := []string{
+		`~ trust boundary "Amazon" renamed from "AWS"`,
+		`~ process "API" renamed from "Web Server"`,
+		`~ process "API" tags changed from "" to "internet-facing"`,
+		`+ data store "Cache" (datastore_cache)`,
+		`- external service "Google Analytics" (externalservice_google-analytics)`,
+		`> data store "Logs" moved from trust boundary "AWS" to outside all trust boundaries`,
+		`~ flow "HTTPS" from "Client" to "API" properties changed from "" to "protocol=HTTPS, port=443"`,
+		fmt.Sprintf(`- flow "HTTPS" from "Client" to "Google Analytics" (flow_%s)`, flowID(before, "client", "google-analytics")),
+		fmt.Sprintf(`+ flow "Redis" from "API" to "Cache" (flow_%s)`, flowID(after, "web-server", "cache")),
+	}
+	diff := Compare(before, after)
+	if got := strings.Split(strings.TrimSpace(diff.String()), "\n"); strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected changes:\n%s\ngot:\n%s", strings.Join(expected, "\n"), diff)
+	}
+
+	data, err := json.Marshal(diff)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling the diff: %v", err)
+	}
+	if want := `{"type":"renamed","kind":"trust_boundary","id":"cluster_aws","name":"Amazon","old":"AWS","new":"Amazon"}`; !strings.Contains(string(data), want) {
+		t.Errorf("Expected the JSON diff to contain %s, got %s", want, data)
+	}
+}
+
+func TestCompareByName(t *testing.T) {
+	build := func(flowName string) *DataFlowDiagram {
+		dfd := InitializeDFD("Separate")
+		tb, _ := dfd.AddTrustBoundary("AWS")
+		api, db := NewProcess("API"), NewDataStore("DB")
+		tb.AddNodeElem(api)
+		tb.AddNodeElem(db)
+		user := NewExternalService("User")
+		dfd.AddNodeElem(user)
+		dfd.AddFlow(user, api, "HTTPS")
+		dfd.AddFlow(api, db, flowName)
+		return dfd
+	}
+	before, after := build("SQL"), build("SQL")
+	if diff := Compare(before, after); !diff.Empty() {
+		t.Errorf("Expected diagrams built separately to match by name, got:\n%s", diff)
+	}
+
+	after = build("Postgres")
+	diff := Compare(before, after)
+	if len(diff.Changes) != 1 || diff.Changes[0].Type != Renamed || diff.Changes[0].Old != "SQL" {
+		t.Errorf("Expected the flow to be renamed, got:\n%s", diff)
+	}
+}
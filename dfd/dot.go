@@ -0,0 +1,94 @@
+package dfd
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+
+	"gonum.org/v1/gonum/graph"
+	"gonum.org/v1/gonum/graph/encoding/dot"
+	fdot "gonum.org/v1/gonum/graph/formats/dot"
+)
+
+// Decode reads a DOT document from r and returns the DFD it describes. A
+// document that is not valid DOT yields a *ParseError.
+func Decode(r io.Reader) (*DataFlowDiagram, error) {
+	buffer, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, &IOError{Op: "read", Err: err}
+	}
+	return unmarshalDOT(buffer)
+}
+
+// Encode writes the DOT representation of dfd to w.
+func Encode(w io.Writer, dfd *DataFlowDiagram) error {
+	got, err := marshalDOT(dfd)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(got); err != nil {
+		return &IOError{Op: "write", Err: err}
+	}
+	return nil
+}
+
+// MarshalDOT returns the DOT representation of the DFD.
+func (dfd *DataFlowDiagram) MarshalDOT() ([]byte, error) {
+	return marshalDOT(dfd)
+}
+
+// UnmarshalDOT replaces the DFD with the one described by the DOT document
+// in data.
+func (dfd *DataFlowDiagram) UnmarshalDOT(data []byte) error {
+	dst, err := unmarshalDOT(data)
+	if err != nil {
+		return err
+	}
+	*dfd = *dst
+	return nil
+}
+
+// ToDOT returns the DOT representation of the DFD as a string.
+func (dfd *DataFlowDiagram) ToDOT() (string, error) {
+	got, err := marshalDOT(dfd)
+	if err != nil {
+		return "", err
+	}
+	return string(got), nil
+}
+
+// marshalDOT returns the DOT representation of g. DFDs list their trust
+// boundaries, elements and flows in a stable order, so that the same diagram
+// always yields the same bytes.
+func marshalDOT(g graph.Graph) ([]byte, error) {
+	dfd, ok := g.(*DataFlowDiagram)
+	if !ok {
+		return dot.Marshal(g, "", "", "\t")
+	}
+	p := dotPrinter{indent: "\t"}
+	p.print(dfd, false)
+	return p.buf.Bytes(), nil
+}
+
+func unmarshalDOT(data []byte) (*DataFlowDiagram, error) {
+	ast, err := fdot.ParseBytes(data)
+	if err != nil {
+		return nil, newParseError(err)
+	}
+	if len(ast.Graphs) == 0 {
+		return nil, newParseError(errors.New("no graph found"))
+	}
+
+	gast := ast.Graphs[0]
+	dst := DeserializeDFD(gast.ID)
+	if err := copyGraph(dst, gast); err != nil {
+		return nil, err
+	}
+	if err := dst.linkResponses(); err != nil {
+		return nil, err
+	}
+	if label, ok := dst.graph.get("label"); ok {
+		dst.Name = unquoteDOT(label)
+	}
+	return dst, nil
+}
@@ -13,6 +13,7 @@ type dotEdge struct {
 	graph.Edge
 	Dir            string
 	Label          string
+	Style          string
 	FromPortLabels dotPortLabels
 	ToPortLabels   dotPortLabels
 }
@@ -24,6 +25,8 @@ func (e *dotEdge) SetAttribute(attr encoding.Attribute) error {
 		e.Label = attr.Value
 	case "dir":
 		e.Dir = attr.Value
+	case "style":
+		e.Style = attr.Value
 	default:
 		return fmt.Errorf("unable to unmarshal edge DOT attribute with key %q", attr.Key)
 	}
@@ -49,3 +52,16 @@ func (e *dotEdge) FromPort() (port, compass string) {
 func (e *dotEdge) ToPort() (port, compass string) {
 	return e.ToPortLabels.Port, e.ToPortLabels.Compass
 }
+
+// attributes returns the DOT attributes of the edge that are not implied by
+// the name of the flow.
+func (e *dotEdge) attributes() []encoding.Attribute {
+	var attrs []encoding.Attribute
+	if len(e.Dir) != 0 {
+		attrs = append(attrs, encoding.Attribute{Key: "dir", Value: e.Dir})
+	}
+	if len(e.Style) != 0 {
+		attrs = append(attrs, encoding.Attribute{Key: "style", Value: e.Style})
+	}
+	return attrs
+}
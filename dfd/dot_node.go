@@ -2,6 +2,7 @@ package dfd
 
 import (
 	"fmt"
+	"strings"
 
 	"gonum.org/v1/gonum/graph"
 	"gonum.org/v1/gonum/graph/encoding"
@@ -12,11 +13,15 @@ import (
 type dotNode struct {
 	graph.Node
 	dotID string
+	// key is the human-readable key the node was decoded with, if any.
+	key string
 	// Node label.
 	Label string
 	Shape string
 	Style string
 	Dir   string
+	// Tags are free-form labels, e.g. "pci-scope".
+	Tags []string
 }
 
 func (n *dotNode) ExternalID() string {
@@ -39,6 +44,8 @@ func (n *dotNode) SetAttribute(attr encoding.Attribute) error {
 		n.Style = attr.Value
 	case "dir":
 		n.Dir = attr.Value
+	case tagsAttr:
+		n.Tags = splitTags(unquoteDOT(attr.Value))
 	default:
 		return fmt.Errorf("unable to unmarshal node DOT attribute with key %q", attr.Key)
 	}
@@ -48,7 +55,7 @@ func (n *dotNode) SetAttribute(attr encoding.Attribute) error {
 
 // Attributes returns the DOT attributes of the node.
 func (n *dotNode) Attributes() []encoding.Attribute {
-	if len(n.Label) == 0 && len(n.Shape) == 0 && len(n.Style) == 0 && len(n.Dir) == 0 {
+	if len(n.Label) == 0 && len(n.Shape) == 0 && len(n.Style) == 0 && len(n.Dir) == 0 && len(n.Tags) == 0 {
 		return nil
 	}
 	var attrs []encoding.Attribute
@@ -64,5 +71,75 @@ func (n *dotNode) Attributes() []encoding.Attribute {
 	if len(n.Dir) != 0 {
 		attrs = append(attrs, encoding.Attribute{Key: "dir", Value: n.Dir})
 	}
+	if len(n.Tags) != 0 {
+		attrs = append(attrs, makeAttribute(tagsAttr, joinTags(n.Tags)))
+	}
+	return attrs
+}
+
+// extraAttributes returns the DOT attributes of the node that are not implied
+// by its name and kind.
+func (n *dotNode) extraAttributes() []encoding.Attribute {
+	var attrs []encoding.Attribute
+	if len(n.Style) != 0 {
+		attrs = append(attrs, encoding.Attribute{Key: "style", Value: n.Style})
+	}
+	if len(n.Dir) != 0 {
+		attrs = append(attrs, encoding.Attribute{Key: "dir", Value: n.Dir})
+	}
 	return attrs
 }
+
+// keyed is implemented by elements that remember the human-readable key they
+// were decoded with.
+type keyed interface {
+	getKey() string
+	setKey(string)
+}
+
+// tagged is implemented by elements that carry tags.
+type tagged interface {
+	tags() []string
+	setTags([]string)
+}
+
+func (n *dotNode) getKey() string {
+	return n.key
+}
+
+func (n *dotNode) setKey(key string) {
+	n.key = key
+}
+
+func (n *dotNode) tags() []string {
+	return n.Tags
+}
+
+func (n *dotNode) setTags(tags []string) {
+	n.Tags = tags
+}
+
+var (
+	// Tags and classifications are comma separated in DOT, so the commas in
+	// them are percent-encoded.
+	dotTagEscaper   = strings.NewReplacer("%", "%25", ",", "%2C")
+	dotTagUnescaper = strings.NewReplacer("%25", "%", "%2C", ",")
+)
+
+// joinTags returns the DOT attribute value of tags.
+func joinTags(tags []string) string {
+	escaped := make([]string, len(tags))
+	for i, tag := range tags {
+		escaped[i] = dotTagEscaper.Replace(tag)
+	}
+	return strings.Join(escaped, ",")
+}
+
+// splitTags returns the tags in a DOT attribute value written by joinTags.
+func splitTags(value string) []string {
+	tags := splitList(value)
+	for i, tag := range tags {
+		tags[i] = dotTagUnescaper.Replace(tag)
+	}
+	return tags
+}
@@ -0,0 +1,226 @@
+package dfd
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+
+	"gonum.org/v1/gonum/graph"
+	"gonum.org/v1/gonum/graph/encoding"
+	"gonum.org/v1/gonum/graph/encoding/dot"
+)
+
+// dotPrinter writes DOT in the layout of gonum's dot.Marshal, but lists
+// trust boundaries, elements and flows in the order of sortedBoundaries,
+// lessNode and lessFlow rather than by node ID, so that the same diagram
+// always yields the same bytes. Every flow of a multigraph is written, as an
+// edge statement of its own.
+type dotPrinter struct {
+	buf    bytes.Buffer
+	indent string
+	depth  int
+}
+
+// dotGraph is the part of DataFlowDiagram and TrustBoundary the printer
+// needs.
+type dotGraph interface {
+	graph.Graph
+	dot.Graph
+	dot.Attributers
+	dot.Structurer
+}
+
+var dotAttributeTypes = []string{"graph", "node", "edge"}
+
+func (p *dotPrinter) print(g dotGraph, isSubgraph bool) {
+	if isSubgraph {
+		p.writeIndent()
+		p.buf.WriteString("subgraph")
+	} else {
+		// A strict graph merges repeated edges, so a diagram with several
+		// flows from one element to another is written as a plain digraph.
+		if dfd, ok := g.(*DataFlowDiagram); ok && hasParallelFlows(dfd) {
+			p.buf.WriteString("digraph")
+		} else {
+			p.buf.WriteString("strict digraph")
+		}
+	}
+	if id := g.DOTID(); id != "" {
+		p.buf.WriteByte(' ')
+		if isSubgraph {
+			id = quoteDOTID(id)
+		}
+		p.buf.WriteString(id)
+	}
+	p.openBlock(" {")
+
+	p.writeAttributeComplex(g)
+	for _, sg := range g.Structure() {
+		p.buf.WriteByte('\n')
+		p.print(sg.(dotGraph), true)
+	}
+
+	nodes := graph.NodesOf(g.Nodes())
+	sort.Slice(nodes, func(i, j int) bool {
+		return lessNode(nodes[i], nodes[j])
+	})
+	for i, n := range nodes {
+		if i == 0 {
+			p.newline()
+			p.buf.WriteString("// Node definitions.")
+		}
+		p.newline()
+		p.buf.WriteString(dotNodeID(n))
+		if a, ok := n.(encoding.Attributer); ok {
+			p.writeAttributeList(a)
+		}
+		p.buf.WriteByte(';')
+	}
+
+	var edges []graph.Edge
+	for _, n := range nodes {
+		for _, t := range graph.NodesOf(g.From(n.ID())) {
+			mg, ok := g.(graph.Multigraph)
+			if !ok {
+				edges = append(edges, g.Edge(n.ID(), t.ID()))
+				continue
+			}
+			for _, l := range graph.LinesOf(mg.Lines(n.ID(), t.ID())) {
+				edges = append(edges, l)
+			}
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		return lessFlow(edges[i], edges[j])
+	})
+	for i, e := range edges {
+		if i == 0 {
+			p.buf.WriteByte('\n')
+			p.newline()
+			p.buf.WriteString("// Edge definitions.")
+		}
+		p.newline()
+		p.buf.WriteString(dotNodeID(e.From()))
+		porter, isPorter := e.(dot.Porter)
+		if isPorter {
+			p.writePort(porter.FromPort())
+		}
+		p.buf.WriteString(" -> ")
+		p.buf.WriteString(dotNodeID(e.To()))
+		if isPorter {
+			p.writePort(porter.ToPort())
+		}
+		if a, ok := e.(encoding.Attributer); ok {
+			p.writeAttributeList(a)
+		}
+		p.buf.WriteByte(';')
+	}
+
+	p.closeBlock("}")
+}
+
+func (p *dotPrinter) writeAttributeComplex(g dot.Attributers) {
+	ga, na, ea := g.DOTAttributers()
+	written := false
+	for i, a := range []encoding.Attributer{ga, na, ea} {
+		attrs := a.Attributes()
+		if len(attrs) == 0 {
+			continue
+		}
+		if written {
+			p.buf.WriteByte(';')
+		}
+		p.newline()
+		p.buf.WriteString(dotAttributeTypes[i])
+		p.openBlock(" [")
+		for _, attr := range attrs {
+			p.newline()
+			p.writeAttribute(attr)
+		}
+		p.closeBlock("]")
+		written = true
+	}
+	if written {
+		p.buf.WriteString(";\n")
+	}
+}
+
+func (p *dotPrinter) writeAttributeList(a encoding.Attributer) {
+	attrs := a.Attributes()
+	switch len(attrs) {
+	case 0:
+	case 1:
+		p.buf.WriteString(" [")
+		p.writeAttribute(attrs[0])
+		p.buf.WriteString("]")
+	default:
+		p.openBlock(" [")
+		for _, attr := range attrs {
+			p.newline()
+			p.writeAttribute(attr)
+		}
+		p.closeBlock("]")
+	}
+}
+
+func (p *dotPrinter) writeAttribute(attr encoding.Attribute) {
+	p.buf.WriteString(attr.Key)
+	p.buf.WriteByte('=')
+	p.buf.WriteString(attr.Value)
+}
+
+func (p *dotPrinter) writePort(port, compass string) {
+	if port != "" {
+		p.buf.WriteByte(':')
+		p.buf.WriteString(port)
+	}
+	if compass != "" {
+		p.buf.WriteByte(':')
+		p.buf.WriteString(compass)
+	}
+}
+
+func (p *dotPrinter) writeIndent() {
+	for i := 0; i < p.depth; i++ {
+		p.buf.WriteString(p.indent)
+	}
+}
+
+func (p *dotPrinter) newline() {
+	p.buf.WriteByte('\n')
+	p.writeIndent()
+}
+
+func (p *dotPrinter) openBlock(b string) {
+	p.buf.WriteString(b)
+	p.depth++
+}
+
+func (p *dotPrinter) closeBlock(b string) {
+	p.depth--
+	p.newline()
+	p.buf.WriteString(b)
+}
+
+// dotNodeID returns the DOT ID of a node, quoted if needed, or its numeric
+// ID.
+func dotNodeID(n graph.Node) string {
+	if n, ok := n.(dot.Node); ok {
+		return quoteDOTID(n.DOTID())
+	}
+	return strconv.FormatInt(n.ID(), 10)
+}
+
+// hasParallelFlows reports whether several flows of dfd go from one element
+// to the same other element.
+func hasParallelFlows(dfd *DataFlowDiagram) bool {
+	seen := map[[2]int64]bool{}
+	for _, f := range dfd.Flows {
+		ends := [2]int64{f.From().ID(), f.To().ID()}
+		if seen[ends] {
+			return true
+		}
+		seen[ends] = true
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package dfd
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecodeEncode(t *testing.T) {
+	dfd, err := Decode(strings.NewReader(testGraph))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding DOT: %v", err)
+	}
+	if dfd.Name != "WebApp Thing" {
+		t.Errorf("Expected a DFD name of %s, but got %s", "WebApp Thing", dfd.Name)
+	}
+	if len(dfd.TrustBoundaries) != 2 {
+		t.Errorf("Expected 2 trust boundaries, but got %d", len(dfd.TrustBoundaries))
+	}
+	if len(dfd.Flows) != 3 {
+		t.Errorf("Expected 3 flows, but got %d", len(dfd.Flows))
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, dfd); err != nil {
+		t.Fatalf("Unexpected error encoding DOT: %v", err)
+	}
+	again, err := Decode(&buf)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding encoded DOT: %v", err)
+	}
+	if describeDFD(dfd) != describeDFD(again) {
+		t.Error("Encoded DFD does not decode to the same DFD")
+	}
+}
+
+func TestDecodeParseError(t *testing.T) {
+	cases := []string{
+		"",
+		"digraph {",
+		"strict digraph 1 { process_1 [label=] }",
+		"strict digraph 1 { subgraph { process_1 } }",
+		"graph 1 { process_1 -- process_2 }",
+	}
+
+	for _, c := range cases {
+		t.Run(c, func(t *testing.T) {
+			_, err := Decode(strings.NewReader(c))
+			if _, ok := err.(*ParseError); !ok {
+				t.Errorf("Expected a *ParseError, got %T (%v)", err, err)
+			}
+		})
+	}
+}
+
+func TestDecodeAttributeError(t *testing.T) {
+	_, err := Decode(strings.NewReader(`strict digraph 1 { process_1 -> process_2 [dfd_id="a b"] }`))
+	if _, ok := err.(*AttributeError); !ok {
+		t.Fatalf("Expected an *AttributeError, got %T (%v)", err, err)
+	}
+	var malformed *MalformedIDError
+	if !errors.As(err, &malformed) || malformed.ID != "a b" {
+		t.Errorf("Expected the error to wrap a *MalformedIDError, got %v", err)
+	}
+}
+
+func TestDecodeReferenceError(t *testing.T) {
+	cases := []string{
+		"strict digraph 1 { process_1 -> process_1 }",
+		"strict digraph 1 { process_1 -> process_2 -> process_2 }",
+		"strict digraph 1 { process_1 datastore_1 }",
+		"strict digraph 1 { process_1 -> datastore_1 }",
+	}
+
+	for _, c := range cases {
+		t.Run(c, func(t *testing.T) {
+			_, err := Decode(strings.NewReader(c))
+			if _, ok := err.(*ReferenceError); !ok {
+				t.Errorf("Expected a *ReferenceError, got %T (%v)", err, err)
+			}
+		})
+	}
+}
+
+func TestDecodeEdgeChain(t *testing.T) {
+	dfd, err := Decode(strings.NewReader(`digraph 1 { process_1 -> process_2 -> datastore_3 [label="SQL"] }`))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding DOT: %v", err)
+	}
+	if len(dfd.Flows) != 2 {
+		t.Fatalf("Expected 2 flows, but got %d", len(dfd.Flows))
+	}
+	for _, f := range dfd.Flows {
+		if f.Name != "SQL" {
+			t.Errorf("Expected flow %s to be named SQL, but got %q", f.ExternalID(), f.Name)
+		}
+	}
+	if findings := CheckIntegrity(dfd); len(findings) != 0 {
+		t.Errorf("Expected no integrity findings, got %v", findings)
+	}
+}
+
+func TestUnmarshalDOT(t *testing.T) {
+	dfd := InitializeDFD("replaced")
+	if err := dfd.UnmarshalDOT([]byte(testGraph)); err != nil {
+		t.Fatalf("Unexpected error unmarshaling DOT: %v", err)
+	}
+	if dfd.ExternalID() != "1552575689497326632" {
+		t.Errorf("Expected a DFD id of %s, but got %s", "1552575689497326632", dfd.ExternalID())
+	}
+	if dfd.Name != "WebApp Thing" {
+		t.Errorf("Expected a DFD name of %s, but got %s", "WebApp Thing", dfd.Name)
+	}
+
+	if err := dfd.UnmarshalDOT([]byte("digraph {")); err == nil {
+		t.Error("Expected an error unmarshaling malformed DOT")
+	}
+	if dfd.Name != "WebApp Thing" {
+		t.Error("A failed UnmarshalDOT should leave the DFD untouched")
+	}
+}
+
+func TestToDOT(t *testing.T) {
+	dfd := InitializeDFD("My WebApp")
+	dfd.AddNodeElem(NewProcess("Web Server"))
+
+	dot, err := dfd.ToDOT()
+	if err != nil {
+		t.Fatalf("Unexpected error generating DOT: %v", err)
+	}
+	if !strings.Contains(dot, `label="My WebApp"`) || !strings.Contains(dot, `label="Web Server"`) {
+		t.Errorf("Expected DOT output to contain the DFD and node labels, got %s", dot)
+	}
+
+	marshaled, err := dfd.MarshalDOT()
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling DOT: %v", err)
+	}
+	if string(marshaled) != dot {
+		t.Error("Expected MarshalDOT and ToDOT to agree")
+	}
+}
+
+func TestNestedTrustBoundaries(t *testing.T) {
+	dfd := InitializeDFD("Nested")
+	vpc, _ := dfd.AddTrustBoundary("VPC")
+	subnet, err := dfd.AddNestedTrustBoundary(vpc.ExternalID(), "Subnet")
+	if err != nil {
+		t.Fatalf("Unexpected error adding a nested trust boundary: %v", err)
+	}
+	container, _ := dfd.AddNestedTrustBoundary(subnet.ExternalID(), "Container")
+	lb, p := NewProcess("Load Balancer"), NewProcess("App")
+	vpc.AddNodeElem(lb)
+	container.AddNodeElem(p)
+	dfd.AddFlow(lb, p, "HTTP")
+
+	if _, err := dfd.AddNestedTrustBoundary("42", "Orphan"); err == nil {
+		t.Error("Expected an error nesting a trust boundary in an unknown one")
+	}
+	if len(dfd.Structure()) != 1 {
+		t.Errorf("Expected 1 top level trust boundary, but got %d", len(dfd.Structure()))
+	}
+
+	out, err := dfd.MarshalDOT()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding DOT: %v", err)
+	}
+	for _, sub := range []*TrustBoundary{subnet, container} {
+		depth := 0
+		for tb := sub; tb != nil; tb = tb.Parent() {
+			depth++
+		}
+		want := strings.Repeat("\t", depth) + "subgraph " + sub.DOTID() + " {"
+		if !strings.Contains(string(out), want) {
+			t.Errorf("Expected %s to be nested at depth %d, got:\n%s", sub.Name, depth, out)
+		}
+	}
+
+	again, err := Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding DOT: %v", err)
+	}
+	if describeDFD(dfd) != describeDFD(again) {
+		t.Errorf("Expected nesting to survive a round trip, want:\n%s\ngot:\n%s", describeDFD(dfd), describeDFD(again))
+	}
+	if tb := again.BoundaryOf(p.ExternalID()); tb == nil || tb.Name != "Container" {
+		t.Errorf("Expected App to be in Container, but got %v", tb)
+	}
+
+	again.RemoveTrustBoundary(subnet.ExternalID())
+	if len(again.TrustBoundaries) != 1 || len(again.TrustBoundaries[vpc.ExternalID()].TrustBoundaries) != 0 {
+		t.Errorf("Expected removing Subnet to remove Container and unlink it from VPC, got %v", again.TrustBoundaries)
+	}
+}
@@ -0,0 +1,176 @@
+package dfd
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Error is implemented by every error type returned by this package.
+type Error interface {
+	error
+	dfdError()
+}
+
+// ParseError is returned when a document is not valid DOT, or not valid in
+// one of the other supported formats. Line and Column are 1-based and are zero
+// when the position is unknown.
+type ParseError struct {
+	// Format is the format of the document, "DOT" if empty.
+	Format       string
+	Line, Column int
+	Err          error
+}
+
+func (e *ParseError) Error() string {
+	format := e.Format
+	if format == "" {
+		format = "DOT"
+	}
+	msg := strings.TrimPrefix(e.Err.Error(), "dfd: ")
+	if e.Line == 0 {
+		return fmt.Sprintf("dfd: malformed %s: %s", format, msg)
+	}
+	if e.Column == 0 {
+		return fmt.Sprintf("dfd: malformed %s at line %d: %s", format, e.Line, msg)
+	}
+	return fmt.Sprintf("dfd: malformed %s at line %d, column %d: %s", format, e.Line, e.Column, msg)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// MalformedIDError is returned when a DOT node ID does not follow the
+// <type>_<id> format written by this package.
+type MalformedIDError struct {
+	ID string
+}
+
+func (e *MalformedIDError) Error() string {
+	return fmt.Sprintf("dfd: malformed node ID %q", e.ID)
+}
+
+// UnknownElementError is returned when a DOT document contains an element
+// that cannot be mapped onto a DataFlowDiagram, such as a node type other than
+// process, externalservice or datastore.
+type UnknownElementError struct {
+	// Kind is the kind of element, e.g. "node type" or "statement".
+	Kind string
+	// Type is the unrecognized type.
+	Type string
+}
+
+func (e *UnknownElementError) Error() string {
+	return fmt.Sprintf("dfd: unknown %s %s", e.Kind, e.Type)
+}
+
+// AttributeError is returned when a DOT attribute cannot be applied to an
+// element.
+type AttributeError struct {
+	// Element is the kind of element the attribute was set on.
+	Element    string
+	Key, Value string
+	Err        error
+}
+
+func (e *AttributeError) Error() string {
+	return fmt.Sprintf("dfd: unable to unmarshal %s DOT attribute (%s=%s): %v", e.Element, e.Key, e.Value, e.Err)
+}
+
+func (e *AttributeError) Unwrap() error {
+	return e.Err
+}
+
+// IOError is returned when reading or writing a DFD file fails.
+type IOError struct {
+	Op   string
+	Path string
+	Err  error
+}
+
+// Error leaves out Op and Path when Err is a *os.PathError, which already
+// names them.
+func (e *IOError) Error() string {
+	if _, ok := e.Err.(*os.PathError); ok {
+		return fmt.Sprintf("dfd: %v", e.Err)
+	}
+	if e.Path == "" {
+		return fmt.Sprintf("dfd: %s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("dfd: %s %s: %v", e.Op, e.Path, e.Err)
+}
+
+func (e *IOError) Unwrap() error {
+	return e.Err
+}
+
+// ReferenceError is returned when a serialized DFD declares the same element
+// twice or refers to an element that it does not declare.
+type ReferenceError struct {
+	ID string
+	// Reason describes the problem, e.g. "duplicate element ID".
+	Reason string
+}
+
+func (e *ReferenceError) Error() string {
+	return fmt.Sprintf("dfd: %s %q", e.Reason, e.ID)
+}
+
+// VersionError is returned when a serialized DFD uses a schema version that
+// this package does not understand.
+type VersionError struct {
+	Format  string
+	Version int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("dfd: unsupported %s schema version %d", e.Format, e.Version)
+}
+
+// HistoryError is returned when a History cannot undo, redo or start or end
+// a transaction.
+type HistoryError struct {
+	// Reason describes the problem, e.g. "nothing to undo".
+	Reason string
+}
+
+func (e *HistoryError) Error() string {
+	return "dfd: " + e.Reason
+}
+
+func (*ParseError) dfdError()          {}
+func (*MalformedIDError) dfdError()    {}
+func (*UnknownElementError) dfdError() {}
+func (*AttributeError) dfdError()      {}
+func (*IOError) dfdError()             {}
+func (*ReferenceError) dfdError()      {}
+func (*VersionError) dfdError()        {}
+func (*HistoryError) dfdError()        {}
+
+// newParseError wraps an error returned by the DOT parser. The parser's error
+// type lives in an internal gonum package, so its position is read through
+// reflection.
+func newParseError(err error) *ParseError {
+	pe := &ParseError{Err: err}
+	v := reflect.ValueOf(err)
+	if v.Kind() != reflect.Ptr || v.Elem().Kind() != reflect.Struct {
+		return pe
+	}
+	tok := v.Elem().FieldByName("ErrorToken")
+	if !tok.IsValid() || tok.Kind() != reflect.Ptr || tok.IsNil() {
+		return pe
+	}
+	pos := tok.Elem().FieldByName("Pos")
+	if !pos.IsValid() || pos.Kind() != reflect.Struct {
+		return pe
+	}
+	if line := pos.FieldByName("Line"); line.IsValid() && line.Kind() == reflect.Int {
+		pe.Line = int(line.Int())
+	}
+	if column := pos.FieldByName("Column"); column.IsValid() && column.Kind() == reflect.Int {
+		pe.Column = int(column.Int())
+	}
+	return pe
+}
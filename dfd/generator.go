@@ -1,6 +1,7 @@
 package dfd
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 	"unsafe"
@@ -11,8 +12,39 @@ import (
 	"gonum.org/v1/gonum/graph/formats/dot/ast"
 )
 
+// copyGraph copies the statements of the DOT AST graph src into dst. The
+// generator reports errors by panicking with one of the error types in
+// errors.go; those are recovered here and returned. Any other panic, such as
+// one raised by gonum on a graph it cannot build, is returned as a
+// *ParseError, so that bad input never crashes the caller.
+func copyGraph(dst *DataFlowDiagram, src *ast.Graph) (err error) {
+	defer func() {
+		switch e := recover().(type) {
+		case nil:
+		case Error:
+			err = e
+		case error:
+			err = &ParseError{Err: e}
+		default:
+			err = &ParseError{Err: fmt.Errorf("%v", e)}
+		}
+	}()
+	// Flows have a direction, which an undirected graph does not give.
+	if !src.Directed {
+		return &ParseError{Err: errors.New("undirected graph, a DFD is a digraph")}
+	}
+	gen := initGenerator(dst)
+	for _, stmt := range src.Stmts {
+		gen.addStmt(dst, stmt)
+	}
+	return nil
+}
+
 func initGenerator(dst encoding.Builder) *generator {
 	gen := &generator{directed: true, ids: make(map[string]graph.Node)}
+	if dfd, ok := dst.(*DataFlowDiagram); ok {
+		gen.root = dfd
+	}
 	if a, ok := dst.(dot.AttributeSetters); ok {
 		gen.graphAttr, gen.nodeAttr, gen.edgeAttr = a.DOTAttributeSetters()
 	}
@@ -24,8 +56,12 @@ func initGenerator(dst encoding.Builder) *generator {
 type generator struct {
 	// Directed graph.
 	directed bool
-	// Map from dot AST node ID to gonum node.
+	// Map from dot AST node ID to gonum node. It is shared with the
+	// generators of any trust boundaries so that a node declared in a
+	// subgraph and again at the top level is only created once.
 	ids map[string]graph.Node
+	// The diagram being generated.
+	root *DataFlowDiagram
 	// Nodes processed within the context of a subgraph, that is to be used as a
 	// vertex of an edge.
 	subNodes []graph.Node
@@ -40,30 +76,28 @@ type generator struct {
 // generating a new such node if none exist.
 func (gen *generator) node(dst encoding.Builder, id string) graph.Node {
 	var ntype string
-	var n graph.Node
-	node_id_obj := strings.Split(id, "_")
+	node_id_obj := strings.Split(unquoteDOT(id), "_")
 	if len(node_id_obj) != 2 {
-		panic(fmt.Errorf("Malformed Node ID: %s", id))
+		panic(&MalformedIDError{ID: id})
 	}
 
 	ntype = node_id_obj[0]
 	id = node_id_obj[1]
 
 	// bail if already visited
-	// FIXME subgraphs need to be accounted for
 	if n, ok := gen.ids[id]; ok {
+		// Elements of every type share one ID space, so process_1 and
+		// datastore_1 cannot both be in the diagram.
+		if n.(DfdNode).DOTID() != ntype+"_"+id {
+			panic(&ReferenceError{ID: id, Reason: "element ID is used by elements of two types"})
+		}
+		gen.adopt(dst, id, n)
 		return n
 	}
 
-	switch ntype {
-	case "process":
-		n = DeserializeProcess(id)
-	case "externalservice":
-		n = DeserializeExternalService(id)
-	case "datastore":
-		n = DeserializeDataStore(id)
-	default:
-		panic(fmt.Sprintf("unknown node type %s", ntype))
+	n, err := deserializeNode(ntype, id)
+	if err != nil {
+		panic(err)
 	}
 
 	if g, ok := dst.(DfdGraph); ok {
@@ -75,11 +109,37 @@ func (gen *generator) node(dst encoding.Builder, id string) graph.Node {
 	return n
 }
 
+// adopt moves a node that was first declared at the top level of the diagram,
+// or in an enclosing trust boundary, into the trust boundary that declares it.
+func (gen *generator) adopt(dst encoding.Builder, id string, n graph.Node) {
+	tb, ok := dst.(*TrustBoundary)
+	if !ok || gen.root == nil || tb.FindNode(id) != nil {
+		return
+	}
+	// The node keeps any flows already read, so it is moved rather than
+	// removed.
+	gen.root.unplaceElement(n.(DfdNode))
+	tb.AddNodeElem(n)
+}
+
+// subGenerator returns a generator for the trust boundary sub, sharing the
+// node IDs seen so far.
+func (gen *generator) subGenerator(sub *TrustBoundary) *generator {
+	next := initGenerator(sub)
+	next.ids = gen.ids
+	next.root = gen.root
+	return next
+}
+
 // addStmt adds the given statement to the graph.
 func (gen *generator) addStmt(dst encoding.Builder, stmt ast.Stmt) {
 	switch stmt := stmt.(type) {
 	case *ast.NodeStmt:
-		n, ok := gen.node(dst, stmt.Node.ID).(encoding.AttributeSetter)
+		node := gen.node(dst, stmt.Node.ID)
+		if gen.isInSubgraph() {
+			gen.appendSubgraphNode(node)
+		}
+		n, ok := node.(encoding.AttributeSetter)
 		if !ok {
 			return
 		}
@@ -89,7 +149,7 @@ func (gen *generator) addStmt(dst encoding.Builder, stmt ast.Stmt) {
 				Value: attr.Val,
 			}
 			if err := n.SetAttribute(a); err != nil {
-				panic(fmt.Errorf("unable to unmarshal node DOT attribute (%s=%s)", a.Key, a.Value))
+				panic(&AttributeError{Element: "node", Key: a.Key, Value: a.Value, Err: err})
 			}
 		}
 	case *ast.EdgeStmt:
@@ -125,21 +185,35 @@ func (gen *generator) addStmt(dst encoding.Builder, stmt ast.Stmt) {
 				Value: attr.Val,
 			}
 			if err := n.SetAttribute(a); err != nil {
-				panic(fmt.Errorf("unable to unmarshal global %s DOT attribute (%s=%s)", dst, a.Key, a.Value))
+				panic(&AttributeError{Element: "global " + dst, Key: a.Key, Value: a.Value, Err: err})
 			}
 		}
 	case *ast.Attr:
 		// ignore.
 	case *ast.Subgraph:
-		tb_id := strings.Replace(stmt.ID, "cluster_", "", -1)
+		// Trust boundaries are written as subgraph cluster_<id>, so a
+		// subgraph without an ID has nothing to identify it by.
+		if stmt.ID == "" {
+			panic(&ParseError{Err: errors.New("subgraph without an ID")})
+		}
+		tb_id := strings.Replace(unquoteDOT(stmt.ID), "cluster_", "", -1)
+		if !validID(tb_id) {
+			panic(&MalformedIDError{ID: stmt.ID})
+		}
 		sub := DeserializeTrustBoundary(tb_id)
-		dst.(*DataFlowDiagram).TrustBoundaries[tb_id] = sub
-		next_gen := initGenerator(sub)
+		gen.root.registerTrustBoundary(sub)
+		if parent, ok := dst.(*TrustBoundary); ok {
+			parent.addTrustBoundary(sub)
+		}
+		next_gen := gen.subGenerator(sub)
 		for _, stmt := range stmt.Stmts {
 			next_gen.addStmt(sub, stmt)
 		}
+		if label, ok := sub.graph.get("label"); ok {
+			sub.Name = unquoteDOT(label)
+		}
 	default:
-		panic(fmt.Sprintf("unknown statement type %T", stmt))
+		panic(&UnknownElementError{Kind: "statement type", Type: fmt.Sprintf("%T", stmt)})
 	}
 }
 
@@ -155,24 +229,66 @@ func (gen *generator) appendSubgraphNode(n graph.Node) {
 	gen.subNodes = append(gen.subNodes, n)
 }
 
-// addEdgeStmt adds the given edge statement to the graph.
+// addEdgeStmt adds the given edge statement to the graph. Every statement
+// adds flows of its own, with the ID given by the dfd_id attribute if any.
 func (gen *generator) addEdgeStmt(dst encoding.Builder, stmt *ast.EdgeStmt) {
+	var id string
+	var attrs []*ast.Attr
+	for _, attr := range stmt.Attrs {
+		if attr.Key == flowIDAttr {
+			id = unquoteDOT(attr.Val)
+			continue
+		}
+		attrs = append(attrs, attr)
+	}
 	fs := gen.addVertex(dst, stmt.From)
-	ts := gen.addEdge(dst, stmt.To, stmt.Attrs)
+	ts := gen.addEdge(dst, stmt.To, id, attrs)
+	gen.addFlows(fs, ts, stmt.From, stmt.To, id, attrs)
+}
+
+// addFlows adds a flow from each node of fs to each node of ts, which are the
+// nodes of the vertex from and of the edge to, with the attributes of their
+// statement.
+func (gen *generator) addFlows(fs, ts []graph.Node, from ast.Vertex, to *ast.Edge, id string, attrs []*ast.Attr) {
 	for _, f := range fs {
 		for _, t := range ts {
-			edge := dst.(*DataFlowDiagram).AddFlow(f, t, "")
-			applyPortsToEdge(stmt.From, stmt.To, edge)
-			addEdgeAttrs(edge, stmt.Attrs)
+			checkSelfLoop(f, t)
+			var edge *Flow
+			if id == "" {
+				edge = gen.root.AddFlow(f, t, "")
+			} else {
+				var err error
+				if edge, err = gen.root.AddFlowWithID(id, f, t, ""); err != nil {
+					panic(&AttributeError{Element: "edge", Key: flowIDAttr, Value: id, Err: err})
+				}
+			}
+			applyPortsToEdge(from, to, edge)
+			addEdgeAttrs(edge, attrs)
 		}
 	}
 }
 
+// checkSelfLoop panics with a *ReferenceError if an edge from f to t would
+// start and end at the same element, which a DFD cannot hold.
+func checkSelfLoop(f, t graph.Node) {
+	if f.ID() != t.ID() {
+		return
+	}
+	id := fmt.Sprint(f.ID())
+	if n, ok := f.(DfdNode); ok {
+		id = n.ExternalID()
+	}
+	panic(&ReferenceError{ID: id, Reason: "flow starts and ends at the same element"})
+}
+
 // addVertex adds the given vertex to the graph, and returns its set of nodes.
 func (gen *generator) addVertex(dst encoding.Builder, v ast.Vertex) []graph.Node {
 	switch v := v.(type) {
 	case *ast.Node:
 		n := gen.node(dst, v.ID)
+		if gen.isInSubgraph() {
+			gen.appendSubgraphNode(n)
+		}
 		return []graph.Node{n}
 	case *ast.Subgraph:
 		gen.pushSubgraph()
@@ -181,26 +297,20 @@ func (gen *generator) addVertex(dst encoding.Builder, v ast.Vertex) []graph.Node
 		}
 		return gen.popSubgraph()
 	default:
-		panic(fmt.Sprintf("unknown vertex type %T", v))
+		panic(&UnknownElementError{Kind: "vertex type", Type: fmt.Sprintf("%T", v)})
 	}
 }
 
-// addEdge adds the given edge to the graph, and returns its set of nodes.
-func (gen *generator) addEdge(dst encoding.Builder, to *ast.Edge, attrs []*ast.Attr) []graph.Node {
+// addEdge adds the given edge to the graph, and returns its set of nodes. Each
+// segment of a chain such as a -> b -> c adds flows of its own.
+func (gen *generator) addEdge(dst encoding.Builder, to *ast.Edge, id string, attrs []*ast.Attr) []graph.Node {
 	if !gen.directed && to.Directed {
-		panic(fmt.Errorf("directed edge to %v in undirected graph", to.Vertex))
+		panic(&ParseError{Err: fmt.Errorf("directed edge to %v in undirected graph", to.Vertex)})
 	}
 	fs := gen.addVertex(dst, to.Vertex)
 	if to.To != nil {
-		ts := gen.addEdge(dst, to.To, attrs)
-		for _, f := range fs {
-			for _, t := range ts {
-				edge := dst.NewEdge(f, t)
-				dst.SetEdge(edge)
-				applyPortsToEdge(to.Vertex, to.To, edge)
-				addEdgeAttrs(edge, attrs)
-			}
-		}
+		ts := gen.addEdge(dst, to.To, id, attrs)
+		gen.addFlows(fs, ts, to.Vertex, to.To, id, attrs)
 	}
 	return fs
 }
@@ -213,7 +323,7 @@ func applyPortsToEdge(from ast.Vertex, to *ast.Edge, edge graph.Edge) {
 			if n.Port != nil {
 				err := ps.SetFromPort(n.Port.ID, n.Port.CompassPoint.String())
 				if err != nil {
-					panic(fmt.Errorf("unable to unmarshal edge port (:%s:%s)", n.Port.ID, n.Port.CompassPoint.String()))
+					panic(&AttributeError{Element: "edge", Key: "port", Value: fmt.Sprintf(":%s:%s", n.Port.ID, n.Port.CompassPoint.String()), Err: err})
 				}
 			}
 		}
@@ -222,7 +332,7 @@ func applyPortsToEdge(from ast.Vertex, to *ast.Edge, edge graph.Edge) {
 			if n.Port != nil {
 				err := ps.SetToPort(n.Port.ID, n.Port.CompassPoint.String())
 				if err != nil {
-					panic(fmt.Errorf("unable to unmarshal edge DOT port (:%s:%s)", n.Port.ID, n.Port.CompassPoint.String()))
+					panic(&AttributeError{Element: "edge", Key: "port", Value: fmt.Sprintf(":%s:%s", n.Port.ID, n.Port.CompassPoint.String()), Err: err})
 				}
 			}
 		}
@@ -335,7 +445,7 @@ func addEdgeAttrs(edge graph.Edge, attrs []*ast.Attr) {
 			Value: attr.Val,
 		}
 		if err := e.SetAttribute(a); err != nil {
-			panic(fmt.Errorf("unable to unmarshal edge DOT attribute (%s=%s)", a.Key, a.Value))
+			panic(&AttributeError{Element: "edge", Key: a.Key, Value: a.Value, Err: err})
 		}
 	}
 }
@@ -0,0 +1,197 @@
+package dfd
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// goldenDFD returns a diagram whose elements, trust boundaries and flows are
+// named in a different order than their IDs, with names shared by elements of
+// different kinds and by flows.
+func goldenDFD() *DataFlowDiagram {
+	dfd := DeserializeDFD("100")
+	dfd.UpdateName("Shop")
+
+	aws := DeserializeTrustBoundary("20")
+	aws.UpdateName("AWS")
+	dfd.TrustBoundaries[aws.ExternalID()] = aws
+	vpc := DeserializeTrustBoundary("10")
+	vpc.UpdateName("VPC")
+	dfd.TrustBoundaries[vpc.ExternalID()] = vpc
+	aws.addTrustBoundary(vpc)
+	browser := DeserializeTrustBoundary("30")
+	browser.UpdateName("Browser")
+	dfd.TrustBoundaries[browser.ExternalID()] = browser
+
+	api := DeserializeProcess("9")
+	api.UpdateName("API")
+	api.Properties.Runtime = "go1.12"
+	vpc.AddNodeElem(api)
+	worker := DeserializeProcess("1")
+	worker.UpdateName("Worker")
+	vpc.AddNodeElem(worker)
+	orders := DeserializeDataStore("8")
+	orders.UpdateName("Orders")
+	orders.Tags = []string{"pci"}
+	vpc.AddNodeElem(orders)
+	cache := DeserializeDataStore("2")
+	cache.UpdateName("Cache")
+	aws.AddNodeElem(cache)
+	client := DeserializeProcess("7")
+	client.UpdateName("Client")
+	browser.AddNodeElem(client)
+	stripe := DeserializeExternalService("3")
+	stripe.UpdateName("Stripe")
+	dfd.AddNodeElem(stripe)
+	customer := DeserializeExternalService("6")
+	customer.UpdateName("Customer")
+	dfd.AddNodeElem(customer)
+	auditor := DeserializeExternalService("5")
+	auditor.UpdateName("API")
+	dfd.AddNodeElem(auditor)
+
+	dfd.AddFlow(customer, client, "Clicks")
+	dfd.AddFlow(client, api, "HTTPS")
+	dfd.AddRequestResponse(api, stripe, "HTTPS", "Receipt")
+	dfd.AddFlow(api, orders, "SQL")
+	dfd.AddFlow(worker, orders, "SQL")
+	dfd.AddFlow(api, cache, "")
+	dfd.AddFlow(auditor, api, "HTTPS").Dir = "both"
+	return dfd
+}
+
+func TestGoldenOutput(t *testing.T) {
+	writers := []struct {
+		file  string
+		write func(*DataFlowDiagram) ([]byte, error)
+	}{
+		{"shop.dot", func(d *DataFlowDiagram) ([]byte, error) { return d.MarshalDOT() }},
+		{"shop.json", func(d *DataFlowDiagram) ([]byte, error) {
+			data, err := d.MarshalJSON()
+			if err != nil {
+				return nil, err
+			}
+			var buf bytes.Buffer
+			err = json.Indent(&buf, data, "", "  ")
+			return buf.Bytes(), err
+		}},
+		{"shop.yaml", func(d *DataFlowDiagram) ([]byte, error) {
+			var buf bytes.Buffer
+			err := EncodeYAML(&buf, d)
+			return buf.Bytes(), err
+		}},
+		{"shop.puml", func(d *DataFlowDiagram) ([]byte, error) {
+			var buf bytes.Buffer
+			err := EncodePlantUML(&buf, d)
+			return buf.Bytes(), err
+		}},
+		{"shop.mmd", func(d *DataFlowDiagram) ([]byte, error) {
+			var buf bytes.Buffer
+			err := EncodeMermaid(&buf, d)
+			return buf.Bytes(), err
+		}},
+	}
+	for _, w := range writers {
+		path := filepath.Join("testdata", w.file)
+		got, err := w.write(goldenDFD())
+		if err != nil {
+			t.Fatalf("Unexpected error writing %s: %v", w.file, err)
+		}
+		if *update {
+			if err := ioutil.WriteFile(path, got, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatalf("Unexpected error reading %s, run go test -update to create it: %v", path, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s does not match, got:\n%s", w.file, got)
+		}
+		// Map iteration order differs between runs, so repeated writes catch
+		// any ordering that depends on it.
+		for i := 0; i < 20; i++ {
+			again, err := w.write(goldenDFD())
+			if err != nil {
+				t.Fatalf("Unexpected error writing %s: %v", w.file, err)
+			}
+			if !bytes.Equal(again, got) {
+				t.Errorf("%s differs between writes, got:\n%s", w.file, again)
+				break
+			}
+		}
+	}
+}
+
+func TestGoldenDOTRoundTrip(t *testing.T) {
+	want, err := ioutil.ReadFile(filepath.Join("testdata", "shop.dot"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dfd, err := Decode(bytes.NewReader(want))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding shop.dot: %v", err)
+	}
+	got, err := dfd.MarshalDOT()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding shop.dot: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("Decoding and encoding shop.dot changed it, got:\n%s", got)
+	}
+}
+
+// TestGoldenParallelFlows checks that several flows from one element to
+// another are written to a graph that does not merge them, and all read back.
+func TestGoldenParallelFlows(t *testing.T) {
+	dfd := DeserializeDFD("200")
+	dfd.UpdateName("Parallel")
+	api := DeserializeProcess("1")
+	api.UpdateName("API")
+	dfd.AddNodeElem(api)
+	db := DeserializeDataStore("2")
+	db.UpdateName("DB")
+	dfd.AddNodeElem(db)
+	dfd.AddFlow(api, db, "Reads")
+	dfd.AddFlow(api, db, "Writes")
+
+	got, err := dfd.MarshalDOT()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding DOT: %v", err)
+	}
+	path := filepath.Join("testdata", "parallel.dot")
+	if *update {
+		if err := ioutil.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Unexpected error reading %s, run go test -update to create it: %v", path, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("parallel.dot does not match, got:\n%s", got)
+	}
+	if bytes.HasPrefix(got, []byte("strict")) {
+		t.Errorf("Expected parallel flows not to be written to a strict graph, got:\n%s", got)
+	}
+
+	back, err := Decode(bytes.NewReader(want))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding parallel.dot: %v", err)
+	}
+	var names []string
+	for _, f := range back.FlowsBetween(back.FindNode("1"), back.FindNode("2")) {
+		names = append(names, f.Name)
+	}
+	if len(names) != 2 || names[0] != "Reads" || names[1] != "Writes" {
+		t.Errorf("Expected both flows to survive a round trip, got %v", names)
+	}
+}
@@ -0,0 +1,565 @@
+package dfd
+
+import (
+	"fmt"
+
+	"gonum.org/v1/gonum/graph"
+)
+
+// Op is an edit of a diagram that can be undone. Ops are applied through a
+// History, which records them.
+type Op interface {
+	// Do applies the edit, or applies it again after Undo. It leaves the
+	// diagram as it was if it returns an error.
+	Do(dfd *DataFlowDiagram) error
+	// Undo reverts the last Do.
+	Undo(dfd *DataFlowDiagram) error
+	// String describes the edit, e.g. add process "API".
+	String() string
+}
+
+// History applies Ops to a diagram and records them, so that they can be
+// undone and redone. Ops applied between Begin and Commit form a transaction,
+// which is undone and redone as a whole, and which Rollback reverts. The
+// diagram must only be edited through the History while it is in use, and a
+// History is not safe for concurrent use.
+type History struct {
+	dfd          *DataFlowDiagram
+	done, undone [][]Op
+	// tx holds the ops of the current transaction, and is nil outside one.
+	tx []Op
+}
+
+// NewHistory returns an empty History of the edits of dfd.
+func NewHistory(dfd *DataFlowDiagram) *History {
+	return &History{dfd: dfd}
+}
+
+// DFD returns the diagram the History edits.
+func (h *History) DFD() *DataFlowDiagram {
+	return h.dfd
+}
+
+// Apply applies op and records it, as part of the current transaction if
+// there is one. Applying an op discards the ops that were undone.
+func (h *History) Apply(op Op) error {
+	if err := op.Do(h.dfd); err != nil {
+		return err
+	}
+	if h.tx != nil {
+		h.tx = append(h.tx, op)
+		return nil
+	}
+	h.done = append(h.done, []Op{op})
+	h.undone = nil
+	return nil
+}
+
+// Undo reverts the last op or transaction that was applied or redone. Errors
+// are *HistoryError, or those of the op.
+func (h *History) Undo() error {
+	if h.tx != nil {
+		return &HistoryError{Reason: "cannot undo during a transaction"}
+	}
+	if len(h.done) == 0 {
+		return &HistoryError{Reason: "nothing to undo"}
+	}
+	ops := h.done[len(h.done)-1]
+	if err := undo(h.dfd, ops); err != nil {
+		return err
+	}
+	h.done = h.done[:len(h.done)-1]
+	h.undone = append(h.undone, ops)
+	return nil
+}
+
+// Redo applies the last op or transaction that was undone again. Errors are
+// *HistoryError, or those of the op.
+func (h *History) Redo() error {
+	if h.tx != nil {
+		return &HistoryError{Reason: "cannot redo during a transaction"}
+	}
+	if len(h.undone) == 0 {
+		return &HistoryError{Reason: "nothing to redo"}
+	}
+	ops := h.undone[len(h.undone)-1]
+	for i, op := range ops {
+		if err := op.Do(h.dfd); err != nil {
+			undo(h.dfd, ops[:i])
+			return err
+		}
+	}
+	h.undone = h.undone[:len(h.undone)-1]
+	h.done = append(h.done, ops)
+	return nil
+}
+
+// CanUndo reports whether there is an op or transaction to undo.
+func (h *History) CanUndo() bool {
+	return h.tx == nil && len(h.done) != 0
+}
+
+// CanRedo reports whether there is an op or transaction to redo.
+func (h *History) CanRedo() bool {
+	return h.tx == nil && len(h.undone) != 0
+}
+
+// Begin starts a transaction. Transactions cannot be nested. Errors are
+// *HistoryError.
+func (h *History) Begin() error {
+	if h.tx != nil {
+		return &HistoryError{Reason: "transaction already in progress"}
+	}
+	h.tx = []Op{}
+	return nil
+}
+
+// Commit ends the current transaction, recording its ops as one. Errors are
+// *HistoryError.
+func (h *History) Commit() error {
+	if h.tx == nil {
+		return &HistoryError{Reason: "no transaction in progress"}
+	}
+	if len(h.tx) != 0 {
+		h.done = append(h.done, h.tx)
+		h.undone = nil
+	}
+	h.tx = nil
+	return nil
+}
+
+// Rollback ends the current transaction, undoing its ops. Errors are
+// *HistoryError, or those of the ops.
+func (h *History) Rollback() error {
+	if h.tx == nil {
+		return &HistoryError{Reason: "no transaction in progress"}
+	}
+	ops := h.tx
+	h.tx = nil
+	return undo(h.dfd, ops)
+}
+
+// Transaction runs edit in a transaction, which is committed if edit returns
+// nil, and rolled back otherwise:
+//
+//	err := h.Transaction(func() error {
+//		if err := h.Apply(AddElementOp(api, "vpc")); err != nil {
+//			return err
+//		}
+//		return h.Apply(AddFlowOp("", "user", api.ExternalID(), "HTTPS"))
+//	})
+func (h *History) Transaction(edit func() error) error {
+	if err := h.Begin(); err != nil {
+		return err
+	}
+	if err := edit(); err != nil {
+		if rerr := h.Rollback(); rerr != nil {
+			return rerr
+		}
+		return err
+	}
+	return h.Commit()
+}
+
+// undo reverts ops, last first.
+func undo(dfd *DataFlowDiagram, ops []Op) error {
+	for i := len(ops) - 1; i >= 0; i-- {
+		if err := ops[i].Undo(dfd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewOp returns an Op described by description that calls do and undo.
+func NewOp(description string, do, undo func(*DataFlowDiagram) error) Op {
+	return &funcOp{description: description, do: do, undo: undo}
+}
+
+type funcOp struct {
+	description string
+	do, undo    func(*DataFlowDiagram) error
+}
+
+func (op *funcOp) Do(dfd *DataFlowDiagram) error   { return op.do(dfd) }
+func (op *funcOp) Undo(dfd *DataFlowDiagram) error { return op.undo(dfd) }
+func (op *funcOp) String() string                  { return op.description }
+
+// AddElementOp adds a Process, ExternalService or DataStore to the diagram,
+// or to the trust boundary with the given ID if it is not empty, as
+// DataFlowDiagram.AddElement does.
+func AddElementOp(n DfdNode, boundaryID string) Op {
+	return NewOp("add "+describeElement(n), func(dfd *DataFlowDiagram) error {
+		return dfd.AddElement(n, boundaryID)
+	}, func(dfd *DataFlowDiagram) error {
+		return dfd.RemoveElement(n.ExternalID(), Refuse)
+	})
+}
+
+// RemoveElementOp removes the element with the given ID, as
+// DataFlowDiagram.RemoveElement does.
+func RemoveElementOp(id string, policy RemovePolicy) Op {
+	var r *removal
+	return NewOp(fmt.Sprintf("remove element %q", id), func(dfd *DataFlowDiagram) error {
+		r = dfd.removal([]string{id}, nil)
+		return dfd.RemoveElement(id, policy)
+	}, func(dfd *DataFlowDiagram) error {
+		return dfd.restore(r)
+	})
+}
+
+// MoveElementOp moves the element with the given ID, as
+// DataFlowDiagram.MoveElement does.
+func MoveElementOp(id, targetBoundaryID string) Op {
+	var from string
+	return NewOp(fmt.Sprintf("move element %q", id), func(dfd *DataFlowDiagram) error {
+		from = ""
+		if tb := dfd.BoundaryOf(id); tb != nil {
+			from = tb.ExternalID()
+		}
+		return dfd.MoveElement(id, targetBoundaryID)
+	}, func(dfd *DataFlowDiagram) error {
+		return dfd.MoveElement(id, from)
+	})
+}
+
+// AddTrustBoundaryOp adds a trust boundary, as
+// DataFlowDiagram.AddTrustBoundaryWithID does. If id is empty,
+// DataFlowDiagram.NewID derives an ID from the name, and undoing and redoing
+// the op keep that ID.
+func AddTrustBoundaryOp(id, name, parentID string) Op {
+	var tb *TrustBoundary
+	return NewOp(fmt.Sprintf("add trust boundary %q", name), func(dfd *DataFlowDiagram) error {
+		if tb != nil {
+			return dfd.insertTrustBoundary(tb, parentID)
+		}
+		tbID := id
+		if tbID == "" {
+			tbID = dfd.NewID(name)
+		}
+		added, err := dfd.AddTrustBoundaryWithID(tbID, name, parentID)
+		if err != nil {
+			return err
+		}
+		tb = added
+		return nil
+	}, func(dfd *DataFlowDiagram) error {
+		return dfd.RemoveTrustBoundaryWithPolicy(tb.ExternalID(), Refuse)
+	})
+}
+
+// RemoveTrustBoundaryOp removes the trust boundary with the given ID, as
+// DataFlowDiagram.RemoveTrustBoundaryWithPolicy does.
+func RemoveTrustBoundaryOp(id string, policy RemovePolicy) Op {
+	var (
+		tb       *TrustBoundary
+		parentID string
+		// children and elements are the trust boundaries and elements that
+		// Reparent moves out of tb.
+		children []*TrustBoundary
+		elements []string
+		// r records what Cascade removes with tb.
+		r *removal
+	)
+	return NewOp(fmt.Sprintf("remove trust boundary %q", id), func(dfd *DataFlowDiagram) error {
+		if tb = dfd.TrustBoundaries[id]; tb == nil {
+			return dfd.RemoveTrustBoundaryWithPolicy(id, policy)
+		}
+		parentID, children, elements, r = "", nil, nil, nil
+		if tb.parent != nil {
+			parentID = tb.parent.ExternalID()
+		}
+		if policy == Reparent {
+			children = sortedBoundaries(tb.TrustBoundaries)
+			for _, n := range sortedElements(tb.Processes, tb.ExternalServices, tb.DataStores) {
+				elements = append(elements, n.ExternalID())
+			}
+		} else {
+			var ids []string
+			var collect func(*TrustBoundary)
+			collect = func(tb *TrustBoundary) {
+				for _, n := range sortedElements(tb.Processes, tb.ExternalServices, tb.DataStores) {
+					ids = append(ids, n.ExternalID())
+				}
+				for _, child := range sortedBoundaries(tb.TrustBoundaries) {
+					collect(child)
+				}
+			}
+			collect(tb)
+			r = dfd.removal(ids, nil)
+		}
+		return dfd.RemoveTrustBoundaryWithPolicy(id, policy)
+	}, func(dfd *DataFlowDiagram) error {
+		if err := dfd.insertTrustBoundary(tb, parentID); err != nil {
+			return err
+		}
+		if r != nil {
+			return dfd.restore(r)
+		}
+		dfd.mtx.Lock()
+		for _, child := range children {
+			if child.parent != nil {
+				delete(child.parent.TrustBoundaries, child.ExternalID())
+			}
+			tb.addTrustBoundary(child)
+		}
+		dfd.mtx.Unlock()
+		for _, id := range elements {
+			if err := dfd.MoveElement(id, tb.ExternalID()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AddFlowOp adds a flow between the elements with the IDs fromID and toID. An
+// empty id gets a derived ID, as with DataFlowDiagram.AddFlow; the flow can
+// then be found with DataFlowDiagram.FlowsBetween.
+func AddFlowOp(id, fromID, toID, name string) Op {
+	var flow *Flow
+	return NewOp(fmt.Sprintf("add flow %q from %q to %q", name, fromID, toID), func(dfd *DataFlowDiagram) error {
+		if flow != nil {
+			dfd.mtx.Lock()
+			defer dfd.mtx.Unlock()
+			return dfd.insertFlow(flow)
+		}
+		from, to := dfd.FindNode(fromID), dfd.FindNode(toID)
+		switch {
+		case from == nil:
+			return &ReferenceError{ID: fromID, Reason: "unknown element"}
+		case to == nil:
+			return &ReferenceError{ID: toID, Reason: "unknown element"}
+		case id == "":
+			flow = dfd.AddFlow(from, to, name)
+			return nil
+		}
+		added, err := dfd.AddFlowWithID(id, from, to, name)
+		if err != nil {
+			return err
+		}
+		flow = added
+		return nil
+	}, func(dfd *DataFlowDiagram) error {
+		dfd.RemoveFlowWithID(flow.id)
+		return nil
+	})
+}
+
+// RemoveFlowOp removes the flow with the given ID.
+func RemoveFlowOp(id string) Op {
+	var r *removal
+	return NewOp(fmt.Sprintf("remove flow %q", id), func(dfd *DataFlowDiagram) error {
+		if dfd.Flows[id] == nil {
+			return &ReferenceError{ID: id, Reason: "unknown flow"}
+		}
+		r = dfd.removal(nil, []string{id})
+		dfd.RemoveFlowWithID(id)
+		return nil
+	}, func(dfd *DataFlowDiagram) error {
+		return dfd.restore(r)
+	})
+}
+
+// SetResponseOp pairs a response with its request, as
+// DataFlowDiagram.SetResponse does.
+func SetResponseOp(responseID, requestID string) Op {
+	var old string
+	return NewOp(fmt.Sprintf("set the request of flow %q", responseID), func(dfd *DataFlowDiagram) error {
+		if f := dfd.Flows[responseID]; f != nil {
+			old = f.responseTo
+		}
+		return dfd.SetResponse(responseID, requestID)
+	}, func(dfd *DataFlowDiagram) error {
+		return dfd.SetResponse(responseID, old)
+	})
+}
+
+// RenameOp renames the diagram if id is empty, or else the element, trust
+// boundary or flow with the given ID, looked up in that order.
+func RenameOp(id, name string) Op {
+	var old string
+	rename := func(dfd *DataFlowDiagram, name string) (string, error) {
+		if id == "" {
+			old := dfd.Name
+			dfd.UpdateName(name)
+			return old, nil
+		}
+		switch n := dfd.FindNode(id).(type) {
+		case *Process:
+			old := n.Name
+			n.UpdateName(name)
+			return old, nil
+		case *ExternalService:
+			old := n.Name
+			n.UpdateName(name)
+			return old, nil
+		case *DataStore:
+			old := n.Name
+			n.UpdateName(name)
+			return old, nil
+		}
+		if tb, ok := dfd.TrustBoundaries[id]; ok {
+			old := tb.Name
+			tb.UpdateName(name)
+			return old, nil
+		}
+		if f, ok := dfd.Flows[id]; ok {
+			old := f.Name
+			f.Name = name
+			f.Label = formatFlowLabel(name, f.Properties)
+			return old, nil
+		}
+		return "", &ReferenceError{ID: id, Reason: "unknown element, trust boundary or flow"}
+	}
+	return NewOp(fmt.Sprintf("rename %q to %q", id, name), func(dfd *DataFlowDiagram) error {
+		var err error
+		old, err = rename(dfd, name)
+		return err
+	}, func(dfd *DataFlowDiagram) error {
+		_, err := rename(dfd, old)
+		return err
+	})
+}
+
+// SetFlowPropertiesOp sets the properties of the flow with the given ID.
+func SetFlowPropertiesOp(id string, p FlowProperties) Op {
+	var old FlowProperties
+	set := func(dfd *DataFlowDiagram, p FlowProperties) (FlowProperties, error) {
+		f, ok := dfd.Flows[id]
+		if !ok {
+			return FlowProperties{}, &ReferenceError{ID: id, Reason: "unknown flow"}
+		}
+		old := f.Properties
+		f.setProperties(p)
+		return old, nil
+	}
+	return NewOp(fmt.Sprintf("set the properties of flow %q", id), func(dfd *DataFlowDiagram) error {
+		var err error
+		old, err = set(dfd, p)
+		return err
+	}, func(dfd *DataFlowDiagram) error {
+		_, err := set(dfd, old)
+		return err
+	})
+}
+
+// removal records elements and flows that an op removes from a diagram, so
+// that its Undo can put the same ones back.
+type removal struct {
+	elements []placedElement
+	flows    []*Flow
+	// responseTo maps the removed flows, and the responses to them, onto the
+	// ID of the request they answer.
+	responseTo map[*Flow]string
+}
+
+// placedElement is an element and the ID of its trust boundary, empty at the
+// top level.
+type placedElement struct {
+	n          DfdNode
+	boundaryID string
+}
+
+// removal records the elements with the given IDs, the flows with the given
+// IDs and the flows of the elements, before they are removed.
+func (dfd *DataFlowDiagram) removal(elementIDs, flowIDs []string) *removal {
+	dfd.mtx.RLock()
+	defer dfd.mtx.RUnlock()
+	r := &removal{responseTo: map[*Flow]string{}}
+	gone := map[string]bool{}
+	remove := func(f *Flow) {
+		if !gone[f.id] {
+			gone[f.id] = true
+			r.flows = append(r.flows, f)
+		}
+	}
+	for _, id := range elementIDs {
+		n, ok := dfd.FindNode(id).(DfdNode)
+		if !ok {
+			continue
+		}
+		el := placedElement{n: n}
+		if tb := dfd.BoundaryOf(id); tb != nil {
+			el.boundaryID = tb.ExternalID()
+		}
+		r.elements = append(r.elements, el)
+		for _, f := range dfd.flowsOf(n.(graph.Node).ID()) {
+			remove(f)
+		}
+	}
+	for _, id := range flowIDs {
+		if f, ok := dfd.Flows[id]; ok {
+			remove(f)
+		}
+	}
+	for _, f := range dfd.Flows {
+		if f.responseTo != "" && (gone[f.id] || gone[f.responseTo]) {
+			r.responseTo[f] = f.responseTo
+		}
+	}
+	return r
+}
+
+// restore puts back what r recorded.
+func (dfd *DataFlowDiagram) restore(r *removal) error {
+	for _, el := range r.elements {
+		if err := dfd.AddElement(el.n, el.boundaryID); err != nil {
+			return err
+		}
+	}
+	dfd.mtx.Lock()
+	defer dfd.mtx.Unlock()
+	for _, f := range r.flows {
+		if err := dfd.insertFlow(f); err != nil {
+			return err
+		}
+	}
+	for f, request := range r.responseTo {
+		f.responseTo = request
+	}
+	return nil
+}
+
+// insertFlow puts back f, a flow removed from the diagram, adding its ends to
+// the graph if they are not in it.
+func (dfd *DataFlowDiagram) insertFlow(f *Flow) error {
+	if _, ok := dfd.Flows[f.id]; ok {
+		return &ReferenceError{ID: f.id, Reason: "flow ID already in use"}
+	}
+	dfd.Flows[f.id] = f
+	if !dfd.HasEdgeFromTo(f.From().ID(), f.To().ID()) {
+		dfd.SetEdge(f)
+	}
+	return nil
+}
+
+// insertTrustBoundary puts back tb, a trust boundary removed from the
+// diagram, with the trust boundaries still nested in it, into the one with the
+// ID parentID, or at the top level if it is empty.
+func (dfd *DataFlowDiagram) insertTrustBoundary(tb *TrustBoundary, parentID string) error {
+	dfd.mtx.Lock()
+	defer dfd.mtx.Unlock()
+	if _, ok := dfd.TrustBoundaries[tb.ExternalID()]; ok {
+		return &ReferenceError{ID: tb.ExternalID(), Reason: "trust boundary ID already in use"}
+	}
+	var parent *TrustBoundary
+	if parentID != "" {
+		var ok bool
+		if parent, ok = dfd.TrustBoundaries[parentID]; !ok {
+			return &ReferenceError{ID: parentID, Reason: "unknown trust boundary"}
+		}
+	}
+	var register func(*TrustBoundary)
+	register = func(tb *TrustBoundary) {
+		dfd.registerTrustBoundary(tb)
+		for _, child := range tb.TrustBoundaries {
+			register(child)
+		}
+	}
+	register(tb)
+	if parent != nil {
+		parent.addTrustBoundary(tb)
+	}
+	return nil
+}
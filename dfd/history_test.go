@@ -0,0 +1,234 @@
+package dfd
+
+import (
+	"testing"
+
+	"gonum.org/v1/gonum/graph"
+)
+
+func mustMarshalDOT(t *testing.T, dfd *DataFlowDiagram) string {
+	t.Helper()
+	out, err := dfd.MarshalDOT()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding DOT: %v", err)
+	}
+	return string(out)
+}
+
+func TestHistory(t *testing.T) {
+	h := NewHistory(InitializeDFD("Shop"))
+	api, _ := NewProcessWithID("api", "API")
+	db, _ := NewDataStoreWithID("db", "DB")
+	user, _ := NewExternalServiceWithID("user", "User")
+	ops := []Op{
+		AddTrustBoundaryOp("aws", "AWS", ""),
+		AddTrustBoundaryOp("vpc", "VPC", "aws"),
+		AddElementOp(api, "vpc"),
+		AddElementOp(db, "vpc"),
+		AddElementOp(user, ""),
+		AddFlowOp("", "user", "api", "Request"),
+		AddFlowOp("response", "api", "user", "Response"),
+		AddFlowOp("query", "api", "db", "Query"),
+		SetResponseOp("response", genFlowID(user, api)),
+		SetFlowPropertiesOp("query", FlowProperties{Protocol: "postgres", Encrypted: true}),
+		RenameOp("api", "Checkout API"),
+		RenameOp("", "Store"),
+		MoveElementOp("db", "aws"),
+		RemoveElementOp("user", Cascade),
+		RemoveTrustBoundaryOp("aws", Cascade),
+	}
+	states := []string{mustMarshalDOT(t, h.DFD())}
+	for _, op := range ops {
+		if err := h.Apply(op); err != nil {
+			t.Fatalf("Unexpected error applying %s: %v", op, err)
+		}
+		states = append(states, mustMarshalDOT(t, h.DFD()))
+	}
+	if len(h.DFD().Flows) != 0 || len(h.DFD().TrustBoundaries) != 0 || h.DFD().Name != "Store" {
+		t.Fatalf("Expected an empty diagram named Store, got:\n%s", states[len(states)-1])
+	}
+
+	for i := len(ops) - 1; i >= 0; i-- {
+		if err := h.Undo(); err != nil {
+			t.Fatalf("Unexpected error undoing %s: %v", ops[i], err)
+		}
+		if got := mustMarshalDOT(t, h.DFD()); got != states[i] {
+			t.Errorf("Expected undoing %s to restore:\n%s\ngot:\n%s", ops[i], states[i], got)
+		}
+		if findings := CheckIntegrity(h.DFD()); len(findings) != 0 {
+			t.Errorf("Expected no integrity problems after undoing %s, got %v", ops[i], findings)
+		}
+	}
+	if _, ok := h.Undo().(*HistoryError); !ok || h.CanUndo() {
+		t.Error("Expected nothing left to undo")
+	}
+	for i, op := range ops {
+		if err := h.Redo(); err != nil {
+			t.Fatalf("Unexpected error redoing %s: %v", op, err)
+		}
+		if got := mustMarshalDOT(t, h.DFD()); got != states[i+1] {
+			t.Errorf("Expected redoing %s to give:\n%s\ngot:\n%s", op, states[i+1], got)
+		}
+	}
+	if _, ok := h.Redo().(*HistoryError); !ok || h.CanRedo() {
+		t.Error("Expected nothing left to redo")
+	}
+
+	h.Undo()
+	h.Undo()
+	if h.DFD().FindNode("user") != graph.Node(user) || h.DFD().FindNode("api") != graph.Node(api) {
+		t.Error("Expected undoing removals to bring back the same elements")
+	}
+	if err := h.Apply(RenameOp("user", "Customer")); err != nil || h.CanRedo() {
+		t.Errorf("Expected applying an op to discard the undone ones, got %v", err)
+	}
+}
+
+func TestHistoryTransaction(t *testing.T) {
+	dfd, api, _, _ := integrityDFD()
+	h := NewHistory(dfd)
+	before := mustMarshalDOT(t, dfd)
+
+	err := h.Transaction(func() error {
+		if err := h.Apply(RenameOp("api", "Checkout")); err != nil {
+			return err
+		}
+		if err := h.Apply(RemoveElementOp("db", Cascade)); err != nil {
+			return err
+		}
+		return h.Apply(AddFlowOp("", "api", "nowhere", "Lost"))
+	})
+	if _, ok := err.(*ReferenceError); !ok {
+		t.Fatalf("Expected the *ReferenceError of the failed op, got %v", err)
+	}
+	if got := mustMarshalDOT(t, dfd); got != before || api.Name != "API" {
+		t.Errorf("Expected the transaction to be rolled back, got:\n%s", got)
+	}
+	if h.CanUndo() {
+		t.Error("Expected a rolled back transaction not to be recorded")
+	}
+
+	if err := h.Transaction(func() error {
+		if err := h.Apply(MoveElementOp("api", "")); err != nil {
+			return err
+		}
+		return h.Apply(RemoveTrustBoundaryOp("vpc", Reparent))
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	after := mustMarshalDOT(t, dfd)
+	if err := h.Undo(); err != nil || mustMarshalDOT(t, dfd) != before {
+		t.Errorf("Expected a transaction to be undone as a whole, got %v", err)
+	}
+	if err := h.Redo(); err != nil || mustMarshalDOT(t, dfd) != after {
+		t.Errorf("Expected a transaction to be redone as a whole, got %v", err)
+	}
+
+	h.Begin()
+	for name, err := range map[string]error{"Begin": h.Begin(), "Undo": h.Undo(), "Redo": h.Redo()} {
+		if _, ok := err.(*HistoryError); !ok {
+			t.Errorf("Expected %s during a transaction to return a *HistoryError, got %v", name, err)
+		}
+	}
+	if err := h.Commit(); err != nil || !h.CanUndo() {
+		t.Errorf("Expected committing an empty transaction to keep the history, got %v", err)
+	}
+	if _, ok := h.Rollback().(*HistoryError); !ok {
+		t.Error("Expected Rollback outside a transaction to return a *HistoryError")
+	}
+}
+
+// TestHistoryInterleaved undoes and redoes ops between new ones, checking
+// that every undo and redo gives back the diagram as it was, with the same
+// elements and flows.
+func TestHistoryInterleaved(t *testing.T) {
+	dfd, api, req, resp := integrityDFD()
+	h := NewHistory(dfd)
+	// states mirrors the history: states[i] is the diagram before done op i.
+	var states, undone []string
+	check := func(want, what string) {
+		t.Helper()
+		if got := mustMarshalDOT(t, dfd); got != want {
+			t.Errorf("Expected %s to give:\n%s\ngot:\n%s", what, want, got)
+		}
+		if findings := CheckIntegrity(dfd); len(findings) != 0 {
+			t.Errorf("Expected no integrity problems after %s, got %v", what, findings)
+		}
+	}
+	apply := func(op Op) {
+		t.Helper()
+		before := mustMarshalDOT(t, dfd)
+		if err := h.Apply(op); err != nil {
+			t.Fatalf("Unexpected error applying %s: %v", op, err)
+		}
+		states, undone = append(states, before), nil
+	}
+	undoOne := func() {
+		t.Helper()
+		after := mustMarshalDOT(t, dfd)
+		if err := h.Undo(); err != nil {
+			t.Fatalf("Unexpected error undoing: %v", err)
+		}
+		check(states[len(states)-1], "undoing")
+		states, undone = states[:len(states)-1], append(undone, after)
+	}
+	redoOne := func() {
+		t.Helper()
+		before := mustMarshalDOT(t, dfd)
+		if err := h.Redo(); err != nil {
+			t.Fatalf("Unexpected error redoing: %v", err)
+		}
+		check(undone[len(undone)-1], "redoing")
+		states, undone = append(states, before), undone[:len(undone)-1]
+	}
+
+	apply(RenameOp("api", "Checkout"))
+	apply(RemoveFlowOp(resp.ExternalID()))
+	undoOne()
+	if dfd.Flows[resp.ExternalID()] != resp || dfd.ResponseOf(req) != resp {
+		t.Error("Expected undoing the removal of a response to bring it back paired with its request")
+	}
+	apply(MoveElementOp("db", ""))
+	apply(RemoveTrustBoundaryOp("vpc", Reparent))
+	apply(AddFlowOp("sync", "db", "user", "Sync"))
+	undoOne()
+	undoOne()
+	redoOne()
+	apply(RemoveElementOp("api", Cascade))
+	undoOne()
+	if dfd.FindNode("api") != graph.Node(api) || dfd.Flows[req.ExternalID()] != req || dfd.ResponseOf(req) != resp {
+		t.Error("Expected undoing a cascade removal to bring back the same element and flows")
+	}
+	if tb := dfd.BoundaryOf("api"); tb == nil || tb.ExternalID() != "aws" {
+		t.Errorf("Expected API to be back in AWS, got %v", tb)
+	}
+	redoOne()
+	apply(RemoveTrustBoundaryOp("aws", Cascade))
+	apply(RenameOp("", "Empty"))
+	for len(states) != 0 {
+		undoOne()
+	}
+	if api.Name != "API" || dfd.Name != "Integrity" {
+		t.Errorf("Expected every rename to be undone, got %s and %s", api.Name, dfd.Name)
+	}
+	for len(undone) != 0 {
+		redoOne()
+	}
+}
+
+func TestAddTrustBoundaryOpNewID(t *testing.T) {
+	h := NewHistory(InitializeDFD("Shop"))
+	if err := h.Apply(AddTrustBoundaryOp("", "Payments VPC", "")); err != nil {
+		t.Fatalf("Unexpected error adding a trust boundary: %v", err)
+	}
+	tb := h.DFD().TrustBoundaries["payments-vpc"]
+	if tb == nil || len(h.DFD().TrustBoundaries) != 1 {
+		t.Fatalf("Expected a trust boundary with an ID derived from its name, got %v", h.DFD().TrustBoundaries)
+	}
+	if err := h.Undo(); err != nil || len(h.DFD().TrustBoundaries) != 0 {
+		t.Fatalf("Expected undoing to remove the trust boundary, got %v (%v)", h.DFD().TrustBoundaries, err)
+	}
+	if err := h.Redo(); err != nil || h.DFD().TrustBoundaries["payments-vpc"] != tb {
+		t.Errorf("Expected redoing to bring back the same trust boundary, got %v (%v)", h.DFD().TrustBoundaries, err)
+	}
+}
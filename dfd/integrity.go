@@ -0,0 +1,357 @@
+package dfd
+
+import (
+	"fmt"
+	"sort"
+
+	"gonum.org/v1/gonum/graph"
+)
+
+// RemovePolicy says what happens to what references an element or a trust
+// boundary when it is removed.
+type RemovePolicy int
+
+const (
+	// Cascade removes the flows of a removed element, and the elements and
+	// trust boundaries nested in a removed trust boundary along with their
+	// flows.
+	Cascade RemovePolicy = iota
+	// Reparent moves the elements and trust boundaries nested in a removed
+	// trust boundary to its parent, or to the top level. The flows of a
+	// removed element have nowhere to go and are removed, as with Cascade.
+	Reparent
+	// Refuse fails to remove an element that has flows, or a trust boundary
+	// that holds elements, at any depth. Empty trust boundaries nested in a
+	// removed one are removed.
+	Refuse
+)
+
+func (p RemovePolicy) String() string {
+	switch p {
+	case Cascade:
+		return "cascade"
+	case Reparent:
+		return "reparent"
+	case Refuse:
+		return "refuse"
+	}
+	return fmt.Sprintf("RemovePolicy(%d)", int(p))
+}
+
+// RemoveElement removes the element with the given ID, wherever it is in the
+// diagram, and deals with its flows according to policy. Errors are
+// *ReferenceError.
+func (dfd *DataFlowDiagram) RemoveElement(id string, policy RemovePolicy) error {
+	dfd.mtx.Lock()
+	defer dfd.mtx.Unlock()
+	n, ok := dfd.FindNode(id).(DfdNode)
+	if !ok {
+		return &ReferenceError{ID: id, Reason: "unknown element"}
+	}
+	xid := n.(graph.Node).ID()
+	if flows := dfd.flowsOf(xid); policy == Refuse && len(flows) != 0 {
+		return &ReferenceError{ID: id, Reason: fmt.Sprintf("element has %d flows", len(flows))}
+	}
+	dfd.removeFlowsOf(xid)
+	dfd.unplaceElement(n)
+	dfd.RemoveNode(xid)
+	return nil
+}
+
+// RemoveTrustBoundaryWithPolicy removes the trust boundary with the given ID
+// and deals with the elements and trust boundaries nested in it according to
+// policy. Errors are *ReferenceError.
+func (dfd *DataFlowDiagram) RemoveTrustBoundaryWithPolicy(id string, policy RemovePolicy) error {
+	dfd.mtx.Lock()
+	defer dfd.mtx.Unlock()
+	tb, ok := dfd.TrustBoundaries[id]
+	if !ok {
+		return &ReferenceError{ID: id, Reason: "unknown trust boundary"}
+	}
+	return dfd.removeTrustBoundary(tb, policy)
+}
+
+func (dfd *DataFlowDiagram) removeTrustBoundary(tb *TrustBoundary, policy RemovePolicy) error {
+	id := tb.ExternalID()
+	switch policy {
+	case Refuse:
+		if !tb.isEmpty() {
+			return &ReferenceError{ID: id, Reason: "trust boundary is not empty"}
+		}
+	case Reparent:
+		for _, n := range sortedElements(tb.Processes, tb.ExternalServices, tb.DataStores) {
+			dfd.placeElement(n, tb.parent)
+		}
+		for _, child := range sortedBoundaries(tb.TrustBoundaries) {
+			delete(tb.TrustBoundaries, child.ExternalID())
+			child.parent = nil
+			if tb.parent != nil {
+				tb.parent.addTrustBoundary(child)
+			}
+		}
+	}
+
+	if tb.parent != nil {
+		delete(tb.parent.TrustBoundaries, id)
+		tb.parent = nil
+	}
+	var remove func(*TrustBoundary)
+	remove = func(tb *TrustBoundary) {
+		for _, n := range sortedElements(tb.Processes, tb.ExternalServices, tb.DataStores) {
+			xid := n.(graph.Node).ID()
+			dfd.removeFlowsOf(xid)
+			dfd.unplaceElement(n)
+			dfd.RemoveNode(xid)
+		}
+		delete(dfd.TrustBoundaries, tb.ExternalID())
+		tb.dfd = nil
+		for _, child := range tb.TrustBoundaries {
+			remove(child)
+		}
+	}
+	remove(tb)
+	return nil
+}
+
+// isEmpty reports whether the trust boundary and the ones nested in it hold
+// no elements.
+func (tb *TrustBoundary) isEmpty() bool {
+	if len(tb.Processes)+len(tb.ExternalServices)+len(tb.DataStores) != 0 {
+		return false
+	}
+	for _, child := range tb.TrustBoundaries {
+		if !child.isEmpty() {
+			return false
+		}
+	}
+	return true
+}
+
+// flowsOf returns the flows from or to the node with the given ID.
+func (dfd *DataFlowDiagram) flowsOf(xid int64) []*Flow {
+	var flows []*Flow
+	for _, f := range sortedFlows(dfd) {
+		if f.From().ID() == xid || f.To().ID() == xid {
+			flows = append(flows, f)
+		}
+	}
+	return flows
+}
+
+// removeFlowsOf removes the flows from or to the node with the given ID.
+func (dfd *DataFlowDiagram) removeFlowsOf(xid int64) {
+	for _, f := range dfd.flowsOf(xid) {
+		dfd.removeFlow(f.id)
+	}
+}
+
+// placeElement moves n, an element of the diagram, into tb, or to the top
+// level if tb is nil. Its flows are left as they are.
+func (dfd *DataFlowDiagram) placeElement(n DfdNode, tb *TrustBoundary) {
+	dfd.unplaceElement(n)
+	if tb != nil {
+		tb.AddNodeElem(n.(graph.Node))
+		return
+	}
+	switch el := n.(type) {
+	case *Process:
+		dfd.addProcess(el)
+	case *ExternalService:
+		dfd.addExternalService(el)
+	case *DataStore:
+		dfd.addDataStore(el)
+	}
+	if dfd.Node(n.(graph.Node).ID()) == nil {
+		dfd.AddNode(n.(graph.Node))
+	}
+}
+
+// unplaceElement takes n out of the top level and of every trust boundary,
+// leaving it in the graph of the diagram with its flows.
+func (dfd *DataFlowDiagram) unplaceElement(n DfdNode) {
+	id, xid := n.ExternalID(), n.(graph.Node).ID()
+	delete(dfd.Processes, id)
+	delete(dfd.ExternalServices, id)
+	delete(dfd.DataStores, id)
+	for _, tb := range dfd.TrustBoundaries {
+		delete(tb.Processes, id)
+		delete(tb.ExternalServices, id)
+		delete(tb.DataStores, id)
+		tb.RemoveNode(xid)
+	}
+}
+
+// CheckIntegrity reports the inconsistencies that editing the maps of a
+// diagram directly, or removing elements and trust boundaries with earlier
+// versions of this package, may leave behind: flows whose ends are not
+// elements of the diagram, flows missing from the graph, nodes and edges of
+// the graph without an element or a flow, responses to missing requests,
+// elements in several places, and trust boundaries nested in ones that are not
+// in the diagram. RepairIntegrity fixes them.
+func CheckIntegrity(dfd *DataFlowDiagram) []Finding {
+	dfd.mtx.Lock()
+	defer dfd.mtx.Unlock()
+	return dfd.integrity(false)
+}
+
+// RepairIntegrity fixes the inconsistencies reported by CheckIntegrity and
+// returns them. Dangling flows are removed, the graph is made to match the
+// elements and flows, responses to missing requests are unpaired, an element
+// in several places is kept in the first one, the top level first, trust
+// boundaries nested in ones that are not in the diagram are moved to the top
+// level, and those that are not in the diagram are dropped from the ones
+// holding them.
+func RepairIntegrity(dfd *DataFlowDiagram) []Finding {
+	dfd.mtx.Lock()
+	defer dfd.mtx.Unlock()
+	return dfd.integrity(true)
+}
+
+// Dangling flows are left to checkDanglingFlows.
+func checkIntegrity(dfd *DataFlowDiagram) []Finding {
+	var findings []Finding
+	for _, f := range CheckIntegrity(dfd) {
+		if f.Rule == RuleIntegrity {
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+// integrity checks the diagram, and repairs it if repair is true.
+func (dfd *DataFlowDiagram) integrity(repair bool) []Finding {
+	var findings []Finding
+	report := func(rule, target, format string, args ...interface{}) {
+		findings = append(findings, Finding{
+			Rule:     rule,
+			Severity: SeverityError,
+			Target:   target,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	for _, tb := range sortedTrustBoundaries(dfd) {
+		if tb.parent != nil && dfd.TrustBoundaries[tb.parent.ExternalID()] != tb.parent {
+			report(RuleIntegrity, tb.DOTID(), "trust boundary %q is nested in trust boundary %q, which is not in the diagram", tb.Name, tb.parent.Name)
+			if repair {
+				delete(tb.parent.TrustBoundaries, tb.ExternalID())
+				tb.parent = nil
+			}
+		}
+		for _, child := range sortedBoundaries(tb.TrustBoundaries) {
+			if dfd.TrustBoundaries[child.ExternalID()] != child {
+				report(RuleIntegrity, child.DOTID(), "trust boundary %q holds trust boundary %q, which is not in the diagram", tb.Name, child.Name)
+				if repair {
+					delete(tb.TrustBoundaries, child.ExternalID())
+				}
+			}
+		}
+	}
+
+	places := map[string]*TrustBoundary{}
+	for _, n := range sortedElements(dfd.Processes, dfd.ExternalServices, dfd.DataStores) {
+		places[n.ExternalID()] = nil
+	}
+	for _, tb := range sortedTrustBoundaries(dfd) {
+		for _, n := range sortedElements(tb.Processes, tb.ExternalServices, tb.DataStores) {
+			id := n.ExternalID()
+			first, ok := places[id]
+			if !ok {
+				places[id] = tb
+				continue
+			}
+			report(RuleIntegrity, n.DOTID(), "%s is %s and also in %s", describeElement(n), placeName(first), boundaryName(tb))
+			if repair {
+				delete(tb.Processes, id)
+				delete(tb.ExternalServices, id)
+				delete(tb.DataStores, id)
+				tb.RemoveNode(n.(graph.Node).ID())
+			}
+		}
+	}
+
+	for _, f := range sortedFlows(dfd) {
+		dangling := false
+		for _, n := range []DfdNode{f.From().(DfdNode), f.To().(DfdNode)} {
+			if dfd.FindNode(n.ExternalID()) == nil {
+				dangling = true
+				report(RuleDanglingFlow, "flow_"+f.id, "flow %q references %s, which is not an element of the diagram", f.Name, n.DOTID())
+			}
+		}
+		if dangling {
+			if repair {
+				dfd.removeFlow(f.id)
+				// Drop the ends that are left with neither an element nor a flow.
+				for _, n := range []graph.Node{f.From(), f.To()} {
+					if dfd.FindNode(n.(DfdNode).ExternalID()) == nil && len(dfd.flowsOf(n.ID())) == 0 {
+						dfd.RemoveNode(n.ID())
+					}
+				}
+			}
+			continue
+		}
+		if fid, tid := f.From().ID(), f.To().ID(); !dfd.HasEdgeFromTo(fid, tid) {
+			report(RuleIntegrity, "flow_"+f.id, "flow %q is missing from the graph", f.Name)
+			if repair {
+				dfd.SetEdge(f)
+			}
+		}
+		if req := f.responseTo; req != "" && dfd.Flows[req] == nil {
+			report(RuleIntegrity, "flow_"+f.id, "flow %q is the response to flow %s, which is not in the diagram", f.Name, req)
+			if repair {
+				f.responseTo = ""
+			}
+		}
+	}
+
+	// Flows to nodes that are not elements are reported as dangling above.
+	var strays []DfdNode
+	for _, node := range dfd.nodes {
+		if n := node.(DfdNode); dfd.FindNode(n.ExternalID()) == nil && len(dfd.flowsOf(node.ID())) == 0 {
+			strays = append(strays, n)
+		}
+	}
+	sort.Slice(strays, func(i, j int) bool {
+		return lessElement(strays[i], strays[j])
+	})
+	for _, n := range strays {
+		report(RuleIntegrity, n.DOTID(), "the graph has %s, which is not an element of the diagram", describeElement(n))
+		if repair {
+			dfd.RemoveNode(n.(graph.Node).ID())
+		}
+	}
+
+	var edges []graph.Edge
+	for it := dfd.Edges(); it.Next(); {
+		edges = append(edges, it.Edge())
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		return genFlowID(edges[i].From(), edges[i].To()) < genFlowID(edges[j].From(), edges[j].To())
+	})
+	for _, e := range edges {
+		if f, ok := e.(*Flow); ok && dfd.Flows[f.id] == f {
+			continue
+		}
+		fid, tid := e.From().ID(), e.To().ID()
+		report(RuleIntegrity, "flow_"+genFlowID(e.From(), e.To()), "the graph has an edge from %s to %s that is not a flow of the diagram", e.From().(DfdNode).DOTID(), e.To().(DfdNode).DOTID())
+		if repair {
+			dfd.RemoveEdge(fid, tid)
+			for _, f := range sortedFlows(dfd) {
+				if f.From().ID() == fid && f.To().ID() == tid {
+					dfd.SetEdge(f)
+					break
+				}
+			}
+		}
+	}
+	return findings
+}
+
+// placeName describes where an element is, e.g. at the top level or in trust
+// boundary "VPC".
+func placeName(tb *TrustBoundary) string {
+	if tb == nil {
+		return "at the top level"
+	}
+	return "in " + boundaryName(tb)
+}
@@ -0,0 +1,187 @@
+package dfd
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// integrityDFD returns a diagram with a process in a VPC nested in AWS, and
+// flows to and from it.
+func integrityDFD() (dfd *DataFlowDiagram, api *Process, req, resp *Flow) {
+	dfd = InitializeDFD("Integrity")
+	dfd.AddTrustBoundaryWithID("aws", "AWS", "")
+	dfd.AddTrustBoundaryWithID("vpc", "VPC", "aws")
+	dfd.AddTrustBoundaryWithID("subnet", "Subnet", "vpc")
+	api, _ = NewProcessWithID("api", "API")
+	db, _ := NewDataStoreWithID("db", "DB")
+	user, _ := NewExternalServiceWithID("user", "User")
+	dfd.AddElement(api, "vpc")
+	dfd.AddElement(db, "subnet")
+	dfd.AddElement(user, "")
+	req, resp = dfd.AddRequestResponse(user, api, "Request", "Response")
+	dfd.AddFlow(api, db, "Query")
+	return dfd, api, req, resp
+}
+
+// describeIntegrity lists the elements of dfd with their trust boundary,
+// then its trust boundaries with their parent, then its flows.
+func describeIntegrity(dfd *DataFlowDiagram) string {
+	var s []string
+	for _, n := range allElements(dfd) {
+		where := "-"
+		if tb := dfd.BoundaryOf(n.ExternalID()); tb != nil {
+			where = tb.ExternalID()
+		}
+		s = append(s, n.ExternalID()+"@"+where)
+	}
+	for _, tb := range sortedTrustBoundaries(dfd) {
+		parent := "-"
+		if tb.Parent() != nil {
+			parent = tb.Parent().ExternalID()
+		}
+		s = append(s, tb.ExternalID()+"<"+parent)
+	}
+	var flows []string
+	for _, f := range dfd.Flows {
+		flows = append(flows, f.Name)
+	}
+	sort.Strings(flows)
+	return strings.Join(append(s, flows...), " ")
+}
+
+func TestRemoveElement(t *testing.T) {
+	dfd, api, _, _ := integrityDFD()
+	if err := dfd.RemoveElement("nowhere", Cascade); err == nil {
+		t.Error("Expected removing an unknown element to fail")
+	}
+	err := dfd.RemoveElement(api.ExternalID(), Refuse)
+	if _, ok := err.(*ReferenceError); !ok {
+		t.Fatalf("Expected a *ReferenceError refusing to remove an element with flows, got %v", err)
+	}
+	if err := dfd.RemoveElement(api.ExternalID(), Cascade); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	const want = "user@- db@subnet aws<- subnet<vpc vpc<aws"
+	if got := describeIntegrity(dfd); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if dfd.Node(api.ID()) != nil {
+		t.Error("Expected the process to be gone from the graph")
+	}
+	if findings := CheckIntegrity(dfd); len(findings) != 0 {
+		t.Errorf("Expected no integrity problems, got %v", findings)
+	}
+
+	dfd, api, _, _ = integrityDFD()
+	dfd.RemoveDataStore(api.ExternalID())
+	dfd.RemoveProcess(api.ExternalID())
+	if got := describeIntegrity(dfd); got != want {
+		t.Errorf("Expected RemoveProcess to remove API from VPC with its flows, got %s", got)
+	}
+	if findings := CheckIntegrity(dfd); len(findings) != 0 {
+		t.Errorf("Expected no integrity problems, got %v", findings)
+	}
+
+	dfd, _, _, _ = integrityDFD()
+	dfd.TrustBoundaries["subnet"].RemoveDataStore("db")
+	const withoutDB = "user@- api@vpc aws<- subnet<vpc vpc<aws Request Response"
+	if got := describeIntegrity(dfd); got != withoutDB {
+		t.Errorf("Expected TrustBoundary.RemoveDataStore to remove the flows of DB, got %s", got)
+	}
+	if findings := CheckIntegrity(dfd); len(findings) != 0 {
+		t.Errorf("Expected no integrity problems, got %v", findings)
+	}
+}
+
+func TestRemoveTrustBoundaryWithPolicy(t *testing.T) {
+	cases := []struct {
+		policy RemovePolicy
+		want   string
+	}{
+		{Cascade, "user@- aws<-"},
+		{Reparent, "user@- api@aws db@subnet aws<- subnet<aws Query Request Response"},
+	}
+	for _, c := range cases {
+		t.Run(c.policy.String(), func(t *testing.T) {
+			dfd, _, _, _ := integrityDFD()
+			if err := dfd.RemoveTrustBoundaryWithPolicy("vpc", c.policy); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := describeIntegrity(dfd); got != c.want {
+				t.Errorf("Expected %s, got %s", c.want, got)
+			}
+			if findings := CheckIntegrity(dfd); len(findings) != 0 {
+				t.Errorf("Expected no integrity problems, got %v", findings)
+			}
+		})
+	}
+
+	dfd, _, _, _ := integrityDFD()
+	err := dfd.RemoveTrustBoundaryWithPolicy("aws", Refuse)
+	if _, ok := err.(*ReferenceError); !ok {
+		t.Fatalf("Expected a *ReferenceError refusing to remove a trust boundary holding elements, got %v", err)
+	}
+	dfd.RemoveTrustBoundary("vpc")
+	const want = "user@- api@aws db@aws aws<- Query Request Response"
+	if got := describeIntegrity(dfd); got != want {
+		t.Errorf("Expected RemoveTrustBoundary to move the elements to AWS, got %s", got)
+	}
+	dfd.AddTrustBoundaryWithID("empty", "Empty", "aws")
+	dfd.RemoveElement("api", Cascade)
+	dfd.RemoveElement("db", Cascade)
+	if err := dfd.RemoveTrustBoundaryWithPolicy("aws", Refuse); err != nil || len(dfd.TrustBoundaries) != 0 {
+		t.Errorf("Expected AWS and the empty trust boundary in it to be removed, got %v and %v", err, dfd.TrustBoundaries)
+	}
+}
+
+func TestRepairIntegrity(t *testing.T) {
+	dfd, _, req, _ := integrityDFD()
+	// Corrupt the diagram the way editing its maps directly would.
+	delete(dfd.TrustBoundaries, "subnet")
+	dfd.TrustBoundaries["aws"].AddNodeElem(dfd.FindNode("user"))
+	delete(dfd.Flows, req.ExternalID())
+
+	var got []string
+	for _, f := range CheckIntegrity(dfd) {
+		got = append(got, f.Rule+": "+f.Message)
+	}
+	want := []string{
+		`integrity: trust boundary "VPC" holds trust boundary "Subnet", which is not in the diagram`,
+		`integrity: external service "User" is at the top level and also in trust boundary "AWS"`,
+		`dangling-flow: flow "Query" references datastore_db, which is not an element of the diagram`,
+		`integrity: flow "Response" is the response to flow ` + req.ExternalID() + `, which is not in the diagram`,
+		`integrity: the graph has an edge from externalservice_user to process_api that is not a flow of the diagram`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Expected the problems:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+	for _, f := range Validate(dfd) {
+		if f.Rule == RuleIntegrity && strings.Contains(f.Message, "references") {
+			t.Errorf("Expected dangling flows to be reported by %s only, got %v", RuleDanglingFlow, f)
+		}
+	}
+
+	if repaired := RepairIntegrity(dfd); len(repaired) != len(want) {
+		t.Errorf("Expected %d problems to be repaired, got %v", len(want), repaired)
+	}
+	if findings := CheckIntegrity(dfd); len(findings) != 0 {
+		t.Errorf("Expected no integrity problems after repairing, got %v", findings)
+	}
+	const described = "user@- api@vpc aws<- vpc<aws Response"
+	if got := describeIntegrity(dfd); got != described {
+		t.Errorf("Expected %s, got %s", described, got)
+	}
+	out, err := dfd.MarshalDOT()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding DOT: %v", err)
+	}
+	back, err := Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding DOT: %v", err)
+	}
+	if got := describeIntegrity(back); got != described {
+		t.Errorf("Expected %s after a round trip, got %s", described, got)
+	}
+}
@@ -0,0 +1,129 @@
+package dfd
+
+import (
+	"fmt"
+
+	"gonum.org/v1/gonum/graph"
+)
+
+// Most flows carry data one way. A bidirectional flow carries the same data
+// both ways, and is written with dir=both. A request/response interaction is
+// a pair of flows in opposite directions, the response naming its request, so
+// that each direction has its own name and properties and is analyzed on its
+// own. Responses are drawn dashed.
+
+// AddBidirectionalFlow adds a flow from f to t that carries the same data both
+// ways.
+func (g *DataFlowDiagram) AddBidirectionalFlow(f graph.Node, t graph.Node, name string) *Flow {
+	flow := g.AddFlow(f, t, name)
+	flow.Dir = "both"
+	return flow
+}
+
+// Bidirectional reports whether the flow carries data both ways.
+func (f *Flow) Bidirectional() bool {
+	return unquoteDOT(f.Dir) == "both"
+}
+
+// AddRequestResponse adds a request from f to t and its response from t back
+// to f.
+func (g *DataFlowDiagram) AddRequestResponse(f graph.Node, t graph.Node, request, response string) (req, resp *Flow) {
+	req = g.AddFlow(f, t, request)
+	resp = g.AddFlow(t, f, response)
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	resp.responseTo = req.id
+	return req, resp
+}
+
+// ResponseTo returns the ID of the request the flow is the response to, or ""
+// if it is not a response.
+func (f *Flow) ResponseTo() string {
+	return f.responseTo
+}
+
+// SetResponse makes the flow with the ID responseID the response to the one
+// with the ID requestID, or no longer a response if requestID is empty. The
+// response must go back the way of the request, and a request has a single
+// response, which is not a request itself. Errors are *ReferenceError.
+func (g *DataFlowDiagram) SetResponse(responseID, requestID string) error {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	resp, ok := g.Flows[responseID]
+	if !ok {
+		return &ReferenceError{ID: responseID, Reason: "unknown flow"}
+	}
+	if requestID == "" {
+		resp.responseTo = ""
+		return nil
+	}
+	req, ok := g.Flows[requestID]
+	switch {
+	case !ok:
+		return &ReferenceError{ID: requestID, Reason: "unknown request flow"}
+	case req.From().ID() != resp.To().ID() || req.To().ID() != resp.From().ID():
+		return &ReferenceError{ID: responseID, Reason: fmt.Sprintf("response does not go back the way of request %s", requestID)}
+	case req.responseTo != "":
+		return &ReferenceError{ID: requestID, Reason: "request is itself a response"}
+	}
+	for _, other := range g.Flows {
+		switch {
+		case other != resp && other.responseTo == requestID:
+			return &ReferenceError{ID: requestID, Reason: "request already has a response"}
+		case other.responseTo == responseID:
+			return &ReferenceError{ID: responseID, Reason: "response is itself a request"}
+		}
+	}
+	resp.responseTo = requestID
+	return nil
+}
+
+// RequestOf returns the request f is the response to, or nil if it is not a
+// response.
+func (g *DataFlowDiagram) RequestOf(f *Flow) *Flow {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	return g.Flows[f.responseTo]
+}
+
+// ResponseOf returns the response to the request f, or nil if it has none.
+func (g *DataFlowDiagram) ResponseOf(f *Flow) *Flow {
+	g.mtx.RLock()
+	defer g.mtx.RUnlock()
+	for _, other := range g.Flows {
+		if other.responseTo == f.id {
+			return other
+		}
+	}
+	return nil
+}
+
+// linkResponses checks the requests that decoded flows name, as SetResponse
+// does.
+func (g *DataFlowDiagram) linkResponses() error {
+	for _, f := range sortedFlows(g) {
+		if f.responseTo == "" {
+			continue
+		}
+		request := f.responseTo
+		f.responseTo = ""
+		if err := g.SetResponse(f.id, request); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describeFlow describes a flow for threats, e.g. flow "HTTPS" from "API" to
+// "Stripe", response "Receipt" from "Stripe" to "API" to "HTTPS", or flow
+// "Sync" between "API" and "Auditor".
+func describeFlow(dfd *DataFlowDiagram, f *Flow) string {
+	from, to := nodeName(f.From().(DfdNode)), nodeName(f.To().(DfdNode))
+	if req := dfd.RequestOf(f); req != nil {
+		return fmt.Sprintf("response %q from %q to %q to %q", f.Name, from, to, req.Name)
+	}
+	if f.Bidirectional() {
+		return fmt.Sprintf("flow %q between %q and %q", f.Name, from, to)
+	}
+	return fmt.Sprintf("flow %q from %q to %q", f.Name, from, to)
+}
@@ -0,0 +1,230 @@
+package dfd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"gonum.org/v1/gonum/graph/encoding"
+)
+
+func interactionDFD() (dfd *DataFlowDiagram, req, resp *Flow) {
+	dfd = InitializeDFD("Payments")
+	dfd.AddTrustBoundaryWithID("vpc", "VPC", "")
+	api, _ := NewProcessWithID("api", "API")
+	issuer, _ := NewExternalServiceWithID("issuer", "Issuer")
+	dfd.AddElement(api, "vpc")
+	dfd.AddElement(issuer, "")
+	req, resp = dfd.AddRequestResponse(api, issuer, "Authorization", "Approval")
+	req.Properties.Classifications = []DataClassification{ClassificationPCI}
+	dfd.AddBidirectionalFlow(api, issuer, "Sync")
+	return dfd, req, resp
+}
+
+// describeResponses lists the responses of dfd with their request.
+func describeResponses(dfd *DataFlowDiagram) string {
+	var s []string
+	for _, f := range sortedFlows(dfd) {
+		if req := dfd.RequestOf(f); req != nil {
+			s = append(s, f.Name+" -> "+req.Name)
+		}
+		if f.Bidirectional() {
+			s = append(s, f.Name+" <->")
+		}
+	}
+	return strings.Join(s, ", ")
+}
+
+func TestRequestResponse(t *testing.T) {
+	dfd, req, resp := interactionDFD()
+	if resp.ResponseTo() != req.ExternalID() || dfd.ResponseOf(req) != resp || dfd.RequestOf(resp) != req {
+		t.Fatalf("Expected %s to be the response to %s", resp.ExternalID(), req.ExternalID())
+	}
+	if dfd.ResponseOf(resp) != nil || dfd.RequestOf(req) != nil {
+		t.Error("Expected the request and response not to be paired the other way")
+	}
+	const want = "Approval -> Authorization, Sync <->"
+	if got := describeResponses(dfd); got != want {
+		t.Fatalf("Expected %s, got %s", want, got)
+	}
+
+	api, issuer := req.From(), req.To()
+	other := dfd.AddFlow(issuer, api, "Decline")
+	cases := []struct {
+		name                  string
+		responseID, requestID string
+	}{
+		{"unknown response", "nowhere", req.ExternalID()},
+		{"unknown request", other.ExternalID(), "nowhere"},
+		{"same direction", dfd.AddFlow(api, issuer, "Capture").ExternalID(), req.ExternalID()},
+		{"request already answered", other.ExternalID(), req.ExternalID()},
+		{"request is a response", dfd.AddFlow(api, issuer, "Ack").ExternalID(), resp.ExternalID()},
+		{"response is a request", req.ExternalID(), other.ExternalID()},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := dfd.SetResponse(c.responseID, c.requestID)
+			if _, ok := err.(*ReferenceError); !ok {
+				t.Errorf("Expected a *ReferenceError, got %v", err)
+			}
+		})
+	}
+	if err := dfd.SetResponse(resp.ExternalID(), ""); err != nil || dfd.ResponseOf(req) != nil {
+		t.Errorf("Expected the response to be unpaired, got %v", err)
+	}
+	if err := dfd.SetResponse(other.ExternalID(), req.ExternalID()); err != nil {
+		t.Fatalf("Unexpected error pairing another response: %v", err)
+	}
+	dfd.RemoveFlowWithID(req.ExternalID())
+	if other.ResponseTo() != "" {
+		t.Errorf("Expected removing the request to unpair its response, got %q", other.ResponseTo())
+	}
+}
+
+func TestRequestResponseRoundTrip(t *testing.T) {
+	in, _, _ := interactionDFD()
+	want := describeResponses(in)
+
+	out, err := in.MarshalDOT()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding DOT: %v", err)
+	}
+	if !strings.Contains(string(out), "style=dashed") {
+		t.Errorf("Expected the response to be dashed, got:\n%s", out)
+	}
+	back, err := Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding DOT: %v", err)
+	}
+	if got := describeResponses(back); got != want {
+		t.Errorf("Expected %s after a DOT round trip, got %s", want, got)
+	}
+
+	js, err := in.MarshalJSON()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding JSON: %v", err)
+	}
+	back = InitializeDFD("")
+	if err := back.UnmarshalJSON(js); err != nil {
+		t.Fatalf("Unexpected error decoding JSON: %v", err)
+	}
+	if got := describeResponses(back); got != want {
+		t.Errorf("Expected %s after a JSON round trip, got %s", want, got)
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeYAML(&buf, in); err != nil {
+		t.Fatalf("Unexpected error encoding YAML: %v", err)
+	}
+	if back, err = DecodeYAML(&buf); err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	if got := describeResponses(back); got != want {
+		t.Errorf("Expected %s after a YAML round trip, got %s", want, got)
+	}
+
+	buf.Reset()
+	if err := EncodePlantUML(&buf, in); err != nil {
+		t.Fatalf("Unexpected error encoding PlantUML: %v", err)
+	}
+	if back, err = DecodePlantUML(&buf); err != nil {
+		t.Fatalf("Unexpected error decoding PlantUML: %v", err)
+	}
+	if got := describeResponses(back); got != want {
+		t.Errorf("Expected %s after a PlantUML round trip, got %s", want, got)
+	}
+
+	bad := strings.Replace(string(js), `"response_to":"`, `"response_to":"x`, 1)
+	if err := InitializeDFD("").UnmarshalJSON([]byte(bad)); err == nil {
+		t.Error("Expected a response to an unknown flow to be rejected")
+	} else if _, ok := err.(*ReferenceError); !ok {
+		t.Errorf("Expected a *ReferenceError, got %T", err)
+	}
+}
+
+func TestRequestResponseThreats(t *testing.T) {
+	dfd, _, resp := interactionDFD()
+	descriptions := map[string]string{}
+	for _, threat := range GenerateThreats(dfd) {
+		if threat.Category == InformationDisclosure {
+			descriptions[threat.Target] = threat.Description
+		}
+	}
+	if d := descriptions["flow_"+resp.ExternalID()]; !strings.Contains(d, `response "Approval" from "Issuer" to "API" to "Authorization"`) {
+		t.Errorf("Expected the threat to describe the response, got %q", d)
+	}
+	var found bool
+	for _, d := range descriptions {
+		found = found || strings.Contains(d, `flow "Sync" between "API" and "Issuer"`)
+	}
+	if !found {
+		t.Errorf("Expected a threat to describe the bidirectional flow, got %v", descriptions)
+	}
+}
+
+func TestRequestResponseMergeAndDiff(t *testing.T) {
+	a, _, _ := interactionDFD()
+	b, _, resp := interactionDFD()
+	merged, conflicts, err := Merge(MergeOptions{}, a, b)
+	if err != nil {
+		t.Fatalf("Unexpected error merging: %v", err)
+	}
+	if len(conflicts) != 0 {
+		t.Errorf("Expected no conflicts, got %v", conflicts)
+	}
+	if got, want := describeResponses(merged), describeResponses(a); got != want {
+		t.Errorf("Expected %s after merging, got %s", want, got)
+	}
+
+	b.SetResponse(resp.ExternalID(), "")
+	var changes []string
+	for _, c := range Compare(a, b).Changes {
+		changes = append(changes, c.String())
+	}
+	want := `~ flow "Approval" from "Issuer" to "API" request changed from "Authorization" to ""`
+	if got := strings.Join(changes, "\n"); got != want {
+		t.Errorf("Expected the change\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestDashedFlowRoundTrip(t *testing.T) {
+	in, req, resp := interactionDFD()
+	api, issuer := req.From(), req.To()
+	dashed := in.AddFlow(issuer, api, "Webhook")
+	if err := dashed.SetAttribute(encoding.Attribute{Key: "style", Value: "dashed"}); err != nil {
+		t.Fatalf("Unexpected error setting the style: %v", err)
+	}
+
+	out, err := in.MarshalDOT()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding DOT: %v", err)
+	}
+	back, err := Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding DOT: %v", err)
+	}
+	if f := back.Flows[dashed.ExternalID()]; f == nil || f.Style != "dashed" || f.ResponseTo() != "" {
+		t.Errorf("Expected a plain dashed flow to stay dashed after a round trip, got %+v", f)
+	}
+	if f := back.Flows[resp.ExternalID()]; f == nil || f.Style != "" {
+		t.Errorf("Expected the style of a response to stay implied, got %+v", f)
+	}
+	if again, err := back.MarshalDOT(); err != nil || !bytes.Equal(again, out) {
+		t.Errorf("Expected a second round trip not to change the DOT, got:\n%s", again)
+	}
+
+	// A response whose style comes before the request it answers is still
+	// written dashed once.
+	doc := `strict digraph 1 {
+		process_1 -> externalservice_2;
+		externalservice_2 -> process_1 [style=dashed dfd_response_to="1-2"];
+	}`
+	back, err = Decode(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding DOT: %v", err)
+	}
+	out, _ = back.MarshalDOT()
+	if n := strings.Count(string(out), "style=dashed"); n != 1 {
+		t.Errorf("Expected the response to be written dashed once, got:\n%s", out)
+	}
+}
@@ -0,0 +1,324 @@
+package dfd
+
+import (
+	"encoding/json"
+	"sort"
+
+	"gonum.org/v1/gonum/graph"
+	"gonum.org/v1/gonum/graph/encoding"
+)
+
+// JSONSchemaVersion is the version of the JSON representation written by
+// MarshalJSON. The matching JSON Schema is published in
+// schema/dfd.v2.schema.json. UnmarshalJSON also reads version 1, described by
+// schema/dfd.v1.schema.json, which only has numeric IDs and flat trust
+// boundaries, and no properties, tags, child diagrams or responses.
+const JSONSchemaVersion = 2
+
+type jsonDFD struct {
+	Version          int                 `json:"version"`
+	ID               string              `json:"id"`
+	Name             string              `json:"name"`
+	Processes        []jsonNode          `json:"processes"`
+	ExternalServices []jsonNode          `json:"external_services"`
+	DataStores       []jsonNode          `json:"data_stores"`
+	TrustBoundaries  []jsonTrustBoundary `json:"trust_boundaries"`
+	Flows            []jsonFlow          `json:"flows"`
+}
+
+type jsonTrustBoundary struct {
+	ID               string     `json:"id"`
+	Name             string     `json:"name"`
+	Parent           string     `json:"parent,omitempty"`
+	Processes        []jsonNode `json:"processes"`
+	ExternalServices []jsonNode `json:"external_services"`
+	DataStores       []jsonNode `json:"data_stores"`
+}
+
+type jsonNode struct {
+	ID         string            `json:"id"`
+	Name       string            `json:"name"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Tags       []string          `json:"tags,omitempty"`
+	// Properties holds the ProcessProperties, ExternalServiceProperties or
+	// DataStoreProperties of the element.
+	Properties json.RawMessage `json:"properties,omitempty"`
+	// Child is the child DFD of a process.
+	Child *DataFlowDiagram `json:"child,omitempty"`
+}
+
+type jsonFlow struct {
+	ID          string            `json:"id,omitempty"`
+	Source      string            `json:"source"`
+	Destination string            `json:"destination"`
+	Name        string            `json:"name"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	Properties  *FlowProperties   `json:"properties,omitempty"`
+	// ResponseTo is the ID of the request the flow is the response to.
+	ResponseTo string `json:"response_to,omitempty"`
+}
+
+// MarshalJSON implements json.Marshaler. Elements and flows are sorted by ID
+// so that the output is stable.
+func (dfd *DataFlowDiagram) MarshalJSON() ([]byte, error) {
+	doc := jsonDFD{
+		Version:          JSONSchemaVersion,
+		ID:               dfd.ExternalID(),
+		Name:             dfd.Name,
+		Processes:        jsonProcesses(dfd.Processes),
+		ExternalServices: jsonExternalServices(dfd.ExternalServices),
+		DataStores:       jsonDataStores(dfd.DataStores),
+		TrustBoundaries:  []jsonTrustBoundary{},
+		Flows:            []jsonFlow{},
+	}
+	for _, tb := range sortedTrustBoundaries(dfd) {
+		parent := ""
+		if tb.parent != nil {
+			parent = tb.parent.ExternalID()
+		}
+		doc.TrustBoundaries = append(doc.TrustBoundaries, jsonTrustBoundary{
+			ID:               tb.ExternalID(),
+			Name:             tb.Name,
+			Parent:           parent,
+			Processes:        jsonProcesses(tb.Processes),
+			ExternalServices: jsonExternalServices(tb.ExternalServices),
+			DataStores:       jsonDataStores(tb.DataStores),
+		})
+	}
+	for _, id := range sortedFlowIDs(dfd) {
+		f := dfd.Flows[id]
+		doc.Flows = append(doc.Flows, jsonFlow{
+			ID:          id,
+			Source:      f.From().(DfdNode).ExternalID(),
+			Destination: f.To().(DfdNode).ExternalID(),
+			Name:        f.Name,
+			Attributes:  jsonAttributes(f.dotEdge.attributes()),
+			Properties:  flowProperties(f),
+			ResponseTo:  f.responseTo,
+		})
+	}
+	return json.Marshal(doc)
+}
+
+// UnmarshalJSON implements json.Unmarshaler, replacing the DFD with the one
+// described by data.
+func (dfd *DataFlowDiagram) UnmarshalJSON(data []byte) error {
+	var doc jsonDFD
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc.Version != 1 && doc.Version != JSONSchemaVersion {
+		return &VersionError{Format: "JSON", Version: doc.Version}
+	}
+
+	dst := DeserializeDFD(doc.ID)
+	dst.UpdateName(doc.Name)
+	nodes := map[string]graph.Node{}
+	add := func(add func(graph.Node), kind string, elems []jsonNode) error {
+		for _, el := range elems {
+			if _, ok := nodes[el.ID]; ok {
+				return &ReferenceError{ID: el.ID, Reason: "duplicate element ID"}
+			}
+			n, err := deserializeNode(kind, el.ID)
+			if err != nil {
+				return err
+			}
+			n.(DfdNode).UpdateName(el.Name)
+			if err := setAttributes(n.(encoding.AttributeSetter), "node", el.Attributes); err != nil {
+				return err
+			}
+			if len(el.Properties) != 0 {
+				if err := json.Unmarshal(el.Properties, propertiesOf(n)); err != nil {
+					return err
+				}
+			}
+			n.(tagged).setTags(el.Tags)
+			if el.Child != nil {
+				p, ok := n.(*Process)
+				if !ok {
+					return &ReferenceError{ID: el.ID, Reason: "only processes have a child diagram"}
+				}
+				p.Child = el.Child
+			}
+			add(n)
+			nodes[el.ID] = n
+		}
+		return nil
+	}
+	addAll := func(g DfdGraph, ps, es, ds []jsonNode) error {
+		if err := add(g.AddNodeElem, "process", ps); err != nil {
+			return err
+		}
+		if err := add(g.AddNodeElem, "externalservice", es); err != nil {
+			return err
+		}
+		return add(g.AddNodeElem, "datastore", ds)
+	}
+
+	if err := addAll(dst, doc.Processes, doc.ExternalServices, doc.DataStores); err != nil {
+		return err
+	}
+	for _, jtb := range doc.TrustBoundaries {
+		if _, ok := dst.TrustBoundaries[jtb.ID]; ok {
+			return &ReferenceError{ID: jtb.ID, Reason: "duplicate trust boundary ID"}
+		}
+		tb := DeserializeTrustBoundary(jtb.ID)
+		tb.UpdateName(jtb.Name)
+		dst.registerTrustBoundary(tb)
+		if err := addAll(tb, jtb.Processes, jtb.ExternalServices, jtb.DataStores); err != nil {
+			return err
+		}
+	}
+	for _, jtb := range doc.TrustBoundaries {
+		if jtb.Parent == "" {
+			continue
+		}
+		parent, ok := dst.TrustBoundaries[jtb.Parent]
+		if !ok {
+			return &ReferenceError{ID: jtb.Parent, Reason: "trust boundary parent references unknown trust boundary"}
+		}
+		for p := parent; p != nil; p = p.parent {
+			if p.ExternalID() == jtb.ID {
+				return &ReferenceError{ID: jtb.ID, Reason: "trust boundary is nested in itself"}
+			}
+		}
+		parent.addTrustBoundary(dst.TrustBoundaries[jtb.ID])
+	}
+	for _, jf := range doc.Flows {
+		src, ok := nodes[jf.Source]
+		if !ok {
+			return &ReferenceError{ID: jf.Source, Reason: "flow source references unknown element"}
+		}
+		dest, ok := nodes[jf.Destination]
+		if !ok {
+			return &ReferenceError{ID: jf.Destination, Reason: "flow destination references unknown element"}
+		}
+		if src.ID() == dest.ID() {
+			return &ReferenceError{ID: jf.Source, Reason: "flow source and destination are the same element"}
+		}
+		var flow *Flow
+		// Version 1 derives flow IDs from their ends and ignores the one given.
+		if jf.ID == "" || doc.Version == 1 {
+			flow = dst.AddFlow(src, dest, jf.Name)
+		} else {
+			var err error
+			if flow, err = dst.AddFlowWithID(jf.ID, src, dest, jf.Name); err != nil {
+				return err
+			}
+		}
+		if err := setAttributes(flow.dotEdge, "edge", jf.Attributes); err != nil {
+			return err
+		}
+		if jf.Properties != nil {
+			flow.setProperties(*jf.Properties)
+		}
+		flow.responseTo = jf.ResponseTo
+	}
+	if err := dst.linkResponses(); err != nil {
+		return err
+	}
+
+	*dfd = *dst
+	return nil
+}
+
+// flowProperties returns the properties of a flow, or nil if none is set.
+func flowProperties(f *Flow) *FlowProperties {
+	if f.Properties.IsZero() {
+		return nil
+	}
+	p := f.Properties
+	return &p
+}
+
+// deserializeNode returns a node of the given DOT type with the given ID.
+func deserializeNode(kind, id string) (graph.Node, error) {
+	if !validID(id) {
+		return nil, &MalformedIDError{ID: id}
+	}
+	switch kind {
+	case "process":
+		return DeserializeProcess(id), nil
+	case "externalservice":
+		return DeserializeExternalService(id), nil
+	case "datastore":
+		return DeserializeDataStore(id), nil
+	default:
+		return nil, &UnknownElementError{Kind: "node type", Type: kind}
+	}
+}
+
+// setAttributes applies a map of DOT attributes in key order.
+func setAttributes(n encoding.AttributeSetter, element string, attrs map[string]string) error {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := n.SetAttribute(encoding.Attribute{Key: k, Value: attrs[k]}); err != nil {
+			return &AttributeError{Element: element, Key: k, Value: attrs[k], Err: err}
+		}
+	}
+	return nil
+}
+
+// jsonAttributes converts DOT attributes to a map, or nil if there are none.
+func jsonAttributes(attrs []encoding.Attribute) map[string]string {
+	if len(attrs) == 0 {
+		return nil
+	}
+	m := make(map[string]string, len(attrs))
+	for _, attr := range attrs {
+		m[attr.Key] = attr.Value
+	}
+	return m
+}
+
+func jsonProcesses(m map[string]*Process) []jsonNode {
+	nodes := []jsonNode{}
+	for id, n := range m {
+		el := newJSONNode(id, n.Name, n.dotNode, &n.Properties)
+		el.Child = n.Child
+		nodes = append(nodes, el)
+	}
+	return sortJSONNodes(nodes)
+}
+
+func jsonExternalServices(m map[string]*ExternalService) []jsonNode {
+	nodes := []jsonNode{}
+	for id, n := range m {
+		nodes = append(nodes, newJSONNode(id, n.Name, n.dotNode, &n.Properties))
+	}
+	return sortJSONNodes(nodes)
+}
+
+func jsonDataStores(m map[string]*DataStore) []jsonNode {
+	nodes := []jsonNode{}
+	for id, n := range m {
+		nodes = append(nodes, newJSONNode(id, n.Name, n.dotNode, &n.Properties))
+	}
+	return sortJSONNodes(nodes)
+}
+
+func newJSONNode(id, name string, n *dotNode, props elementProperties) jsonNode {
+	el := jsonNode{ID: id, Name: name, Attributes: jsonAttributes(n.extraAttributes()), Tags: n.Tags}
+	if !props.IsZero() {
+		// The property types only hold strings, booleans and slices of
+		// strings, which always marshal.
+		el.Properties, _ = json.Marshal(props)
+	}
+	return el
+}
+
+// sortJSONNodes orders elements of the same kind by name, then ID, as
+// lessElement does.
+func sortJSONNodes(nodes []jsonNode) []jsonNode {
+	sort.Slice(nodes, func(i, j int) bool {
+		if nodes[i].Name != nodes[j].Name {
+			return nodes[i].Name < nodes[j].Name
+		}
+		return nodes[i].ID < nodes[j].ID
+	})
+	return nodes
+}
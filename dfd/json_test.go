@@ -0,0 +1,117 @@
+package dfd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"testing/quick"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	roundTrip := func(in randomDFD) bool {
+		data, err := json.Marshal(in.DataFlowDiagram)
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		out := &DataFlowDiagram{}
+		if err := json.Unmarshal(data, out); err != nil {
+			t.Log(err)
+			return false
+		}
+		want, got := describeDFD(in.DataFlowDiagram), describeDFD(out)
+		if want != got {
+			t.Logf("want:\n%s\ngot:\n%s", want, got)
+			return false
+		}
+		again, err := json.Marshal(out)
+		if err != nil || !bytes.Equal(data, again) {
+			t.Logf("JSON output is not stable:\n%s\n%s", data, again)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnmarshalJSONErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		json string
+		err  error
+	}{
+		{"an unknown version", `{"version": 3}`, &VersionError{}},
+		{"a duplicate element", `{"version": 2, "id": "1", "processes": [{"id": "2"}], "data_stores": [{"id": "2"}]}`, &ReferenceError{}},
+		{"a duplicate trust boundary", `{"version": 2, "id": "1", "trust_boundaries": [{"id": "2"}, {"id": "2"}]}`, &ReferenceError{}},
+		{"an unknown trust boundary parent", `{"version": 2, "id": "1", "trust_boundaries": [{"id": "2", "parent": "3"}]}`, &ReferenceError{}},
+		{"a trust boundary nested in itself", `{"version": 2, "id": "1", "trust_boundaries": [{"id": "2", "parent": "3"}, {"id": "3", "parent": "2"}]}`, &ReferenceError{}},
+		{"a dangling flow", `{"version": 2, "id": "1", "processes": [{"id": "2"}], "flows": [{"source": "2", "destination": "3"}]}`, &ReferenceError{}},
+		{"a malformed ID", `{"version": 2, "id": "1", "processes": [{"id": "web_server"}]}`, &MalformedIDError{}},
+		{"an unknown attribute", `{"version": 2, "id": "1", "processes": [{"id": "2", "attributes": {"color": "red"}}]}`, &AttributeError{}},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("Unmarshaling JSON with %s", c.name), func(t *testing.T) {
+			err := json.Unmarshal([]byte(c.json), &DataFlowDiagram{})
+			if reflect.TypeOf(err) != reflect.TypeOf(c.err) {
+				t.Errorf("Expected an error of type %T, got %T (%v)", c.err, err, err)
+			}
+		})
+	}
+}
+
+func TestUnmarshalJSONVersion1(t *testing.T) {
+	const v1 = `{
+		"version": 1, "id": "1", "name": "Old",
+		"processes": [{"id": "2", "name": "API"}],
+		"external_services": [],
+		"data_stores": [],
+		"trust_boundaries": [{"id": "3", "name": "AWS", "processes": [], "external_services": [], "data_stores": [{"id": "4", "name": "DB"}]}],
+		"flows": [{"id": "ignored", "source": "2", "destination": "4", "name": "SQL"}]
+	}`
+	dfd := &DataFlowDiagram{}
+	if err := json.Unmarshal([]byte(v1), dfd); err != nil {
+		t.Fatalf("Unexpected error reading a version 1 document: %v", err)
+	}
+	if tb := dfd.BoundaryOf("4"); tb == nil || tb.Name != "AWS" {
+		t.Errorf("Expected DB to be in AWS, got %v", tb)
+	}
+	flows := dfd.FlowsBetween(dfd.FindNode("2"), dfd.FindNode("4"))
+	if len(flows) != 1 || flows[0].ExternalID() != genFlowID(dfd.FindNode("2"), dfd.FindNode("4")) {
+		t.Errorf("Expected one flow with an ID derived from its ends, got %v", flows)
+	}
+	data, err := json.Marshal(dfd)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte(fmt.Sprintf(`{"version":%d,`, JSONSchemaVersion))) {
+		t.Errorf("Expected a version 1 document to be written as version %d, got %s", JSONSchemaVersion, data)
+	}
+}
+
+func TestJSONSchema(t *testing.T) {
+	for version := 1; version <= JSONSchemaVersion; version++ {
+		data, err := ioutil.ReadFile(fmt.Sprintf("../schema/dfd.v%d.schema.json", version))
+		if err != nil {
+			t.Fatalf("The JSON Schema for version %d is missing: %v", version, err)
+		}
+		var schema struct {
+			Properties struct {
+				Version struct {
+					Const int `json:"const"`
+				} `json:"version"`
+			} `json:"properties"`
+		}
+		if err := json.Unmarshal(data, &schema); err != nil {
+			t.Fatalf("The JSON Schema for version %d is not valid JSON: %v", version, err)
+		}
+		if schema.Properties.Version.Const != version {
+			t.Errorf("Expected the JSON Schema to describe version %d, got %d", version, schema.Properties.Version.Const)
+		}
+	}
+}
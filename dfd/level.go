@@ -0,0 +1,181 @@
+package dfd
+
+import "fmt"
+
+// A DFD is leveled by decomposing its processes into child DFDs, which
+// repeat the elements the process exchanges data with as their context.
+// Elements of a child DFD stand for an element of its parent when they share
+// its ID and kind, or else when they are the only element of that kind whose
+// name has the same slug. External services of a child DFD are context too,
+// and should stand for an element of the parent.
+
+// Expand returns a copy of dfd in which every decomposed process is replaced
+// by the contents of its child DFD, recursively, for rendering the expanded
+// view of a leveled DFD. The contents of each child are placed in a trust
+// boundary named after the process, except for the elements standing for an
+// element of the parent, which are unified with it. Trust boundaries of the
+// child are unified with those of the parent with the same ID or name, as by
+// Merge. Flows into and out of the process give way to those of the child, so
+// the child should balance (see RuleUnbalancedDecomposition). A child DFD is
+// expanded once, which also stops a DFD from expanding into itself. dfd is
+// left untouched, and exporters render it collapsed. Errors are those of
+// Merge.
+func Expand(dfd *DataFlowDiagram) (*DataFlowDiagram, error) {
+	m := &merger{dfd: DeserializeDFD(dfd.ExternalID()), opts: MergeOptions{MatchNames: true}}
+	m.dfd.UpdateName(dfd.Name)
+	if err := m.merge(0, dfd, nil); err != nil {
+		return nil, err
+	}
+
+	expanded := map[*DataFlowDiagram]bool{dfd: true}
+	for i := 1; ; i++ {
+		p := nextDecomposed(m.dfd, expanded)
+		if p == nil {
+			return m.dfd, nil
+		}
+		expanded[p.Child] = true
+		var parentID string
+		if tb := m.dfd.BoundaryOf(p.ExternalID()); tb != nil {
+			parentID = tb.ExternalID()
+		}
+		// p was found in the diagram, so removing it cannot fail.
+		m.dfd.RemoveElement(p.ExternalID(), Cascade)
+		// The ID is free, as NewID checks it.
+		root, _ := m.dfd.AddTrustBoundaryWithID(m.dfd.NewID(p.Name), p.Name, parentID)
+		if err := m.merge(i, p.Child, root); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// nextDecomposed returns the first decomposed process of dfd whose child has
+// not been expanded, or nil if there is none.
+func nextDecomposed(dfd *DataFlowDiagram, expanded map[*DataFlowDiagram]bool) *Process {
+	for _, n := range allElements(dfd) {
+		if p, ok := n.(*Process); ok && p.Child != nil && !expanded[p.Child] {
+			return p
+		}
+	}
+	return nil
+}
+
+// contextOf returns the element of parent, other than the decomposed process
+// p, that the element n of p's child DFD stands for, or nil if there is none.
+func contextOf(parent *DataFlowDiagram, p *Process, n DfdNode) DfdNode {
+	var candidates []DfdNode
+	for _, other := range allElements(parent) {
+		if other == DfdNode(p) {
+			continue
+		}
+		if other.ExternalID() == n.ExternalID() && elementKind(other) == elementKind(n) {
+			return other
+		}
+		candidates = append(candidates, other)
+	}
+	return matchName(candidates, n)
+}
+
+// Processes may be decomposed into a child DFD, whose flows to and from its
+// context must match the flows into and out of the process.
+func checkDecompositions(dfd *DataFlowDiagram) []Finding {
+	return checkLevels(dfd, map[*DataFlowDiagram]bool{dfd: true})
+}
+
+func checkLevels(dfd *DataFlowDiagram, seen map[*DataFlowDiagram]bool) []Finding {
+	var findings []Finding
+	for _, n := range allElements(dfd) {
+		p, ok := n.(*Process)
+		if !ok || p.Child == nil || seen[p.Child] {
+			continue
+		}
+		seen[p.Child] = true
+		findings = append(findings, checkBalance(dfd, p)...)
+		findings = append(findings, checkLevels(p.Child, seen)...)
+	}
+	return findings
+}
+
+// boundaryFlow is a flow into or out of a decomposed process, identified by
+// the element at its other end: an element of the parent DFD, or an external
+// service of the child that stands for none.
+type boundaryFlow struct {
+	other DfdNode
+	in    bool
+	name  string
+}
+
+// checkBalance compares the flows into and out of the decomposed process p
+// of parent with the flows between its child DFD and its context.
+func checkBalance(parent *DataFlowDiagram, p *Process) []Finding {
+	childFlows := map[boundaryFlow]bool{}
+	for _, bf := range boundaryFlows(parent, p) {
+		childFlows[bf] = true
+	}
+
+	var findings []Finding
+	parentFlows := map[boundaryFlow]bool{}
+	for _, id := range sortedFlowIDs(parent) {
+		f := parent.Flows[id]
+		from, to := f.From().(DfdNode), f.To().(DfdNode)
+		var bf boundaryFlow
+		switch {
+		case to == DfdNode(p):
+			bf = boundaryFlow{other: from, in: true, name: f.Name}
+		case from == DfdNode(p):
+			bf = boundaryFlow{other: to, name: f.Name}
+		default:
+			continue
+		}
+		parentFlows[bf] = true
+		if !childFlows[bf] {
+			findings = append(findings, Finding{
+				Severity: SeverityWarning,
+				Target:   "flow_" + id,
+				Message:  fmt.Sprintf("flow %q %s has no matching flow in the child diagram", f.Name, describeBoundaryFlow(bf, p)),
+			})
+		}
+	}
+	for _, bf := range boundaryFlows(parent, p) {
+		if !parentFlows[bf] {
+			findings = append(findings, Finding{
+				Severity: SeverityWarning,
+				Target:   p.DOTID(),
+				Message:  fmt.Sprintf("flow %q %s in the child diagram has no matching flow in the parent diagram", bf.name, describeBoundaryFlow(bf, p)),
+			})
+		}
+	}
+	return findings
+}
+
+// boundaryFlows returns the flows between the child DFD of p and its
+// context, in the order of sortedFlows.
+func boundaryFlows(parent *DataFlowDiagram, p *Process) []boundaryFlow {
+	context := func(n DfdNode) (DfdNode, bool) {
+		if other := contextOf(parent, p, n); other != nil {
+			return other, true
+		}
+		_, external := n.(*ExternalService)
+		return n, external
+	}
+	var bfs []boundaryFlow
+	for _, f := range sortedFlows(p.Child) {
+		from, fromContext := context(f.From().(DfdNode))
+		to, toContext := context(f.To().(DfdNode))
+		switch {
+		case fromContext && !toContext:
+			bfs = append(bfs, boundaryFlow{other: from, in: true, name: f.Name})
+		case toContext && !fromContext:
+			bfs = append(bfs, boundaryFlow{other: to, name: f.Name})
+		}
+	}
+	return bfs
+}
+
+// describeBoundaryFlow describes where a flow into or out of p comes from or
+// goes to, e.g. from external service "Customer" into process "API".
+func describeBoundaryFlow(bf boundaryFlow, p *Process) string {
+	if bf.in {
+		return fmt.Sprintf("from %s into %s", describeElement(bf.other), describeElement(p))
+	}
+	return fmt.Sprintf("from %s out to %s", describeElement(p), describeElement(bf.other))
+}
@@ -0,0 +1,165 @@
+package dfd
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const testYAMLLevels = `version: 1
+name: Shop
+elements:
+  customer:
+    kind: external_service
+    name: Customer
+  orders:
+    kind: process
+    name: Orders
+    child:
+      name: Orders
+      elements:
+        customer:
+          kind: external_service
+          name: Customer
+        validate:
+          kind: process
+          name: Validate
+        store:
+          kind: process
+          name: Store
+        database:
+          kind: data_store
+          name: DB
+      flows:
+        - from: customer
+          to: validate
+          name: Order
+        - from: validate
+          to: store
+          name: Valid order
+        - from: store
+          to: database
+          name: SQL
+        - from: validate
+          to: customer
+          name: Receipt
+  db:
+    kind: data_store
+    name: DB
+flows:
+  - from: customer
+    to: orders
+    name: Order
+  - from: orders
+    to: customer
+    name: Receipt
+  - from: orders
+    to: db
+    name: SQL
+`
+
+func TestLevels(t *testing.T) {
+	d, err := DecodeYAML(strings.NewReader(testYAMLLevels))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	balance := NewRule(RuleUnbalancedDecomposition, checkDecompositions)
+	if findings := ValidateRules(d, balance); len(findings) != 0 {
+		t.Errorf("Expected a balanced decomposition, got %v", findings)
+	}
+
+	orders := d.Processes["orders"]
+	var buf bytes.Buffer
+	if err := Encode(&buf, d); err != nil {
+		t.Fatalf("Unexpected error encoding DOT: %v", err)
+	}
+	fromDOT, err := Decode(&buf)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding DOT: %v", err)
+	}
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatalf("Unexpected error marshaling JSON: %v", err)
+	}
+	fromJSON := &DataFlowDiagram{}
+	if err := json.Unmarshal(data, fromJSON); err != nil {
+		t.Fatalf("Unexpected error unmarshaling JSON: %v", err)
+	}
+	yml, err := d.ToYAML()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding YAML: %v", err)
+	}
+	fromYAML, err := DecodeYAML(strings.NewReader(yml))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	for format, got := range map[string]*DataFlowDiagram{"DOT": fromDOT, "JSON": fromJSON, "YAML": fromYAML} {
+		p := got.Processes[orders.ExternalID()]
+		if p == nil || p.Child == nil {
+			t.Errorf("Expected the %s round trip to keep the child diagram", format)
+			continue
+		}
+		if diff := Compare(orders.Child, p.Child); !diff.Empty() {
+			t.Errorf("Expected the %s round trip to keep the child diagram intact, got:\n%s", format, diff)
+		}
+		if findings := ValidateRules(got, balance); len(findings) != 0 {
+			t.Errorf("Expected the %s round trip to stay balanced, got %v", format, findings)
+		}
+	}
+
+	for _, f := range orders.Child.Flows {
+		if f.Name == "Receipt" {
+			f.Name = "Invoice"
+		}
+	}
+	expected := []string{
+		`warning: flow_` + genFlowID(orders, d.ExternalServices["customer"]) + `: flow "Receipt" from process "Orders" out to external service "Customer" has no matching flow in the child diagram (unbalanced-decomposition)`,
+		`warning: process_orders: flow "Invoice" from process "Orders" out to external service "Customer" in the child diagram has no matching flow in the parent diagram (unbalanced-decomposition)`,
+	}
+	findings := ValidateRules(d, balance)
+	if len(findings) != len(expected) {
+		t.Fatalf("Expected %d findings, got %v", len(expected), findings)
+	}
+	for i, f := range findings {
+		if f.String() != expected[i] {
+			t.Errorf("Expected finding %q, got %q", expected[i], f)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	d, err := DecodeYAML(strings.NewReader(testYAMLLevels))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	expanded, err := Expand(d)
+	if err != nil {
+		t.Fatalf("Unexpected error expanding: %v", err)
+	}
+	if p := d.Processes["orders"]; p == nil || p.Child == nil {
+		t.Fatal("Expected Expand to leave the DFD untouched")
+	}
+
+	var names []string
+	for _, n := range allElements(expanded) {
+		names = append(names, describeElement(n))
+	}
+	if got, want := strings.Join(names, ", "), `external service "Customer", data store "DB", process "Store", process "Validate"`; got != want {
+		t.Errorf("Expected elements %s, got %s", want, got)
+	}
+	tb := expanded.BoundaryOf("validate")
+	if tb == nil || tb.Name != "Orders" || expanded.BoundaryOf("customer") != nil {
+		t.Errorf("Expected the child elements in trust boundary \"Orders\" and its context outside, got %v", tb)
+	}
+	var flows []string
+	for _, f := range sortedFlows(expanded) {
+		flows = append(flows, nodeName(f.From().(DfdNode))+" -> "+nodeName(f.To().(DfdNode)))
+	}
+	if got, want := strings.Join(flows, ", "), "Customer -> Validate, Validate -> Customer, Store -> DB, Validate -> Store"; got != want {
+		t.Errorf("Expected flows %s, got %s", want, got)
+	}
+	if _, err := expanded.ToDOT(); err != nil {
+		t.Errorf("Unexpected error encoding the expanded DFD: %v", err)
+	}
+}
@@ -0,0 +1,415 @@
+package dfd
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gonum.org/v1/gonum/graph"
+)
+
+// MergeOptions controls how Merge unifies the elements of several DFDs.
+type MergeOptions struct {
+	// Name is the name of the merged DFD, by default that of the first one.
+	Name string
+	// MatchNames unifies trust boundaries, and elements of the same kind,
+	// whose names have the same slug (e.g. "Web Server" and "web-server")
+	// when their IDs differ, as long as the match is unambiguous.
+	MatchNames bool
+}
+
+// Conflict is a disagreement between DFDs passed to Merge about an element,
+// trust boundary or flow that they share. The merged DFD keeps the value of
+// the first DFD that set it.
+type Conflict struct {
+	// Kind is one of YAMLProcess, YAMLExternalService, YAMLDataStore,
+	// ChangeTrustBoundary or ChangeFlow.
+	Kind string `json:"kind" yaml:"kind"`
+	// ID is the DOT ID in the merged DFD, or flow_<id> for a flow.
+	ID   string `json:"id" yaml:"id"`
+	Name string `json:"name" yaml:"name"`
+	// Field is what differs: "kind", "name", "boundary", "parent",
+	// "properties" or "direction".
+	Field string `json:"field" yaml:"field"`
+	// Kept is the value in the merged DFD and Other the one in the DFD at
+	// index Diagram of the arguments to Merge. Trust boundaries are described
+	// by name, or as "outside all trust boundaries".
+	Kept    string `json:"kept" yaml:"kept"`
+	Other   string `json:"other" yaml:"other"`
+	Diagram int    `json:"diagram" yaml:"diagram"`
+}
+
+func (c Conflict) String() string {
+	what := fmt.Sprintf("%s %q", strings.Replace(c.Kind, "_", " ", -1), c.Name)
+	kept, other := strconv.Quote(c.Kept), strconv.Quote(c.Other)
+	if c.Field == "boundary" || c.Field == "parent" {
+		kept, other = c.Kept, c.Other
+	}
+	return fmt.Sprintf("%s (%s): %s %s kept over %s from diagram %d", what, c.ID, c.Field, kept, other, c.Diagram)
+}
+
+// Merge combines several DFDs, for instance one per service, into a new
+// system-level DFD. Elements and trust boundaries with the same ID are
+// unified, and so are those with matching names if opts.MatchNames is set.
+// Trust boundaries, elements and flows are otherwise unioned, and tags of
+// unified elements too.
+//
+// Where unified elements disagree the first value is kept and a Conflict
+// reported, except for empty names and properties, which later DFDs fill in.
+// Elements sharing an ID but not a kind are both kept, the later one with a
+// new ID. The inputs are left untouched. An element that is not a Process,
+// ExternalService or DataStore yields an *UnknownElementError.
+func Merge(opts MergeOptions, dfds ...*DataFlowDiagram) (*DataFlowDiagram, []Conflict, error) {
+	name := opts.Name
+	if name == "" && len(dfds) > 0 {
+		name = dfds[0].Name
+	}
+	m := &merger{dfd: InitializeDFD(name), opts: opts}
+	for i, src := range dfds {
+		if err := m.merge(i, src, nil); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	sort.SliceStable(m.conflicts, func(i, j int) bool {
+		a, b := m.conflicts[i], m.conflicts[j]
+		if changeOrder[a.Kind] != changeOrder[b.Kind] {
+			return changeOrder[a.Kind] < changeOrder[b.Kind]
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		return a.Diagram < b.Diagram
+	})
+	return m.dfd, m.conflicts, nil
+}
+
+type merger struct {
+	dfd       *DataFlowDiagram
+	opts      MergeOptions
+	conflicts []Conflict
+	// Mappings from the trust boundaries and element IDs of the DFD being
+	// merged to those of the merged DFD.
+	boundaries map[*TrustBoundary]*TrustBoundary
+	elements   map[string]DfdNode
+	diagram    int
+}
+
+func (m *merger) conflict(c Conflict) {
+	c.Diagram = m.diagram
+	m.conflicts = append(m.conflicts, c)
+}
+
+// merge merges the DFD at index i of the arguments to Merge. Its top level
+// elements and trust boundaries are placed in root, or at the top level if
+// root is nil.
+func (m *merger) merge(i int, src *DataFlowDiagram, root *TrustBoundary) error {
+	m.diagram = i
+	m.boundaries = map[*TrustBoundary]*TrustBoundary{nil: root}
+	m.elements = map[string]DfdNode{}
+
+	var walk func(tbs []*TrustBoundary)
+	walk = func(tbs []*TrustBoundary) {
+		for _, tb := range tbs {
+			m.mergeBoundary(tb)
+			walk(sortedBoundaries(tb.TrustBoundaries))
+		}
+	}
+	walk(topLevelBoundaries(src))
+
+	for _, n := range allElements(src) {
+		if err := m.mergeElement(n, src.BoundaryOf(n.ExternalID())); err != nil {
+			return err
+		}
+	}
+	for _, n := range topLevelElements(src) {
+		if _, ok := m.elements[n.ExternalID()]; !ok {
+			if err := m.mergeElement(n, nil); err != nil {
+				return err
+			}
+		}
+	}
+	flows := map[string]*Flow{}
+	for _, f := range sortedFlows(src) {
+		flows[f.id] = m.mergeFlow(f)
+	}
+	// Responses keep their request, unless the merged flows were already
+	// paired otherwise.
+	for _, f := range sortedFlows(src) {
+		resp, req := flows[f.id], flows[f.responseTo]
+		if resp != nil && req != nil && resp.responseTo == "" {
+			m.dfd.SetResponse(resp.id, req.id)
+		}
+	}
+	return nil
+}
+
+func (m *merger) mergeBoundary(tb *TrustBoundary) {
+	parent := m.boundaries[tb.parent]
+	merged, ok := m.dfd.TrustBoundaries[tb.ExternalID()]
+	if !ok && m.opts.MatchNames {
+		var matches []*TrustBoundary
+		for _, other := range sortedTrustBoundaries(m.dfd) {
+			if slugify(other.Name) == slugify(tb.Name) {
+				matches = append(matches, other)
+			}
+		}
+		if len(matches) == 1 {
+			merged, ok = matches[0], true
+		}
+	}
+	if !ok {
+		var parentID string
+		if parent != nil {
+			parentID = parent.ExternalID()
+		}
+		var err error
+		if merged, err = m.dfd.AddTrustBoundaryWithID(tb.ExternalID(), tb.Name, parentID); err != nil {
+			// The ID is free, as boundaries are matched by ID first, but
+			// may be malformed.
+			merged, _ = m.dfd.AddTrustBoundaryWithID(m.dfd.NewID(tb.Name), tb.Name, parentID)
+		}
+		m.boundaries[tb] = merged
+		return
+	}
+	m.boundaries[tb] = merged
+
+	c := Conflict{Kind: ChangeTrustBoundary, ID: merged.DOTID(), Name: merged.Name}
+	if merged.Name == "" {
+		merged.UpdateName(tb.Name)
+	} else if tb.Name != "" && tb.Name != merged.Name {
+		c.Field, c.Kept, c.Other = "name", merged.Name, tb.Name
+		m.conflict(c)
+	}
+	if merged.parent != parent {
+		c.Field, c.Kept, c.Other = "parent", boundaryName(merged.parent), boundaryName(parent)
+		m.conflict(c)
+	}
+}
+
+func (m *merger) mergeElement(n DfdNode, tb *TrustBoundary) error {
+	if propertiesOf(n) == nil {
+		return &UnknownElementError{Kind: "element type", Type: fmt.Sprintf("%T", n)}
+	}
+	boundary := m.boundaries[tb]
+	merged := m.findElement(n)
+	if merged == nil {
+		id := n.ExternalID()
+		if existing, ok := m.dfd.FindNode(id).(DfdNode); ok {
+			m.conflict(Conflict{Kind: elementKind(existing), ID: existing.DOTID(), Name: nodeName(existing), Field: "kind", Kept: elementKind(existing), Other: elementKind(n)})
+			id = m.dfd.NewID(nodeName(n))
+		}
+		var err error
+		if merged, err = copyElement(n, id); err != nil {
+			return err
+		}
+		var boundaryID string
+		if boundary != nil {
+			boundaryID = boundary.ExternalID()
+		}
+		if err := m.dfd.AddElement(merged, boundaryID); err != nil {
+			// The ID is malformed or collides with another one once
+			// hashed.
+			if merged, err = copyElement(n, m.dfd.NewID(nodeName(n))); err != nil {
+				return err
+			}
+			if err := m.dfd.AddElement(merged, boundaryID); err != nil {
+				return err
+			}
+		}
+		m.elements[n.ExternalID()] = merged
+		return nil
+	}
+	m.elements[n.ExternalID()] = merged
+
+	c := Conflict{Kind: elementKind(merged), ID: merged.DOTID(), Name: nodeName(merged)}
+	if nodeName(merged) == "" {
+		merged.UpdateName(nodeName(n))
+	} else if nodeName(n) != "" && nodeName(n) != nodeName(merged) {
+		c.Field, c.Kept, c.Other = "name", nodeName(merged), nodeName(n)
+		m.conflict(c)
+	}
+	if kept := m.dfd.BoundaryOf(merged.ExternalID()); kept != boundary {
+		c.Field, c.Kept, c.Other = "boundary", boundaryName(kept), boundaryName(boundary)
+		m.conflict(c)
+	}
+	kept, other := propertiesOf(merged), propertiesOf(n)
+	if kept.IsZero() {
+		setProperties(merged, other)
+	} else if kp, op := describeAttributes(kept.attributes()), describeAttributes(other.attributes()); !other.IsZero() && kp != op {
+		c.Field, c.Kept, c.Other = "properties", kp, op
+		m.conflict(c)
+	}
+	t := merged.(tagged)
+	for _, tag := range n.(tagged).tags() {
+		if !containsString(t.tags(), tag) {
+			t.setTags(append(t.tags(), tag))
+		}
+	}
+	return nil
+}
+
+// findElement returns the element of the merged DFD that n represents, or
+// nil if there is none.
+func (m *merger) findElement(n DfdNode) DfdNode {
+	if existing, ok := m.dfd.FindNode(n.ExternalID()).(DfdNode); ok {
+		if elementKind(existing) == elementKind(n) {
+			return existing
+		}
+		return nil
+	}
+	if !m.opts.MatchNames {
+		return nil
+	}
+	return matchName(allElements(m.dfd), n)
+}
+
+// matchName returns the only element among candidates of the same kind as n
+// whose name has the same slug, or nil if there is no such element or more
+// than one.
+func matchName(candidates []DfdNode, n DfdNode) DfdNode {
+	var matches []DfdNode
+	for _, other := range candidates {
+		if elementKind(other) == elementKind(n) && slugify(nodeName(other)) == slugify(nodeName(n)) {
+			matches = append(matches, other)
+		}
+	}
+	if len(matches) == 1 {
+		return matches[0]
+	}
+	return nil
+}
+
+// mergeFlow merges a flow and returns the flow it was merged into, or nil if
+// there is none.
+func (m *merger) mergeFlow(f *Flow) *Flow {
+	from := m.elements[f.From().(DfdNode).ExternalID()]
+	to := m.elements[f.To().(DfdNode).ExternalID()]
+	if from == nil || to == nil || from == to {
+		// Flows between two elements that were unified have nowhere to go.
+		return nil
+	}
+	id := mergedFlowID(f, from.(graph.Node), to.(graph.Node))
+	merged := matchFlow(m.dfd.FlowsBetween(from.(graph.Node), to.(graph.Node)), id, f.Name)
+	if merged == nil {
+		var err error
+		if merged, err = m.dfd.AddFlowWithID(id, from.(graph.Node), to.(graph.Node), f.Name); err != nil {
+			// The ID is taken by a flow between other elements.
+			merged = m.dfd.AddFlow(from.(graph.Node), to.(graph.Node), f.Name)
+		}
+		merged.Dir = f.Dir
+		merged.setProperties(f.Properties)
+		return merged
+	}
+
+	c := Conflict{Kind: ChangeFlow, ID: "flow_" + merged.ExternalID(), Name: merged.Name}
+	if merged.Name == "" {
+		merged.Name = f.Name
+		merged.setProperties(merged.Properties)
+	} else if f.Name != "" && f.Name != merged.Name {
+		c.Field, c.Kept, c.Other = "name", merged.Name, f.Name
+		m.conflict(c)
+	}
+	if kd, od := unquoteDOT(merged.Dir), unquoteDOT(f.Dir); kd != od {
+		c.Field, c.Kept, c.Other = "direction", kd, od
+		m.conflict(c)
+	}
+	if merged.Properties.IsZero() {
+		merged.setProperties(f.Properties)
+	} else if kp, op := describeAttributes(merged.Properties.attributes()), describeAttributes(f.Properties.attributes()); !f.Properties.IsZero() && kp != op {
+		c.Field, c.Kept, c.Other = "properties", kp, op
+		m.conflict(c)
+	}
+	return merged
+}
+
+// mergedFlowID returns the ID the flow f takes in the merged DFD, where it
+// goes from the element from to the element to. IDs derived from the ends of
+// f, as given by AddFlow, are derived from the merged ends instead.
+func mergedFlowID(f *Flow, from, to graph.Node) string {
+	src := genFlowID(f.From(), f.To())
+	switch {
+	case f.id == src:
+		return genFlowID(from, to)
+	case strings.HasPrefix(f.id, src+"-"):
+		return genFlowID(from, to) + strings.TrimPrefix(f.id, src)
+	}
+	return f.id
+}
+
+// matchFlow returns the flow among flows between the same ends that a
+// merged flow with the given ID and name is unified with: the one with the
+// same name, or else the one with the same ID, or nil if there is none.
+func matchFlow(flows []*Flow, id, name string) *Flow {
+	if name != "" {
+		for _, f := range flows {
+			if f.Name == name {
+				return f
+			}
+		}
+	}
+	for _, f := range flows {
+		if f.id == id {
+			return f
+		}
+	}
+	return nil
+}
+
+// copyElement returns a copy of an element with the given ID. Errors are
+// *UnknownElementError.
+func copyElement(n DfdNode, id string) (DfdNode, error) {
+	var c DfdNode
+	var src, dst *dotNode
+	switch n := n.(type) {
+	case *Process:
+		p := DeserializeProcess(id)
+		p.UpdateName(n.Name)
+		p.Properties = n.Properties
+		p.Child = n.Child
+		c, src, dst = p, n.dotNode, p.dotNode
+	case *ExternalService:
+		es := DeserializeExternalService(id)
+		es.UpdateName(n.Name)
+		es.Properties = n.Properties
+		c, src, dst = es, n.dotNode, es.dotNode
+	case *DataStore:
+		ds := DeserializeDataStore(id)
+		ds.UpdateName(n.Name)
+		ds.Properties = n.Properties
+		ds.Properties.Classifications = append([]DataClassification(nil), n.Properties.Classifications...)
+		c, src, dst = ds, n.dotNode, ds.dotNode
+	default:
+		return nil, &UnknownElementError{Kind: "element type", Type: fmt.Sprintf("%T", n)}
+	}
+	dst.Style, dst.Dir = src.Style, src.Dir
+	dst.Tags = append([]string(nil), src.Tags...)
+	return c, nil
+}
+
+// setProperties sets the properties of an element to a copy of p, which
+// must be of the matching type.
+func setProperties(n DfdNode, p elementProperties) {
+	switch n := n.(type) {
+	case *Process:
+		n.Properties = *p.(*ProcessProperties)
+	case *ExternalService:
+		n.Properties = *p.(*ExternalServiceProperties)
+	case *DataStore:
+		n.Properties = *p.(*DataStoreProperties)
+		n.Properties.Classifications = append([]DataClassification(nil), n.Properties.Classifications...)
+	}
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package dfd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gonum.org/v1/gonum/graph"
+	"gonum.org/v1/gonum/graph/simple"
+)
+
+const testYAMLOrders = `version: 1
+name: Orders
+trust_boundaries:
+  aws:
+    name: AWS
+    elements:
+      api:
+        kind: process
+        name: API
+        properties: {runtime: go1.12}
+      db:
+        kind: data_store
+        name: Orders DB
+flows:
+  - from: api
+    to: db
+    name: SQL
+`
+
+const testYAMLPayments = `version: 1
+name: Payments
+elements:
+  stripe:
+    kind: external_service
+    name: Stripe
+  db:
+    kind: data_store
+    name: Orders DB
+    properties: {encrypted_at_rest: true}
+trust_boundaries:
+  aws:
+    name: AWS
+    elements:
+      api:
+        kind: process
+        name: API
+        tags: [internet-facing]
+        properties: {runtime: python3}
+flows:
+  - from: api
+    to: stripe
+    name: HTTPS
+  - from: api
+    to: db
+    name: Queries
+`
+
+func TestMerge(t *testing.T) {
+	orders, err := DecodeYAML(strings.NewReader(testYAMLOrders))
+	if err != nil {
+		t.Fatal(err)
+	}
+	payments, err := DecodeYAML(strings.NewReader(testYAMLPayments))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, conflicts, err := Merge(MergeOptions{Name: "Shop"}, orders, payments)
+	if err != nil {
+		t.Fatalf("Unexpected error merging: %v", err)
+	}
+	if merged.Name != "Shop" || len(merged.TrustBoundaries) != 1 || len(merged.Flows) != 2 {
+		t.Fatalf("Expected Shop with 1 trust boundary and 2 flows, got %s with %d and %d", merged.Name, len(merged.TrustBoundaries), len(merged.Flows))
+	}
+	api := merged.FindNode("api").(*Process)
+	if api.Properties.Runtime != "go1.12" || !reflect.DeepEqual(api.Tags, []string{"internet-facing"}) {
+		t.Errorf("Expected the first runtime and the union of tags, got %+v and %v", api.Properties, api.Tags)
+	}
+	db := merged.FindNode("db").(*DataStore)
+	if !db.Properties.EncryptedAtRest || merged.BoundaryOf(db.ExternalID()) == nil {
+		t.Errorf("Expected properties to be filled in and the first trust boundary kept, got %+v in %v", db.Properties, merged.BoundaryOf(db.ExternalID()))
+	}
+	if len(merged.ExternalServices) != 1 {
+		t.Errorf("Expected Stripe at the top level, got %v", merged.ExternalServices)
+	}
+
+	var got []string
+	for _, c := range conflicts {
+		got = append(got, c.String())
+	}
+	want := []string{
+		`process "API" (process_api): properties "runtime=go1.12" kept over "runtime=python3" from diagram 1`,
+		`data store "Orders DB" (datastore_db): boundary trust boundary "AWS" kept over outside all trust boundaries from diagram 1`,
+		`flow "SQL" (flow_` + genFlowID(api, db) + `): name "SQL" kept over "Queries" from diagram 1`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected conflicts:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+
+	// The inputs are untouched.
+	if len(orders.Flows) != 1 || orders.FindNode("api").(*Process).Tags != nil {
+		t.Error("Expected Merge to leave its inputs untouched")
+	}
+}
+
+func TestMergeByName(t *testing.T) {
+	a := InitializeDFD("A")
+	ws := NewProcess("Web Server")
+	a.AddNodeElem(ws)
+	b := InitializeDFD("B")
+	ws2 := NewProcess("web server")
+	b.AddNodeElem(ws2)
+	clash := DeserializeDataStore(ws.ExternalID())
+	clash.UpdateName("Logs")
+	b.AddNodeElem(clash)
+	b.AddFlow(ws2, clash, "TCP")
+
+	merged, conflicts, err := Merge(MergeOptions{}, a, b)
+	if err != nil {
+		t.Fatalf("Unexpected error merging: %v", err)
+	}
+	if len(merged.Processes) != 2 || len(merged.DataStores) != 1 {
+		t.Errorf("Expected both web servers and the data store without name matching, got %d processes and %d data stores", len(merged.Processes), len(merged.DataStores))
+	}
+	if len(conflicts) != 1 || conflicts[0].Field != "kind" {
+		t.Errorf("Expected a kind conflict, got %v", conflicts)
+	}
+
+	if merged, _, err = Merge(MergeOptions{MatchNames: true}, a, b); err != nil {
+		t.Fatalf("Unexpected error merging: %v", err)
+	}
+	if len(merged.Processes) != 1 || len(merged.DataStores) != 1 || len(merged.Flows) != 1 {
+		t.Errorf("Expected the web servers to be unified, got %d processes, %d data stores and %d flows", len(merged.Processes), len(merged.DataStores), len(merged.Flows))
+	}
+	if merged.Name != "A" {
+		t.Errorf("Expected the name of the first diagram, got %s", merged.Name)
+	}
+}
+
+// unknownElement is an element of a kind that Merge does not know.
+type unknownElement struct{ graph.Node }
+
+func (unknownElement) ExternalID() string { return "unknown" }
+func (unknownElement) UpdateName(string)  {}
+func (unknownElement) DOTID() string      { return "unknown_unknown" }
+
+func TestMergeUnknownElement(t *testing.T) {
+	a := InitializeDFD("A")
+	api := NewProcess("API")
+	a.AddNodeElem(api)
+	a.AddFlow(unknownElement{simple.Node(idToID64("unknown"))}, api, "Calls")
+
+	_, _, err := Merge(MergeOptions{}, a)
+	if _, ok := err.(*UnknownElementError); !ok {
+		t.Errorf("Expected an *UnknownElementError, got %T (%v)", err, err)
+	}
+
+	parent := InitializeDFD("Parent")
+	p := NewProcess("Decomposed")
+	p.Child = a
+	parent.AddNodeElem(p)
+	_, err = Expand(parent)
+	if _, ok := err.(*UnknownElementError); !ok {
+		t.Errorf("Expected an *UnknownElementError expanding, got %T (%v)", err, err)
+	}
+}
+
+func TestMergeElementAddError(t *testing.T) {
+	// The merged boundary is not in the merged diagram, so adding the
+	// element fails again with a new ID.
+	src, gone := DeserializeTrustBoundary("aws"), DeserializeTrustBoundary("gone")
+	m := &merger{
+		dfd:        InitializeDFD("Merged"),
+		boundaries: map[*TrustBoundary]*TrustBoundary{src: gone},
+		elements:   map[string]DfdNode{},
+	}
+	err := m.mergeElement(NewProcess("API"), src)
+	if ref, ok := err.(*ReferenceError); !ok || ref.ID != "gone" {
+		t.Errorf("Expected a *ReferenceError for the missing trust boundary, got %T (%v)", err, err)
+	}
+	if len(m.elements) != 0 {
+		t.Errorf("Expected no merged element, got %v", m.elements)
+	}
+}
@@ -0,0 +1,107 @@
+package dfd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// EncodeMermaid writes dfd to w as a Mermaid flowchart. Trust boundaries
+// become dashed subgraphs, processes circles, external services rhombi, data
+// stores cylinders and flows labeled arrows.
+func EncodeMermaid(w io.Writer, dfd *DataFlowDiagram) error {
+	var buf bytes.Buffer
+	if dfd.Name != "" {
+		fmt.Fprintf(&buf, "---\ntitle: %s\n---\n", mermaidTitle(dfd.Name))
+	}
+	buf.WriteString("%%{init: {\"themeVariables\": {\"fontFamily\": \"Arial\"}}}%%\n")
+	fmt.Fprintf(&buf, "flowchart %s\n", rankdir(dfd))
+	buf.WriteString("\tclassDef trustBoundary fill:none,stroke:#595959,color:#595959,stroke-dasharray:5 5,font-size:10px\n")
+
+	writeMermaidBoundaries(&buf, topLevelBoundaries(dfd), "\t")
+	for _, n := range topLevelElements(dfd) {
+		fmt.Fprintf(&buf, "\t%s\n", mermaidNode(n))
+	}
+	for _, f := range sortedFlows(dfd) {
+		fmt.Fprintf(&buf, "\t%s\n", mermaidFlow(f))
+	}
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return &IOError{Op: "write", Err: err}
+	}
+	return nil
+}
+
+// writeMermaidBoundaries writes trust boundaries as subgraphs, along with the
+// trust boundaries nested in them.
+func writeMermaidBoundaries(buf *bytes.Buffer, tbs []*TrustBoundary, indent string) {
+	for _, tb := range tbs {
+		fmt.Fprintf(buf, "%ssubgraph %s[%s]\n", indent, identifier(tb.DOTID()), mermaidLabel(tb.Name))
+		writeMermaidBoundaries(buf, sortedBoundaries(tb.TrustBoundaries), indent+"\t")
+		for _, n := range sortedElements(tb.Processes, tb.ExternalServices, tb.DataStores) {
+			fmt.Fprintf(buf, "%s\t%s\n", indent, mermaidNode(n))
+		}
+		fmt.Fprintf(buf, "%send\n", indent)
+		fmt.Fprintf(buf, "%sclass %s trustBoundary\n", indent, identifier(tb.DOTID()))
+	}
+}
+
+// ToMermaid returns the DFD as a Mermaid flowchart.
+func (dfd *DataFlowDiagram) ToMermaid() (string, error) {
+	var buf bytes.Buffer
+	if err := EncodeMermaid(&buf, dfd); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func mermaidNode(n DfdNode) string {
+	label := mermaidLabel(nodeName(n))
+	switch n.(type) {
+	case *ExternalService:
+		return fmt.Sprintf("%s{%s}", identifier(n.DOTID()), label)
+	case *DataStore:
+		return fmt.Sprintf("%s[(%s)]", identifier(n.DOTID()), label)
+	default:
+		return fmt.Sprintf("%s((%s))", identifier(n.DOTID()), label)
+	}
+}
+
+func mermaidFlow(f *Flow) string {
+	from, to := identifier(f.From().(DfdNode).DOTID()), identifier(f.To().(DfdNode).DOTID())
+	// Responses are dotted.
+	arrow, dotted := "-->", "-.->"
+	switch unquoteDOT(f.Dir) {
+	case "both":
+		arrow, dotted = "<-->", "<-.->"
+	case "none":
+		arrow, dotted = "---", "-.-"
+	case "back":
+		from, to = to, from
+	}
+	if f.responseTo != "" {
+		arrow = dotted
+	}
+	if f.Name == "" {
+		return fmt.Sprintf("%s %s %s", from, arrow, to)
+	}
+	return fmt.Sprintf("%s %s|%s| %s", from, arrow, mermaidLabel(f.Name), to)
+}
+
+var mermaidEscaper = strings.NewReplacer(
+	"#", "#35;",
+	`"`, "#quot;",
+	"<", "#lt;",
+	">", "#gt;",
+	"\n", "<br>",
+)
+
+// mermaidLabel quotes a label, escaping characters with a meaning in Mermaid.
+func mermaidLabel(s string) string {
+	return `"` + mermaidEscaper.Replace(s) + `"`
+}
+
+func mermaidTitle(s string) string {
+	return strings.Replace(strings.Replace(s, "\n", " ", -1), "---", "- - -", -1)
+}
@@ -0,0 +1,84 @@
+package dfd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"gonum.org/v1/gonum/graph/encoding"
+)
+
+func TestToMermaid(t *testing.T) {
+	dfd := InitializeDFD("WebApp Thing")
+	google := DeserializeExternalService("1")
+	google.UpdateName("Google Analytics")
+	dfd.AddNodeElem(google)
+
+	tb := DeserializeTrustBoundary("2")
+	tb.UpdateName("AWS")
+	dfd.TrustBoundaries["2"] = tb
+	ws := DeserializeProcess("3")
+	ws.UpdateName("Web Server")
+	tb.AddNodeElem(ws)
+	subnet := DeserializeTrustBoundary("5")
+	subnet.UpdateName("Subnet")
+	dfd.TrustBoundaries["5"] = subnet
+	tb.addTrustBoundary(subnet)
+	logs := DeserializeDataStore("4")
+	logs.UpdateName(`"Logs" <#1>`)
+	subnet.AddNodeElem(logs)
+
+	dfd.AddFlow(ws, logs, "TCP")
+	dfd.AddFlow(ws, google, "")
+	dfd.AddFlow(google, ws, "HTTPS").Dir = "both"
+
+	actual, err := dfd.ToMermaid()
+	if err != nil {
+		t.Fatalf("Unexpected error generating Mermaid: %v", err)
+	}
+	if strings.TrimSpace(actual) != strings.TrimSpace(testMermaid) {
+		t.Errorf("Returned Mermaid does not match the expected flowchart, got:\n%s", actual)
+	}
+}
+
+func TestRankdir(t *testing.T) {
+	cases := []struct {
+		rankdir, direction string
+	}{
+		{`"t"`, "TB"},
+		{"LR", "LR"},
+		{`"rl"`, "RL"},
+		{"BT", "BT"},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("Mapping rankdir %s", c.rankdir), func(t *testing.T) {
+			dfd := DeserializeDFD("1")
+			dfd.graph.SetAttribute(encoding.Attribute{Key: "rankdir", Value: c.rankdir})
+			if actual := rankdir(dfd); actual != c.direction {
+				t.Errorf("Expected %s, got %s", c.direction, actual)
+			}
+		})
+	}
+}
+
+const testMermaid = `
+---
+title: WebApp Thing
+---
+%%{init: {"themeVariables": {"fontFamily": "Arial"}}}%%
+flowchart TB
+	classDef trustBoundary fill:none,stroke:#595959,color:#595959,stroke-dasharray:5 5,font-size:10px
+	subgraph cluster_2["AWS"]
+		subgraph cluster_5["Subnet"]
+			datastore_4[("#quot;Logs#quot; #lt;#35;1#gt;")]
+		end
+		class cluster_5 trustBoundary
+		process_3(("Web Server"))
+	end
+	class cluster_2 trustBoundary
+	externalservice_1{"Google Analytics"}
+	process_3 --> externalservice_1
+	externalservice_1 <-->|"HTTPS"| process_3
+	process_3 -->|"TCP"| datastore_4
+`
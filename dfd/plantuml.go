@@ -0,0 +1,452 @@
+package dfd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gonum.org/v1/gonum/graph"
+)
+
+// PlantUML element types written for each kind of element. DecodePlantUML
+// also accepts the other element types listed in plantUMLKinds.
+const (
+	PlantUMLProcess         = "control"
+	PlantUMLExternalService = "actor"
+	PlantUMLDataStore       = "database"
+	PlantUMLTrustBoundary   = "rectangle"
+)
+
+// plantUMLKinds maps PlantUML element types onto DOT node types.
+var plantUMLKinds = map[string]string{
+	"control":     "process",
+	"usecase":     "process",
+	"circle":      "process",
+	"component":   "process",
+	"node":        "process",
+	"actor":       "externalservice",
+	"person":      "externalservice",
+	"agent":       "externalservice",
+	"boundary":    "externalservice",
+	"cloud":       "externalservice",
+	"entity":      "externalservice",
+	"interface":   "externalservice",
+	"rectangle":   "externalservice",
+	"database":    "datastore",
+	"storage":     "datastore",
+	"queue":       "datastore",
+	"stack":       "datastore",
+	"collections": "datastore",
+	"file":        "datastore",
+}
+
+// plantUMLGroups are the PlantUML element types that are read as trust
+// boundaries when they enclose other elements.
+var plantUMLGroups = map[string]bool{
+	"rectangle": true,
+	"package":   true,
+	"frame":     true,
+	"folder":    true,
+	"node":      true,
+	"cloud":     true,
+}
+
+// EncodePlantUML writes dfd to w as a PlantUML diagram. Trust boundaries
+// become dashed rectangles, processes controls, external services actors,
+// data stores databases and flows labeled arrows.
+func EncodePlantUML(w io.Writer, dfd *DataFlowDiagram) error {
+	var buf bytes.Buffer
+	buf.WriteString("@startuml\n")
+	if dfd.Name != "" {
+		fmt.Fprintf(&buf, "title %s\n", plantUMLEscape(dfd.Name))
+	}
+	buf.WriteString("skinparam defaultFontName Arial\n")
+	if rankdir(dfd) == "LR" {
+		buf.WriteString("left to right direction\n")
+	} else {
+		buf.WriteString("top to bottom direction\n")
+	}
+
+	writePlantUMLBoundaries(&buf, topLevelBoundaries(dfd), "")
+	for _, n := range sortPlantUMLElements(topLevelElements(dfd)) {
+		fmt.Fprintf(&buf, "%s\n", plantUMLElement(n))
+	}
+	for _, f := range sortPlantUMLFlows(sortedFlows(dfd)) {
+		fmt.Fprintf(&buf, "%s\n", plantUMLFlow(f))
+	}
+	buf.WriteString("@enduml\n")
+
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		return &IOError{Op: "write", Err: err}
+	}
+	return nil
+}
+
+// writePlantUMLBoundaries writes trust boundaries ordered by name, then
+// alias, along with the trust boundaries nested in them.
+func writePlantUMLBoundaries(buf *bytes.Buffer, tbs []*TrustBoundary, indent string) {
+	sort.SliceStable(tbs, func(i, j int) bool {
+		if tbs[i].Name != tbs[j].Name {
+			return tbs[i].Name < tbs[j].Name
+		}
+		return plantUMLBoundaryAlias(tbs[i]) < plantUMLBoundaryAlias(tbs[j])
+	})
+	for _, tb := range tbs {
+		fmt.Fprintf(buf, "%s%s \"%s\" as %s #line.dashed;line:595959;text:595959 {\n", indent, PlantUMLTrustBoundary, plantUMLEscape(tb.Name), plantUMLBoundaryAlias(tb))
+		writePlantUMLBoundaries(buf, sortedBoundaries(tb.TrustBoundaries), indent+"\t")
+		for _, n := range sortPlantUMLElements(sortedElements(tb.Processes, tb.ExternalServices, tb.DataStores)) {
+			fmt.Fprintf(buf, "%s\t%s\n", indent, plantUMLElement(n))
+		}
+		fmt.Fprintf(buf, "%s}\n", indent)
+	}
+}
+
+// ToPlantUML returns the DFD as a PlantUML diagram.
+func (dfd *DataFlowDiagram) ToPlantUML() (string, error) {
+	var buf bytes.Buffer
+	if err := EncodePlantUML(&buf, dfd); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func plantUMLElement(n DfdNode) string {
+	kind := PlantUMLProcess
+	switch n.(type) {
+	case *ExternalService:
+		kind = PlantUMLExternalService
+	case *DataStore:
+		kind = PlantUMLDataStore
+	}
+	var stereotypes string
+	if t, ok := n.(tagged); ok {
+		for _, tag := range t.tags() {
+			stereotypes += " <<" + plantUMLTagEscaper.Replace(tag) + ">>"
+		}
+	}
+	return fmt.Sprintf("%s \"%s\" as %s%s", kind, plantUMLEscape(nodeName(n)), plantUMLAlias(n), stereotypes)
+}
+
+// plantUMLAlias returns the alias an element was decoded with, or its DOT ID.
+func plantUMLAlias(n DfdNode) string {
+	if k, ok := n.(keyed); ok && k.getKey() != "" {
+		return k.getKey()
+	}
+	return identifier(n.DOTID())
+}
+
+// plantUMLBoundaryAlias returns the alias a trust boundary was decoded with,
+// or its DOT ID.
+func plantUMLBoundaryAlias(tb *TrustBoundary) string {
+	if tb.key != "" {
+		return tb.key
+	}
+	return identifier(tb.DOTID())
+}
+
+// sortPlantUMLElements orders elements by kind, then name, then alias, as
+// decoding assigns new IDs but keeps aliases.
+func sortPlantUMLElements(elems []DfdNode) []DfdNode {
+	sort.SliceStable(elems, func(i, j int) bool {
+		return lessElementBy(elems[i], elems[j], plantUMLAlias)
+	})
+	return elems
+}
+
+// sortPlantUMLFlows orders flows by name, then source, then destination,
+// ordering their ends as sortPlantUMLElements does.
+func sortPlantUMLFlows(flows []*Flow) []*Flow {
+	sort.SliceStable(flows, func(i, j int) bool {
+		a, b := flows[i], flows[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		af, bf := a.From().(DfdNode), b.From().(DfdNode)
+		if plantUMLAlias(af) != plantUMLAlias(bf) {
+			return lessElementBy(af, bf, plantUMLAlias)
+		}
+		return lessElementBy(a.To().(DfdNode), b.To().(DfdNode), plantUMLAlias)
+	})
+	return flows
+}
+
+func plantUMLFlow(f *Flow) string {
+	from, to := plantUMLAlias(f.From().(DfdNode)), plantUMLAlias(f.To().(DfdNode))
+	arrow := "-->"
+	switch unquoteDOT(f.Dir) {
+	case "both":
+		arrow = "<-->"
+	case "none":
+		arrow = "--"
+	case "back":
+		arrow = "<--"
+	}
+	if f.responseTo != "" {
+		// Responses are dashed.
+		arrow = strings.Replace(arrow, "--", "..", 1)
+	}
+	if f.Name == "" {
+		return fmt.Sprintf("%s %s %s", from, arrow, to)
+	}
+	return fmt.Sprintf("%s %s %s : %s", from, arrow, to, plantUMLEscape(f.Name))
+}
+
+var (
+	plantUMLEscaper = strings.NewReplacer(
+		`\`, "<U+005C>",
+		`"`, "<U+0022>",
+		"\n", `\n`,
+	)
+	plantUMLUnescaper = strings.NewReplacer(
+		"<U+005C>", `\`,
+		"<U+0022>", `"`,
+		"<U+0020>", " ",
+		`\n`, "\n",
+	)
+	// Tags are written as stereotypes, which end at the first >, so the
+	// characters that could end them early are percent-encoded.
+	plantUMLTagEscaper = strings.NewReplacer(
+		"%", "%25",
+		"<", "%3C",
+		">", "%3E",
+		"\n", "%0A",
+	)
+	plantUMLTagUnescaper = strings.NewReplacer(
+		"%25", "%",
+		"%3C", "<",
+		"%3E", ">",
+		"%0A", "\n",
+	)
+)
+
+// plantUMLEscape escapes characters that cannot appear in a PlantUML label,
+// including leading and trailing spaces which PlantUML would trim.
+func plantUMLEscape(s string) string {
+	s = plantUMLEscaper.Replace(s)
+	trimmed := strings.TrimLeft(s, " ")
+	s = strings.Repeat("<U+0020>", len(s)-len(trimmed)) + trimmed
+	trimmed = strings.TrimRight(s, " ")
+	return trimmed + strings.Repeat("<U+0020>", len(s)-len(trimmed))
+}
+
+func plantUMLUnescape(s string) string {
+	return plantUMLUnescaper.Replace(s)
+}
+
+var (
+	// keyword "label" as alias, keyword alias as "label" or keyword alias,
+	// optionally followed by stereotypes, a color and an opening brace.
+	// Stereotypes of elements become tags.
+	plantUMLElementRE    = regexp.MustCompile(`^([a-z]+)\s+("[^"]*"|[^\s"{]+)(?:\s+as\s+("[^"]*"|[^\s"{]+))?((?:\s*<<[^>]*>>)*)(?:\s+#\S+)?\s*(\{)?$`)
+	plantUMLStereotypeRE = regexp.MustCompile(`<<([^>]*)>>`)
+	// from arrow to : label, where the arrow may carry a style and direction
+	// such as -[#red]-> or -up->.
+	plantUMLFlowRE = regexp.MustCompile(`^("[^"]*"|[^\s"]+)\s*(<)?([-.=]+(?:\[[^\]]*\])?(?:up|down|left|right|u|d|l|r)?[-.=]*)(>)?\s*("[^"]*"|[^\s":]+)\s*(?::\s*(.*))?$`)
+	// Statements that do not affect the structure of the diagram.
+	plantUMLIgnoredRE = regexp.MustCompile(`^(?:@startuml|@enduml|'|!|skinparam\s|hide\s|show\s|top to bottom direction|scale\s|caption\s|header\s|footer\s)`)
+)
+
+type plantUMLDecoder struct {
+	dfd *DataFlowDiagram
+	// Elements by alias.
+	nodes map[string]graph.Node
+	// Stack of open groupings, the innermost last.
+	groups []*TrustBoundary
+	// Flows drawn with dashed arrows, which may be responses.
+	dashed []*Flow
+}
+
+// DecodePlantUML reads a PlantUML diagram from r and returns the DFD it
+// describes. Element types are mapped onto element kinds as listed in
+// plantUMLKinds, groupings become trust boundaries, possibly nested, and
+// arrows become flows. A dashed arrow is the response to the only solid, one-way
+// arrow going the other way, if there is one.
+// Errors are reported as a *ParseError carrying the offending line.
+func DecodePlantUML(r io.Reader) (*DataFlowDiagram, error) {
+	dec := &plantUMLDecoder{
+		dfd:   InitializeDFD(""),
+		nodes: map[string]graph.Node{},
+	}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	// Multi-line blocks that are skipped, and the line that ends them.
+	var skipUntil *regexp.Regexp
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if skipUntil != nil {
+			if skipUntil.MatchString(text) {
+				skipUntil = nil
+			}
+			continue
+		}
+		switch {
+		case text == "" || plantUMLIgnoredRE.MatchString(text):
+			if strings.HasPrefix(text, "skinparam") && strings.HasSuffix(text, "{") {
+				skipUntil = regexp.MustCompile(`^}$`)
+			}
+		case strings.HasPrefix(text, "/'"):
+			if !strings.HasSuffix(text, "'/") {
+				skipUntil = regexp.MustCompile(`'/$`)
+			}
+		case strings.HasPrefix(text, "note ") && !strings.Contains(text, ":"):
+			skipUntil = regexp.MustCompile(`^end\s?note$`)
+		case strings.HasPrefix(text, "note "):
+		case text == "legend" || strings.HasPrefix(text, "legend "):
+			skipUntil = regexp.MustCompile(`^endlegend$`)
+		case strings.HasPrefix(text, "title "):
+			dec.dfd.UpdateName(plantUMLUnescape(strings.TrimSpace(strings.TrimPrefix(text, "title "))))
+		case text == "left to right direction":
+			dec.setRankdir("LR")
+		case text == "}":
+			if len(dec.groups) == 0 {
+				return nil, &ParseError{Format: "PlantUML", Line: line, Err: errors.New("unbalanced }")}
+			}
+			dec.groups = dec.groups[:len(dec.groups)-1]
+		default:
+			if err := dec.statement(text); err != nil {
+				return nil, &ParseError{Format: "PlantUML", Line: line, Err: err}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, &IOError{Op: "read", Err: err}
+	}
+	if len(dec.groups) != 0 {
+		return nil, &ParseError{Format: "PlantUML", Line: line, Err: errors.New("missing }")}
+	}
+	dec.pairResponses()
+	return dec.dfd, nil
+}
+
+// pairResponses makes each dashed arrow the response to the solid, one-way
+// arrow going the other way, when there is exactly one that has no response
+// yet.
+func (dec *plantUMLDecoder) pairResponses() {
+	dashed := map[*Flow]bool{}
+	for _, f := range dec.dashed {
+		dashed[f] = true
+	}
+	for _, resp := range dec.dashed {
+		var requests []*Flow
+		for _, f := range dec.dfd.FlowsBetween(resp.To(), resp.From()) {
+			if !dashed[f] && !f.Bidirectional() && dec.dfd.ResponseOf(f) == nil {
+				requests = append(requests, f)
+			}
+		}
+		if len(requests) == 1 {
+			dec.dfd.SetResponse(resp.id, requests[0].id)
+		}
+	}
+}
+
+func (dec *plantUMLDecoder) setRankdir(dir string) {
+	for i, attr := range dec.dfd.graph {
+		if attr.Key == "rankdir" {
+			dec.dfd.graph[i] = makeAttribute("rankdir", dir)
+		}
+	}
+}
+
+func (dec *plantUMLDecoder) statement(text string) error {
+	if m := plantUMLElementRE.FindStringSubmatch(text); m != nil {
+		kind, isElement := plantUMLKinds[m[1]]
+		isGroup := m[5] == "{" && plantUMLGroups[m[1]]
+		if isElement || isGroup {
+			alias, label := m[2], m[2]
+			if m[3] != "" {
+				if strings.HasPrefix(m[2], `"`) {
+					alias = m[3]
+				} else {
+					label = m[3]
+				}
+			}
+			alias, label = strings.Trim(alias, `"`), plantUMLUnescape(strings.Trim(label, `"`))
+			if isGroup {
+				return dec.group(alias, label)
+			}
+			if m[5] == "{" {
+				return &UnknownElementError{Kind: "grouping", Type: m[1]}
+			}
+			var tags []string
+			for _, st := range plantUMLStereotypeRE.FindAllStringSubmatch(m[4], -1) {
+				tags = append(tags, plantUMLTagUnescaper.Replace(st[1]))
+			}
+			return dec.element(kind, alias, label, tags)
+		}
+	}
+	if m := plantUMLFlowRE.FindStringSubmatch(text); m != nil {
+		return dec.flow(m)
+	}
+	if fields := strings.Fields(text); len(fields) > 1 && plantUMLElementRE.MatchString(text) {
+		return &UnknownElementError{Kind: "PlantUML element type", Type: fields[0]}
+	}
+	return fmt.Errorf("unsupported statement %q", text)
+}
+
+func (dec *plantUMLDecoder) group(alias, label string) error {
+	tb := DeserializeTrustBoundary(keyID("boundary:" + alias))
+	if _, ok := dec.dfd.TrustBoundaries[tb.ExternalID()]; ok {
+		return &ReferenceError{ID: alias, Reason: "duplicate grouping alias"}
+	}
+	tb.UpdateName(label)
+	tb.key = alias
+	dec.dfd.registerTrustBoundary(tb)
+	if len(dec.groups) > 0 {
+		dec.groups[len(dec.groups)-1].addTrustBoundary(tb)
+	}
+	dec.groups = append(dec.groups, tb)
+	return nil
+}
+
+func (dec *plantUMLDecoder) element(kind, alias, label string, tags []string) error {
+	if _, ok := dec.nodes[alias]; ok {
+		return &ReferenceError{ID: alias, Reason: "duplicate element alias"}
+	}
+	n, err := deserializeNode(kind, keyID(alias))
+	if err != nil {
+		return err
+	}
+	n.(DfdNode).UpdateName(label)
+	n.(keyed).setKey(alias)
+	n.(tagged).setTags(tags)
+	if len(dec.groups) > 0 {
+		dec.groups[len(dec.groups)-1].AddNodeElem(n)
+	} else {
+		dec.dfd.AddNodeElem(n)
+	}
+	dec.nodes[alias] = n
+	return nil
+}
+
+func (dec *plantUMLDecoder) flow(m []string) error {
+	ends := [2]graph.Node{}
+	for i, alias := range []string{m[1], m[5]} {
+		n, ok := dec.nodes[strings.Trim(alias, `"`)]
+		if !ok {
+			return &ReferenceError{ID: strings.Trim(alias, `"`), Reason: "arrow references undeclared element"}
+		}
+		ends[i] = n
+	}
+	if ends[0].ID() == ends[1].ID() {
+		return &ReferenceError{ID: strings.Trim(m[1], `"`), Reason: "arrow starts and ends at the same element"}
+	}
+	flow := dec.dfd.AddFlow(ends[0], ends[1], plantUMLUnescape(strings.TrimSpace(m[6])))
+	if strings.HasPrefix(m[3], ".") {
+		dec.dashed = append(dec.dashed, flow)
+	}
+	switch back, forward := m[2] == "<", m[4] == ">"; {
+	case back && forward:
+		flow.Dir = "both"
+	case back:
+		flow.Dir = "back"
+	case !forward:
+		flow.Dir = "none"
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package dfd
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+func TestToPlantUML(t *testing.T) {
+	dfd := InitializeDFD("WebApp Thing")
+	google := DeserializeExternalService("1")
+	google.UpdateName("Google Analytics")
+	dfd.AddNodeElem(google)
+
+	tb := DeserializeTrustBoundary("2")
+	tb.UpdateName("AWS")
+	dfd.TrustBoundaries["2"] = tb
+	ws := DeserializeProcess("3")
+	ws.UpdateName("Web Server")
+	tb.AddNodeElem(ws)
+	logs := DeserializeDataStore("4")
+	logs.UpdateName(` "Logs" `)
+	tb.AddNodeElem(logs)
+
+	dfd.AddFlow(ws, logs, "TCP")
+	dfd.AddFlow(ws, google, "")
+	dfd.AddFlow(google, ws, "HTTPS").Dir = "both"
+
+	actual, err := dfd.ToPlantUML()
+	if err != nil {
+		t.Fatalf("Unexpected error generating PlantUML: %v", err)
+	}
+	if strings.TrimSpace(actual) != strings.TrimSpace(testPlantUML) {
+		t.Errorf("Returned PlantUML does not match the expected diagram, got:\n%s", actual)
+	}
+}
+
+func TestDecodePlantUML(t *testing.T) {
+	const doc = `@startuml
+title Payments
+' a comment
+skinparam rectangle {
+  BorderColor red
+}
+left to right direction
+/' a
+   block comment '/
+actor "Card Holder" as holder
+package "Cardholder Data Environment" as cde {
+  usecase "Payment API" as api <<service>>
+  frame "Storage" {
+    database "Card Vault" as vault #lightblue
+  }
+}
+note right of api
+  tokenizes cards
+end note
+cloud issuer
+holder -[#red]-> api : card data
+api ..> vault : "token"
+api <-- issuer : authorization
+"api" -up- issuer
+@enduml
+`
+	dfd, err := DecodePlantUML(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding PlantUML: %v", err)
+	}
+	if dfd.Name != "Payments" {
+		t.Errorf("Expected a DFD name of %s, but got %s", "Payments", dfd.Name)
+	}
+	if rankdir(dfd) != "LR" {
+		t.Errorf("Expected a rankdir of LR, got %s", rankdir(dfd))
+	}
+	if len(dfd.ExternalServices) != 2 || len(dfd.TrustBoundaries) != 2 {
+		t.Fatalf("Expected 2 external services and 2 trust boundaries, got %d and %d", len(dfd.ExternalServices), len(dfd.TrustBoundaries))
+	}
+	cde, storage := dfd.TrustBoundaries[keyID("boundary:cde")], dfd.TrustBoundaries[keyID("boundary:Storage")]
+	if cde == nil || cde.Name != "Cardholder Data Environment" || len(cde.Processes) != 1 || cde.Parent() != nil {
+		t.Errorf("Expected a top level Cardholder Data Environment with 1 process, got %+v", cde)
+	}
+	if api := dfd.FindNode(keyID("api")); api == nil || !reflect.DeepEqual(api.(*Process).Tags, []string{"service"}) {
+		t.Errorf("Expected the Payment API stereotype to become a tag, got %+v", api)
+	}
+	if storage == nil || len(storage.DataStores) != 1 || storage.Parent() != cde || cde.TrustBoundaries[storage.ExternalID()] != storage {
+		t.Errorf("Expected the Storage frame to be nested in its package with 1 data store, got %+v", storage)
+	}
+
+	flows := map[string][]string{}
+	for _, f := range sortedFlows(dfd) {
+		key := fmt.Sprintf("%s->%s", nodeName(f.From().(DfdNode)), nodeName(f.To().(DfdNode)))
+		flows[key] = append(flows[key], f.Name+"/"+f.Dir)
+	}
+	expected := map[string][]string{
+		"Card Holder->Payment API": {"card data/"},
+		"Payment API->Card Vault":  {`"token"/`},
+		"Payment API->issuer":      {"/none", "authorization/back"},
+	}
+	if !reflect.DeepEqual(flows, expected) {
+		t.Errorf("Expected flows %v, got %v", expected, flows)
+	}
+}
+
+func TestPlantUMLRoundTrip(t *testing.T) {
+	roundTrip := func(in randomDFD) bool {
+		first, err := in.ToPlantUML()
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		out, err := DecodePlantUML(strings.NewReader(first))
+		if err != nil {
+			t.Logf("%v\n%s", err, first)
+			return false
+		}
+		second, err := out.ToPlantUML()
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		if first != second {
+			t.Logf("want:\n%s\ngot:\n%s", first, second)
+			return false
+		}
+		if want, got := describeNesting(in.DataFlowDiagram), describeNesting(out); want != got {
+			t.Logf("want:\n%s\ngot:\n%s", want, got)
+			return false
+		}
+		return out.Name == in.Name && len(out.Flows) == len(in.Flows)
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecodePlantUMLErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		doc  string
+		err  error
+		line int
+	}{
+		{"an undeclared element", "actor a\na --> b\n", &ReferenceError{}, 2},
+		{"a duplicate alias", "actor a\ndatabase a\n", &ReferenceError{}, 2},
+		{"an unknown element type", "class a\n", &UnknownElementError{}, 1},
+		{"an element that is not a grouping", "actor a\ndatabase b {\n}\n", &UnknownElementError{}, 2},
+		{"an unbalanced brace", "actor a\n}\n", nil, 2},
+		{"a missing brace", "package p {\nactor a\n", nil, 2},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("Decoding PlantUML with %s", c.name), func(t *testing.T) {
+			_, err := DecodePlantUML(strings.NewReader(c.doc))
+			pe, ok := err.(*ParseError)
+			if !ok {
+				t.Fatalf("Expected a *ParseError, got %T (%v)", err, err)
+			}
+			if c.err != nil && reflect.TypeOf(pe.Err) != reflect.TypeOf(c.err) {
+				t.Errorf("Expected a wrapped error of type %T, got %T (%v)", c.err, pe.Err, pe.Err)
+			}
+			if pe.Line != c.line {
+				t.Errorf("Expected error on line %d, got %d (%v)", c.line, pe.Line, pe)
+			}
+		})
+	}
+}
+
+const testPlantUML = `
+@startuml
+title WebApp Thing
+skinparam defaultFontName Arial
+top to bottom direction
+rectangle "AWS" as cluster_2 #line.dashed;line:595959;text:595959 {
+	control "Web Server" as process_3
+	database "<U+0020><U+0022>Logs<U+0022><U+0020>" as datastore_4
+}
+actor "Google Analytics" as externalservice_1
+process_3 --> externalservice_1
+externalservice_1 <--> process_3 : HTTPS
+process_3 --> datastore_4 : TCP
+@enduml
+`
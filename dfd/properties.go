@@ -0,0 +1,371 @@
+package dfd
+
+import (
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	"gonum.org/v1/gonum/graph/encoding"
+)
+
+// DataClassification is a kind of sensitive data. Any value may be used; the
+// constants below are the common ones.
+type DataClassification string
+
+const (
+	ClassificationPII     DataClassification = "PII"
+	ClassificationPCI     DataClassification = "PCI"
+	ClassificationSecrets DataClassification = "secrets"
+)
+
+// FlowProperties describes how data moves along a Flow. The zero value means
+// that nothing is known about the flow.
+type FlowProperties struct {
+	// Protocol is the application protocol, e.g. HTTPS or gRPC.
+	Protocol string `json:"protocol,omitempty" yaml:"protocol,omitempty"`
+	// Port is the destination port, zero if unknown.
+	Port          int  `json:"port,omitempty" yaml:"port,omitempty"`
+	Authenticated bool `json:"authenticated,omitempty" yaml:"authenticated,omitempty"`
+	// Authentication is how the flow is authenticated, e.g. mTLS or OAuth.
+	Authentication string `json:"authentication,omitempty" yaml:"authentication,omitempty"`
+	// Encrypted reports whether the flow is encrypted in transit.
+	Encrypted  bool   `json:"encrypted,omitempty" yaml:"encrypted,omitempty"`
+	TLSVersion string `json:"tls_version,omitempty" yaml:"tls_version,omitempty"`
+	// Classifications lists the kinds of sensitive data carried by the flow.
+	Classifications []DataClassification `json:"classifications,omitempty" yaml:"classifications,omitempty"`
+}
+
+// DOT attributes holding flow properties. Graphviz ignores attributes it does
+// not know, so these only matter to this package.
+const (
+	flowProtocolAttr       = "dfd_protocol"
+	flowPortAttr           = "dfd_port"
+	flowAuthenticatedAttr  = "dfd_authenticated"
+	flowAuthenticationAttr = "dfd_authentication"
+	flowEncryptedAttr      = "dfd_encrypted"
+	flowTLSVersionAttr     = "dfd_tls_version"
+	flowClassificationAttr = "dfd_classification"
+	// flowIDAttr holds the ID of a flow when it is not the one genFlowID
+	// derives from its ends.
+	flowIDAttr = "dfd_id"
+	// flowResponseToAttr holds the ID of the request a response answers.
+	flowResponseToAttr = "dfd_response_to"
+)
+
+// IsZero reports whether no property is set.
+func (p FlowProperties) IsZero() bool {
+	return p.Protocol == "" && p.Port == 0 && !p.Authenticated && p.Authentication == "" &&
+		!p.Encrypted && p.TLSVersion == "" && len(p.Classifications) == 0
+}
+
+// setAttribute sets the property held by a DOT attribute, reporting whether
+// the attribute is a flow property.
+func (p *FlowProperties) setAttribute(attr encoding.Attribute) (bool, error) {
+	value := unquoteDOT(attr.Value)
+	var err error
+	switch attr.Key {
+	case flowProtocolAttr:
+		p.Protocol = value
+	case flowPortAttr:
+		p.Port, err = strconv.Atoi(value)
+	case flowAuthenticatedAttr:
+		p.Authenticated, err = strconv.ParseBool(value)
+	case flowAuthenticationAttr:
+		p.Authentication = value
+	case flowEncryptedAttr:
+		p.Encrypted, err = strconv.ParseBool(value)
+	case flowTLSVersionAttr:
+		p.TLSVersion = value
+	case flowClassificationAttr:
+		p.Classifications = nil
+		p.Classifications = splitClassifications(value)
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+// attributes returns the DOT attributes holding the properties that are set.
+func (p FlowProperties) attributes() []encoding.Attribute {
+	var attrs []encoding.Attribute
+	add := func(key, value string) {
+		attrs = append(attrs, makeAttribute(key, value))
+	}
+	if p.Protocol != "" {
+		add(flowProtocolAttr, p.Protocol)
+	}
+	if p.Port != 0 {
+		add(flowPortAttr, strconv.Itoa(p.Port))
+	}
+	if p.Authenticated {
+		add(flowAuthenticatedAttr, "true")
+	}
+	if p.Authentication != "" {
+		add(flowAuthenticationAttr, p.Authentication)
+	}
+	if p.Encrypted {
+		add(flowEncryptedAttr, "true")
+	}
+	if p.TLSVersion != "" {
+		add(flowTLSVersionAttr, p.TLSVersion)
+	}
+	if len(p.Classifications) != 0 {
+		add(flowClassificationAttr, joinClassificationAttr(p.Classifications))
+	}
+	return attrs
+}
+
+// summary returns one line per group of properties that are set, for display
+// in the label of the flow.
+func (p FlowProperties) summary() []string {
+	var lines []string
+	switch {
+	case p.Protocol != "" && p.Port != 0:
+		lines = append(lines, fmt.Sprintf("%s:%d", p.Protocol, p.Port))
+	case p.Protocol != "":
+		lines = append(lines, p.Protocol)
+	case p.Port != 0:
+		lines = append(lines, fmt.Sprintf("port %d", p.Port))
+	}
+	switch {
+	case p.Authenticated && p.Authentication != "":
+		lines = append(lines, fmt.Sprintf("authenticated (%s)", p.Authentication))
+	case p.Authenticated:
+		lines = append(lines, "authenticated")
+	}
+	switch {
+	case p.TLSVersion != "":
+		lines = append(lines, "TLS "+strings.TrimPrefix(p.TLSVersion, "TLS "))
+	case p.Encrypted:
+		lines = append(lines, "encrypted")
+	}
+	if len(p.Classifications) != 0 {
+		lines = append(lines, joinClassifications(p.Classifications))
+	}
+	return lines
+}
+
+func joinClassifications(cs []DataClassification) string {
+	s := make([]string, len(cs))
+	for i, c := range cs {
+		s[i] = string(c)
+	}
+	return strings.Join(s, ", ")
+}
+
+// joinClassificationAttr returns the DOT attribute value of cs, escaped like
+// tags so that a classification may contain a comma.
+func joinClassificationAttr(cs []DataClassification) string {
+	s := make([]string, len(cs))
+	for i, c := range cs {
+		s[i] = dotTagEscaper.Replace(string(c))
+	}
+	return strings.Join(s, ", ")
+}
+
+// splitClassifications returns the classifications in a DOT attribute value
+// written by joinClassificationAttr.
+func splitClassifications(value string) []DataClassification {
+	var cs []DataClassification
+	for _, c := range splitTags(value) {
+		cs = append(cs, DataClassification(c))
+	}
+	return cs
+}
+
+// formatFlowLabel returns the HTML-like DOT label of a flow: its name in bold,
+// followed by a summary of its properties.
+func formatFlowLabel(name string, p FlowProperties) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, `<<table border="0" cellborder="0" cellpadding="2"><tr><td><b>%s</b></td></tr>`, html.EscapeString(name))
+	for _, line := range p.summary() {
+		fmt.Fprintf(&b, `<tr><td><font point-size="10">%s</font></td></tr>`, html.EscapeString(line))
+	}
+	b.WriteString("</table>>")
+	return b.String()
+}
+
+// PrivilegeLevel is the level of privilege a Process runs with.
+type PrivilegeLevel string
+
+const (
+	PrivilegeUnprivileged PrivilegeLevel = "unprivileged"
+	PrivilegeUser         PrivilegeLevel = "user"
+	PrivilegeRoot         PrivilegeLevel = "root"
+)
+
+// TrustLevel is how far an ExternalService is trusted.
+type TrustLevel string
+
+const (
+	TrustUntrusted TrustLevel = "untrusted"
+	TrustPartial   TrustLevel = "partial"
+	TrustTrusted   TrustLevel = "trusted"
+)
+
+// ProcessProperties describes a Process.
+type ProcessProperties struct {
+	// Runtime is the runtime or platform, e.g. JVM or AWS Lambda.
+	Runtime   string         `json:"runtime,omitempty" yaml:"runtime,omitempty"`
+	Language  string         `json:"language,omitempty" yaml:"language,omitempty"`
+	Privilege PrivilegeLevel `json:"privilege,omitempty" yaml:"privilege,omitempty"`
+}
+
+// ExternalServiceProperties describes an ExternalService.
+type ExternalServiceProperties struct {
+	Vendor string     `json:"vendor,omitempty" yaml:"vendor,omitempty"`
+	Trust  TrustLevel `json:"trust,omitempty" yaml:"trust,omitempty"`
+}
+
+// DataStoreProperties describes a DataStore.
+type DataStoreProperties struct {
+	EncryptedAtRest bool `json:"encrypted_at_rest,omitempty" yaml:"encrypted_at_rest,omitempty"`
+	BackedUp        bool `json:"backed_up,omitempty" yaml:"backed_up,omitempty"`
+	// Classifications lists the kinds of sensitive data stored.
+	Classifications []DataClassification `json:"classifications,omitempty" yaml:"classifications,omitempty"`
+}
+
+// DOT attributes holding element properties and tags.
+const (
+	processRuntimeAttr           = "dfd_runtime"
+	processLanguageAttr          = "dfd_language"
+	processPrivilegeAttr         = "dfd_privilege"
+	externalServiceVendorAttr    = "dfd_vendor"
+	externalServiceTrustAttr     = "dfd_trust"
+	dataStoreEncryptedAtRestAttr = "dfd_encrypted_at_rest"
+	dataStoreBackedUpAttr        = "dfd_backed_up"
+	dataStoreClassificationAttr  = "dfd_classification"
+	tagsAttr                     = "dfd_tags"
+	childAttr                    = "dfd_child"
+)
+
+// elementProperties is implemented by pointers to the properties of each kind
+// of element.
+type elementProperties interface {
+	IsZero() bool
+	setAttribute(encoding.Attribute) (bool, error)
+	attributes() []encoding.Attribute
+}
+
+// propertiesOf returns a pointer to the properties of a Process,
+// ExternalService or DataStore.
+func propertiesOf(n interface{}) elementProperties {
+	switch n := n.(type) {
+	case *Process:
+		return &n.Properties
+	case *ExternalService:
+		return &n.Properties
+	case *DataStore:
+		return &n.Properties
+	}
+	return nil
+}
+
+func (p ProcessProperties) IsZero() bool {
+	return p == ProcessProperties{}
+}
+
+func (p *ProcessProperties) setAttribute(attr encoding.Attribute) (bool, error) {
+	value := unquoteDOT(attr.Value)
+	switch attr.Key {
+	case processRuntimeAttr:
+		p.Runtime = value
+	case processLanguageAttr:
+		p.Language = value
+	case processPrivilegeAttr:
+		p.Privilege = PrivilegeLevel(value)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+func (p ProcessProperties) attributes() []encoding.Attribute {
+	var attrs []encoding.Attribute
+	if p.Runtime != "" {
+		attrs = append(attrs, makeAttribute(processRuntimeAttr, p.Runtime))
+	}
+	if p.Language != "" {
+		attrs = append(attrs, makeAttribute(processLanguageAttr, p.Language))
+	}
+	if p.Privilege != "" {
+		attrs = append(attrs, makeAttribute(processPrivilegeAttr, string(p.Privilege)))
+	}
+	return attrs
+}
+
+func (p ExternalServiceProperties) IsZero() bool {
+	return p == ExternalServiceProperties{}
+}
+
+func (p *ExternalServiceProperties) setAttribute(attr encoding.Attribute) (bool, error) {
+	value := unquoteDOT(attr.Value)
+	switch attr.Key {
+	case externalServiceVendorAttr:
+		p.Vendor = value
+	case externalServiceTrustAttr:
+		p.Trust = TrustLevel(value)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+func (p ExternalServiceProperties) attributes() []encoding.Attribute {
+	var attrs []encoding.Attribute
+	if p.Vendor != "" {
+		attrs = append(attrs, makeAttribute(externalServiceVendorAttr, p.Vendor))
+	}
+	if p.Trust != "" {
+		attrs = append(attrs, makeAttribute(externalServiceTrustAttr, string(p.Trust)))
+	}
+	return attrs
+}
+
+func (p DataStoreProperties) IsZero() bool {
+	return !p.EncryptedAtRest && !p.BackedUp && len(p.Classifications) == 0
+}
+
+func (p *DataStoreProperties) setAttribute(attr encoding.Attribute) (bool, error) {
+	value := unquoteDOT(attr.Value)
+	var err error
+	switch attr.Key {
+	case dataStoreEncryptedAtRestAttr:
+		p.EncryptedAtRest, err = strconv.ParseBool(value)
+	case dataStoreBackedUpAttr:
+		p.BackedUp, err = strconv.ParseBool(value)
+	case dataStoreClassificationAttr:
+		p.Classifications = nil
+		p.Classifications = splitClassifications(value)
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func (p DataStoreProperties) attributes() []encoding.Attribute {
+	var attrs []encoding.Attribute
+	if p.EncryptedAtRest {
+		attrs = append(attrs, makeAttribute(dataStoreEncryptedAtRestAttr, "true"))
+	}
+	if p.BackedUp {
+		attrs = append(attrs, makeAttribute(dataStoreBackedUpAttr, "true"))
+	}
+	if len(p.Classifications) != 0 {
+		attrs = append(attrs, makeAttribute(dataStoreClassificationAttr, joinClassificationAttr(p.Classifications)))
+	}
+	return attrs
+}
+
+// splitList splits a comma separated DOT attribute value, dropping empty
+// items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,158 @@
+package dfd
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFlowPropertiesDOT(t *testing.T) {
+	dfd := InitializeDFD("Properties")
+	client, server := NewExternalService("Client"), NewProcess("Server")
+	dfd.AddNodeElem(client)
+	dfd.AddNodeElem(server)
+	flow := dfd.AddFlow(client, server, "Checkout")
+	flow.Properties = FlowProperties{
+		Protocol:        "HTTPS",
+		Port:            443,
+		Authenticated:   true,
+		Authentication:  "mTLS",
+		Encrypted:       true,
+		TLSVersion:      "1.3",
+		Classifications: []DataClassification{ClassificationPII, ClassificationSecrets, "card data, masked"},
+	}
+
+	out, err := dfd.ToDOT()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding DOT: %v", err)
+	}
+	for _, want := range []string{
+		`dfd_protocol="HTTPS"`,
+		`dfd_port="443"`,
+		`dfd_classification="PII, secrets, card data%2C masked"`,
+		`<b>Checkout</b>`,
+		`>HTTPS:443<`,
+		`>authenticated (mTLS)<`,
+		`>TLS 1.3<`,
+		`>PII, secrets, card data, masked<`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected DOT output to contain %s, got:\n%s", want, out)
+		}
+	}
+
+	again, err := Decode(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding DOT: %v", err)
+	}
+	for _, f := range again.Flows {
+		if f.Name != "Checkout" || !reflect.DeepEqual(f.Properties, flow.Properties) {
+			t.Errorf("Expected flow Checkout with %+v, but got %s with %+v", flow.Properties, f.Name, f.Properties)
+		}
+	}
+}
+
+func TestFlowPropertiesErrors(t *testing.T) {
+	cases := []string{`dfd_port="https"`, `dfd_authenticated="maybe"`, `dfd_encrypted="1.3"`}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("Decoding a flow with %s", c), func(t *testing.T) {
+			doc := fmt.Sprintf("strict digraph 1 { process_2 -> process_3 [%s] }", c)
+			_, err := Decode(strings.NewReader(doc))
+			if _, ok := err.(*AttributeError); !ok {
+				t.Errorf("Expected an *AttributeError, got %T (%v)", err, err)
+			}
+		})
+	}
+}
+
+func TestFlowPropertiesSummary(t *testing.T) {
+	cases := []struct {
+		properties FlowProperties
+		summary    []string
+	}{
+		{FlowProperties{}, nil},
+		{FlowProperties{Port: 5432}, []string{"port 5432"}},
+		{FlowProperties{Protocol: "gRPC", Authenticated: true}, []string{"gRPC", "authenticated"}},
+		{FlowProperties{Encrypted: true}, []string{"encrypted"}},
+		{FlowProperties{TLSVersion: "TLS 1.2"}, []string{"TLS 1.2"}},
+		{FlowProperties{Authentication: "OAuth", Classifications: []DataClassification{ClassificationPCI}}, []string{"PCI"}},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("Summarizing %+v", c.properties), func(t *testing.T) {
+			if summary := c.properties.summary(); !reflect.DeepEqual(summary, c.summary) {
+				t.Errorf("Expected %q, but got %q", c.summary, summary)
+			}
+		})
+	}
+}
+
+func TestElementPropertiesDOT(t *testing.T) {
+	dfd := InitializeDFD("Properties")
+	api := NewProcess("API")
+	api.Properties = ProcessProperties{Runtime: "JVM", Language: "Kotlin", Privilege: PrivilegeUnprivileged}
+	api.Tags = []string{"internet-facing", "pci-scope", "owner: payments, fraud", "100%"}
+	stripe := NewExternalService("Stripe")
+	stripe.Properties = ExternalServiceProperties{Vendor: "Stripe, Inc.", Trust: TrustPartial}
+	vault := NewDataStore("Vault")
+	vault.Properties = DataStoreProperties{EncryptedAtRest: true, Classifications: []DataClassification{ClassificationPCI, "health, 100%"}}
+	dfd.AddNodeElem(api)
+	dfd.AddNodeElem(stripe)
+	dfd.AddNodeElem(vault)
+
+	out, err := dfd.ToDOT()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding DOT: %v", err)
+	}
+	for _, want := range []string{
+		`dfd_runtime="JVM"`,
+		`dfd_privilege="unprivileged"`,
+		`dfd_tags="internet-facing,pci-scope,owner: payments%2C fraud,100%25"`,
+		`dfd_vendor="Stripe, Inc."`,
+		`dfd_trust="partial"`,
+		`dfd_encrypted_at_rest="true"`,
+		`dfd_classification="PCI, health%2C 100%25"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected DOT output to contain %s, got:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "dfd_backed_up") {
+		t.Errorf("Expected unset properties to be omitted, got:\n%s", out)
+	}
+
+	again, err := Decode(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding DOT: %v", err)
+	}
+	if p := again.Processes[api.ExternalID()]; p == nil || p.Properties != api.Properties || !reflect.DeepEqual(p.Tags, api.Tags) {
+		t.Errorf("Expected process with %+v and tags %q, got %+v", api.Properties, api.Tags, p)
+	}
+	if es := again.ExternalServices[stripe.ExternalID()]; es == nil || es.Properties != stripe.Properties || es.Tags != nil {
+		t.Errorf("Expected external service with %+v and no tags, got %+v", stripe.Properties, es)
+	}
+	if ds := again.DataStores[vault.ExternalID()]; ds == nil || !reflect.DeepEqual(ds.Properties, vault.Properties) {
+		t.Errorf("Expected data store with %+v, got %+v", vault.Properties, ds)
+	}
+}
+
+func TestElementPropertiesErrors(t *testing.T) {
+	cases := []string{
+		`process_2 [dfd_vendor="x"]`,
+		`externalservice_2 [dfd_privilege="root"]`,
+		`datastore_2 [dfd_encrypted_at_rest="maybe"]`,
+		`datastore_2 [dfd_backed_up="daily"]`,
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("Decoding an element with %s", c), func(t *testing.T) {
+			doc := fmt.Sprintf("strict digraph 1 { %s }", c)
+			_, err := Decode(strings.NewReader(doc))
+			if _, ok := err.(*AttributeError); !ok {
+				t.Errorf("Expected an *AttributeError, got %T (%v)", err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package dfd
+
+import (
+	"fmt"
+	"sort"
+)
+
+// StrideCategory is one of the six STRIDE threat categories.
+type StrideCategory string
+
+const (
+	Spoofing              StrideCategory = "Spoofing"
+	Tampering             StrideCategory = "Tampering"
+	Repudiation           StrideCategory = "Repudiation"
+	InformationDisclosure StrideCategory = "Information Disclosure"
+	DenialOfService       StrideCategory = "Denial of Service"
+	ElevationOfPrivilege  StrideCategory = "Elevation of Privilege"
+)
+
+// ThreatStatus records the outcome of reviewing a Threat.
+type ThreatStatus string
+
+const (
+	ThreatOpen          ThreatStatus = "open"
+	ThreatMitigated     ThreatStatus = "mitigated"
+	ThreatAccepted      ThreatStatus = "accepted"
+	ThreatNotApplicable ThreatStatus = "not_applicable"
+)
+
+// Threat is a potential threat against an element or flow of a DFD.
+type Threat struct {
+	// ID is derived from the category and target, so that generating threats
+	// for the same diagram twice yields the same IDs.
+	ID       string         `json:"id" yaml:"id"`
+	Category StrideCategory `json:"category" yaml:"category"`
+	// Target is the DOT ID of the element, e.g. process_1234, or flow_<id>
+	// for a Flow.
+	Target      string       `json:"target" yaml:"target"`
+	Description string       `json:"description" yaml:"description"`
+	Status      ThreatStatus `json:"status" yaml:"status"`
+}
+
+// strideLetters are used to build threat IDs.
+var strideLetters = map[StrideCategory]string{
+	Spoofing:              "S",
+	Tampering:             "T",
+	Repudiation:           "R",
+	InformationDisclosure: "I",
+	DenialOfService:       "D",
+	ElevationOfPrivilege:  "E",
+}
+
+// threatTemplates describe each category; %s is replaced with a description
+// of the target.
+var threatTemplates = map[StrideCategory]string{
+	Spoofing:              "An attacker may impersonate %s.",
+	Tampering:             "An attacker may modify %s or the data it holds.",
+	Repudiation:           "Actions performed through %s may not be attributable to the party that performed them.",
+	InformationDisclosure: "Data may be disclosed to parties not authorized to read it through %s.",
+	DenialOfService:       "An attacker may make %s unavailable.",
+	ElevationOfPrivilege:  "An attacker may gain privileges through %s that they were not granted.",
+}
+
+// STRIDE-per-element: the categories applicable to each kind of element.
+var (
+	processThreats         = []StrideCategory{Spoofing, Tampering, Repudiation, InformationDisclosure, DenialOfService, ElevationOfPrivilege}
+	externalServiceThreats = []StrideCategory{Spoofing, Repudiation}
+	dataStoreThreats       = []StrideCategory{Tampering, Repudiation, InformationDisclosure, DenialOfService}
+	flowThreats            = []StrideCategory{Tampering, InformationDisclosure, DenialOfService}
+)
+
+// GenerateThreats enumerates the STRIDE categories that apply to every
+// element of dfd and to every flow that crosses a trust boundary. All threats
+// are open, and are sorted by ID.
+func GenerateThreats(dfd *DataFlowDiagram) []Threat {
+	threats := []Threat{}
+	add := func(target, what string, categories []StrideCategory) {
+		for _, c := range categories {
+			threats = append(threats, Threat{
+				ID:          strideLetters[c] + "-" + target,
+				Category:    c,
+				Target:      target,
+				Description: fmt.Sprintf(threatTemplates[c], what),
+				Status:      ThreatOpen,
+			})
+		}
+	}
+
+	elems := topLevelElements(dfd)
+	for _, tb := range sortedTrustBoundaries(dfd) {
+		elems = append(elems, sortedElements(tb.Processes, tb.ExternalServices, tb.DataStores)...)
+	}
+	for _, n := range elems {
+		switch n := n.(type) {
+		case *Process:
+			add(n.DOTID(), fmt.Sprintf("process %q", n.Name), processThreats)
+		case *ExternalService:
+			add(n.DOTID(), fmt.Sprintf("external service %q", n.Name), externalServiceThreats)
+		case *DataStore:
+			add(n.DOTID(), fmt.Sprintf("data store %q", n.Name), dataStoreThreats)
+		}
+	}
+
+	for _, fb := range dfd.CrossingFlows() {
+		what := fmt.Sprintf("%s crossing from %s to %s",
+			describeFlow(dfd, fb.Flow), boundaryName(fb.Source), boundaryName(fb.Destination))
+		add("flow_"+fb.ID, what, flowThreats)
+	}
+
+	sort.Slice(threats, func(i, j int) bool {
+		return threats[i].ID < threats[j].ID
+	})
+	return threats
+}
+
+func boundaryName(tb *TrustBoundary) string {
+	if tb == nil {
+		return "outside all trust boundaries"
+	}
+	return fmt.Sprintf("trust boundary %q", tb.Name)
+}
+
+// ThreatModel is a DFD together with the threats identified against it. It
+// can be serialized as JSON or YAML.
+type ThreatModel struct {
+	Diagram *DataFlowDiagram `json:"diagram" yaml:"diagram"`
+	Threats []Threat         `json:"threats" yaml:"threats"`
+}
+
+// NewThreatModel returns a ThreatModel with the threats generated for dfd.
+func NewThreatModel(dfd *DataFlowDiagram) *ThreatModel {
+	return &ThreatModel{Diagram: dfd, Threats: GenerateThreats(dfd)}
+}
+
+// Refresh regenerates the threats after the diagram has changed. Threats that
+// still apply keep their status, and threats whose target was removed or no
+// longer crosses a trust boundary are dropped.
+func (tm *ThreatModel) Refresh() {
+	status := make(map[string]ThreatStatus, len(tm.Threats))
+	for _, t := range tm.Threats {
+		status[t.ID] = t.Status
+	}
+	tm.Threats = GenerateThreats(tm.Diagram)
+	for i, t := range tm.Threats {
+		if s, ok := status[t.ID]; ok {
+			tm.Threats[i].Status = s
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package dfd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestGenerateThreats(t *testing.T) {
+	dfd, err := DecodeYAML(strings.NewReader(testYAML))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	threats := GenerateThreats(dfd)
+
+	counts := map[string]int{}
+	for _, threat := range threats {
+		counts[threat.Target]++
+		if threat.Status != ThreatOpen {
+			t.Errorf("Expected threat %s to be open, but got %s", threat.ID, threat.Status)
+		}
+	}
+	cases := []struct {
+		target string
+		count  int
+	}{
+		{"process_client", 6},
+		{"externalservice_google-analytics", 2},
+		{"datastore_logs", 4},
+		{"flow_" + genFlowID(dfd.FindNode("client"), dfd.FindNode("web-server")), 3},
+		{"flow_" + genFlowID(dfd.FindNode("web-server"), dfd.FindNode("logs")), 0},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("Threats against %s", c.target), func(t *testing.T) {
+			if counts[c.target] != c.count {
+				t.Errorf("Expected %d threats, but got %d", c.count, counts[c.target])
+			}
+		})
+	}
+	if len(threats) != 24 {
+		t.Errorf("Expected 24 threats, but got %d", len(threats))
+	}
+	if !reflect.DeepEqual(threats, GenerateThreats(dfd)) {
+		t.Error("Expected generating threats twice to yield the same threats")
+	}
+}
+
+func TestThreatModelRefresh(t *testing.T) {
+	dfd := InitializeDFD("Refresh")
+	tb, _ := dfd.AddTrustBoundary("Internal")
+	client, server := NewExternalService("Client"), NewProcess("Server")
+	dfd.AddNodeElem(client)
+	tb.AddNodeElem(server)
+	dfd.AddFlow(client, server, "HTTPS")
+
+	tm := NewThreatModel(dfd)
+	if len(tm.Threats) != 11 {
+		t.Fatalf("Expected 11 threats, but got %d", len(tm.Threats))
+	}
+	spoofing := "S-" + server.DOTID()
+	for i := range tm.Threats {
+		if tm.Threats[i].ID == spoofing {
+			tm.Threats[i].Status = ThreatMitigated
+		}
+	}
+
+	dfd.RemoveTrustBoundary(tb.ExternalID())
+	tm.Refresh()
+	if len(tm.Threats) != 8 {
+		t.Errorf("Expected 8 threats once the flow no longer crosses a boundary, but got %d", len(tm.Threats))
+	}
+	for _, threat := range tm.Threats {
+		if threat.ID == spoofing && threat.Status != ThreatMitigated {
+			t.Errorf("Expected %s to stay mitigated, but got %s", spoofing, threat.Status)
+		}
+	}
+}
+
+func TestThreatModelSerialization(t *testing.T) {
+	dfd, err := DecodeYAML(strings.NewReader(testYAML))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	tm := NewThreatModel(dfd)
+	tm.Threats[0].Status = ThreatAccepted
+
+	cases := []struct {
+		format    string
+		marshal   func(interface{}) ([]byte, error)
+		unmarshal func([]byte, interface{}) error
+	}{
+		{"JSON", json.Marshal, json.Unmarshal},
+		{"YAML", yaml.Marshal, yaml.Unmarshal},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("Serializing a threat model as %s", c.format), func(t *testing.T) {
+			data, err := c.marshal(tm)
+			if err != nil {
+				t.Fatalf("Unexpected error marshaling: %v", err)
+			}
+			out := &ThreatModel{}
+			if err := c.unmarshal(data, out); err != nil {
+				t.Fatalf("Unexpected error unmarshaling: %v", err)
+			}
+			if !reflect.DeepEqual(tm.Threats, out.Threats) {
+				t.Errorf("Expected threats %v, but got %v", tm.Threats, out.Threats)
+			}
+			if describeDFD(tm.Diagram) != describeDFD(out.Diagram) {
+				t.Errorf("Expected the diagram to survive serialization")
+			}
+			again, _ := c.marshal(out)
+			if !bytes.Equal(data, again) {
+				t.Errorf("Expected %s output to be stable", c.format)
+			}
+		})
+	}
+}
@@ -2,9 +2,15 @@ package dfd
 
 import (
 	"crypto/rand"
+	"hash/fnv"
 	"math"
 	"math/big"
+	"sort"
 	"strconv"
+	"strings"
+	"unicode"
+
+	"gonum.org/v1/gonum/graph"
 )
 
 func genID() string {
@@ -12,7 +18,293 @@ func genID() string {
 	return strconv.FormatInt(xid.Int64(), 10)
 }
 
+// idToID64 maps an element ID onto the int64 ID of its gonum node. Numeric
+// IDs are used as is and others, such as slugs, are hashed.
 func idToID64(id string) int64 {
-	xid64, _ := strconv.ParseInt(id, 10, 64)
-	return xid64
+	if xid64, err := strconv.ParseInt(id, 10, 64); err == nil {
+		return xid64
+	}
+	return hashID(id)
+}
+
+// validID reports whether id can identify an element or trust boundary: a
+// non-empty string of letters, digits and dashes. Underscores are excluded as
+// they separate the type from the ID in DOT IDs.
+func validID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, r := range id {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' {
+			return false
+		}
+	}
+	return true
+}
+
+// identifier returns a DOT ID with its dashes replaced by underscores, for
+// formats whose identifiers cannot contain dashes. As IDs cannot contain
+// underscores, distinct DOT IDs remain distinct.
+func identifier(dotID string) string {
+	return strings.Replace(dotID, "-", "_", -1)
+}
+
+// quoteDOTID quotes a DOT ID unless it is a plain DOT identifier, which slugs
+// containing dashes are not.
+func quoteDOTID(id string) string {
+	if _, err := strconv.ParseUint(id, 10, 64); err == nil {
+		return id
+	}
+	for i, r := range id {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return strconv.Quote(id)
+		}
+	}
+	return id
+}
+
+// uniqueSlug returns the slug of name, followed by -2, -3 and so on if it is
+// already taken. Names without letters or digits yield fallback.
+func uniqueSlug(name, fallback string, taken func(string) bool) string {
+	slug := slugify(name)
+	if slug == "" {
+		slug = fallback
+	}
+	id := slug
+	for i := 2; taken(id); i++ {
+		id = slug + "-" + strconv.Itoa(i)
+	}
+	return id
+}
+
+// unquoteDOT returns the text of a DOT ID. Quoted strings written with
+// strconv.Quote are unquoted, other quoted strings simply lose their quotes
+// and anything else is returned as is.
+func unquoteDOT(id string) string {
+	if s, err := strconv.Unquote(id); err == nil {
+		return s
+	}
+	if len(id) >= 2 && strings.HasPrefix(id, `"`) && strings.HasSuffix(id, `"`) {
+		return strings.Replace(id[1:len(id)-1], `\"`, `"`, -1)
+	}
+	return id
+}
+
+// keyID derives a stable ID from a human-readable key, so that loading the
+// same document twice yields the same IDs.
+func keyID(key string) string {
+	return strconv.FormatInt(hashID(key), 10)
+}
+
+// hashID returns a stable, non-negative int64 hash of key.
+func hashID(key string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int64(h.Sum64() & math.MaxInt64)
+}
+
+// slugify turns a name into a lower case key made of letters, digits and
+// dashes.
+func slugify(name string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(name) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			b.WriteRune(r)
+			dash = false
+		} else {
+			dash = true
+		}
+	}
+	return b.String()
+}
+
+// elementRank orders the kinds of elements: processes, external services,
+// then data stores, then anything else.
+func elementRank(n DfdNode) int {
+	switch n.(type) {
+	case *Process:
+		return 0
+	case *ExternalService:
+		return 1
+	case *DataStore:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// lessElement reports whether a sorts before b, ordering elements by kind,
+// then name, then ID. This is the order in which every writer lists them.
+func lessElement(a, b DfdNode) bool {
+	return lessElementBy(a, b, DfdNode.ExternalID)
+}
+
+// lessElementBy is lessElement for formats that identify elements by
+// something other than their ID, such as PlantUML aliases.
+func lessElementBy(a, b DfdNode, id func(DfdNode) string) bool {
+	if ra, rb := elementRank(a), elementRank(b); ra != rb {
+		return ra < rb
+	}
+	if x, y := nodeName(a), nodeName(b); x != y {
+		return x < y
+	}
+	return id(a) < id(b)
+}
+
+// lessNode is lessElement for graph nodes, ordering nodes that are not
+// elements by ID.
+func lessNode(a, b graph.Node) bool {
+	na, aok := a.(DfdNode)
+	nb, bok := b.(DfdNode)
+	if !aok || !bok {
+		return a.ID() < b.ID()
+	}
+	return lessElement(na, nb)
+}
+
+// lessFlow reports whether a sorts before b, ordering flows by name, then
+// source, then destination, then ID.
+func lessFlow(a, b graph.Edge) bool {
+	if x, y := edgeName(a), edgeName(b); x != y {
+		return x < y
+	}
+	if a.From().ID() != b.From().ID() {
+		return lessNode(a.From(), b.From())
+	}
+	if a.To().ID() != b.To().ID() {
+		return lessNode(a.To(), b.To())
+	}
+	fa, aok := a.(*Flow)
+	fb, bok := b.(*Flow)
+	return aok && bok && fa.id < fb.id
+}
+
+// edgeName returns the name of a flow, or the empty string for other edges.
+func edgeName(e graph.Edge) string {
+	if f, ok := e.(*Flow); ok {
+		return f.Name
+	}
+	return ""
+}
+
+// sortedElements returns the elements of the given maps ordered by kind, then
+// name, then ID.
+func sortedElements(ps map[string]*Process, es map[string]*ExternalService, ds map[string]*DataStore) []DfdNode {
+	elems := make([]DfdNode, 0, len(ps)+len(es)+len(ds))
+	for _, n := range ps {
+		elems = append(elems, n)
+	}
+	for _, n := range es {
+		elems = append(elems, n)
+	}
+	for _, n := range ds {
+		elems = append(elems, n)
+	}
+	sort.Slice(elems, func(i, j int) bool {
+		return lessElement(elems[i], elems[j])
+	})
+	return elems
+}
+
+// topLevelElements returns the elements of dfd that are not in a trust
+// boundary, followed by flow endpoints that were never added as elements.
+func topLevelElements(dfd *DataFlowDiagram) []DfdNode {
+	elems := sortedElements(dfd.Processes, dfd.ExternalServices, dfd.DataStores)
+	var strays []DfdNode
+	seen := map[string]bool{}
+	for _, f := range sortedFlows(dfd) {
+		for _, n := range []DfdNode{f.From().(DfdNode), f.To().(DfdNode)} {
+			if id := n.ExternalID(); !seen[id] && dfd.FindNode(id) == nil {
+				seen[id] = true
+				strays = append(strays, n)
+			}
+		}
+	}
+	sort.Slice(strays, func(i, j int) bool {
+		return lessElement(strays[i], strays[j])
+	})
+	return append(elems, strays...)
+}
+
+// allElements returns the elements of dfd, those at the top level first, then
+// those of each trust boundary in order.
+func allElements(dfd *DataFlowDiagram) []DfdNode {
+	elems := sortedElements(dfd.Processes, dfd.ExternalServices, dfd.DataStores)
+	for _, tb := range sortedTrustBoundaries(dfd) {
+		elems = append(elems, sortedElements(tb.Processes, tb.ExternalServices, tb.DataStores)...)
+	}
+	return elems
+}
+
+// sortedTrustBoundaries returns all trust boundaries of dfd, at any depth,
+// ordered by name, then ID.
+func sortedTrustBoundaries(dfd *DataFlowDiagram) []*TrustBoundary {
+	return sortedBoundaries(dfd.TrustBoundaries)
+}
+
+// topLevelBoundaries returns the trust boundaries of dfd that are not nested
+// in another one, ordered by name, then ID.
+func topLevelBoundaries(dfd *DataFlowDiagram) []*TrustBoundary {
+	tbs := []*TrustBoundary{}
+	for _, tb := range sortedTrustBoundaries(dfd) {
+		if tb.parent == nil {
+			tbs = append(tbs, tb)
+		}
+	}
+	return tbs
+}
+
+// sortedBoundaries returns the trust boundaries of a map ordered by name,
+// then ID.
+func sortedBoundaries(m map[string]*TrustBoundary) []*TrustBoundary {
+	tbs := make([]*TrustBoundary, 0, len(m))
+	for _, tb := range m {
+		tbs = append(tbs, tb)
+	}
+	sort.Slice(tbs, func(i, j int) bool {
+		if tbs[i].Name != tbs[j].Name {
+			return tbs[i].Name < tbs[j].Name
+		}
+		return tbs[i].ExternalID() < tbs[j].ExternalID()
+	})
+	return tbs
+}
+
+// sortedFlowIDs returns the IDs of the flows of dfd, ordered as their flows.
+func sortedFlowIDs(dfd *DataFlowDiagram) []string {
+	ids := make([]string, 0, len(dfd.Flows))
+	for id := range dfd.Flows {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return lessFlow(dfd.Flows[ids[i]], dfd.Flows[ids[j]])
+	})
+	return ids
+}
+
+// sortedFlows returns the flows of dfd ordered by name, then source, then
+// destination, then ID.
+func sortedFlows(dfd *DataFlowDiagram) []*Flow {
+	ids := sortedFlowIDs(dfd)
+	flows := make([]*Flow, len(ids))
+	for i, id := range ids {
+		flows[i] = dfd.Flows[id]
+	}
+	return flows
+}
+
+// rankdir returns the rankdir graph attribute of dfd as one of TB, LR, RL or
+// BT, defaulting to TB.
+func rankdir(dfd *DataFlowDiagram) string {
+	value, _ := dfd.graph.get("rankdir")
+	switch dir := strings.ToUpper(unquoteDOT(value)); dir {
+	case "LR", "RL", "BT":
+		return dir
+	default:
+		return "TB"
+	}
 }
@@ -0,0 +1,271 @@
+package dfd
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Severity is how serious a Finding is.
+type Severity int
+
+const (
+	SeverityInfo Severity = iota
+	SeverityWarning
+	SeverityError
+)
+
+var severityNames = map[Severity]string{
+	SeverityInfo:    "info",
+	SeverityWarning: "warning",
+	SeverityError:   "error",
+}
+
+func (s Severity) String() string {
+	if name, ok := severityNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Severity(%d)", int(s))
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *Severity) UnmarshalText(text []byte) error {
+	for severity, name := range severityNames {
+		if name == string(text) {
+			*s = severity
+			return nil
+		}
+	}
+	return fmt.Errorf("dfd: unknown severity %q", text)
+}
+
+// Finding is a problem reported by a Rule.
+type Finding struct {
+	// Rule is the name of the rule that reported the finding.
+	Rule     string   `json:"rule" yaml:"rule"`
+	Severity Severity `json:"severity" yaml:"severity"`
+	// Target is the DOT ID of the element, e.g. process_1234, or flow_<id>
+	// for a Flow, as for a Threat.
+	Target  string `json:"target" yaml:"target"`
+	Message string `json:"message" yaml:"message"`
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s: %s (%s)", f.Severity, f.Target, f.Message, f.Rule)
+}
+
+// Rule checks a DFD for one kind of problem.
+type Rule interface {
+	// Name identifies the rule, e.g. "orphan-element".
+	Name() string
+	Check(dfd *DataFlowDiagram) []Finding
+}
+
+type ruleFunc struct {
+	name  string
+	check func(*DataFlowDiagram) []Finding
+}
+
+func (r ruleFunc) Name() string {
+	return r.name
+}
+
+func (r ruleFunc) Check(dfd *DataFlowDiagram) []Finding {
+	return r.check(dfd)
+}
+
+// NewRule returns a Rule with the given name that reports the findings
+// returned by check.
+func NewRule(name string, check func(*DataFlowDiagram) []Finding) Rule {
+	return ruleFunc{name: name, check: check}
+}
+
+var (
+	rulesMu sync.RWMutex
+	rules   = map[string]Rule{}
+)
+
+// RegisterRule adds a rule to the ones run by Validate. It panics if a rule
+// with the same name is already registered.
+func RegisterRule(r Rule) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	if _, ok := rules[r.Name()]; ok {
+		panic(fmt.Sprintf("dfd: rule %q registered twice", r.Name()))
+	}
+	rules[r.Name()] = r
+}
+
+// UnregisterRule removes the rule with the given name from the ones run by
+// Validate, including a built-in rule.
+func UnregisterRule(name string) {
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	delete(rules, name)
+}
+
+// Rules returns the registered rules, sorted by name.
+func Rules() []Rule {
+	rulesMu.RLock()
+	defer rulesMu.RUnlock()
+	rs := make([]Rule, 0, len(rules))
+	for _, r := range rules {
+		rs = append(rs, r)
+	}
+	sort.Slice(rs, func(i, j int) bool {
+		return rs[i].Name() < rs[j].Name()
+	})
+	return rs
+}
+
+// Validate checks dfd against the registered rules. Findings are sorted by
+// decreasing severity, then by target, rule and message.
+func Validate(dfd *DataFlowDiagram) []Finding {
+	return ValidateRules(dfd, Rules()...)
+}
+
+// ValidateRules checks dfd against the given rules only. Findings are sorted
+// as by Validate.
+func ValidateRules(dfd *DataFlowDiagram, rs ...Rule) []Finding {
+	findings := []Finding{}
+	for _, r := range rs {
+		for _, f := range r.Check(dfd) {
+			if f.Rule == "" {
+				f.Rule = r.Name()
+			}
+			findings = append(findings, f)
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.Severity != b.Severity {
+			return a.Severity > b.Severity
+		}
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		if a.Rule != b.Rule {
+			return a.Rule < b.Rule
+		}
+		return a.Message < b.Message
+	})
+	return findings
+}
+
+// Names of the built-in rules.
+const (
+	RuleDataStoreToDataStore       = "data-store-to-data-store"
+	RuleExternalServiceToDataStore = "external-service-to-data-store"
+	RuleOrphanElement              = "orphan-element"
+	RuleDanglingFlow               = "dangling-flow"
+	RuleIntegrity                  = "integrity"
+	RuleUnbalancedDecomposition    = "unbalanced-decomposition"
+)
+
+func init() {
+	RegisterRule(NewRule(RuleDataStoreToDataStore, checkDataStoreToDataStore))
+	RegisterRule(NewRule(RuleExternalServiceToDataStore, checkExternalServiceToDataStore))
+	RegisterRule(NewRule(RuleOrphanElement, checkOrphanElements))
+	RegisterRule(NewRule(RuleDanglingFlow, checkDanglingFlows))
+	RegisterRule(NewRule(RuleIntegrity, checkIntegrity))
+	RegisterRule(NewRule(RuleUnbalancedDecomposition, checkDecompositions))
+}
+
+// Data only moves between data stores through a process, which is what
+// reads from one and writes to the other.
+func checkDataStoreToDataStore(dfd *DataFlowDiagram) []Finding {
+	var findings []Finding
+	for id, f := range dfd.Flows {
+		from, fromStore := f.From().(*DataStore)
+		to, toStore := f.To().(*DataStore)
+		if fromStore && toStore {
+			findings = append(findings, Finding{
+				Severity: SeverityError,
+				Target:   "flow_" + id,
+				Message:  fmt.Sprintf("flow %q connects data store %q directly to data store %q without a process", f.Name, from.Name, to.Name),
+			})
+		}
+	}
+	return findings
+}
+
+// External services only reach data stores through a process of the system.
+func checkExternalServiceToDataStore(dfd *DataFlowDiagram) []Finding {
+	var findings []Finding
+	for id, f := range dfd.Flows {
+		var es *ExternalService
+		var ds *DataStore
+		switch from := f.From().(type) {
+		case *ExternalService:
+			es = from
+			ds, _ = f.To().(*DataStore)
+		case *DataStore:
+			ds = from
+			es, _ = f.To().(*ExternalService)
+		}
+		if es == nil || ds == nil {
+			continue
+		}
+		findings = append(findings, Finding{
+			Severity: SeverityError,
+			Target:   "flow_" + id,
+			Message:  fmt.Sprintf("flow %q connects external service %q directly to data store %q without a process", f.Name, es.Name, ds.Name),
+		})
+	}
+	return findings
+}
+
+// Elements without flows play no part in the diagram.
+func checkOrphanElements(dfd *DataFlowDiagram) []Finding {
+	connected := map[string]bool{}
+	for _, f := range dfd.Flows {
+		connected[f.From().(DfdNode).ExternalID()] = true
+		connected[f.To().(DfdNode).ExternalID()] = true
+	}
+	var findings []Finding
+	for _, n := range allElements(dfd) {
+		if !connected[n.ExternalID()] {
+			findings = append(findings, Finding{
+				Severity: SeverityWarning,
+				Target:   n.DOTID(),
+				Message:  fmt.Sprintf("%s has no flows", describeElement(n)),
+			})
+		}
+	}
+	return findings
+}
+
+// Removing an element also removes its flows, so only files edited by hand, or
+// written by earlier versions of this package, have flows to missing elements.
+func checkDanglingFlows(dfd *DataFlowDiagram) []Finding {
+	var findings []Finding
+	for id, f := range dfd.Flows {
+		for _, n := range []DfdNode{f.From().(DfdNode), f.To().(DfdNode)} {
+			if dfd.FindNode(n.ExternalID()) == nil {
+				findings = append(findings, Finding{
+					Severity: SeverityError,
+					Target:   "flow_" + id,
+					Message:  fmt.Sprintf("flow %q references %s, which is not an element of the diagram", f.Name, n.DOTID()),
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// describeElement returns the kind and name of an element, e.g. process "API".
+func describeElement(n DfdNode) string {
+	switch n := n.(type) {
+	case *ExternalService:
+		return fmt.Sprintf("external service %q", n.Name)
+	case *DataStore:
+		return fmt.Sprintf("data store %q", n.Name)
+	default:
+		return fmt.Sprintf("process %q", nodeName(n))
+	}
+}
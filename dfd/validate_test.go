@@ -0,0 +1,112 @@
+package dfd
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gonum.org/v1/gonum/graph"
+)
+
+func TestValidate(t *testing.T) {
+	dfd, err := DecodeYAML(strings.NewReader(testYAML))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	if findings := Validate(dfd); len(findings) != 0 {
+		t.Errorf("Expected no findings for a valid diagram, got %v", findings)
+	}
+
+	node := func(key string) graph.Node {
+		return dfd.FindNode(key)
+	}
+	client, ws, logs, ga := node("client"), node("web-server"), node("logs"), node("google-analytics")
+	backups := NewDataStore("Backups")
+	dfd.TrustBoundaries["aws"].AddNodeElem(backups)
+	dfd.AddFlow(logs, backups, "Copy")
+	dfd.AddFlow(ga, logs, "Events")
+	idle := NewProcess("Idle")
+	dfd.AddNodeElem(idle)
+	// Deleting the client from the map directly, as editing a file by hand
+	// would, leaves its flows behind.
+	delete(dfd.TrustBoundaries["browser"].Processes, client.(DfdNode).ExternalID())
+
+	flow := func(from, to graph.Node) string {
+		return "flow_" + genFlowID(from, to)
+	}
+	expected := map[string]Severity{
+		RuleDanglingFlow + " " + flow(client, ga):             SeverityError,
+		RuleDanglingFlow + " " + flow(client, ws):             SeverityError,
+		RuleDataStoreToDataStore + " " + flow(logs, backups):  SeverityError,
+		RuleExternalServiceToDataStore + " " + flow(ga, logs): SeverityError,
+		RuleOrphanElement + " " + idle.DOTID():                SeverityWarning,
+	}
+	findings := Validate(dfd)
+	got := map[string]Severity{}
+	for i, f := range findings {
+		got[f.Rule+" "+f.Target] = f.Severity
+		if i > 0 && f.Severity > findings[i-1].Severity {
+			t.Errorf("Expected findings to be sorted by decreasing severity, got %v", findings)
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected findings %v, got %v", expected, findings)
+	}
+}
+
+func TestRegisterRule(t *testing.T) {
+	dfd := InitializeDFD("Custom")
+	db := NewDataStore("Unencrypted")
+	dfd.AddNodeElem(db)
+
+	rule := NewRule("encrypted-at-rest", func(dfd *DataFlowDiagram) []Finding {
+		var findings []Finding
+		for _, ds := range dfd.DataStores {
+			if !ds.Properties.EncryptedAtRest {
+				findings = append(findings, Finding{Severity: SeverityWarning, Target: ds.DOTID(), Message: "not encrypted at rest"})
+			}
+		}
+		return findings
+	})
+	RegisterRule(rule)
+	defer UnregisterRule(rule.Name())
+
+	expected := []Finding{
+		{Rule: "encrypted-at-rest", Severity: SeverityWarning, Target: db.DOTID(), Message: "not encrypted at rest"},
+		{Rule: RuleOrphanElement, Severity: SeverityWarning, Target: db.DOTID(), Message: `data store "Unencrypted" has no flows`},
+	}
+	if findings := Validate(dfd); !reflect.DeepEqual(findings, expected) {
+		t.Errorf("Expected findings %v, got %v", expected, findings)
+	}
+	if findings := ValidateRules(dfd, rule); len(findings) != 1 {
+		t.Errorf("Expected only the custom rule to run, got %v", findings)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected registering a rule twice to panic")
+		}
+	}()
+	RegisterRule(rule)
+}
+
+func TestSeverityText(t *testing.T) {
+	for _, s := range []Severity{SeverityInfo, SeverityWarning, SeverityError} {
+		t.Run(fmt.Sprintf("Round tripping %s", s), func(t *testing.T) {
+			data, err := json.Marshal(Finding{Severity: s})
+			if err != nil {
+				t.Fatalf("Unexpected error marshaling a finding: %v", err)
+			}
+			var f Finding
+			if err := json.Unmarshal(data, &f); err != nil || f.Severity != s {
+				t.Errorf("Expected severity %s, got %s (%v)", s, f.Severity, err)
+			}
+		})
+	}
+	var s Severity
+	if err := s.UnmarshalText([]byte("fatal")); err == nil {
+		t.Error("Expected an error unmarshaling an unknown severity")
+	}
+}
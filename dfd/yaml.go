@@ -0,0 +1,732 @@
+package dfd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+
+	"gonum.org/v1/gonum/graph"
+	"gonum.org/v1/gonum/graph/encoding"
+	"gopkg.in/yaml.v3"
+)
+
+// YAMLSchemaVersion is the version of the YAML format read by DecodeYAML and
+// written by EncodeYAML.
+//
+// The YAML format is meant to be written by hand. Elements and trust
+// boundaries are keyed by human-readable keys rather than IDs, and flows refer
+// to elements by key:
+//
+//	version: 1
+//	name: My WebApp
+//	elements:
+//	  google-analytics:
+//	    kind: external_service
+//	    name: Google Analytics
+//	trust_boundaries:
+//	  aws:
+//	    name: AWS
+//	    elements:
+//	      web-server:
+//	        kind: process
+//	        name: Web Server
+//	      logs:
+//	        kind: data_store
+//	flows:
+//	  - from: web-server
+//	    to: logs
+//	    name: TCP
+//
+// A process may decompose into a child diagram, given under its child key in
+// the same format, without the version. Keys in the child diagram are
+// independent from those of its parent, but elements that stand for the same
+// element in both should use the same key.
+//
+// Trust boundaries may be nested by listing them under the trust_boundaries
+// key of another trust boundary. Trust boundary keys are unique across the
+// whole document.
+//
+// Several flows may connect the same elements. A flow may be given an id,
+// otherwise its ID is derived from the keys of its ends. The response to a
+// flow is given under its response key, with the id, name, attributes and
+// properties of a flow, and goes back from the to element to the from one.
+//
+// The name of an element or trust boundary defaults to its key. A key made of
+// letters, digits and dashes is used as the ID, and the IDs of other keys are
+// derived from them, so loading the same document twice yields the same DFD.
+// When writing, elements and trust boundaries with such an ID are keyed by it,
+// and the keys of others are derived from their names.
+const YAMLSchemaVersion = 1
+
+// YAML element kinds.
+const (
+	YAMLProcess         = "process"
+	YAMLExternalService = "external_service"
+	YAMLDataStore       = "data_store"
+)
+
+var yamlKinds = map[string]string{
+	YAMLProcess:         "process",
+	YAMLExternalService: "externalservice",
+	YAMLDataStore:       "datastore",
+}
+
+// yamlProperties lists the properties of each kind of element.
+var yamlProperties = map[string][]string{
+	YAMLProcess:         {"runtime", "language", "privilege"},
+	YAMLExternalService: {"vendor", "trust"},
+	YAMLDataStore:       {"encrypted_at_rest", "backed_up", "classifications"},
+}
+
+type yamlDFD struct {
+	Version         int                          `yaml:"version,omitempty"`
+	Name            string                       `yaml:"name,omitempty"`
+	Elements        map[string]yamlElement       `yaml:"elements,omitempty"`
+	TrustBoundaries map[string]yamlTrustBoundary `yaml:"trust_boundaries,omitempty"`
+	Flows           []yamlFlow                   `yaml:"flows,omitempty"`
+}
+
+type yamlTrustBoundary struct {
+	Name            string                       `yaml:"name"`
+	Elements        map[string]yamlElement       `yaml:"elements,omitempty"`
+	TrustBoundaries map[string]yamlTrustBoundary `yaml:"trust_boundaries,omitempty"`
+}
+
+type yamlElement struct {
+	Kind       string            `yaml:"kind"`
+	Name       string            `yaml:"name"`
+	Attributes map[string]string `yaml:"attributes,omitempty"`
+	Tags       []string          `yaml:"tags,omitempty"`
+	Properties elementProperties `yaml:"properties,omitempty"`
+	// Child is the child DFD of a process, without a version.
+	Child *yamlDFD `yaml:"child,omitempty"`
+}
+
+type yamlFlow struct {
+	// ID is only written for flows whose ID is not derived from their ends.
+	ID         string            `yaml:"id,omitempty"`
+	From       string            `yaml:"from"`
+	To         string            `yaml:"to"`
+	Name       string            `yaml:"name"`
+	Attributes map[string]string `yaml:"attributes,omitempty"`
+	Properties *FlowProperties   `yaml:"properties,omitempty"`
+	// Response is the response to the flow, which goes back from To to From.
+	Response *yamlResponse `yaml:"response,omitempty"`
+}
+
+type yamlResponse struct {
+	ID         string            `yaml:"id,omitempty"`
+	Name       string            `yaml:"name"`
+	Attributes map[string]string `yaml:"attributes,omitempty"`
+	Properties *FlowProperties   `yaml:"properties,omitempty"`
+}
+
+// DecodeYAML reads a YAML document from r and returns the DFD it describes.
+// Errors in the document are reported as a *ParseError carrying the line and
+// column of the offending value.
+func DecodeYAML(r io.Reader) (*DataFlowDiagram, error) {
+	buffer, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, &IOError{Op: "read", Err: err}
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(buffer, &doc); err != nil {
+		return nil, &ParseError{Format: "YAML", Err: err}
+	}
+	if len(doc.Content) == 0 {
+		return nil, &ParseError{Format: "YAML", Err: errors.New("empty document")}
+	}
+	dst, err := yamlToDFD(doc.Content[0])
+	if err != nil {
+		return nil, err
+	}
+	return dst, nil
+}
+
+// EncodeYAML writes the YAML representation of dfd to w.
+func EncodeYAML(w io.Writer, dfd *DataFlowDiagram) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(dfdToYAML(dfd)); err != nil {
+		return &IOError{Op: "write", Err: err}
+	}
+	if err := enc.Close(); err != nil {
+		return &IOError{Op: "write", Err: err}
+	}
+	return nil
+}
+
+// MarshalYAML implements yaml.Marshaler.
+func (dfd *DataFlowDiagram) MarshalYAML() (interface{}, error) {
+	return dfdToYAML(dfd), nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler, replacing the DFD with the one
+// described by the node.
+func (dfd *DataFlowDiagram) UnmarshalYAML(node *yaml.Node) error {
+	dst, err := yamlToDFD(node)
+	if err != nil {
+		return err
+	}
+	*dfd = *dst
+	return nil
+}
+
+// ToYAML returns the YAML representation of the DFD as a string.
+func (dfd *DataFlowDiagram) ToYAML() (string, error) {
+	var buf bytes.Buffer
+	if err := EncodeYAML(&buf, dfd); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+func yamlError(node *yaml.Node, err error) error {
+	return &ParseError{Format: "YAML", Line: node.Line, Column: node.Column, Err: err}
+}
+
+// yamlFields checks that node is a mapping with only the allowed keys and
+// returns its value nodes by key.
+func yamlFields(node *yaml.Node, allowed ...string) (map[string]*yaml.Node, error) {
+	if node.Kind != yaml.MappingNode {
+		return nil, yamlError(node, errors.New("expected a mapping"))
+	}
+	keys, values := map[string]*yaml.Node{}, map[string]*yaml.Node{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		known := false
+		for _, a := range allowed {
+			known = known || a == k.Value
+		}
+		if !known {
+			return nil, yamlError(k, fmt.Errorf("unknown field %q", k.Value))
+		}
+		if prev, ok := keys[k.Value]; ok {
+			return nil, yamlError(k, fmt.Errorf("field %q already set at line %d", k.Value, prev.Line))
+		}
+		keys[k.Value], values[k.Value] = k, v
+	}
+	return values, nil
+}
+
+// yamlDecode decodes an optional scalar or mapping field.
+func yamlDecode(node *yaml.Node, out interface{}) error {
+	if node == nil {
+		return nil
+	}
+	if err := node.Decode(out); err != nil {
+		return yamlError(node, err)
+	}
+	return nil
+}
+
+type yamlDecoder struct {
+	dfd *DataFlowDiagram
+	// Element key nodes and elements, by key.
+	keys  map[string]*yaml.Node
+	nodes map[string]graph.Node
+	// boundaries holds the trust boundary keys seen so far.
+	boundaries map[string]*yaml.Node
+}
+
+func yamlToDFD(node *yaml.Node) (*DataFlowDiagram, error) {
+	fields, err := yamlFields(node, "version", "name", "elements", "trust_boundaries", "flows")
+	if err != nil {
+		return nil, err
+	}
+	version := YAMLSchemaVersion
+	if err := yamlDecode(fields["version"], &version); err != nil {
+		return nil, err
+	}
+	if version != YAMLSchemaVersion {
+		return nil, yamlError(fields["version"], &VersionError{Format: "YAML", Version: version})
+	}
+	var name string
+	if err := yamlDecode(fields["name"], &name); err != nil {
+		return nil, err
+	}
+
+	dec := &yamlDecoder{
+		dfd:        DeserializeDFD(keyID("diagram:" + name)),
+		keys:       map[string]*yaml.Node{},
+		nodes:      map[string]graph.Node{},
+		boundaries: map[string]*yaml.Node{},
+	}
+	dec.dfd.UpdateName(name)
+	if err := dec.elements(dec.dfd, fields["elements"]); err != nil {
+		return nil, err
+	}
+	if err := dec.trustBoundaries(nil, fields["trust_boundaries"]); err != nil {
+		return nil, err
+	}
+	if err := dec.flows(fields["flows"]); err != nil {
+		return nil, err
+	}
+	return dec.dfd, nil
+}
+
+func (dec *yamlDecoder) elements(g DfdGraph, node *yaml.Node) error {
+	if node == nil {
+		return nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return yamlError(node, errors.New("elements must be a mapping of keys to elements"))
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		if prev, ok := dec.keys[k.Value]; ok {
+			return yamlError(k, &ReferenceError{ID: k.Value, Reason: fmt.Sprintf("duplicate element key (first declared at line %d)", prev.Line)})
+		}
+		fields, err := yamlFields(v, "kind", "name", "attributes", "tags", "properties", "child")
+		if err != nil {
+			return err
+		}
+		var el yamlElement
+		if err := yamlDecode(fields["kind"], &el.Kind); err != nil {
+			return err
+		}
+		if err := yamlDecode(fields["name"], &el.Name); err != nil {
+			return err
+		}
+		if err := yamlDecode(fields["attributes"], &el.Attributes); err != nil {
+			return err
+		}
+		if err := yamlDecode(fields["tags"], &el.Tags); err != nil {
+			return err
+		}
+		kind, ok := yamlKinds[el.Kind]
+		if !ok {
+			pos := fields["kind"]
+			if pos == nil {
+				pos = v
+			}
+			return yamlError(pos, &UnknownElementError{Kind: "element kind", Type: strconv.Quote(el.Kind)})
+		}
+		if fields["name"] == nil {
+			el.Name = k.Value
+		}
+		n, err := deserializeNode(kind, yamlID(k.Value, ""))
+		if err != nil {
+			return yamlError(k, err)
+		}
+		n.(keyed).setKey(k.Value)
+		n.(DfdNode).UpdateName(el.Name)
+		if err := setAttributes(n.(encoding.AttributeSetter), "node", el.Attributes); err != nil {
+			return yamlError(fields["attributes"], err)
+		}
+		if props := fields["properties"]; props != nil {
+			if _, err := yamlFields(props, yamlProperties[el.Kind]...); err != nil {
+				return err
+			}
+			if err := yamlDecode(props, propertiesOf(n)); err != nil {
+				return err
+			}
+		}
+		n.(tagged).setTags(el.Tags)
+		if child := fields["child"]; child != nil {
+			p, ok := n.(*Process)
+			if !ok {
+				return yamlError(child, errors.New("only processes have a child diagram"))
+			}
+			if p.Child, err = yamlToDFD(child); err != nil {
+				return err
+			}
+		}
+		g.AddNodeElem(n)
+		dec.keys[k.Value] = k
+		dec.nodes[k.Value] = n
+	}
+	return nil
+}
+
+// trustBoundaries decodes the trust boundaries nested in parent, or the top
+// level ones if parent is nil.
+func (dec *yamlDecoder) trustBoundaries(parent *TrustBoundary, node *yaml.Node) error {
+	if node == nil {
+		return nil
+	}
+	if node.Kind != yaml.MappingNode {
+		return yamlError(node, errors.New("trust_boundaries must be a mapping of keys to trust boundaries"))
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		if prev, ok := dec.boundaries[k.Value]; ok {
+			return yamlError(k, &ReferenceError{ID: k.Value, Reason: fmt.Sprintf("duplicate trust boundary key (first declared at line %d)", prev.Line)})
+		}
+		dec.boundaries[k.Value] = k
+		fields, err := yamlFields(v, "name", "elements", "trust_boundaries")
+		if err != nil {
+			return err
+		}
+		name := k.Value
+		if err := yamlDecode(fields["name"], &name); err != nil {
+			return err
+		}
+		tb := DeserializeTrustBoundary(yamlID(k.Value, "boundary:"))
+		tb.UpdateName(name)
+		tb.key = k.Value
+		dec.dfd.registerTrustBoundary(tb)
+		if parent != nil {
+			parent.addTrustBoundary(tb)
+		}
+		if err := dec.elements(tb, fields["elements"]); err != nil {
+			return err
+		}
+		if err := dec.trustBoundaries(tb, fields["trust_boundaries"]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (dec *yamlDecoder) flows(node *yaml.Node) error {
+	if node == nil {
+		return nil
+	}
+	if node.Kind != yaml.SequenceNode {
+		return yamlError(node, errors.New("flows must be a list"))
+	}
+	for _, item := range node.Content {
+		fields, err := yamlFields(item, "id", "from", "to", "name", "attributes", "properties", "response")
+		if err != nil {
+			return err
+		}
+		ends := [2]graph.Node{}
+		for i, end := range []string{"from", "to"} {
+			v := fields[end]
+			if v == nil {
+				return yamlError(item, fmt.Errorf("flow is missing %q", end))
+			}
+			n, ok := dec.nodes[v.Value]
+			if !ok {
+				return yamlError(v, &ReferenceError{ID: v.Value, Reason: fmt.Sprintf("flow %q references unknown element", end)})
+			}
+			ends[i] = n
+		}
+		if ends[0].ID() == ends[1].ID() {
+			return yamlError(item, &ReferenceError{ID: fields["from"].Value, Reason: "flow starts and ends at the same element"})
+		}
+		req, err := dec.flow(fields, ends[0], ends[1])
+		if err != nil {
+			return err
+		}
+		if fields["response"] == nil {
+			continue
+		}
+		if fields, err = yamlFields(fields["response"], "id", "name", "attributes", "properties"); err != nil {
+			return err
+		}
+		resp, err := dec.flow(fields, ends[1], ends[0])
+		if err != nil {
+			return err
+		}
+		resp.responseTo = req.id
+	}
+	return nil
+}
+
+// flow adds a flow from f to t with the id, name, attributes and properties
+// in fields.
+func (dec *yamlDecoder) flow(fields map[string]*yaml.Node, f, t graph.Node) (*Flow, error) {
+	var yf yamlFlow
+	if err := yamlDecode(fields["id"], &yf.ID); err != nil {
+		return nil, err
+	}
+	if err := yamlDecode(fields["name"], &yf.Name); err != nil {
+		return nil, err
+	}
+	if err := yamlDecode(fields["attributes"], &yf.Attributes); err != nil {
+		return nil, err
+	}
+	if props := fields["properties"]; props != nil {
+		if _, err := yamlFields(props, "protocol", "port", "authenticated", "authentication", "encrypted", "tls_version", "classifications"); err != nil {
+			return nil, err
+		}
+		yf.Properties = &FlowProperties{}
+		if err := yamlDecode(props, yf.Properties); err != nil {
+			return nil, err
+		}
+	}
+	var flow *Flow
+	if yf.ID == "" {
+		flow = dec.dfd.AddFlow(f, t, yf.Name)
+	} else {
+		var err error
+		if flow, err = dec.dfd.AddFlowWithID(yf.ID, f, t, yf.Name); err != nil {
+			return nil, yamlError(fields["id"], err)
+		}
+	}
+	if err := setAttributes(flow.dotEdge, "edge", yf.Attributes); err != nil {
+		return nil, yamlError(fields["attributes"], err)
+	}
+	if yf.Properties != nil {
+		flow.setProperties(*yf.Properties)
+	}
+	return flow, nil
+}
+
+// yamlKeyed is an element awaiting a key.
+type yamlKeyed struct {
+	kind, name, id string
+	// key is the key the element was decoded with, if any.
+	key      string
+	attrs    []encoding.Attribute
+	tags     []string
+	props    elementProperties
+	child    *DataFlowDiagram
+	boundary string
+}
+
+func newYAMLKeyed(n graph.Node, boundary string) yamlKeyed {
+	el := yamlKeyed{boundary: boundary}
+	var dn *dotNode
+	switch n := n.(type) {
+	case *Process:
+		el.kind, el.name, el.child, dn = YAMLProcess, n.Name, n.Child, n.dotNode
+	case *ExternalService:
+		el.kind, el.name, dn = YAMLExternalService, n.Name, n.dotNode
+	case *DataStore:
+		el.kind, el.name, dn = YAMLDataStore, n.Name, n.dotNode
+	}
+	el.id, el.attrs, el.tags = dn.dotID, dn.extraAttributes(), dn.Tags
+	el.key = yamlKey(dn.key, dn.dotID)
+	if props := propertiesOf(n); !props.IsZero() {
+		el.props = props
+	}
+	return el
+}
+
+func dfdToYAML(dfd *DataFlowDiagram) yamlDFD {
+	doc := yamlDFD{Version: YAMLSchemaVersion, Name: dfd.Name}
+
+	var elems []yamlKeyed
+	collect := func(boundary string, ps map[string]*Process, es map[string]*ExternalService, ds map[string]*DataStore) {
+		for _, n := range ps {
+			elems = append(elems, newYAMLKeyed(n, boundary))
+		}
+		for _, n := range es {
+			elems = append(elems, newYAMLKeyed(n, boundary))
+		}
+		for _, n := range ds {
+			elems = append(elems, newYAMLKeyed(n, boundary))
+		}
+	}
+	collect("", dfd.Processes, dfd.ExternalServices, dfd.DataStores)
+	// Flow endpoints that were never added as elements are written at the
+	// top level, which is where DOT output places them too.
+	strays := map[string]graph.Node{}
+	for _, f := range dfd.Flows {
+		for _, n := range []graph.Node{f.From(), f.To()} {
+			if id := n.(DfdNode).ExternalID(); dfd.FindNode(id) == nil {
+				strays[id] = n
+			}
+		}
+	}
+	for _, n := range strays {
+		elems = append(elems, newYAMLKeyed(n, ""))
+	}
+
+	boundaries := make([]*TrustBoundary, 0, len(dfd.TrustBoundaries))
+	for _, tb := range dfd.TrustBoundaries {
+		boundaries = append(boundaries, tb)
+	}
+	sort.Slice(boundaries, func(i, j int) bool {
+		if boundaries[i].Name != boundaries[j].Name {
+			return boundaries[i].Name < boundaries[j].Name
+		}
+		return boundaries[i].ExternalID() < boundaries[j].ExternalID()
+	})
+	boundaryKeys := uniqueKeys{}
+	for _, tb := range boundaries {
+		boundaryKeys.reserve(yamlKey(tb.key, tb.ExternalID()))
+	}
+	tbKeys := map[*TrustBoundary]string{}
+	for _, tb := range boundaries {
+		key := boundaryKeys.next(yamlKey(tb.key, tb.ExternalID()), tb.Name, "boundary")
+		tbKeys[tb] = key
+		collect(key, tb.Processes, tb.ExternalServices, tb.DataStores)
+	}
+
+	sort.Slice(elems, func(i, j int) bool {
+		a, b := elems[i], elems[j]
+		if a.kind != b.kind {
+			return a.kind < b.kind
+		}
+		if a.name != b.name {
+			return a.name < b.name
+		}
+		return a.id < b.id
+	})
+	keys := map[string]string{}
+	elementKeys := uniqueKeys{}
+	for _, el := range elems {
+		elementKeys.reserve(el.key)
+	}
+	// Elements by trust boundary key, the empty key being the top level.
+	contents := map[string]map[string]yamlElement{}
+	for _, el := range elems {
+		key := elementKeys.next(el.key, el.name, el.kind)
+		keys[el.id] = key
+		if contents[el.boundary] == nil {
+			contents[el.boundary] = map[string]yamlElement{}
+		}
+		yel := yamlElement{
+			Kind:       el.kind,
+			Name:       el.name,
+			Attributes: jsonAttributes(el.attrs),
+			Tags:       el.tags,
+			Properties: el.props,
+		}
+		if el.child != nil {
+			child := dfdToYAML(el.child)
+			child.Version = 0
+			yel.Child = &child
+		}
+		contents[el.boundary][key] = yel
+	}
+	doc.Elements = contents[""]
+	var nest func(map[string]*TrustBoundary) map[string]yamlTrustBoundary
+	nest = func(tbs map[string]*TrustBoundary) map[string]yamlTrustBoundary {
+		if len(tbs) == 0 {
+			return nil
+		}
+		m := make(map[string]yamlTrustBoundary, len(tbs))
+		for _, tb := range tbs {
+			m[tbKeys[tb]] = yamlTrustBoundary{
+				Name:            tb.Name,
+				Elements:        contents[tbKeys[tb]],
+				TrustBoundaries: nest(tb.TrustBoundaries),
+			}
+		}
+		return m
+	}
+	top := map[string]*TrustBoundary{}
+	for _, tb := range topLevelBoundaries(dfd) {
+		top[tb.ExternalID()] = tb
+	}
+	doc.TrustBoundaries = nest(top)
+
+	yamlFlowID := func(f *Flow) string {
+		if f.hasDerivedID() {
+			return ""
+		}
+		return f.id
+	}
+	responses := map[string]*Flow{}
+	for _, f := range dfd.Flows {
+		if f.responseTo != "" {
+			responses[f.responseTo] = f
+		}
+	}
+	for _, f := range dfd.Flows {
+		if _, ok := dfd.Flows[f.responseTo]; ok {
+			// Responses are written along with their request.
+			continue
+		}
+		yf := yamlFlow{
+			ID:         yamlFlowID(f),
+			From:       keys[f.From().(DfdNode).ExternalID()],
+			To:         keys[f.To().(DfdNode).ExternalID()],
+			Name:       f.Name,
+			Attributes: jsonAttributes(f.dotEdge.attributes()),
+			Properties: flowProperties(f),
+		}
+		if resp := responses[f.id]; resp != nil {
+			yf.Response = &yamlResponse{
+				ID:         yamlFlowID(resp),
+				Name:       resp.Name,
+				Attributes: jsonAttributes(resp.dotEdge.attributes()),
+				Properties: flowProperties(resp),
+			}
+		}
+		doc.Flows = append(doc.Flows, yf)
+	}
+	sort.Slice(doc.Flows, func(i, j int) bool {
+		a, b := doc.Flows[i], doc.Flows[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		// Flows between the same elements may differ in nothing else.
+		return describeYAMLFlow(a) < describeYAMLFlow(b)
+	})
+	return doc
+}
+
+// describeYAMLFlow describes the attributes and properties of a flow and of
+// its response.
+func describeYAMLFlow(f yamlFlow) string {
+	s := fmt.Sprint(f.Attributes, f.Properties)
+	if r := f.Response; r != nil {
+		s += fmt.Sprint(" ", r.ID, r.Name, r.Attributes, r.Properties)
+	}
+	return s
+}
+
+// yamlID returns the ID of the element or trust boundary with the given key:
+// the key itself if it is a valid ID, otherwise one derived from the key and
+// prefix. Numeric keys are only used as is when written the way the number
+// is, as 0 and 00 would otherwise share a node ID.
+func yamlID(key, prefix string) string {
+	if validID(key) {
+		n, err := strconv.ParseInt(key, 10, 64)
+		if err != nil || (n >= 0 && strconv.FormatInt(n, 10) == key) {
+			return key
+		}
+	}
+	return keyID(prefix + key)
+}
+
+// yamlKey returns the key of an element or trust boundary decoded with the
+// given key, if any, and ID. Slug IDs are used as keys so that they survive a
+// round trip, while numeric ones leave the key to be derived from the name.
+func yamlKey(key, id string) string {
+	if key != "" {
+		return key
+	}
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil && validID(id) {
+		return id
+	}
+	return ""
+}
+
+// uniqueKeys hands out keys. Elements keep the key they were decoded with,
+// others get a key derived from their name, with a numeric suffix when that
+// key has already been used.
+type uniqueKeys map[string]int
+
+// reserve records a key that an element was decoded with.
+func (u uniqueKeys) reserve(key string) {
+	if key != "" {
+		u[key]++
+	}
+}
+
+func (u uniqueKeys) next(key, name, fallback string) string {
+	if key != "" && u[key] == 1 {
+		u[key] = -1
+		return key
+	}
+	base := slugify(name)
+	if base == "" {
+		base = fallback
+	}
+	key = base
+	for i := 2; u[key] != 0; i++ {
+		key = fmt.Sprintf("%s-%d", base, i)
+	}
+	u[key] = -1
+	return key
+}
@@ -0,0 +1,236 @@
+package dfd
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+const testYAML = `version: 1
+name: My WebApp
+elements:
+  google-analytics:
+    kind: external_service
+    name: Google Analytics
+trust_boundaries:
+  aws:
+    name: AWS
+    elements:
+      logs:
+        kind: data_store
+        name: Logs
+      web-server:
+        kind: process
+        name: Web Server
+  browser:
+    name: Browser
+    elements:
+      client:
+        kind: process
+        name: Client
+flows:
+  - from: client
+    to: google-analytics
+    name: HTTPS
+  - from: client
+    to: web-server
+    name: HTTPS
+  - from: web-server
+    to: logs
+    name: TCP
+`
+
+func TestDecodeYAML(t *testing.T) {
+	dfd, err := DecodeYAML(strings.NewReader(testYAML))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	if dfd.Name != "My WebApp" {
+		t.Errorf("Expected a DFD name of %s, but got %s", "My WebApp", dfd.Name)
+	}
+	if len(dfd.ExternalServices) != 1 || len(dfd.TrustBoundaries) != 2 || len(dfd.Flows) != 3 {
+		t.Errorf("Expected 1 external service, 2 trust boundaries and 3 flows, got %d, %d and %d",
+			len(dfd.ExternalServices), len(dfd.TrustBoundaries), len(dfd.Flows))
+	}
+	ws := dfd.FindNode("web-server")
+	if p, ok := ws.(*Process); !ok || p.Name != "Web Server" {
+		t.Errorf("Expected web-server to be a Process named Web Server, got %#v", ws)
+	}
+
+	again, err := DecodeYAML(strings.NewReader(testYAML))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	if describeDFD(dfd) != describeDFD(again) {
+		t.Error("Decoding the same YAML twice should yield the same DFD")
+	}
+
+	var buf bytes.Buffer
+	if err := EncodeYAML(&buf, dfd); err != nil {
+		t.Fatalf("Unexpected error encoding YAML: %v", err)
+	}
+	if buf.String() != testYAML {
+		t.Errorf("Expected YAML output to match its input, got:\n%s", buf.String())
+	}
+}
+
+func TestYAMLRoundTrip(t *testing.T) {
+	roundTrip := func(in randomDFD) bool {
+		first, err := in.ToYAML()
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		out, err := DecodeYAML(strings.NewReader(first))
+		if err != nil {
+			t.Logf("%v\n%s", err, first)
+			return false
+		}
+		second, err := out.ToYAML()
+		if err != nil {
+			t.Log(err)
+			return false
+		}
+		if first != second {
+			t.Logf("want:\n%s\ngot:\n%s", first, second)
+			return false
+		}
+		if want, got := describeNesting(in.DataFlowDiagram), describeNesting(out); want != got {
+			t.Logf("want:\n%s\ngot:\n%s", want, got)
+			return false
+		}
+		return len(out.Flows) == len(in.Flows) && len(out.TrustBoundaries) == len(in.TrustBoundaries)
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecodeYAMLErrors(t *testing.T) {
+	cases := []struct {
+		name         string
+		yaml         string
+		err          error
+		line, column int
+	}{
+		{"a syntax error", "name: [", nil, 0, 0},
+		{"an unknown version", "version: 2\n", &VersionError{}, 1, 10},
+		{"an unknown field", "name: x\nelement: {}\n", nil, 2, 1},
+		{"an unknown element kind", "elements:\n  a:\n    kind: actor\n", &UnknownElementError{}, 3, 11},
+		{"a duplicate element key", "elements:\n  a: {kind: process}\ntrust_boundaries:\n  b:\n    elements:\n      a: {kind: data_store}\n", &ReferenceError{}, 6, 7},
+		{"a duplicate trust boundary key", "trust_boundaries:\n  b: {}\n  b: {}\n", &ReferenceError{}, 3, 3},
+		{"a dangling flow", "elements:\n  a: {kind: process}\nflows:\n  - {from: a, to: b}\n", &ReferenceError{}, 4, 19},
+		{"a flow missing an endpoint", "elements:\n  a: {kind: process}\nflows:\n  - {from: a}\n", nil, 4, 5},
+		{"a self flow", "elements:\n  a: {kind: process}\nflows:\n  - {from: a, to: a}\n", &ReferenceError{}, 4, 5},
+		{"an unknown attribute", "elements:\n  a: {kind: process, attributes: {color: red}}\n", &AttributeError{}, 2, 34},
+		{"a property of another kind of element", "elements:\n  a: {kind: data_store, properties: {vendor: x}}\n", nil, 2, 38},
+		{"an unknown flow property", "elements:\n  a: {kind: process}\n  b: {kind: process}\nflows:\n  - {from: a, to: b, properties: {proto: x}}\n", nil, 5, 35},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("Decoding YAML with %s", c.name), func(t *testing.T) {
+			_, err := DecodeYAML(strings.NewReader(c.yaml))
+			pe, ok := err.(*ParseError)
+			if !ok {
+				t.Fatalf("Expected a *ParseError, got %T (%v)", err, err)
+			}
+			if c.err != nil && reflect.TypeOf(pe.Err) != reflect.TypeOf(c.err) {
+				t.Errorf("Expected a wrapped error of type %T, got %T (%v)", c.err, pe.Err, pe.Err)
+			}
+			if pe.Line != c.line || pe.Column != c.column {
+				t.Errorf("Expected error at %d:%d, got %d:%d (%v)", c.line, c.column, pe.Line, pe.Column, pe)
+			}
+		})
+	}
+}
+
+func TestYAMLKeepsKeys(t *testing.T) {
+	const doc = `version: 1
+name: Keys
+elements:
+  db:
+    kind: data_store
+    name: Primary Database
+  ws:
+    kind: process
+    name: Web Server
+flows:
+  - from: ws
+    to: db
+    name: SQL
+`
+	dfd, err := DecodeYAML(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	dfd.AddNodeElem(NewProcess("Web Server"))
+	out, err := dfd.ToYAML()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding YAML: %v", err)
+	}
+	if !strings.Contains(out, "  ws:\n") || !strings.Contains(out, "  db:\n") {
+		t.Errorf("Expected decoded keys to be kept, got:\n%s", out)
+	}
+	if !strings.Contains(out, "  web-server:\n") {
+		t.Errorf("Expected a key derived from the name of the new process, got:\n%s", out)
+	}
+}
+
+func TestYAMLKeysAsIDs(t *testing.T) {
+	const doc = `version: 1
+name: Keys
+elements:
+  web-server:
+    kind: process
+  primary db:
+    kind: data_store
+trust_boundaries:
+  aws:
+    elements:
+      logs:
+        kind: data_store
+flows:
+  - from: web-server
+    to: primary db
+  - from: web-server
+    to: logs
+`
+	dfd, err := DecodeYAML(strings.NewReader(doc))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	if dfd.Processes["web-server"] == nil || dfd.TrustBoundaries["aws"] == nil || dfd.BoundaryOf("logs") == nil {
+		t.Errorf("Expected keys that are valid IDs to be used as IDs, got:\n%s", describeDFD(dfd))
+	}
+	if dfd.DataStores[keyID("primary db")] == nil {
+		t.Errorf("Expected the ID of an invalid key to be derived from it, got:\n%s", describeDFD(dfd))
+	}
+	out, err := dfd.ToDOT()
+	if err != nil {
+		t.Fatalf("Unexpected error encoding DOT: %v", err)
+	}
+	for _, want := range []string{`"process_web-server"`, `cluster_aws`, `datastore_logs`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("Expected DOT output to contain %s, got:\n%s", want, out)
+		}
+	}
+
+	slugs := InitializeDFD("Slugs")
+	api, _ := NewProcessWithID(slugs.NewID("API"), "Payments API")
+	slugs.AddNodeElem(api)
+	tb, _ := slugs.AddTrustBoundary("Payments VPC")
+	tb.Name = "VPC"
+	if out, err = slugs.ToYAML(); err != nil {
+		t.Fatalf("Unexpected error encoding YAML: %v", err)
+	}
+	again, err := DecodeYAML(strings.NewReader(out))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding YAML: %v", err)
+	}
+	if again.Processes[api.ExternalID()] == nil || again.TrustBoundaries[tb.ExternalID()] == nil {
+		t.Errorf("Expected slug IDs to survive a round trip, got:\n%s", describeDFD(again))
+	}
+}
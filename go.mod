@@ -3,4 +3,5 @@ module github.com/marqeta/go-dfd
 require (
 	gonum.org/v1/gonum v0.0.0-20181210083604-572d9101fe4f
 	gonum.org/v1/netlib v0.0.0-20181029234149-ec6d1f5cefe6 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,584 @@
+// Package svg lays out and renders a DataFlowDiagram as SVG without requiring
+// Graphviz.
+//
+// Elements are placed in layers along the rankdir of the diagram, so that
+// flows point in that direction where possible, and are ordered within each
+// layer to reduce crossings. Each trust boundary is given its own band across
+// the layers, containing the bands of the trust boundaries nested in it, so
+// that boundaries never overlap.
+package svg
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/marqeta/go-dfd/dfd"
+	"gonum.org/v1/gonum/graph"
+)
+
+// Kind is the kind of a laid out element.
+type Kind int
+
+const (
+	Process Kind = iota
+	ExternalService
+	DataStore
+)
+
+const (
+	nodeFontSize    = 14
+	edgeFontSize    = 12
+	clusterFontSize = 10
+	titleFontSize   = 20
+	// Space between elements, across and along layers.
+	orderGap = 40
+	rankGap  = 90
+	// Padding inside a trust boundary, and space between trust boundaries.
+	clusterPad = 20
+	clusterGap = 30
+	margin     = 20
+	// Number of barycenter sweeps used to order the elements of a layer.
+	sweeps = 4
+)
+
+// Point is a position in the SVG coordinate system.
+type Point struct {
+	X, Y float64
+}
+
+// Node is a laid out Process, ExternalService or DataStore.
+type Node struct {
+	// ID is the DOT ID of the element.
+	ID     string
+	Name   string
+	Kind   Kind
+	Center Point
+	Width  float64
+	Height float64
+	// Boundary is the DOT ID of the trust boundary containing the element,
+	// or empty.
+	Boundary string
+	// Rank is the layer the element was placed in.
+	Rank int
+}
+
+// Edge is a laid out Flow.
+type Edge struct {
+	From, To string
+	Label    string
+	// Dir is the DOT dir attribute of the flow: forward, back, both or none.
+	Dir        string
+	Start, End Point
+	// LabelAt is the center of the label.
+	LabelAt Point
+	// Response reports whether the flow is the response to another one, and
+	// drawn dashed.
+	Response bool
+}
+
+// Cluster is a laid out TrustBoundary.
+type Cluster struct {
+	ID   string
+	Name string
+	Min  Point
+	Max  Point
+}
+
+// Layout is the position of every element of a DataFlowDiagram.
+type Layout struct {
+	Title    string
+	Rankdir  string
+	Width    float64
+	Height   float64
+	Nodes    []Node
+	Edges    []Edge
+	Clusters []Cluster
+}
+
+// textWidth estimates the width of s rendered in Arial at the given size.
+func textWidth(s string, size float64) float64 {
+	return float64(utf8.RuneCountInString(s)) * size * 0.6
+}
+
+func newNode(n graph.Node) *Node {
+	var ln *Node
+	switch n := n.(type) {
+	case *dfd.Process:
+		ln = &Node{ID: n.DOTID(), Name: n.Name, Kind: Process}
+		d := math.Max(60, textWidth(n.Name, nodeFontSize)+20)
+		ln.Width, ln.Height = d, d
+	case *dfd.ExternalService:
+		ln = &Node{ID: n.DOTID(), Name: n.Name, Kind: ExternalService}
+		ln.Width = math.Max(80, textWidth(n.Name, nodeFontSize)*1.6+30)
+		ln.Height = math.Max(50, ln.Width/2)
+	case *dfd.DataStore:
+		ln = &Node{ID: n.DOTID(), Name: n.Name, Kind: DataStore}
+		ln.Width, ln.Height = math.Max(70, textWidth(n.Name, nodeFontSize)+30), 50
+	}
+	return ln
+}
+
+// group is a trust boundary, or the elements outside of all of them.
+type group struct {
+	cluster *Cluster
+	nodes   []*Node
+	// Widest layer of the group, in elements.
+	width int
+	// Trust boundaries nested in this one, or the top level trust
+	// boundaries for the group of elements outside of all of them.
+	children []*group
+}
+
+// NewLayout lays out d.
+func NewLayout(d *dfd.DataFlowDiagram) *Layout {
+	l := &Layout{Title: d.Name, Rankdir: rankdir(d)}
+
+	// Collect the elements, grouped by trust boundary.
+	nodes := map[int64]*Node{}
+	var groups []*group
+	add := func(g *group, n graph.Node) {
+		if _, ok := nodes[n.ID()]; ok {
+			return
+		}
+		ln := newNode(n)
+		if ln == nil {
+			return
+		}
+		if g.cluster != nil {
+			ln.Boundary = g.cluster.ID
+		}
+		nodes[n.ID()] = ln
+		g.nodes = append(g.nodes, ln)
+	}
+	tbs := make([]*dfd.TrustBoundary, 0, len(d.TrustBoundaries))
+	for _, tb := range d.TrustBoundaries {
+		tbs = append(tbs, tb)
+	}
+	sort.Slice(tbs, func(i, j int) bool { return tbs[i].DOTID() < tbs[j].DOTID() })
+	byBoundary := map[*dfd.TrustBoundary]*group{}
+	for _, tb := range tbs {
+		g := &group{cluster: &Cluster{ID: tb.DOTID(), Name: tb.Name}}
+		for _, n := range members(tb.Processes, tb.ExternalServices, tb.DataStores) {
+			add(g, n)
+		}
+		groups = append(groups, g)
+		byBoundary[tb] = g
+	}
+	top := &group{}
+	for _, tb := range tbs {
+		parent := top
+		if tb.Parent() != nil {
+			parent = byBoundary[tb.Parent()]
+		}
+		parent.children = append(parent.children, byBoundary[tb])
+	}
+	for _, n := range members(d.Processes, d.ExternalServices, d.DataStores) {
+		add(top, n)
+	}
+	flows := make([]*dfd.Flow, 0, len(d.Flows))
+	for _, f := range d.Flows {
+		flows = append(flows, f)
+	}
+	sort.Slice(flows, func(i, j int) bool {
+		a, b := flows[i], flows[j]
+		if a.From().ID() != b.From().ID() {
+			return a.From().ID() < b.From().ID()
+		}
+		if a.To().ID() != b.To().ID() {
+			return a.To().ID() < b.To().ID()
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.ExternalID() < b.ExternalID()
+	})
+	for _, f := range flows {
+		add(top, f.From())
+		add(top, f.To())
+	}
+	groups = append([]*group{top}, groups...)
+
+	rank(nodes, flows)
+	order(groups, nodes, flows)
+	l.place(top)
+	l.route(nodes, flows)
+	return l
+}
+
+// members returns the elements of the given maps ordered by DOT ID.
+func members(ps map[string]*dfd.Process, es map[string]*dfd.ExternalService, ds map[string]*dfd.DataStore) []graph.Node {
+	var ns []graph.Node
+	for _, n := range ps {
+		ns = append(ns, n)
+	}
+	for _, n := range es {
+		ns = append(ns, n)
+	}
+	for _, n := range ds {
+		ns = append(ns, n)
+	}
+	sort.Slice(ns, func(i, j int) bool {
+		return ns[i].(dfd.DfdNode).DOTID() < ns[j].(dfd.DfdNode).DOTID()
+	})
+	return ns
+}
+
+// rankdir returns the rankdir graph attribute of d as one of TB, LR, RL or
+// BT, defaulting to TB.
+func rankdir(d *dfd.DataFlowDiagram) string {
+	g, _, _ := d.DOTAttributers()
+	for _, attr := range g.Attributes() {
+		if attr.Key != "rankdir" {
+			continue
+		}
+		switch dir := strings.ToUpper(strings.Trim(attr.Value, `"`)); dir {
+		case "LR", "RL", "BT":
+			return dir
+		}
+	}
+	return "TB"
+}
+
+// rank assigns each element to a layer using the longest path from the
+// sources, after reversing the flows that close a cycle.
+func rank(nodes map[int64]*Node, flows []*dfd.Flow) {
+	ids := make([]int64, 0, len(nodes))
+	for id := range nodes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return nodes[ids[i]].ID < nodes[ids[j]].ID })
+
+	succ := map[int64][]int64{}
+	for _, f := range flows {
+		succ[f.From().ID()] = append(succ[f.From().ID()], f.To().ID())
+	}
+
+	// Depth first search marking back edges, which are ignored for ranking.
+	const (
+		unvisited = iota
+		active
+		done
+	)
+	state := map[int64]int{}
+	back := map[[2]int64]bool{}
+	var visit func(int64)
+	visit = func(u int64) {
+		state[u] = active
+		for _, v := range succ[u] {
+			switch state[v] {
+			case unvisited:
+				visit(v)
+			case active:
+				back[[2]int64{u, v}] = true
+			}
+		}
+		state[u] = done
+	}
+	for _, id := range ids {
+		if state[id] == unvisited {
+			visit(id)
+		}
+	}
+
+	// Longest path over the remaining edges in topological order.
+	indegree := map[int64]int{}
+	for u, vs := range succ {
+		for _, v := range vs {
+			if !back[[2]int64{u, v}] && u != v {
+				indegree[v]++
+			}
+		}
+	}
+	var queue []int64
+	for _, id := range ids {
+		if indegree[id] == 0 {
+			queue = append(queue, id)
+		}
+	}
+	for len(queue) > 0 {
+		u := queue[0]
+		queue = queue[1:]
+		for _, v := range succ[u] {
+			if back[[2]int64{u, v}] || u == v {
+				continue
+			}
+			if r := nodes[u].Rank + 1; r > nodes[v].Rank {
+				nodes[v].Rank = r
+			}
+			indegree[v]--
+			if indegree[v] == 0 {
+				queue = append(queue, v)
+			}
+		}
+	}
+}
+
+// order sorts the elements of each group by layer, then within each layer by
+// the barycenter of their neighbors in the layers before it.
+func order(groups []*group, nodes map[int64]*Node, flows []*dfd.Flow) {
+	pos := map[*Node]float64{}
+	for _, g := range groups {
+		sort.SliceStable(g.nodes, func(i, j int) bool { return g.nodes[i].Rank < g.nodes[j].Rank })
+		index(g, pos)
+	}
+	neighbors := map[*Node][]*Node{}
+	for _, f := range flows {
+		u, v := nodes[f.From().ID()], nodes[f.To().ID()]
+		neighbors[u] = append(neighbors[u], v)
+		neighbors[v] = append(neighbors[v], u)
+	}
+	for i := 0; i < sweeps; i++ {
+		bary := map[*Node]float64{}
+		for n := range pos {
+			sum, count := 0.0, 0
+			for _, m := range neighbors[n] {
+				if m.Rank != n.Rank {
+					sum += pos[m]
+					count++
+				}
+			}
+			if count == 0 {
+				bary[n] = pos[n]
+			} else {
+				bary[n] = sum / float64(count)
+			}
+		}
+		for _, g := range groups {
+			sort.SliceStable(g.nodes, func(i, j int) bool {
+				a, b := g.nodes[i], g.nodes[j]
+				if a.Rank != b.Rank {
+					return a.Rank < b.Rank
+				}
+				return bary[a] < bary[b]
+			})
+			index(g, pos)
+		}
+	}
+}
+
+// index records the position of every element of g within its layer, and the
+// width of the widest layer of g.
+func index(g *group, pos map[*Node]float64) {
+	g.width = 0
+	i := 0
+	for j, n := range g.nodes {
+		if j > 0 && g.nodes[j-1].Rank != n.Rank {
+			i = 0
+		}
+		pos[n] = float64(i)
+		i++
+		if i > g.width {
+			g.width = i
+		}
+	}
+}
+
+// place computes the coordinates of elements and trust boundaries. Positions
+// are first computed along the rank axis (r) and the order axis (o), then
+// mapped onto x and y according to the rankdir.
+func (l *Layout) place(top *group) {
+	cellR, cellO := 0.0, 0.0
+	maxRank, maxDepth := 0, 0
+	var measure func(*group, int)
+	measure = func(g *group, depth int) {
+		if depth > maxDepth {
+			maxDepth = depth
+		}
+		for _, n := range g.nodes {
+			r, o := n.Height, n.Width
+			if l.horizontal() {
+				r, o = o, r
+			}
+			cellR, cellO = math.Max(cellR, r), math.Max(cellO, o)
+			if n.Rank > maxRank {
+				maxRank = n.Rank
+			}
+		}
+		for _, child := range g.children {
+			measure(child, depth+1)
+		}
+	}
+	measure(top, 0)
+	// Half the size of the largest element along the rank axis.
+	half := cellR / 2
+	cellR += rankGap
+	cellO += orderGap
+
+	// Leave room for the padding and labels of nested trust boundaries
+	// above and below every layer.
+	inset := float64(maxDepth) * (clusterPad + clusterFontSize)
+	rankOf := func(rank int) float64 {
+		if l.Rankdir == "BT" || l.Rankdir == "RL" {
+			rank = maxRank - rank
+		}
+		return float64(rank)*cellR + cellR/2 + inset
+	}
+
+	type box struct{ r0, o0, r1, o1 float64 }
+	centers := map[*Node][2]float64{}
+	var boxes []box
+	// placeGroup places g from cursor along the order axis and returns the
+	// box around it. Groups without any element are skipped.
+	var placeGroup func(g *group, cursor float64) (box, bool)
+	placeGroup = func(g *group, cursor float64) (box, bool) {
+		pad, index := 0.0, -1
+		if g.cluster != nil {
+			pad, index = clusterPad, len(boxes)
+			l.Clusters = append(l.Clusters, *g.cluster)
+			boxes = append(boxes, box{})
+		}
+		b := box{math.Inf(1), cursor, math.Inf(-1), cursor}
+		start := cursor + pad
+		i := 0
+		for j, n := range g.nodes {
+			if j > 0 && g.nodes[j-1].Rank != n.Rank {
+				i = 0
+			}
+			r, o := rankOf(n.Rank), start+float64(i)*cellO+cellO/2
+			centers[n] = [2]float64{r, o}
+			b.r0, b.r1 = math.Min(b.r0, r-half), math.Max(b.r1, r+half)
+			i++
+		}
+		next, placed := start+float64(g.width)*cellO, len(g.nodes) > 0
+		for _, child := range g.children {
+			gap := 0.0
+			if placed {
+				gap = clusterGap
+			}
+			cb, ok := placeGroup(child, next+gap)
+			if !ok {
+				continue
+			}
+			b.r0, b.r1 = math.Min(b.r0, cb.r0), math.Max(b.r1, cb.r1)
+			next, placed = cb.o1, true
+		}
+		if !placed {
+			if index >= 0 {
+				l.Clusters, boxes = l.Clusters[:index], boxes[:index]
+			}
+			return b, false
+		}
+		b.o1 = next + pad
+		if index >= 0 {
+			b.r0 -= clusterPad + clusterFontSize
+			b.r1 += clusterPad
+			boxes[index] = b
+		}
+		return b, true
+	}
+	all, _ := placeGroup(top, 0)
+
+	title := 0.0
+	if l.Title != "" {
+		title = titleFontSize + 10
+	}
+	toXY := func(r, o float64) Point {
+		if l.horizontal() {
+			return Point{margin + r, margin + title + o}
+		}
+		return Point{margin + o, margin + title + r}
+	}
+	for n, c := range centers {
+		n.Center = toXY(c[0], c[1])
+		l.Nodes = append(l.Nodes, *n)
+	}
+	for i, b := range boxes {
+		p0, p1 := toXY(b.r0, b.o0), toXY(b.r1, b.o1)
+		l.Clusters[i].Min = Point{math.Min(p0.X, p1.X), math.Min(p0.Y, p1.Y)}
+		l.Clusters[i].Max = Point{math.Max(p0.X, p1.X), math.Max(p0.Y, p1.Y)}
+	}
+
+	ranks := float64(maxRank+1)*cellR + 2*inset
+	extent := toXY(ranks, all.o1)
+	l.Width = math.Max(extent.X+margin, textWidth(l.Title, titleFontSize)+2*margin)
+	l.Height = extent.Y + margin
+	sort.Slice(l.Nodes, func(i, j int) bool { return l.Nodes[i].ID < l.Nodes[j].ID })
+}
+
+func (l *Layout) horizontal() bool {
+	return l.Rankdir == "LR" || l.Rankdir == "RL"
+}
+
+// route draws flows as straight lines between the outlines of their
+// elements. Flows between the same elements, in either direction, are moved
+// apart, and their labels are spread along them, so that they do not overlap.
+func (l *Layout) route(nodes map[int64]*Node, flows []*dfd.Flow) {
+	placed := map[string]Node{}
+	for _, n := range l.Nodes {
+		placed[n.ID] = n
+	}
+	// Flows are grouped by the elements they connect, from the one with the
+	// lower ID to the other, which sets the direction they are moved apart
+	// in.
+	pairs := map[[2]int64][]*dfd.Flow{}
+	for _, f := range flows {
+		pairs[pairOf(f)] = append(pairs[pairOf(f)], f)
+	}
+	for _, f := range flows {
+		from, to := placed[nodes[f.From().ID()].ID], placed[nodes[f.To().ID()].ID]
+		a, b := from.Center, to.Center
+		at := 0.5
+		if pair := pairs[pairOf(f)]; len(pair) > 1 {
+			k, n := 0, len(pair)
+			for pair[k] != f {
+				k++
+			}
+			at = 0.35 + 0.3*float64(k)/float64(n-1)
+			p, q := a, b
+			if f.From().ID() != pairOf(f)[0] {
+				p, q = b, a
+				at = 1 - at
+			}
+			dx, dy := q.X-p.X, q.Y-p.Y
+			length := math.Hypot(dx, dy)
+			if length > 0 {
+				offset := (float64(k) - float64(n-1)/2) * 12
+				nx, ny := -dy/length*offset, dx/length*offset
+				a, b = Point{a.X + nx, a.Y + ny}, Point{b.X + nx, b.Y + ny}
+			}
+		}
+		start, end := clip(from, a, b), clip(to, b, a)
+		l.Edges = append(l.Edges, Edge{
+			From:     from.ID,
+			To:       to.ID,
+			Label:    f.Name,
+			Dir:      strings.Trim(f.Dir, `"`),
+			Response: f.ResponseTo() != "",
+			Start:    start,
+			End:      end,
+			LabelAt:  Point{start.X + (end.X-start.X)*at, start.Y + (end.Y-start.Y)*at},
+		})
+	}
+}
+
+// pairOf returns the IDs of the elements f connects, the lower one first.
+func pairOf(f *dfd.Flow) [2]int64 {
+	from, to := f.From().ID(), f.To().ID()
+	if from > to {
+		from, to = to, from
+	}
+	return [2]int64{from, to}
+}
+
+// clip returns the point where the segment from p, inside n, towards q leaves
+// the outline of n.
+func clip(n Node, p, q Point) Point {
+	dx, dy := q.X-p.X, q.Y-p.Y
+	if dx == 0 && dy == 0 {
+		return p
+	}
+	a, b := n.Width/2, n.Height/2
+	var t float64
+	switch n.Kind {
+	case Process:
+		t = 1 / math.Sqrt((dx/a)*(dx/a)+(dy/b)*(dy/b))
+	case ExternalService:
+		t = 1 / (math.Abs(dx)/a + math.Abs(dy)/b)
+	default:
+		t = math.Min(a/math.Abs(dx), b/math.Abs(dy))
+	}
+	t = math.Min(t, 1)
+	return Point{p.X + dx*t, p.Y + dy*t}
+}
@@ -0,0 +1,141 @@
+package svg
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"math"
+
+	"github.com/marqeta/go-dfd/dfd"
+)
+
+// Colors and fonts match the DOT attributes written by the dfd package.
+const (
+	fontFamily   = "Arial"
+	clusterColor = "#595959"
+)
+
+// Encode writes d to w as an SVG document.
+func Encode(w io.Writer, d *dfd.DataFlowDiagram) error {
+	return NewLayout(d).Encode(w)
+}
+
+// Render returns d as an SVG document.
+func Render(d *dfd.DataFlowDiagram) (string, error) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, d); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Encode writes the layout to w as an SVG document.
+func (l *Layout) Encode(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	p := func(format string, args ...interface{}) {
+		fmt.Fprintf(bw, format, args...)
+	}
+
+	p(`<svg xmlns="http://www.w3.org/2000/svg" width="%s" height="%s" viewBox="0 0 %s %s" font-family="%s">`+"\n",
+		num(l.Width), num(l.Height), num(l.Width), num(l.Height), fontFamily)
+	p(`<defs><marker id="arrow" viewBox="0 0 10 10" refX="10" refY="5" markerWidth="8" markerHeight="8" orient="auto-start-reverse"><path d="M0,0 L10,5 L0,10 z"/></marker></defs>` + "\n")
+	p(`<rect width="100%%" height="100%%" fill="white"/>` + "\n")
+	if l.Title != "" {
+		p(`<text x="%s" y="%s" text-anchor="middle" font-size="%d">%s</text>`+"\n",
+			num(l.Width/2), num(margin+titleFontSize), titleFontSize, html.EscapeString(l.Title))
+	}
+
+	for _, c := range l.Clusters {
+		p(`<g class="trust-boundary" id="%s">`, html.EscapeString(c.ID))
+		p(`<rect x="%s" y="%s" width="%s" height="%s" fill="none" stroke="%s" stroke-dasharray="5,5"/>`,
+			num(c.Min.X), num(c.Min.Y), num(c.Max.X-c.Min.X), num(c.Max.Y-c.Min.Y), clusterColor)
+		p(`<text x="%s" y="%s" font-size="%d" fill="%s">%s</text>`,
+			num(c.Min.X+6), num(c.Min.Y+clusterFontSize+4), clusterFontSize, clusterColor, html.EscapeString(c.Name))
+		p("</g>\n")
+	}
+
+	for _, e := range l.Edges {
+		p(`<g class="flow">`)
+		var dash string
+		if e.Response {
+			dash = ` stroke-dasharray="4,3"`
+		}
+		p(`<line x1="%s" y1="%s" x2="%s" y2="%s" stroke="black"%s%s/>`,
+			num(e.Start.X), num(e.Start.Y), num(e.End.X), num(e.End.Y), dash, markers(e.Dir))
+		if e.Label != "" {
+			x, y := e.LabelAt.X, e.LabelAt.Y
+			width := textWidth(e.Label, edgeFontSize) + 6
+			p(`<rect x="%s" y="%s" width="%s" height="%d" fill="white"/>`,
+				num(x-width/2), num(y-edgeFontSize/2-2), num(width), edgeFontSize+4)
+			p(`<text x="%s" y="%s" text-anchor="middle" dominant-baseline="central" font-size="%d" font-weight="bold">%s</text>`,
+				num(x), num(y), edgeFontSize, html.EscapeString(e.Label))
+		}
+		p("</g>\n")
+	}
+
+	for _, n := range l.Nodes {
+		p(`<g class="%s" id="%s">`, class(n.Kind), html.EscapeString(n.ID))
+		p("%s", shape(n))
+		p(`<text x="%s" y="%s" text-anchor="middle" dominant-baseline="central" font-size="%d">%s</text>`,
+			num(n.Center.X), num(n.Center.Y), nodeFontSize, html.EscapeString(n.Name))
+		p("</g>\n")
+	}
+	p("</svg>\n")
+	return bw.Flush()
+}
+
+func class(k Kind) string {
+	switch k {
+	case Process:
+		return "process"
+	case ExternalService:
+		return "external-service"
+	default:
+		return "data-store"
+	}
+}
+
+// shape returns the outline of a node: a circle for a Process, a diamond for
+// an ExternalService and a cylinder for a DataStore.
+func shape(n Node) string {
+	x, y, a, b := n.Center.X, n.Center.Y, n.Width/2, n.Height/2
+	const style = ` fill="white" stroke="black"`
+	switch n.Kind {
+	case Process:
+		return fmt.Sprintf(`<ellipse cx="%s" cy="%s" rx="%s" ry="%s"%s/>`, num(x), num(y), num(a), num(b), style)
+	case ExternalService:
+		return fmt.Sprintf(`<polygon points="%s,%s %s,%s %s,%s %s,%s"%s/>`,
+			num(x), num(y-b), num(x+a), num(y), num(x), num(y+b), num(x-a), num(y), style)
+	default:
+		const ry = 6
+		top, bottom := y-b+ry, y+b-ry
+		return fmt.Sprintf(`<path d="M%s,%s A%s,%d 0 0 1 %s,%s A%s,%d 0 0 1 %s,%s L%s,%s A%s,%d 0 0 0 %s,%s L%s,%s"%s/>`,
+			num(x-a), num(top), num(a), ry, num(x+a), num(top), num(a), ry, num(x-a), num(top),
+			num(x-a), num(bottom), num(a), ry, num(x+a), num(bottom), num(x+a), num(top), style)
+	}
+}
+
+// markers returns the arrowhead attributes for a DOT dir attribute.
+func markers(dir string) string {
+	switch dir {
+	case "back":
+		return ` marker-start="url(#arrow)"`
+	case "both":
+		return ` marker-start="url(#arrow)" marker-end="url(#arrow)"`
+	case "none":
+		return ""
+	default:
+		return ` marker-end="url(#arrow)"`
+	}
+}
+
+// num formats a coordinate with at most one decimal place.
+func num(f float64) string {
+	f = math.Round(f*10) / 10
+	if f == math.Trunc(f) {
+		return fmt.Sprintf("%d", int64(f))
+	}
+	return fmt.Sprintf("%.1f", f)
+}
@@ -0,0 +1,253 @@
+package svg
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/marqeta/go-dfd/dfd"
+	"gonum.org/v1/gonum/graph/encoding"
+)
+
+// testDFD returns a browser requesting pages from a web server, which writes
+// to a database and sends logs to an external service.
+func testDFD(rankdir string) *dfd.DataFlowDiagram {
+	d := dfd.InitializeDFD("WebApp Thing")
+	if rankdir != "" {
+		g, _, _ := d.DOTAttributeSetters()
+		g.SetAttribute(encoding.Attribute{Key: "rankdir", Value: rankdir})
+	}
+	browser, _ := d.AddTrustBoundary("Browser")
+	aws, _ := d.AddTrustBoundary("AWS")
+	client := dfd.NewProcess("Client")
+	server := dfd.NewProcess("Web Server")
+	logs := dfd.NewExternalService("Logs")
+	db := dfd.NewDataStore("Database")
+	browser.AddNodeElem(client)
+	aws.AddNodeElem(server)
+	aws.AddNodeElem(db)
+	d.AddNodeElem(logs)
+	d.AddRequestResponse(client, server, "HTTPS", "HTML")
+	d.AddFlow(server, db, "SQL")
+	d.AddFlow(server, logs, "Syslog")
+	return d
+}
+
+func TestNewLayout(t *testing.T) {
+	for _, rankdir := range []string{"", "LR", "BT", "RL"} {
+		t.Run(fmt.Sprintf("rankdir=%q", rankdir), func(t *testing.T) {
+			l := NewLayout(testDFD(rankdir))
+			if len(l.Nodes) != 4 || len(l.Edges) != 4 || len(l.Clusters) != 2 {
+				t.Fatalf("Expected 4 nodes, 4 edges and 2 clusters, but got %d, %d and %d", len(l.Nodes), len(l.Edges), len(l.Clusters))
+			}
+			nodes := map[string]Node{}
+			for _, n := range l.Nodes {
+				nodes[n.Name] = n
+			}
+
+			// Flows from the server point along the rankdir.
+			server := nodes["Web Server"]
+			for _, name := range []string{"Database", "Logs"} {
+				n := nodes[name]
+				if n.Rank != server.Rank+1 {
+					t.Errorf("Expected %s in rank %d, but got %d", name, server.Rank+1, n.Rank)
+				}
+				var ahead bool
+				switch l.Rankdir {
+				case "TB":
+					ahead = n.Center.Y > server.Center.Y
+				case "BT":
+					ahead = n.Center.Y < server.Center.Y
+				case "LR":
+					ahead = n.Center.X > server.Center.X
+				case "RL":
+					ahead = n.Center.X < server.Center.X
+				}
+				if !ahead {
+					t.Errorf("Expected %s after Web Server along %s, but got %v and %v", name, l.Rankdir, n.Center, server.Center)
+				}
+			}
+
+			// Elements do not overlap and stay inside their trust boundary,
+			// and trust boundaries do not overlap.
+			for i, a := range l.Nodes {
+				for _, b := range l.Nodes[i+1:] {
+					if overlap(box(a), box(b)) {
+						t.Errorf("Expected %s and %s not to overlap", a.Name, b.Name)
+					}
+				}
+				for _, c := range l.Clusters {
+					inside := contains([2]Point{c.Min, c.Max}, box(a))
+					if inside != (a.Boundary == c.ID) {
+						t.Errorf("Expected %s inside %s to be %t", a.Name, c.Name, a.Boundary == c.ID)
+					}
+				}
+			}
+			if overlap([2]Point{l.Clusters[0].Min, l.Clusters[0].Max}, [2]Point{l.Clusters[1].Min, l.Clusters[1].Max}) {
+				t.Errorf("Expected trust boundaries not to overlap")
+			}
+			for _, c := range l.Clusters {
+				if c.Min.X < 0 || c.Min.Y < 0 || c.Max.X > l.Width || c.Max.Y > l.Height {
+					t.Errorf("Expected %s inside the %vx%v canvas, but got %v-%v", c.Name, l.Width, l.Height, c.Min, c.Max)
+				}
+			}
+		})
+	}
+}
+
+func TestNewLayoutCycle(t *testing.T) {
+	d := dfd.InitializeDFD("")
+	a, b, c := dfd.NewProcess("a"), dfd.NewProcess("b"), dfd.NewProcess("c")
+	d.AddNodeElem(a)
+	d.AddNodeElem(b)
+	d.AddNodeElem(c)
+	d.AddFlow(a, b, "")
+	d.AddFlow(b, c, "")
+	d.AddFlow(c, a, "")
+	ranks := map[int]bool{}
+	for _, n := range NewLayout(d).Nodes {
+		ranks[n.Rank] = true
+	}
+	if len(ranks) != 3 {
+		t.Errorf("Expected 3 ranks, but got %v", ranks)
+	}
+}
+
+func TestRender(t *testing.T) {
+	d := testDFD("")
+	d.UpdateName(`<Web & "App">`)
+	s, err := Render(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	elements := map[string]int{}
+	dec := xml.NewDecoder(strings.NewReader(s))
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Expected well-formed XML, but got %v", err)
+		}
+		if el, ok := tok.(xml.StartElement); ok {
+			elements[el.Name.Local]++
+		}
+	}
+	cases := []struct {
+		element string
+		count   int
+	}{
+		{"svg", 1},
+		{"ellipse", 2},
+		{"polygon", 1},
+		{"path", 2},
+		{"line", 4},
+	}
+	for _, c := range cases {
+		if elements[c.element] != c.count {
+			t.Errorf("Expected %d %s elements, but got %d", c.count, c.element, elements[c.element])
+		}
+	}
+	for _, want := range []string{
+		`stroke-dasharray="5,5"`,
+		`stroke-dasharray="4,3"`,
+		`&lt;Web &amp; &#34;App&#34;&gt;`,
+		`>HTTPS</text>`,
+		`font-family="Arial"`,
+	} {
+		if !strings.Contains(s, want) {
+			t.Errorf("Expected SVG to contain %s", want)
+		}
+	}
+
+	again, _ := Render(d)
+	if again != s {
+		t.Errorf("Expected rendering to be deterministic")
+	}
+}
+
+func TestMarkers(t *testing.T) {
+	cases := []struct {
+		dir   string
+		start bool
+		end   bool
+	}{
+		{"", false, true},
+		{"forward", false, true},
+		{"back", true, false},
+		{"both", true, true},
+		{"none", false, false},
+	}
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("dir=%q", c.dir), func(t *testing.T) {
+			m := markers(c.dir)
+			if strings.Contains(m, "marker-start") != c.start || strings.Contains(m, "marker-end") != c.end {
+				t.Errorf("Expected start=%t end=%t, but got %q", c.start, c.end, m)
+			}
+		})
+	}
+}
+
+func box(n Node) [2]Point {
+	return [2]Point{
+		{n.Center.X - n.Width/2, n.Center.Y - n.Height/2},
+		{n.Center.X + n.Width/2, n.Center.Y + n.Height/2},
+	}
+}
+
+func overlap(a, b [2]Point) bool {
+	return a[0].X < b[1].X && b[0].X < a[1].X && a[0].Y < b[1].Y && b[0].Y < a[1].Y
+}
+
+func contains(outer, inner [2]Point) bool {
+	return outer[0].X <= inner[0].X && outer[0].Y <= inner[0].Y && outer[1].X >= inner[1].X && outer[1].Y >= inner[1].Y
+}
+
+func TestNewLayoutNested(t *testing.T) {
+	for _, rankdir := range []string{"", "LR"} {
+		t.Run(fmt.Sprintf("rankdir=%q", rankdir), func(t *testing.T) {
+			d := testDFD(rankdir)
+			var aws *dfd.TrustBoundary
+			for _, tb := range d.TrustBoundaries {
+				if tb.Name == "AWS" {
+					aws = tb
+				}
+			}
+			subnet, _ := d.AddNestedTrustBoundary(aws.ExternalID(), "Subnet")
+			worker := dfd.NewProcess("Worker")
+			subnet.AddNodeElem(worker)
+			for _, p := range aws.Processes {
+				d.AddFlow(p, worker, "Jobs")
+			}
+			d.AddNestedTrustBoundary(subnet.ExternalID(), "Empty")
+
+			l := NewLayout(d)
+			clusters := map[string][2]Point{}
+			for _, c := range l.Clusters {
+				clusters[c.Name] = [2]Point{c.Min, c.Max}
+			}
+			if len(clusters) != 3 {
+				t.Fatalf("Expected 3 clusters without the empty one, but got %v", clusters)
+			}
+			if !contains(clusters["AWS"], clusters["Subnet"]) || clusters["AWS"] == clusters["Subnet"] {
+				t.Errorf("Expected Subnet %v inside AWS %v", clusters["Subnet"], clusters["AWS"])
+			}
+			if overlap(clusters["Browser"], clusters["AWS"]) {
+				t.Errorf("Expected Browser and AWS not to overlap")
+			}
+			for _, n := range l.Nodes {
+				inSubnet := contains(clusters["Subnet"], box(n))
+				if inSubnet != (n.Name == "Worker") {
+					t.Errorf("Expected %s inside Subnet to be %t", n.Name, n.Name == "Worker")
+				}
+				if n.Name == "Worker" && !contains(clusters["AWS"], box(n)) {
+					t.Errorf("Expected Worker inside AWS")
+				}
+			}
+		})
+	}
+}